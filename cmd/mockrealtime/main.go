@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/pixaverse-studios/websocket-server/internal/ai/realtimetest"
+)
+
+// mockrealtime runs a fake Realtime API server that plays back whatever the user says, so the
+// server can be developed and tried out without access to the model. Point the server at it with
+// the mock provider, ai.provider: mock (PIXA_AI_PROVIDER=mock), which connects to ai.mock_url,
+// ws://localhost:8090 by default.
+func main() {
+	addr := flag.String("addr", ":8090", "address to listen on")
+	flag.Parse()
+
+	log.Printf("Starting mock realtime server on %s", *addr)
+	if err := http.ListenAndServe(*addr, realtimetest.NewHandler(realtimetest.EchoScenario())); err != nil {
+		log.Fatalf("Failed to start mock realtime server: %v", err)
+	}
+}
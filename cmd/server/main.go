@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
+	"time"
 
+	"github.com/pixaverse-studios/websocket-server/internal/ai"
+	"github.com/pixaverse-studios/websocket-server/internal/auth"
 	"github.com/pixaverse-studios/websocket-server/internal/config"
+	"github.com/pixaverse-studios/websocket-server/internal/health"
+	"github.com/pixaverse-studios/websocket-server/internal/metrics"
 	"github.com/pixaverse-studios/websocket-server/internal/websocket"
 )
 
@@ -23,14 +30,48 @@ func main() {
 	if err := config.ValidateConfig(cfg); err != nil {
 		log.Fatalf("Invalid configuration: %v", err)
 	}
+	if !slices.Contains(ai.Providers(), cfg.AIConfig.Provider) {
+		log.Fatalf("Invalid configuration: unknown ai provider %q, available providers are %v", cfg.AIConfig.Provider, ai.Providers())
+	}
+	if _, err := auth.New(cfg.Auth); err != nil {
+		log.Fatalf("Invalid configuration: %v, available auth modes are %v", err, auth.Modes())
+	}
+	if cfg.Auth.Mode == config.AuthNone {
+		log.Printf("Warning: device authentication is disabled, any client can connect")
+	}
 
 	// Create WebSocket handler
 	handler := websocket.NewHandler(cfg)
+	checker := health.NewChecker(handler.Config)
 
 	// Set up HTTP server
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", cfg.Server.Port),
-		Handler: handler,
+		Handler: newMux(handler, checker),
+	}
+	if cfg.Server.EnableTLS {
+		if server.TLSConfig, err = auth.NewTLSConfig(cfg.Server); err != nil {
+			log.Fatalf("Invalid TLS configuration: %v", err)
+		}
+	}
+
+	// Apply the changes of the config file to the new sessions
+	err = config.WatchConfig(func(next *config.Config, err error) {
+		var ignored []string
+		if err == nil {
+			ignored, err = handler.Reload(next)
+		}
+		switch {
+		case err != nil:
+			log.Printf("Configuration not reloaded: %v", err)
+		case len(ignored) > 0:
+			log.Printf("Configuration reloaded, changes to %v need a restart to apply", ignored)
+		default:
+			log.Printf("Configuration reloaded")
+		}
+	})
+	if err != nil {
+		log.Printf("Configuration will not be reloaded: %v", err)
 	}
 
 	// Set up graceful shutdown
@@ -42,7 +83,11 @@ func main() {
 		var err error
 		if cfg.Server.EnableTLS {
 			log.Printf("TLS enabled, using certificate: %s", cfg.Server.CertFile)
-			err = server.ListenAndServeTLS(cfg.Server.CertFile, cfg.Server.KeyFile)
+			if cfg.Server.ClientCAFile != "" {
+				log.Printf("Mutual TLS enabled, client certificates %s, using CAs: %s", cfg.Server.ClientAuth, cfg.Server.ClientCAFile)
+			}
+			// the certificates are in the TLS configuration
+			err = server.ListenAndServeTLS("", "")
 		} else {
 			err = server.ListenAndServe()
 		}
@@ -54,9 +99,36 @@ func main() {
 	// Wait for interrupt signal
 	<-stop
 	log.Println("Shutting down server...")
+	drainTimeout, _ := time.ParseDuration(cfg.Server.DrainTimeout)
+	shutdown(server, handler, checker, drainTimeout)
+}
+
+// shutdown stops the server, giving the conversations in progress up to drainTimeout to finish
+func shutdown(server *http.Server, handler *websocket.Handler, checker *health.Checker, drainTimeout time.Duration) {
+	// fail the readiness probe so that no new devices are sent here while the conversations in
+	// progress finish
+	checker.Drain()
 
-	// Perform cleanup
-	if err := server.Close(); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := handler.Shutdown(ctx); err != nil {
+		log.Printf("Devices disconnected before the end of their response: %v", err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
 		log.Printf("Error during server shutdown: %v", err)
+		server.Close()
 	}
 }
+
+// newMux routes the requests to the server: the devices connect to the WebSocket at /ws, Kubernetes
+// probes /healthz and /readyz and Prometheus scrapes /metrics
+func newMux(handler http.Handler, checker *health.Checker) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", handler)
+	// devices connecting before /ws existed use the root path
+	mux.Handle("/{$}", handler)
+	mux.HandleFunc("/healthz", checker.Liveness)
+	mux.HandleFunc("/readyz", checker.Readiness)
+	mux.Handle("/metrics", metrics.Handler())
+	return mux
+}
@@ -1,15 +1,219 @@
 package main
 
-import "testing"
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/pixaverse-studios/websocket-server/internal/ai/realtimetest"
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+	"github.com/pixaverse-studios/websocket-server/internal/health"
+	"github.com/pixaverse-studios/websocket-server/internal/utils"
+	"github.com/pixaverse-studios/websocket-server/internal/websocket"
+)
+
+func testConfig(upstream string) *config.Config {
+	return &config.Config{
+		Server:    config.ServerConfig{Port: 8080},
+		Websocket: config.WebsocketConfig{PingInterval: "30s", PongWait: "60s", WriteWait: "10s", MaxMessageQueue: 256, QueuePolicy: utils.Block},
+		Audio:     config.AudioConfig{SampleRate: 16000, Channels: 1, AudioFormat: config.PCM16},
+		AIConfig:  config.AIConfig{Provider: config.ProviderMock, MockURL: upstream, Session: config.SessionConfig{}.WithDefaults()},
+	}
+}
+
+// newTestServer serves the routes of the server running with cfg
+func newTestServer(t *testing.T, cfg *config.Config) (*httptest.Server, *health.Checker) {
+	t.Helper()
+
+	handler := websocket.NewHandler(cfg)
+	checker := health.NewChecker(handler.Config)
+	server := httptest.NewServer(newMux(handler, checker))
+	t.Cleanup(server.Close)
+	return server, checker
+}
+
+// get returns the status code and the checks of a health endpoint
+func get(t *testing.T, url string) (int, map[string]string) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body.Checks
+}
+
+// connect opens a device connection to the WebSocket of server and waits for its session to start
+func connect(t *testing.T, server *httptest.Server) *gorilla.Conn {
+	t.Helper()
+
+	conn, _, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteMessage(gorilla.TextMessage, []byte(`{"type":"ping","id":"1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		typ, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("no pong from the server: %v", err)
+		}
+		if typ == gorilla.TextMessage && strings.Contains(string(msg), `"type":"pong"`) {
+			return conn
+		}
+	}
+}
 
 func TestServer(t *testing.T) {
+	upstream := realtimetest.NewServer(realtimetest.EchoScenario())
+	defer upstream.Close()
+
 	t.Run("test server startup", func(t *testing.T) {
-		// TODO: Implement server startup test
-		t.Skip("Test not implemented")
+		server, _ := newTestServer(t, testConfig(upstream.URL))
+		if code, checks := get(t, server.URL+"/readyz"); code != http.StatusOK {
+			t.Fatalf("expected the server to be ready, got %d: %v", code, checks)
+		}
+		connect(t, server)
 	})
 
 	t.Run("test server shutdown", func(t *testing.T) {
-		// TODO: Implement server shutdown test
-		t.Skip("Test not implemented")
+		cfg := testConfig(upstream.URL)
+		handler := websocket.NewHandler(cfg)
+		checker := health.NewChecker(handler.Config)
+		server := httptest.NewServer(newMux(handler, checker))
+		defer server.Close()
+		conn := connect(t, server)
+
+		done := make(chan struct{})
+		go func() {
+			shutdown(server.Config, handler, checker, 5*time.Second)
+			close(done)
+		}()
+
+		// the session is between turns, so the device is disconnected right away
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				if !gorilla.IsCloseError(err, gorilla.CloseGoingAway) {
+					t.Fatalf("expected the device to be disconnected, got %v", err)
+				}
+				break
+			}
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("server did not shut down")
+		}
+
+		rec := httptest.NewRecorder()
+		checker.Readiness(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected a stopped server not to be ready, got %d", rec.Code)
+		}
+		if _, err := http.Get(server.URL + "/healthz"); err == nil {
+			t.Fatal("expected the server to stop accepting requests")
+		}
+	})
+}
+
+func TestRoutes(t *testing.T) {
+	upstream := realtimetest.NewServer(realtimetest.EchoScenario())
+	defer upstream.Close()
+
+	t.Run("liveness", func(t *testing.T) {
+		server, _ := newTestServer(t, testConfig(upstream.URL))
+		if code, _ := get(t, server.URL+"/healthz"); code != http.StatusOK {
+			t.Fatalf("expected the server to be alive, got %d", code)
+		}
+	})
+
+	t.Run("readiness", func(t *testing.T) {
+		server, checker := newTestServer(t, testConfig(upstream.URL))
+		if code, checks := get(t, server.URL+"/readyz"); code != http.StatusOK {
+			t.Fatalf("expected the server to be ready, got %d: %v", code, checks)
+		}
+
+		checker.Drain()
+		code, checks := get(t, server.URL+"/readyz")
+		if code != http.StatusServiceUnavailable || checks["draining"] == "ok" || checks["upstream"] != "ok" {
+			t.Fatalf("expected a draining server not to be ready, got %d: %v", code, checks)
+		}
+	})
+
+	t.Run("unreachable upstream", func(t *testing.T) {
+		down := realtimetest.NewServer(realtimetest.EchoScenario())
+		down.Close()
+		server, _ := newTestServer(t, testConfig(down.URL))
+		if code, checks := get(t, server.URL+"/readyz"); code != http.StatusServiceUnavailable || checks["upstream"] == "ok" {
+			t.Fatalf("expected the server not to be ready, got %d: %v", code, checks)
+		}
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		cfg := testConfig(upstream.URL)
+		cfg.Audio.SampleRate = 0
+		server, _ := newTestServer(t, cfg)
+		if code, checks := get(t, server.URL+"/readyz"); code != http.StatusServiceUnavailable || checks["config"] == "ok" {
+			t.Fatalf("expected the server not to be ready, got %d: %v", code, checks)
+		}
+	})
+
+	t.Run("reloaded config", func(t *testing.T) {
+		cfg := testConfig(upstream.URL)
+		cfg.AIConfig.Session.Voice = "nobody"
+		handler := websocket.NewHandler(cfg)
+		server := httptest.NewServer(newMux(handler, health.NewChecker(handler.Config)))
+		defer server.Close()
+		if code, checks := get(t, server.URL+"/readyz"); code != http.StatusServiceUnavailable || checks["config"] == "ok" {
+			t.Fatalf("expected the server not to be ready, got %d: %v", code, checks)
+		}
+
+		if _, err := handler.Reload(testConfig(upstream.URL)); err != nil {
+			t.Fatal(err)
+		}
+		if code, checks := get(t, server.URL+"/readyz"); code != http.StatusOK {
+			t.Fatalf("expected the reloaded server to be ready, got %d: %v", code, checks)
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		server, _ := newTestServer(t, testConfig(upstream.URL))
+		for _, path := range []string{"/ws", "/"} {
+			conn, _, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, nil)
+			if err != nil {
+				t.Fatalf("could not connect to %s: %v", path, err)
+			}
+			conn.Close()
+		}
+		if resp, err := http.Get(server.URL + "/other"); err != nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected other paths not to be found, got %v %v", resp, err)
+		}
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		server, _ := newTestServer(t, testConfig(upstream.URL))
+		resp, err := http.Get(server.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected metrics, got %d", resp.StatusCode)
+		}
 	})
 }
@@ -1,15 +1,529 @@
 package ai
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/ai/realtimetest"
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+)
+
+// received is what a client streamed back during a test
+type received struct {
+	events      []Event
+	transcripts []Transcript
+	audioBytes  int
+}
+
+func (r received) eventTypes() []EventType {
+	var types []EventType
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+// collect reads the client streams until n response.done events have been received
+func collect(t *testing.T, c AIClient, n int) received {
+	t.Helper()
+
+	var r received
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-c.GetEventsStream():
+			r.events = append(r.events, e)
+			if e.Type == ResponseDoneEventType {
+				n--
+				if n == 0 {
+					return r
+				}
+			}
+		case tr := <-c.GetTranscriptStream():
+			r.transcripts = append(r.transcripts, tr)
+		case a := <-c.GetResponseStream():
+			r.audioBytes += len(a.AsPCM16())
+		case <-timeout:
+			t.Fatalf("timed out waiting for the response, received %v", r.eventTypes())
+		}
+	}
+}
+
+func newTestClient(t *testing.T, srv *realtimetest.Server, tools *ToolRegistry) *OpenAIClient {
+	t.Helper()
+
+	c := NewOpenAIClient(
+		AzureEndpoint(config.AzureConfig{ServiceURL: srv.URL, OpenAIKey: "test-key"}),
+		config.AIConfig{
+			InputTranscriptionModel: "whisper-1",
+			Reconnect:               config.ReconnectConfig{MaxAttempts: 3, InitialBackoff: "10ms"},
+		},
+		tools,
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		c.Close()
+	})
+	if err := c.Initialize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// half a second of 16 kHz stereo audio, which is enough to trigger a turn of the fake server
+func userSpeech() audio.Audio {
+	return audio.FromPCM16(make([]byte, 16000*2*2/2), 16000, 2)
+}
+
+// tone returns half a second of a 440 Hz tone, loud enough to be taken for speech
+func tone() audio.Audio {
+	frames := make([]float32, 16000*2/2)
+	for i := range frames {
+		frames[i] = float32(0.25 * math.Sin(2*math.Pi*440*float64(i/2)/16000))
+	}
+	return audio.FromFloat32(frames, 16000, 2)
+}
 
 func TestAIProcessing(t *testing.T) {
 	t.Run("test AI model integration", func(t *testing.T) {
-		// TODO: Implement AI model integration test
-		t.Skip("Test not implemented")
+		srv := realtimetest.NewServer(realtimetest.Scenario{Turns: []realtimetest.Turn{{
+			UserTranscript: "hello",
+			Response:       realtimetest.Response{Transcript: "hi there", Audio: make([]byte, 9600)},
+		}}})
+		defer srv.Close()
+		c := newTestClient(t, srv, nil)
+
+		e, ok := srv.WaitForEvent("session.update", 1, time.Second)
+		if !ok {
+			t.Fatal("session was not configured")
+		}
+		var update struct {
+			Session struct {
+				Transcription struct {
+					Model string `json:"model"`
+				} `json:"input_audio_transcription"`
+			} `json:"session"`
+		}
+		if err := json.Unmarshal(e.Raw, &update); err != nil || update.Session.Transcription.Model != "whisper-1" {
+			t.Fatalf("unexpected session.update: %s", e.Raw)
+		}
+		if srv.Headers()[0].Get("api-key") != "test-key" {
+			t.Fatal("api key was not sent")
+		}
+
+		if err := c.SendAudio(userSpeech()); err != nil {
+			t.Fatal(err)
+		}
+		r := collect(t, c, 1)
+
+		expected := []EventType{SpeechStartedEventType, SpeechStoppedEventType, ResponseCreatedEventType, ResponseAudioDoneEventType, ResponseDoneEventType}
+		if !slices.Equal(r.eventTypes(), expected) {
+			t.Fatalf("expected events %v, got %v", expected, r.eventTypes())
+		}
+		if r.audioBytes != 9600 {
+			t.Fatalf("expected 9600 bytes of audio, got %d", r.audioBytes)
+		}
+		last := r.transcripts[len(r.transcripts)-1]
+		if r.transcripts[0] != (Transcript{Role: UserRole, ItemID: r.transcripts[0].ItemID, Text: "hello", Final: true}) ||
+			last.Role != AssistantRole || last.Text != "hi there" || !last.Final {
+			t.Fatalf("unexpected transcripts: %#v", r.transcripts)
+		}
 	})
 
 	t.Run("test response processing", func(t *testing.T) {
-		// TODO: Implement response processing test
-		t.Skip("Test not implemented")
+		srv := realtimetest.NewServer(realtimetest.Scenario{Turns: []realtimetest.Turn{{
+			ToolCall: &realtimetest.ToolCall{Name: "get_current_time", Arguments: "{}"},
+			Response: realtimetest.Response{Transcript: "it is noon", Audio: make([]byte, 4800)},
+		}}})
+		defer srv.Close()
+		tools := NewToolRegistry()
+		RegisterBuiltinTools(tools)
+		c := newTestClient(t, srv, tools)
+
+		if err := c.SendAudio(userSpeech()); err != nil {
+			t.Fatal(err)
+		}
+		r := collect(t, c, 2)
+
+		e, ok := srv.WaitForEvent("conversation.item.create", 1, time.Second)
+		if !ok {
+			t.Fatal("tool result was not sent")
+		}
+		var item struct {
+			Item struct {
+				Type   string `json:"type"`
+				Output string `json:"output"`
+			} `json:"item"`
+		}
+		json.Unmarshal(e.Raw, &item)
+		if item.Item.Type != "function_call_output" || !strings.Contains(item.Item.Output, `"time"`) {
+			t.Fatalf("unexpected tool result: %s", e.Raw)
+		}
+		if r.audioBytes != 4800 {
+			t.Fatalf("expected the response after the tool call to be played, got %d bytes", r.audioBytes)
+		}
+	})
+
+	t.Run("test response interruption", func(t *testing.T) {
+		srv := realtimetest.NewServer(realtimetest.Scenario{
+			Turns:      []realtimetest.Turn{{Response: realtimetest.Response{Audio: make([]byte, 48000)}}},
+			ChunkDelay: 20 * time.Millisecond,
+		})
+		defer srv.Close()
+		c := newTestClient(t, srv, nil)
+
+		if err := c.SendAudio(userSpeech()); err != nil {
+			t.Fatal(err)
+		}
+		// wait for the response to start playing
+		for started := false; !started; {
+			select {
+			case <-c.GetEventsStream():
+			case <-c.GetResponseStream():
+				started = true
+			}
+		}
+		if err := c.CancelResponse(); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.TruncateResponse(100 * time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		r := collect(t, c, 1)
+
+		if done := r.events[len(r.events)-1]; done.ResponseStatus != "cancelled" {
+			t.Fatalf("expected the response to be cancelled, got %#v", done)
+		}
+		e, ok := srv.WaitForEvent("conversation.item.truncate", 1, time.Second)
+		if !ok || !strings.Contains(string(e.Raw), `"audio_end_ms":100`) {
+			t.Fatalf("unexpected truncate event: %s", e.Raw)
+		}
+	})
+}
+
+func TestTranscripts(t *testing.T) {
+	c := NewOpenAIClient(Endpoint{}, config.AIConfig{}, nil)
+	events := []string{
+		`{"type":"conversation.item.input_audio_transcription.completed","item_id":"item_0","transcript":"hello there"}`,
+		`{"type":"conversation.item.input_audio_transcription.failed","item_id":"item_2","error":{"message":"no speech"}}`,
+		`{"type":"response.audio_transcript.delta","response_id":"resp_1","item_id":"item_1","delta":"Hi"}`,
+		`{"type":"response.audio_transcript.done","response_id":"resp_1","item_id":"item_1","transcript":"Hi!"}`,
+	}
+	go func() {
+		for _, e := range events {
+			var base EventBase
+			json.Unmarshal([]byte(e), &base)
+			if err := c.processEvent(context.Background(), base.Type, []byte(e)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	expected := []Transcript{
+		{Role: UserRole, ItemID: "item_0", Text: "hello there", Final: true},
+		{Role: AssistantRole, ItemID: "item_1", Text: "Hi"},
+		{Role: AssistantRole, ItemID: "item_1", Text: "Hi!", Final: true},
+	}
+	for _, want := range expected {
+		select {
+		case got := <-c.GetTranscriptStream():
+			if got != want {
+				t.Fatalf("expected %#v, got %#v", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %#v", want)
+		}
+	}
+}
+
+func TestReconnection(t *testing.T) {
+	srv := realtimetest.NewServer(realtimetest.Scenario{Turns: []realtimetest.Turn{
+		{UserTranscript: "my name is sam", Response: realtimetest.Response{Transcript: "hi sam", Audio: make([]byte, 4800)}},
+		{UserTranscript: "what is my name", Response: realtimetest.Response{Transcript: "sam", Audio: make([]byte, 4800)}},
+	}})
+	defer srv.Close()
+	c := newTestClient(t, srv, nil)
+
+	voice := "verse"
+	if err := c.UpdateSession(SessionUpdate{Voice: &voice}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendAudio(userSpeech()); err != nil {
+		t.Fatal(err)
+	}
+	collect(t, c, 1)
+
+	srv.DropConnections()
+	var r received
+	for e := range c.GetEventsStream() {
+		r.events = append(r.events, e)
+		if e.Type == UpstreamReconnectedEventType {
+			break
+		}
+	}
+	if r.events[0].Type != UpstreamReconnectingEventType || r.events[0].Attempt != 1 {
+		t.Fatalf("unexpected events: %v", r.eventTypes())
+	}
+	if srv.Connections() != 2 {
+		t.Fatalf("expected a second connection, got %d", srv.Connections())
+	}
+
+	// the new session is configured like the old one and knows the conversation so far
+	e, _ := srv.WaitForEvent("session.update", 3, time.Second)
+	if !strings.Contains(string(e.Raw), `"voice":"verse"`) {
+		t.Fatalf("session overrides were not replayed: %s", e.Raw)
+	}
+	items := srv.EventsOfType("conversation.item.create")
+	if len(items) != 2 || !strings.Contains(string(items[0].Raw), "my name is sam") || !strings.Contains(string(items[1].Raw), "hi sam") {
+		t.Fatalf("conversation was not replayed: %v", items)
+	}
+
+	if err := c.SendAudio(userSpeech()); err != nil {
+		t.Fatal(err)
+	}
+	if r := collect(t, c, 1); r.audioBytes != 4800 {
+		t.Fatalf("expected the second turn to be answered, got %d bytes", r.audioBytes)
+	}
+}
+
+func TestReconnectPolicy(t *testing.T) {
+	p := newReconnectPolicy(config.ReconnectConfig{InitialBackoff: "100ms", MaxBackoff: "1s"})
+	for attempt, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 5: time.Second, 10: time.Second} {
+		if d := p.backoff(attempt); d > max || d < max*4/5 {
+			t.Errorf("backoff of attempt %d is %v, expected up to %v", attempt, d, max)
+		}
+	}
+}
+
+func TestToolRegistry(t *testing.T) {
+	r := NewToolRegistry()
+	err := r.Register(Tool{
+		Name: "add",
+		Handler: func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+			var in struct{ A, B int }
+			if err := json.Unmarshal(args, &in); err != nil {
+				return nil, err
+			}
+			return map[string]int{"sum": in.A + in.B}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterBuiltinTools(r); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("duplicate and invalid tools are rejected", func(t *testing.T) {
+		if err := r.Register(Tool{Name: "add", Handler: func(context.Context, json.RawMessage) (interface{}, error) { return nil, nil }}); err == nil {
+			t.Error("expected duplicate tool to be rejected")
+		}
+		if err := r.Register(Tool{Name: "noop"}); err == nil {
+			t.Error("expected tool without handler to be rejected")
+		}
+	})
+
+	t.Run("definitions keep registration order", func(t *testing.T) {
+		defs := r.Definitions()
+		if len(defs) != 2 || defs[0].Name != "add" || defs[1].Name != "get_current_time" || defs[0].Type != "function" {
+			t.Fatalf("unexpected definitions: %#v", defs)
+		}
+	})
+
+	t.Run("call", func(t *testing.T) {
+		out, err := r.Call(context.Background(), "add", json.RawMessage(`{"A": 1, "B": 2}`))
+		if err != nil || out != `{"sum":3}` {
+			t.Fatalf("unexpected output %s, error %v", out, err)
+		}
+		out, err = r.Call(context.Background(), "missing", nil)
+		if err == nil || out != `{"error":"unknown tool missing"}` {
+			t.Fatalf("unexpected output %s, error %v", out, err)
+		}
+	})
+}
+
+func TestSessionUpdate(t *testing.T) {
+	defaults := config.DefaultSessionConfig()
+
+	t.Run("validation", func(t *testing.T) {
+		voice, temperature, threshold := "nobody", 2.0, 1.5
+		for _, u := range []SessionUpdate{{Voice: &voice}, {Temperature: &temperature}, {VADThreshold: &threshold}, {Modalities: []string{"audio"}}} {
+			if err := u.Validate(defaults); !errors.Is(err, ErrInvalidSession) {
+				t.Errorf("expected %#v to be rejected, got %v", u, err)
+			}
+		}
+	})
+
+	t.Run("only changed fields are sent", func(t *testing.T) {
+		silence := 800
+		u := SessionUpdate{SilenceDurationMs: &silence}
+		fields := u.updateFields(u.Apply(defaults))
+		if len(fields) != 1 {
+			t.Fatalf("unexpected fields: %v", fields)
+		}
+		td := fields["turn_detection"].(map[string]interface{})
+		if td["silence_duration_ms"] != 800 || td["threshold"] != 0.5 {
+			t.Fatalf("unexpected turn detection: %v", td)
+		}
+	})
+
+	t.Run("session is sent on connection", func(t *testing.T) {
+		srv := realtimetest.NewServer(realtimetest.EchoScenario())
+		defer srv.Close()
+		temperature := 1.0
+		c := NewOpenAIClient(
+			AzureEndpoint(config.AzureConfig{ServiceURL: srv.URL, OpenAIKey: "test-key"}),
+			config.AIConfig{Session: config.SessionConfig{Voice: "sage", Temperature: &temperature}},
+			nil,
+		)
+		defer c.Close()
+		none := config.TurnDetectionNone
+		if err := c.UpdateSession(SessionUpdate{TurnDetection: &none}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Initialize(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		e, ok := srv.WaitForEvent("session.update", 1, time.Second)
+		if !ok {
+			t.Fatal("session was not configured")
+		}
+		var event struct {
+			Session map[string]interface{} `json:"session"`
+		}
+		if err := json.Unmarshal(e.Raw, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Session["voice"] != "sage" || event.Session["temperature"] != 1.0 || event.Session["turn_detection"] != nil {
+			t.Fatalf("unexpected session: %v", event.Session)
+		}
+	})
+
+	t.Run("explicit zeros are kept", func(t *testing.T) {
+		threshold, padding := 0.0, 0
+		session := config.SessionConfig{TurnDetection: config.TurnDetectionConfig{Threshold: &threshold, PrefixPaddingMs: &padding}}
+		td := sessionFields(session.WithDefaults())["turn_detection"].(map[string]interface{})
+		if td["threshold"] != 0.0 || td["prefix_padding_ms"] != 0 || td["silence_duration_ms"] != 500 {
+			t.Fatalf("unexpected turn detection: %v", td)
+		}
+	})
+
+	t.Run("system prompt is read once per session", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "prompt.txt")
+		if err := os.WriteFile(path, []byte("first prompt"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		aiConfig := config.AIConfig{SystemPromptFilePath: path}
+		c := NewOpenAIClient(Endpoint{}, aiConfig, nil)
+
+		if err := os.WriteFile(path, []byte("second prompt"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if instructions := c.sessionUpdateEvent()["session"].(map[string]interface{})["instructions"]; instructions != "first prompt" {
+			t.Fatalf("expected the session to keep its prompt, got %v", instructions)
+		}
+		next := NewOpenAIClient(Endpoint{}, aiConfig, nil)
+		if instructions := next.sessionUpdateEvent()["session"].(map[string]interface{})["instructions"]; instructions != "second prompt" {
+			t.Fatalf("expected a new session to use the new prompt, got %v", instructions)
+		}
+	})
+}
+
+func TestProviders(t *testing.T) {
+	srv := realtimetest.NewServer(realtimetest.EchoScenario())
+	defer srv.Close()
+
+	t.Run("openai endpoint", func(t *testing.T) {
+		cfg := &config.Config{
+			OpenAI:   config.OpenAIConfig{APIKey: "sk-test", URL: srv.URL, Model: "gpt-4o-realtime-preview"},
+			AIConfig: config.AIConfig{Provider: config.ProviderOpenAI},
+		}
+		c, err := NewClient(cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err := c.Initialize(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		headers := srv.Headers()
+		h := headers[len(headers)-1]
+		if h.Get("Authorization") != "Bearer sk-test" || h.Get("OpenAI-Beta") != "realtime=v1" || h.Get("api-key") != "" {
+			t.Fatalf("unexpected headers: %v", h)
+		}
+		if url := c.(*OpenAIClient).endpoint.URL; !strings.HasSuffix(url, "?model=gpt-4o-realtime-preview") {
+			t.Fatalf("model missing from url %s", url)
+		}
+	})
+
+	t.Run("azure endpoint", func(t *testing.T) {
+		endpoint := AzureEndpoint(config.AzureConfig{ServiceURL: srv.URL, OpenAIKey: "azure-key"})
+		if endpoint.Header.Get("api-key") != "azure-key" || endpoint.Header.Get("Authorization") != "" {
+			t.Fatalf("unexpected headers: %v", endpoint.Header)
+		}
+	})
+
+	t.Run("unknown provider", func(t *testing.T) {
+		if _, err := NewClient(&config.Config{AIConfig: config.AIConfig{Provider: "nope"}}, nil); err == nil {
+			t.Fatal("expected unknown provider to be rejected")
+		}
+		if !slices.Contains(Providers(), config.ProviderEcho) {
+			t.Fatalf("echo provider missing from %v", Providers())
+		}
+	})
+
+	t.Run("probe upstream", func(t *testing.T) {
+		ctx := context.Background()
+		cfg := &config.Config{AIConfig: config.AIConfig{Provider: config.ProviderMock, MockURL: srv.URL}}
+		if err := ProbeUpstream(ctx, cfg); err != nil {
+			t.Fatalf("expected the server to be reachable: %v", err)
+		}
+		down := realtimetest.NewServer(realtimetest.EchoScenario())
+		down.Close()
+		cfg.AIConfig.MockURL = down.URL
+		if err := ProbeUpstream(ctx, cfg); err == nil {
+			t.Fatal("expected a closed server to be unreachable")
+		}
+		if err := ProbeUpstream(ctx, &config.Config{AIConfig: config.AIConfig{Provider: config.ProviderEcho}}); err != nil {
+			t.Fatalf("expected echo not to be probed: %v", err)
+		}
+	})
+
+	t.Run("echo", func(t *testing.T) {
+		c, err := NewClient(&config.Config{AIConfig: config.AIConfig{Provider: config.ProviderEcho}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if err := c.Initialize(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			// silence does not start a turn, a second of speech makes one
+			c.SendAudio(userSpeech())
+			c.SendAudio(tone())
+			c.SendAudio(tone())
+		}()
+		r := collect(t, c, 1)
+		want := []EventType{SpeechStartedEventType, SpeechStoppedEventType, ResponseCreatedEventType, ResponseAudioDoneEventType, ResponseDoneEventType}
+		if !slices.Equal(r.eventTypes(), want) {
+			t.Fatalf("expected events %v, got %v", want, r.eventTypes())
+		}
+		if r.audioBytes != 24000*2 {
+			t.Fatalf("expected a second of 24 kHz audio back, got %d bytes", r.audioBytes)
+		}
 	})
 }
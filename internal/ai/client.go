@@ -2,18 +2,41 @@ package ai
 
 import (
 	"context"
+	"time"
+
 	"github.com/pixaverse-studios/websocket-server/pkg/audio"
 )
 
 // This package provides an interface to interact with the Speech-to-Speech LLM.
 
+// SampleRate is the sample rate of the audio exchanged with the LLM, which is mono 16-bit PCM
+const SampleRate = 24000
+
 type AIClient interface {
 	// Initialize configures the LLM and initalizes the communication channel with the LLM
 	Initialize(context.Context) error
 	// GetResponseStream returns a channel through which the LLM responses are streamed
 	GetResponseStream() <-chan audio.Audio
-	// SendAudio is used to send audio packets to the LLM
+	// GetEventsStream returns a channel through which notable model events, like the start of user speech
+	// or the end of a response, are streamed
+	GetEventsStream() <-chan Event
+	// GetTranscriptStream returns a channel through which the transcripts of the user and the LLM speech are streamed
+	GetTranscriptStream() <-chan Transcript
+	// SendAudio is used to send audio packets to the LLM. Audio that is not mono at SampleRate is converted,
+	// but each packet on its own: callers streaming audio should convert it with an audio.Resampler first.
 	SendAudio(audio.Audio) error
+	// UpdateSession changes the parameters of the ongoing session
+	UpdateSession(SessionUpdate) error
+	// CommitAudio commits the audio sent so far as a user turn and asks the LLM to respond
+	CommitAudio() error
+	// ClearAudio discards the audio sent since the last commit
+	ClearAudio() error
+	// CancelResponse stops the response the LLM is currently generating. Audio from the cancelled response
+	// that arrives afterwards is dropped.
+	CancelResponse() error
+	// TruncateResponse cuts the audio of the last response in the conversation history at the given offset,
+	// so that the LLM only remembers what the user actually heard
+	TruncateResponse(time.Duration) error
 	// Close closes the connection with the LLM
 	Close()
 }
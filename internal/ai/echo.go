@@ -0,0 +1,244 @@
+package ai
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+)
+
+// echoTurnLength is how much audio makes a user turn when the echo client detects turns itself
+const echoTurnLength = time.Second
+
+// echoSpeechLevel is the RMS of the PCM16 samples above which audio is taken as the start of a user
+// turn, about -36 dBFS. Devices stream their microphone all the time, so quieter audio is ignored
+// until the user speaks.
+const echoSpeechLevel = 500
+
+// EchoClient plays the user's audio back instead of asking a model. It needs no model server, which
+// makes it handy to test devices and the audio path. Each user turn is answered with a response
+// made of the turn's audio.
+type EchoClient struct {
+	logger *slog.Logger
+
+	done      chan struct{}
+	closeOnce sync.Once
+	// turns carries the audio of the user turns waiting to be played back
+	turns chan []audio.Audio
+
+	responseStream   chan audio.Audio
+	eventsStream     chan Event
+	transcriptStream chan Transcript
+
+	// mu guards the state below
+	mu      sync.Mutex
+	session config.SessionConfig
+	// input is the audio of the current user turn, resampled to 24 kHz mono
+	input    []audio.Audio
+	inputLen time.Duration
+	// cancelled is set when the response being played back is cancelled
+	cancelled   bool
+	responseSeq int
+}
+
+func NewEchoClient(aiConfig config.AIConfig) *EchoClient {
+	return &EchoClient{
+		logger:           slog.New(slog.NewJSONHandler(os.Stdout, nil)),
+		done:             make(chan struct{}),
+		turns:            make(chan []audio.Audio, 4),
+		responseStream:   make(chan audio.Audio),
+		eventsStream:     make(chan Event),
+		transcriptStream: make(chan Transcript),
+		session:          aiConfig.Session.WithDefaults(),
+	}
+}
+
+func (c *EchoClient) Initialize(ctx context.Context) error {
+	go c.playTurns(ctx)
+	return nil
+}
+
+func (c *EchoClient) GetResponseStream() <-chan audio.Audio {
+	return c.responseStream
+}
+
+func (c *EchoClient) GetEventsStream() <-chan Event {
+	return c.eventsStream
+}
+
+func (c *EchoClient) GetTranscriptStream() <-chan Transcript {
+	return c.transcriptStream
+}
+
+// SendAudio adds a to the current user turn. With server turn detection the turn starts once the
+// audio is louder than echoSpeechLevel and ends once echoTurnLength of audio has been received.
+func (c *EchoClient) SendAudio(a audio.Audio) error {
+	a.SetChannels(1)
+	if a.GetSampleRate() != SampleRate {
+		a.Resample(SampleRate)
+	}
+
+	c.mu.Lock()
+	started := len(c.input) == 0
+	serverVAD := c.session.TurnDetection.Type == config.TurnDetectionServerVAD
+	if serverVAD && started && rms(a.AsPCM16()) < echoSpeechLevel {
+		c.mu.Unlock()
+		return nil
+	}
+	c.input = append(c.input, a)
+	c.inputLen += time.Duration(len(a.AsPCM16())) * time.Second / (SampleRate * 2)
+	var turn []audio.Audio
+	if serverVAD && c.inputLen >= echoTurnLength {
+		turn = c.takeTurn()
+	}
+	c.mu.Unlock()
+
+	if serverVAD && started {
+		c.emitEvent(Event{Type: SpeechStartedEventType})
+	}
+	if turn != nil {
+		c.emitEvent(Event{Type: SpeechStoppedEventType})
+		return c.queueTurn(turn)
+	}
+	return nil
+}
+
+// rms returns the root mean square of little-endian PCM16 samples
+func rms(pcm []byte) float64 {
+	if len(pcm) < 2 {
+		return 0
+	}
+	var sum float64
+	for i := 0; i+1 < len(pcm); i += 2 {
+		sample := float64(int16(binary.LittleEndian.Uint16(pcm[i:])))
+		sum += sample * sample
+	}
+	return math.Sqrt(sum / float64(len(pcm)/2))
+}
+
+// takeTurn empties the current user turn and returns its audio, c.mu must be held
+func (c *EchoClient) takeTurn() []audio.Audio {
+	turn := c.input
+	c.input = nil
+	c.inputLen = 0
+	return turn
+}
+
+func (c *EchoClient) queueTurn(turn []audio.Audio) error {
+	select {
+	case c.turns <- turn:
+		return nil
+	case <-c.done:
+		return fmt.Errorf("client closed")
+	default:
+		c.logger.Warn("Dropping user turn, too many turns are waiting to be played back")
+		return nil
+	}
+}
+
+func (c *EchoClient) UpdateSession(u SessionUpdate) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := u.Validate(c.session); err != nil {
+		return err
+	}
+	c.session = u.Apply(c.session)
+	return nil
+}
+
+func (c *EchoClient) CommitAudio() error {
+	c.mu.Lock()
+	turn := c.takeTurn()
+	c.mu.Unlock()
+
+	return c.queueTurn(turn)
+}
+
+func (c *EchoClient) ClearAudio() error {
+	c.mu.Lock()
+	c.takeTurn()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *EchoClient) CancelResponse() error {
+	c.mu.Lock()
+	c.cancelled = true
+	c.mu.Unlock()
+	return nil
+}
+
+// TruncateResponse does nothing, the echo client has no conversation history
+func (c *EchoClient) TruncateResponse(time.Duration) error {
+	return nil
+}
+
+func (c *EchoClient) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// playTurns answers the user turns one after the other
+func (c *EchoClient) playTurns(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			return
+		case turn := <-c.turns:
+			c.respond(turn)
+		}
+	}
+}
+
+func (c *EchoClient) respond(turn []audio.Audio) {
+	c.mu.Lock()
+	c.responseSeq++
+	responseID := fmt.Sprintf("echo_resp_%d", c.responseSeq)
+	c.cancelled = false
+	withAudio := slices.Contains(c.session.Modalities, "audio")
+	c.mu.Unlock()
+
+	c.emitEvent(Event{Type: ResponseCreatedEventType, ResponseID: responseID})
+	status := "completed"
+	for _, a := range turn {
+		if !withAudio {
+			break
+		}
+		c.mu.Lock()
+		cancelled := c.cancelled
+		c.mu.Unlock()
+		if cancelled {
+			status = "cancelled"
+			break
+		}
+		select {
+		case c.responseStream <- a:
+		case <-c.done:
+			return
+		}
+	}
+	if status == "completed" && withAudio {
+		c.emitEvent(Event{Type: ResponseAudioDoneEventType})
+	}
+	c.emitEvent(Event{Type: ResponseDoneEventType, ResponseID: responseID, ResponseStatus: status})
+}
+
+// emitEvent hands e to the events stream consumer, giving up if the client is closed
+func (c *EchoClient) emitEvent(e Event) {
+	select {
+	case c.eventsStream <- e:
+	case <-c.done:
+	}
+}
@@ -4,14 +4,15 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"net/http"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/pixaverse-studios/websocket-server/internal/config"
+	"github.com/pixaverse-studios/websocket-server/internal/metrics"
 	"github.com/pixaverse-studios/websocket-server/pkg/audio"
 
 	"github.com/gorilla/websocket"
@@ -20,68 +21,117 @@ import (
 const (
 	// WebSocket configuration
 	writeWait = 10 * time.Second
+	// the server is pinged every pingInterval, the connection is considered dead when nothing is
+	// received for readTimeout
+	pingInterval = 20 * time.Second
+	readTimeout  = 60 * time.Second
 )
 
+// ErrDisconnected is returned when a message cannot be sent because the connection to the server
+// is being re-established
+var ErrDisconnected = errors.New("not connected to the model server")
+
 // ChatGPTClient manages the WebSocket connection to the ChatGPT server
 type OpenAIClient struct {
-	conn    *websocket.Conn
-	logger  *slog.Logger
-	headers http.Header
+	conn     *websocket.Conn
+	logger   *slog.Logger
+	endpoint Endpoint
 
+	// mu guards conn and the connection state below
 	mu        sync.Mutex
 	done      chan struct{}
 	closeOnce sync.Once
+	// connected is false while the connection is being re-established
+	connected bool
+	// pendingAudio holds the audio sent while disconnected, it is sent once the connection is back
+	pendingAudio     []string
+	pendingAudioSize int
 
 	responseStream chan audio.Audio
 	// eventsStream lets the client know when some important events happen in the model, like when the model has detected the start of speech, end of speech, completed the response etc. The client can use these to events to curate the behaviour of the system.
-	eventsStream chan EventType
-	config       config.AzureConfig
-	aiconfig     config.AIConfig
+	eventsStream chan Event
+	// transcriptStream carries the transcripts of both the user's and the model's speech
+	transcriptStream chan Transcript
+	aiconfig         config.AIConfig
+	// systemPrompt is read once when the client is created, so that a session keeps its prompt
+	// across reconnections when the file changes
+	systemPrompt string
+	// tools are the functions the model can call, can be nil
+	tools *ToolRegistry
+
+	// stateMu guards the response tracking below, which is needed to cancel and truncate responses
+	// and to ask for a new response once tool results are available
+	stateMu             sync.Mutex
+	activeResponseID    string
+	cancelledResponseID string
+	lastAudioItemID     string
+	pendingToolResponse bool
+	// session holds the current session parameters and instructions the instructions set with
+	// UpdateSession, history the last conversation items. They are all replayed to the new session
+	// after a reconnection.
+	session      config.SessionConfig
+	instructions *string
+	history      []Transcript
 }
 
-func NewOpenAIClient(azureConfig config.AzureConfig, aiConfig config.AIConfig) *OpenAIClient {
-	return &OpenAIClient{
-		logger:         slog.New(slog.NewJSONHandler(os.Stdout, nil)),
-		done:           make(chan struct{}),
-		headers:        http.Header{},
-		responseStream: make(chan audio.Audio),
-		eventsStream:   make(chan EventType),
-		config:         azureConfig,
-		aiconfig:       aiConfig,
+// NewOpenAIClient creates a client of the Realtime API served at endpoint, which can be OpenAI,
+// Azure OpenAI or any server speaking the same protocol
+func NewOpenAIClient(endpoint Endpoint, aiConfig config.AIConfig, tools *ToolRegistry) *OpenAIClient {
+	c := &OpenAIClient{
+		logger:           slog.New(slog.NewJSONHandler(os.Stdout, nil)),
+		done:             make(chan struct{}),
+		endpoint:         endpoint,
+		responseStream:   make(chan audio.Audio),
+		eventsStream:     make(chan Event),
+		transcriptStream: make(chan Transcript),
+		aiconfig:         aiConfig,
+		tools:            tools,
+		session:          aiConfig.Session.WithDefaults(),
 	}
+	c.systemPrompt = c.loadSystemPrompt()
+	return c
 }
 
 // ctx is used to cancel
 func (c *OpenAIClient) Initialize(ctx context.Context) error {
-	c.headers.Set("api-key", c.config.OpenAIKey)
-	err := c.connect()
+	conn, err := c.connect()
 	if err != nil {
+		metrics.UpstreamErrors.WithLabelValues(metrics.UpstreamConnect).Inc()
 		return fmt.Errorf("Could not connect to OpenAI server: %v", err)
 	}
+	c.mu.Lock()
+	c.conn = conn
+	c.connected = true
+	c.mu.Unlock()
+
 	err = c.initializeSession()
 	if err != nil {
 		return fmt.Errorf("Could not initialize OpenAI session: %v", err)
 	}
 	go c.watchServerEvents(ctx)
+	go c.keepAlive(ctx)
 	return nil
 
 }
 
-func (c *OpenAIClient) connect() error {
+func (c *OpenAIClient) connect() (*websocket.Conn, error) {
 	dialer := websocket.Dialer{
 		HandshakeTimeout: 10 * time.Second,
 	}
-	conn, resp, err := dialer.Dial(c.config.ServiceURL, c.headers)
+	conn, resp, err := dialer.Dial(c.endpoint.URL, c.endpoint.Header)
 	if err != nil {
 		if resp != nil {
-			return fmt.Errorf("websocket connection failed with status %d: %v", resp.StatusCode, err)
+			return nil, fmt.Errorf("websocket connection failed with status %d: %v", resp.StatusCode, err)
 		}
-		return fmt.Errorf("websocket connection failed: %v", err)
+		return nil, fmt.Errorf("websocket connection failed: %v", err)
 	}
 
-	c.conn = conn
-	c.logger.Info("Connected to server", "url", c.config.ServiceURL)
-	return nil
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(readTimeout))
+	})
+	c.logger.Info("Connected to server", "url", c.endpoint.URL)
+	return conn, nil
 }
 
 func (c *OpenAIClient) loadSystemPrompt() string {
@@ -96,65 +146,172 @@ func (c *OpenAIClient) loadSystemPrompt() string {
 }
 
 func (c *OpenAIClient) initializeSession() error {
-	sessionEvent := map[string]interface{}{
-		"type": "session.update",
-		"session": map[string]interface{}{
-			"modalities":         []string{"audio", "text"},
-			"input_audio_format": "pcm16",
-			"instructions":       c.loadSystemPrompt(),
-			// turn should be detected automatically
-			"turn_detection": map[string]interface{}{
-				"type":                "server_vad",
-				"threshold":           0.5,
-				"prefix_padding_ms":   300,
-				"silence_duration_ms": 500,
-			},
-		},
-	}
 	fmt.Println("Initializing session...")
-	return c.writeJSON(sessionEvent)
+	return c.writeJSON(c.sessionUpdateEvent())
+}
+
+// sessionUpdateEvent builds the session.update event that configures a new session
+func (c *OpenAIClient) sessionUpdateEvent() map[string]interface{} {
+	c.stateMu.Lock()
+	session := sessionFields(c.session)
+	instructions := c.instructions
+	c.stateMu.Unlock()
+
+	session["input_audio_format"] = "pcm16"
+	session["instructions"] = c.systemPrompt
+	if instructions != nil {
+		session["instructions"] = *instructions
+	}
+	if c.tools != nil {
+		if defs := c.tools.Definitions(); len(defs) > 0 {
+			session["tools"] = defs
+			session["tool_choice"] = "auto"
+		}
+	}
+	if c.aiconfig.InputTranscriptionModel != "" {
+		session["input_audio_transcription"] = map[string]interface{}{
+			"model": c.aiconfig.InputTranscriptionModel,
+		}
+	}
+
+	return map[string]interface{}{
+		"type":    SessionUpdateEventType,
+		"session": session,
+	}
 }
 
 func (c *OpenAIClient) writeJSON(v interface{}) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if !c.connected {
+		return ErrDisconnected
+	}
+	return c.writeJSONLocked(v)
+}
+
+// writeJSONLocked writes to the current connection, c.mu must be held
+func (c *OpenAIClient) writeJSONLocked(v interface{}) error {
 	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 	return c.conn.WriteJSON(v)
 }
 
-func (c *OpenAIClient) processEvent(eventType EventType, msg []byte) error {
+func (c *OpenAIClient) processEvent(ctx context.Context, eventType EventType, msg []byte) error {
 	switch eventType {
 	case ErrorEventType:
 		var errorEvent ErrorEvent
 		if err := json.Unmarshal(msg, &errorEvent); err != nil {
 			return fmt.Errorf("failed to parse error event: %v", err)
 		}
+		metrics.UpstreamErrors.WithLabelValues(metrics.UpstreamServerError).Inc()
 		c.logger.Error("Received error event from OpenAI",
 			"type", errorEvent.Error.Type,
 			"code", errorEvent.Error.Code,
 			"message", errorEvent.Error.Message)
+		c.emitEvent(Event{Type: ErrorEventType, Error: &errorEvent.Error})
 		return fmt.Errorf("server error: %s", errorEvent.Error.Message)
 
-	case ResponseAudioDoneEventType:
-		// send the remaining bytes
-		c.eventsStream <- ResponseAudioDoneEventType
+	case SpeechStartedEventType, SpeechStoppedEventType, ResponseAudioDoneEventType:
+		c.emitEvent(Event{Type: eventType})
+		return nil
+
+	case ResponseCreatedEventType, ResponseDoneEventType:
+		var responseEvent ResponseEvent
+		if err := json.Unmarshal(msg, &responseEvent); err != nil {
+			return fmt.Errorf("failed to parse %s event: %v", eventType, err)
+		}
+		c.stateMu.Lock()
+		createResponse := false
+		if eventType == ResponseCreatedEventType {
+			c.activeResponseID = responseEvent.Response.ID
+		} else if c.activeResponseID == responseEvent.Response.ID {
+			c.activeResponseID = ""
+			// tool results that arrived while this response was generated are waiting for a new response
+			createResponse = c.pendingToolResponse
+			c.pendingToolResponse = false
+		}
+		c.stateMu.Unlock()
+		if createResponse {
+			if err := c.writeJSON(map[string]interface{}{"type": ResponseCreateEventType}); err != nil {
+				return fmt.Errorf("failed to request response for tool results: %v", err)
+			}
+		}
+		c.emitEvent(Event{
+			Type:           eventType,
+			ResponseID:     responseEvent.Response.ID,
+			ResponseStatus: responseEvent.Response.Status,
+		})
 		return nil
 	case ResponseAudioDeltaEventType:
-		fmt.Println("Received audio delta")
-		var data string
-		var resp map[string]interface{}
-		if err := json.Unmarshal(msg, &resp); err != nil {
+		var delta ResponseAudioDeltaEvent
+		if err := json.Unmarshal(msg, &delta); err != nil {
 			return fmt.Errorf("failed to parse delta event: %v", err)
 		}
-		data = resp["delta"].(string)
-		pcm16Data, err := base64.StdEncoding.DecodeString(data)
+
+		c.stateMu.Lock()
+		cancelled := delta.ResponseID != "" && delta.ResponseID == c.cancelledResponseID
+		if !cancelled {
+			c.lastAudioItemID = delta.ItemID
+		}
+		c.stateMu.Unlock()
+		if cancelled {
+			return nil
+		}
+
+		pcm16Data, err := base64.StdEncoding.DecodeString(delta.Delta)
 		if err != nil {
 			return fmt.Errorf("Could not decode base64 audio")
 		}
 
-		a := audio.FromPCM16(pcm16Data, 24000, 1)
-		c.responseStream <- a
+		a := audio.FromPCM16(pcm16Data, SampleRate, 1)
+		select {
+		case c.responseStream <- a:
+		case <-c.done:
+		}
+		return nil
+
+	case AudioTranscriptDeltaEventType:
+		var delta AudioTranscriptDeltaEvent
+		if err := json.Unmarshal(msg, &delta); err != nil {
+			return fmt.Errorf("failed to parse transcript delta event: %v", err)
+		}
+		c.emitTranscript(Transcript{Role: AssistantRole, ItemID: delta.ItemID, Text: delta.Delta})
+		return nil
+
+	case AudioTranscriptDoneEventType:
+		var done AudioTranscriptDoneEvent
+		if err := json.Unmarshal(msg, &done); err != nil {
+			return fmt.Errorf("failed to parse transcript done event: %v", err)
+		}
+		t := Transcript{Role: AssistantRole, ItemID: done.ItemID, Text: done.Transcript, Final: true}
+		c.remember(t)
+		c.emitTranscript(t)
+		return nil
+
+	case InputAudioTranscriptionCompletedEventType:
+		var completed InputAudioTranscriptionCompletedEvent
+		if err := json.Unmarshal(msg, &completed); err != nil {
+			return fmt.Errorf("failed to parse input transcription event: %v", err)
+		}
+		t := Transcript{Role: UserRole, ItemID: completed.ItemID, Text: completed.Transcript, Final: true}
+		c.remember(t)
+		c.emitTranscript(t)
+		return nil
+
+	case InputAudioTranscriptionFailedEventType:
+		var failed InputAudioTranscriptionFailedEvent
+		if err := json.Unmarshal(msg, &failed); err != nil {
+			return fmt.Errorf("failed to parse input transcription event: %v", err)
+		}
+		c.logger.Warn("Could not transcribe user audio", "item_id", failed.ItemID, "error", failed.Error.Message)
+		return nil
+
+	case FunctionCallArgumentsDoneEventType:
+		var call FunctionCallArgumentsDoneEvent
+		if err := json.Unmarshal(msg, &call); err != nil {
+			return fmt.Errorf("failed to parse function call event: %v", err)
+		}
+		go c.callTool(ctx, call)
 		return nil
 
 	default:
@@ -177,20 +334,28 @@ func (c *OpenAIClient) watchServerEvents(ctx context.Context) error {
 		default:
 			_, msg, err := c.conn.ReadMessage()
 			if err != nil {
-				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-					return nil
+				select {
+				case <-c.done:
+					return fmt.Errorf("client closed")
+				default:
 				}
 
-				c.logger.Error("failed to read message from openai server", "error", err)
+				metrics.UpstreamErrors.WithLabelValues(metrics.UpstreamDisconnect).Inc()
+				c.logger.Error("lost connection to openai server", "error", err)
+				if err := c.reconnect(ctx); err != nil {
+					c.logger.Error("could not reconnect to openai server", "error", err)
+					return err
+				}
 				continue
 			}
+			c.conn.SetReadDeadline(time.Now().Add(readTimeout))
 
 			var baseEvent EventBase
 			if err := json.Unmarshal(msg, &baseEvent); err != nil {
 				c.logger.Error("failed to parse base event from openai server", "error", err)
 				continue
 			}
-			if err := c.processEvent(baseEvent.Type, msg); err != nil {
+			if err := c.processEvent(ctx, baseEvent.Type, msg); err != nil {
 				c.logger.Error("failed to process OpenAI event", "type", baseEvent.Type, "error", err)
 			}
 
@@ -199,7 +364,71 @@ func (c *OpenAIClient) watchServerEvents(ctx context.Context) error {
 
 }
 
-func (c *OpenAIClient) GetEventsStream() <-chan EventType {
+// emitEvent hands e to the events stream consumer, giving up if the client is closed
+func (c *OpenAIClient) emitEvent(e Event) {
+	select {
+	case c.eventsStream <- e:
+	case <-c.done:
+	}
+}
+
+// callTool runs the tool the model asked for, hands the result back to the model and asks it to
+// continue the response using it
+func (c *OpenAIClient) callTool(ctx context.Context, call FunctionCallArgumentsDoneEvent) {
+	c.logger.Info("Calling tool", "name", call.Name, "call_id", call.CallID, "arguments", call.Arguments)
+
+	var output string
+	if c.tools == nil {
+		output = toolError(fmt.Errorf("no tools are available"))
+	} else {
+		var err error
+		output, err = c.tools.Call(ctx, call.Name, json.RawMessage(call.Arguments))
+		if err != nil {
+			c.logger.Error("Tool call failed", "name", call.Name, "call_id", call.CallID, "error", err)
+		}
+	}
+
+	event := map[string]interface{}{
+		"type": ConversationItemCreateEventType,
+		"item": map[string]interface{}{
+			"type":    "function_call_output",
+			"call_id": call.CallID,
+			"output":  output,
+		},
+	}
+	if err := c.writeJSON(event); err != nil {
+		c.logger.Error("Could not send tool result", "name", call.Name, "call_id", call.CallID, "error", err)
+		return
+	}
+
+	// only one response can be generated at a time, if the response that made the call is still
+	// going the new one is requested once it is done
+	c.stateMu.Lock()
+	respond := c.activeResponseID == ""
+	if !respond {
+		c.pendingToolResponse = true
+	}
+	c.stateMu.Unlock()
+	if respond {
+		if err := c.writeJSON(map[string]interface{}{"type": ResponseCreateEventType}); err != nil {
+			c.logger.Error("Could not request response for tool result", "call_id", call.CallID, "error", err)
+		}
+	}
+}
+
+// emitTranscript hands t to the transcript stream consumer, giving up if the client is closed
+func (c *OpenAIClient) emitTranscript(t Transcript) {
+	select {
+	case c.transcriptStream <- t:
+	case <-c.done:
+	}
+}
+
+func (c *OpenAIClient) GetTranscriptStream() <-chan Transcript {
+	return c.transcriptStream
+}
+
+func (c *OpenAIClient) GetEventsStream() <-chan Event {
 	return c.eventsStream
 }
 
@@ -209,12 +438,10 @@ func (c *OpenAIClient) GetResponseStream() <-chan audio.Audio {
 
 func (c *OpenAIClient) SendAudio(a audio.Audio) error {
 	// OpenAI requires 16 bit pcm, 1 channel audio, 24khz samplerate
-	if a.GetChannels() != 1 && a.GetChannels() == 2 {
-		a.StereoToMono()
-	}
+	a.SetChannels(1)
 
-	if a.GetSampleRate() != 24000 {
-		a.Resample(24000)
+	if a.GetSampleRate() != SampleRate {
+		a.Resample(SampleRate)
 	}
 
 	return c.AppendToAudioBuffer(base64.StdEncoding.EncodeToString(a.AsPCM16()))
@@ -222,15 +449,87 @@ func (c *OpenAIClient) SendAudio(a audio.Audio) error {
 }
 
 func (c *OpenAIClient) AppendToAudioBuffer(audio string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.connected {
+		c.bufferAudio(audio)
+		return nil
+	}
 	event := map[string]interface{}{
 		"type":  InputAudioBufferAppendEventType,
 		"audio": audio,
 	}
+	return c.writeJSONLocked(event)
+}
+
+// UpdateSession validates the changes against the current session parameters and applies them. It
+// can be called before Initialize to set the parameters of the session.
+func (c *OpenAIClient) UpdateSession(u SessionUpdate) error {
+	c.stateMu.Lock()
+	if err := u.Validate(c.session); err != nil {
+		c.stateMu.Unlock()
+		return err
+	}
+	c.session = u.Apply(c.session)
+	if u.Instructions != nil {
+		c.instructions = u.Instructions
+	}
+	fields := u.updateFields(c.session)
+	c.stateMu.Unlock()
+
+	event := map[string]interface{}{
+		"type":    SessionUpdateEventType,
+		"session": fields,
+	}
+	err := c.writeJSON(event)
+	if errors.Is(err, ErrDisconnected) {
+		// the update is part of the session configuration sent when the connection is back
+		return nil
+	}
+	return err
+}
+
+func (c *OpenAIClient) CommitAudio() error {
+	if err := c.writeJSON(map[string]interface{}{"type": InputAudioBufferCommitEventType}); err != nil {
+		return err
+	}
+	return c.writeJSON(map[string]interface{}{"type": ResponseCreateEventType})
+}
+
+func (c *OpenAIClient) ClearAudio() error {
+	return c.writeJSON(map[string]interface{}{"type": InputAudioBufferClearEventType})
+}
+
+func (c *OpenAIClient) CancelResponse() error {
+	c.stateMu.Lock()
+	c.cancelledResponseID = c.activeResponseID
+	c.stateMu.Unlock()
+	return c.writeJSON(map[string]interface{}{"type": ResponseCancelEventType})
+}
+
+func (c *OpenAIClient) TruncateResponse(audioEnd time.Duration) error {
+	c.stateMu.Lock()
+	itemID := c.lastAudioItemID
+	c.stateMu.Unlock()
+	if itemID == "" {
+		return nil
+	}
+
+	event := map[string]interface{}{
+		"type":          ConversationItemTruncateEventType,
+		"item_id":       itemID,
+		"content_index": 0,
+		"audio_end_ms":  audioEnd.Milliseconds(),
+	}
 	return c.writeJSON(event)
 }
 func (c *OpenAIClient) Close() {
 	c.closeOnce.Do(func() {
 		close(c.done)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
 		if c.conn != nil {
 			c.conn.WriteMessage(websocket.CloseMessage,
 				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
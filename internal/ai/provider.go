@@ -0,0 +1,145 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+)
+
+// ProviderFactory creates the client used by a single device connection
+type ProviderFactory func(cfg *config.Config, tools *ToolRegistry) (AIClient, error)
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]ProviderFactory{
+		config.ProviderAzureOpenAI: func(cfg *config.Config, tools *ToolRegistry) (AIClient, error) {
+			return NewOpenAIClient(AzureEndpoint(cfg.Azure), cfg.AIConfig, tools), nil
+		},
+		config.ProviderOpenAI: func(cfg *config.Config, tools *ToolRegistry) (AIClient, error) {
+			endpoint, err := OpenAIEndpoint(cfg.OpenAI)
+			if err != nil {
+				return nil, err
+			}
+			return NewOpenAIClient(endpoint, cfg.AIConfig, tools), nil
+		},
+		config.ProviderMock: func(cfg *config.Config, tools *ToolRegistry) (AIClient, error) {
+			return NewOpenAIClient(Endpoint{URL: cfg.AIConfig.MockURL}, cfg.AIConfig, tools), nil
+		},
+		config.ProviderEcho: func(cfg *config.Config, tools *ToolRegistry) (AIClient, error) {
+			return NewEchoClient(cfg.AIConfig), nil
+		},
+	}
+)
+
+// RegisterProvider makes a provider available under the given name, replacing any provider
+// registered with the same name
+func RegisterProvider(name string, factory ProviderFactory) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[name] = factory
+}
+
+// Providers returns the names of the registered providers
+func Providers() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewClient creates a client of the provider set in cfg.AIConfig.Provider
+func NewClient(cfg *config.Config, tools *ToolRegistry) (AIClient, error) {
+	name := cfg.AIConfig.Provider
+	if name == "" {
+		name = config.ProviderAzureOpenAI
+	}
+
+	providersMu.RLock()
+	factory, ok := providers[name]
+	providersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown ai provider %q", name)
+	}
+	return factory(cfg, tools)
+}
+
+// Endpoint is a Realtime API server and the headers needed to connect to it
+type Endpoint struct {
+	URL    string
+	Header http.Header
+}
+
+// AzureEndpoint returns the endpoint of an Azure OpenAI deployment, which authenticates with an
+// api-key header
+func AzureEndpoint(cfg config.AzureConfig) Endpoint {
+	return Endpoint{
+		URL:    cfg.ServiceURL,
+		Header: http.Header{"Api-Key": {cfg.OpenAIKey}},
+	}
+}
+
+// OpenAIEndpoint returns the endpoint of the public OpenAI API, which authenticates with a bearer
+// token and needs the realtime beta header. The model is added to the URL unless it already has one.
+func OpenAIEndpoint(cfg config.OpenAIConfig) (Endpoint, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("invalid openai url: %v", err)
+	}
+	if q := u.Query(); q.Get("model") == "" && cfg.Model != "" {
+		q.Set("model", cfg.Model)
+		u.RawQuery = q.Encode()
+	}
+	return Endpoint{
+		URL: u.String(),
+		Header: http.Header{
+			"Authorization": {"Bearer " + cfg.APIKey},
+			"Openai-Beta":   {"realtime=v1"},
+		},
+	}, nil
+}
+
+// ProbeUpstream checks that the Realtime API server of the provider set in cfg.AIConfig.Provider
+// accepts connections. It only opens a TCP connection, which costs no session upstream. Providers
+// without a server, like echo, and the providers added with RegisterProvider are not probed.
+func ProbeUpstream(ctx context.Context, cfg *config.Config) error {
+	var rawURL string
+	switch cfg.AIConfig.Provider {
+	case "", config.ProviderAzureOpenAI:
+		rawURL = cfg.Azure.ServiceURL
+	case config.ProviderOpenAI:
+		rawURL = cfg.OpenAI.URL
+	case config.ProviderMock:
+		rawURL = cfg.AIConfig.MockURL
+	default:
+		return nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid upstream url: %v", err)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" || u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return fmt.Errorf("could not reach %s: %v", u.Host, err)
+	}
+	return conn.Close()
+}
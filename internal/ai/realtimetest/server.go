@@ -0,0 +1,576 @@
+// Package realtimetest provides a fake Realtime API server for tests and offline development.
+//
+// The fake server speaks the subset of the Realtime WebSocket protocol used by ai.OpenAIClient.
+// Instead of running a model it plays a Scenario: a scripted list of turns, each of which is
+// triggered once enough user audio has been appended (or the audio buffer is committed) and
+// answered with VAD, transcription, transcript and audio events.
+package realtimetest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultTurnInputBytes is the amount of PCM16 user audio, half a second at 24 kHz, after which a
+// turn is considered spoken when Turn.InputBytes is not set
+const DefaultTurnInputBytes = 24000
+
+// Response is a scripted answer of the fake model
+type Response struct {
+	// Transcript is streamed word by word as response.audio_transcript.delta events
+	Transcript string
+	// Audio is PCM16 24 kHz mono audio streamed as response.audio.delta events
+	Audio []byte
+	// EchoInput plays back the user audio of the turn instead of Audio
+	EchoInput bool
+}
+
+// ToolCall is a function call the fake model makes before answering
+type ToolCall struct {
+	Name      string
+	Arguments string
+}
+
+// Turn is one scripted exchange between the user and the fake model
+type Turn struct {
+	// InputBytes is the amount of user audio after which the user stops speaking, defaults to
+	// DefaultTurnInputBytes
+	InputBytes int
+	// UserTranscript is sent as the transcription of the user audio
+	UserTranscript string
+	// ToolCall makes the first response of the turn a function call. Response is then played once
+	// the client sends the tool output and asks for a new response.
+	ToolCall *ToolCall
+	Response Response
+	// ResponseDelay is how long the fake model takes to start responding once the user stopped
+	// speaking or the audio was committed. The server does not read the client events in the meantime.
+	ResponseDelay time.Duration
+}
+
+// Scenario is the script the fake server plays on every connection
+type Scenario struct {
+	Turns []Turn
+	// Repeat starts over from the first turn once all turns have been played
+	Repeat bool
+	// ChunkSize is the size in bytes of the audio deltas, defaults to 4800 (100ms)
+	ChunkSize int
+	// ChunkDelay is the time between two audio deltas. Setting it lets clients interrupt responses.
+	ChunkDelay time.Duration
+}
+
+// EchoScenario answers every half second of speech by playing it back
+func EchoScenario() Scenario {
+	return Scenario{
+		Turns:  []Turn{{Response: Response{EchoInput: true}}},
+		Repeat: true,
+	}
+}
+
+// ClientEvent is an event received from a client
+type ClientEvent struct {
+	Type string
+	Raw  json.RawMessage
+}
+
+// Handler is an http.Handler that upgrades requests to WebSocket connections and plays the
+// scenario on each of them
+type Handler struct {
+	scenario Scenario
+	upgrader websocket.Upgrader
+	logger   *slog.Logger
+
+	mu          sync.Mutex
+	events      []ClientEvent
+	headers     []http.Header
+	conns       map[*websocket.Conn]struct{}
+	newEvent    chan struct{}
+	connections int
+}
+
+func NewHandler(scenario Scenario) *Handler {
+	if scenario.ChunkSize <= 0 {
+		scenario.ChunkSize = 4800
+	}
+	return &Handler{
+		scenario: scenario,
+		upgrader: websocket.Upgrader{},
+		logger:   slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelWarn})),
+		conns:    make(map[*websocket.Conn]struct{}),
+		newEvent: make(chan struct{}),
+	}
+}
+
+// ServeHTTP handles a client connection
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		h.logger.Error("Failed to upgrade connection", "error", err)
+		return
+	}
+
+	h.mu.Lock()
+	h.headers = append(h.headers, r.Header.Clone())
+	h.conns[conn] = struct{}{}
+	h.connections++
+	id := h.connections
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.conns, conn)
+		h.mu.Unlock()
+		conn.Close()
+	}()
+
+	c := &fakeConn{handler: h, conn: conn, id: id}
+	c.run()
+}
+
+// Events returns all the events received from clients so far
+func (h *Handler) Events() []ClientEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]ClientEvent(nil), h.events...)
+}
+
+// EventsOfType returns the events of the given type received from clients so far
+func (h *Handler) EventsOfType(typ string) []ClientEvent {
+	var events []ClientEvent
+	for _, e := range h.Events() {
+		if e.Type == typ {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// WaitForEvent waits until n events of the given type have been received and returns the last one
+func (h *Handler) WaitForEvent(typ string, n int, timeout time.Duration) (ClientEvent, bool) {
+	deadline := time.After(timeout)
+	for {
+		h.mu.Lock()
+		newEvent := h.newEvent
+		var matching []ClientEvent
+		for _, e := range h.events {
+			if e.Type == typ {
+				matching = append(matching, e)
+			}
+		}
+		h.mu.Unlock()
+
+		if len(matching) >= n {
+			return matching[n-1], true
+		}
+		select {
+		case <-newEvent:
+		case <-deadline:
+			return ClientEvent{}, false
+		}
+	}
+}
+
+// Headers returns the HTTP headers of every connection request received so far
+func (h *Handler) Headers() []http.Header {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]http.Header(nil), h.headers...)
+}
+
+// Connections returns the number of connections accepted so far
+func (h *Handler) Connections() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.connections
+}
+
+// OpenConnections returns the number of connections currently open
+func (h *Handler) OpenConnections() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.conns)
+}
+
+// DropConnections abruptly closes all open connections, as if the network went down
+func (h *Handler) DropConnections() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for conn := range h.conns {
+		conn.Close()
+	}
+}
+
+func (h *Handler) record(e ClientEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.events = append(h.events, e)
+	close(h.newEvent)
+	h.newEvent = make(chan struct{})
+}
+
+// Server is a fake Realtime API server listening on a local address
+type Server struct {
+	*Handler
+	httpServer *httptest.Server
+	// URL is the WebSocket URL of the server
+	URL string
+}
+
+// NewServer starts a fake Realtime API server playing scenario. It must be closed with Close.
+func NewServer(scenario Scenario) *Server {
+	h := NewHandler(scenario)
+	httpServer := httptest.NewServer(h)
+	return &Server{
+		Handler:    h,
+		httpServer: httpServer,
+		URL:        "ws" + strings.TrimPrefix(httpServer.URL, "http"),
+	}
+}
+
+// Close shuts down the server and closes all its connections
+func (s *Server) Close() {
+	s.DropConnections()
+	s.httpServer.Close()
+}
+
+// fakeConn plays the scenario on a single connection
+type fakeConn struct {
+	handler *Handler
+	conn    *websocket.Conn
+	id      int
+
+	writeMu sync.Mutex
+
+	mu           sync.Mutex
+	seq          int
+	turn         int
+	inputBytes   int
+	input        []byte
+	speaking     bool
+	awaitingTool *Turn
+	cancel       chan struct{}
+}
+
+func (c *fakeConn) run() {
+	c.send(map[string]interface{}{
+		"type":    "session.created",
+		"session": map[string]interface{}{"id": fmt.Sprintf("sess_%d", c.id)},
+	})
+
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var base struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(msg, &base); err != nil {
+			c.sendError("invalid_request_error", fmt.Sprintf("could not parse event: %v", err))
+			continue
+		}
+		c.handler.record(ClientEvent{Type: base.Type, Raw: json.RawMessage(msg)})
+		c.handle(base.Type, msg)
+	}
+}
+
+func (c *fakeConn) handle(typ string, msg []byte) {
+	switch typ {
+	case "session.update":
+		var event struct {
+			Session json.RawMessage `json:"session"`
+		}
+		json.Unmarshal(msg, &event)
+		c.send(map[string]interface{}{"type": "session.updated", "session": event.Session})
+
+	case "input_audio_buffer.append":
+		var event struct {
+			Audio string `json:"audio"`
+		}
+		json.Unmarshal(msg, &event)
+		data, err := base64.StdEncoding.DecodeString(event.Audio)
+		if err != nil {
+			c.sendError("invalid_request_error", "audio is not valid base64")
+			return
+		}
+		c.appendAudio(data)
+
+	case "input_audio_buffer.commit":
+		if t, ok := c.endTurn(); ok {
+			c.send(map[string]interface{}{"type": "input_audio_buffer.committed", "item_id": c.nextID("item")})
+			c.transcribe(t)
+			time.Sleep(t.ResponseDelay)
+			c.respond(t)
+		}
+
+	case "input_audio_buffer.clear":
+		c.mu.Lock()
+		c.inputBytes = 0
+		c.input = nil
+		c.speaking = false
+		c.mu.Unlock()
+		c.send(map[string]interface{}{"type": "input_audio_buffer.cleared"})
+
+	case "response.create":
+		c.mu.Lock()
+		t := c.awaitingTool
+		c.awaitingTool = nil
+		c.mu.Unlock()
+		if t != nil {
+			c.play(*t, nil)
+		}
+
+	case "response.cancel":
+		c.mu.Lock()
+		if c.cancel != nil {
+			close(c.cancel)
+			c.cancel = nil
+		}
+		c.mu.Unlock()
+
+	case "conversation.item.create":
+		var event struct {
+			Item json.RawMessage `json:"item"`
+		}
+		json.Unmarshal(msg, &event)
+		c.send(map[string]interface{}{"type": "conversation.item.created", "item": event.Item})
+
+	case "conversation.item.truncate":
+		var event struct {
+			ItemID     string `json:"item_id"`
+			AudioEndMs int    `json:"audio_end_ms"`
+		}
+		json.Unmarshal(msg, &event)
+		c.send(map[string]interface{}{
+			"type":         "conversation.item.truncated",
+			"item_id":      event.ItemID,
+			"audio_end_ms": event.AudioEndMs,
+		})
+
+	default:
+		c.sendError("invalid_request_error", fmt.Sprintf("unsupported event type %s", typ))
+	}
+}
+
+// appendAudio adds user audio to the current turn and plays the turn once enough audio arrived
+func (c *fakeConn) appendAudio(data []byte) {
+	c.mu.Lock()
+	t, ok := c.currentTurn()
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	started := !c.speaking
+	c.speaking = true
+	c.inputBytes += len(data)
+	c.input = append(c.input, data...)
+	done := c.inputBytes >= t.InputBytes
+	c.mu.Unlock()
+
+	if started {
+		c.send(map[string]interface{}{"type": "input_audio_buffer.speech_started", "item_id": c.nextID("item")})
+	}
+	if !done {
+		return
+	}
+	if t, ok := c.endTurn(); ok {
+		c.send(map[string]interface{}{"type": "input_audio_buffer.speech_stopped"})
+		c.send(map[string]interface{}{"type": "input_audio_buffer.committed", "item_id": c.nextID("item")})
+		c.transcribe(t)
+		time.Sleep(t.ResponseDelay)
+		c.respond(t)
+	}
+}
+
+// currentTurn returns the turn the user is speaking, c.mu must be held
+func (c *fakeConn) currentTurn() (Turn, bool) {
+	turns := c.handler.scenario.Turns
+	if len(turns) == 0 || (c.turn >= len(turns) && !c.handler.scenario.Repeat) {
+		return Turn{}, false
+	}
+	t := turns[c.turn%len(turns)]
+	if t.InputBytes <= 0 {
+		t.InputBytes = DefaultTurnInputBytes
+	}
+	return t, true
+}
+
+// endTurn moves on to the next turn and returns the one that just ended with the user audio attached
+func (c *fakeConn) endTurn() (Turn, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.currentTurn()
+	if !ok {
+		return Turn{}, false
+	}
+	if t.Response.EchoInput {
+		t.Response.Audio = c.input
+	}
+	c.turn++
+	c.inputBytes = 0
+	c.input = nil
+	c.speaking = false
+	return t, true
+}
+
+func (c *fakeConn) transcribe(t Turn) {
+	if t.UserTranscript == "" {
+		return
+	}
+	c.send(map[string]interface{}{
+		"type":          "conversation.item.input_audio_transcription.completed",
+		"item_id":       c.nextID("item"),
+		"content_index": 0,
+		"transcript":    t.UserTranscript,
+	})
+}
+
+// respond answers a turn, either with a function call or with its response
+func (c *fakeConn) respond(t Turn) {
+	if t.ToolCall == nil {
+		c.play(t, nil)
+		return
+	}
+
+	c.mu.Lock()
+	c.awaitingTool = &t
+	c.mu.Unlock()
+	c.play(t, t.ToolCall)
+}
+
+// play streams a response in the background so that the client can cancel it
+func (c *fakeConn) play(t Turn, call *ToolCall) {
+	responseID := c.nextID("resp")
+	itemID := c.nextID("item")
+	cancel := make(chan struct{})
+
+	c.mu.Lock()
+	c.cancel = cancel
+	c.mu.Unlock()
+
+	c.send(map[string]interface{}{
+		"type":     "response.created",
+		"response": map[string]interface{}{"id": responseID, "status": "in_progress"},
+	})
+
+	go func() {
+		status := c.stream(t.Response, call, responseID, itemID, cancel)
+
+		c.mu.Lock()
+		if c.cancel == cancel {
+			c.cancel = nil
+		}
+		c.mu.Unlock()
+
+		c.send(map[string]interface{}{
+			"type":     "response.done",
+			"response": map[string]interface{}{"id": responseID, "status": status},
+		})
+	}()
+}
+
+func (c *fakeConn) stream(r Response, call *ToolCall, responseID, itemID string, cancel chan struct{}) string {
+	if call != nil {
+		c.send(map[string]interface{}{
+			"type":        "response.function_call_arguments.done",
+			"response_id": responseID,
+			"item_id":     itemID,
+			"call_id":     c.nextID("call"),
+			"name":        call.Name,
+			"arguments":   call.Arguments,
+		})
+		return "completed"
+	}
+
+	words := strings.Fields(r.Transcript)
+	chunkSize := c.handler.scenario.ChunkSize
+	for i := 0; i < len(r.Audio) || len(words) > 0; i += chunkSize {
+		select {
+		case <-cancel:
+			return "cancelled"
+		default:
+		}
+
+		if i < len(r.Audio) {
+			end := min(i+chunkSize, len(r.Audio))
+			c.send(map[string]interface{}{
+				"type":          "response.audio.delta",
+				"response_id":   responseID,
+				"item_id":       itemID,
+				"output_index":  0,
+				"content_index": 0,
+				"delta":         base64.StdEncoding.EncodeToString(r.Audio[i:end]),
+			})
+		}
+		if len(words) > 0 {
+			delta := words[0]
+			if len(words) > 1 {
+				delta += " "
+			}
+			words = words[1:]
+			c.send(map[string]interface{}{
+				"type":        "response.audio_transcript.delta",
+				"response_id": responseID,
+				"item_id":     itemID,
+				"delta":       delta,
+			})
+		}
+
+		if d := c.handler.scenario.ChunkDelay; d > 0 {
+			select {
+			case <-cancel:
+				return "cancelled"
+			case <-time.After(d):
+			}
+		}
+	}
+
+	c.send(map[string]interface{}{"type": "response.audio.done", "response_id": responseID, "item_id": itemID})
+	c.send(map[string]interface{}{
+		"type":        "response.audio_transcript.done",
+		"response_id": responseID,
+		"item_id":     itemID,
+		"transcript":  r.Transcript,
+	})
+	return "completed"
+}
+
+func (c *fakeConn) nextID(prefix string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	return fmt.Sprintf("%s_%d_%d", prefix, c.id, c.seq)
+}
+
+func (c *fakeConn) sendError(typ, message string) {
+	c.send(map[string]interface{}{
+		"type":  "error",
+		"error": map[string]interface{}{"type": typ, "message": message},
+	})
+}
+
+func (c *fakeConn) send(v interface{}) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.conn.WriteJSON(v); err != nil {
+		c.handler.logger.Warn("Could not write event", "error", err)
+	}
+}
@@ -0,0 +1,234 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+	"github.com/pixaverse-studios/websocket-server/internal/metrics"
+
+	"github.com/gorilla/websocket"
+)
+
+// reconnectPolicy is the parsed form of config.ReconnectConfig, with defaults for unset values
+type reconnectPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	// audioBufferBytes is the amount of 24 kHz PCM16 audio kept while disconnected
+	audioBufferBytes int
+	replayItems      int
+}
+
+func newReconnectPolicy(cfg config.ReconnectConfig) reconnectPolicy {
+	p := reconnectPolicy{
+		maxAttempts:      5,
+		initialBackoff:   500 * time.Millisecond,
+		maxBackoff:       10 * time.Second,
+		audioBufferBytes: 5 * 24000 * 2,
+		replayItems:      20,
+	}
+	if cfg.MaxAttempts > 0 {
+		p.maxAttempts = cfg.MaxAttempts
+	}
+	if d, err := time.ParseDuration(cfg.InitialBackoff); err == nil && d > 0 {
+		p.initialBackoff = d
+	}
+	if d, err := time.ParseDuration(cfg.MaxBackoff); err == nil && d > 0 {
+		p.maxBackoff = d
+	}
+	if d, err := time.ParseDuration(cfg.AudioBuffer); err == nil && d >= 0 {
+		p.audioBufferBytes = int(d.Seconds() * 24000 * 2)
+	}
+	if cfg.ReplayItems > 0 {
+		p.replayItems = cfg.ReplayItems
+	}
+	return p
+}
+
+// backoff returns how long to wait before the given attempt, doubling from initialBackoff with up to
+// 20% of jitter so that sessions dropped together do not reconnect together
+func (p reconnectPolicy) backoff(attempt int) time.Duration {
+	d := p.initialBackoff
+	for i := 1; i < attempt && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.maxBackoff)
+	return d - time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// reconnect re-establishes the connection after it dropped. The session configuration and the
+// recent conversation items are replayed to the new session, followed by the audio the device sent
+// in the meantime. The events stream reports the progress to the device.
+func (c *OpenAIClient) reconnect(ctx context.Context) error {
+	c.mu.Lock()
+	c.connected = false
+	c.conn.Close()
+	c.mu.Unlock()
+
+	c.abandonResponse()
+
+	policy := newReconnectPolicy(c.aiconfig.Reconnect)
+	for attempt := 1; attempt <= policy.maxAttempts; attempt++ {
+		c.emitEvent(Event{Type: UpstreamReconnectingEventType, Attempt: attempt})
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.done:
+			return fmt.Errorf("client closed")
+		case <-time.After(policy.backoff(attempt)):
+		}
+
+		conn, err := c.connect()
+		if err != nil {
+			metrics.UpstreamErrors.WithLabelValues(metrics.UpstreamConnect).Inc()
+			c.logger.Warn("Reconnection attempt failed", "attempt", attempt, "error", err)
+			continue
+		}
+		if err := c.restoreSession(conn, policy); err != nil {
+			c.logger.Warn("Could not restore session", "attempt", attempt, "error", err)
+			conn.Close()
+			continue
+		}
+
+		c.logger.Info("Reconnected to server", "attempt", attempt)
+		c.emitEvent(Event{Type: UpstreamReconnectedEventType, Attempt: attempt})
+		return nil
+	}
+
+	metrics.UpstreamErrors.WithLabelValues(metrics.UpstreamReconnectFailed).Inc()
+	c.emitEvent(Event{Type: UpstreamFailedEventType})
+	return fmt.Errorf("gave up after %d attempts", policy.maxAttempts)
+}
+
+// restoreSession makes conn the current connection and brings the new session up to date. Nothing
+// else can be sent until it is done.
+func (c *OpenAIClient) restoreSession(conn *websocket.Conn, policy reconnectPolicy) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return fmt.Errorf("client closed")
+	default:
+	}
+
+	c.conn = conn
+	if err := c.writeJSONLocked(c.sessionUpdateEvent()); err != nil {
+		return err
+	}
+
+	c.stateMu.Lock()
+	history := c.history
+	if len(history) > policy.replayItems {
+		history = history[len(history)-policy.replayItems:]
+	}
+	c.stateMu.Unlock()
+	for _, t := range history {
+		if err := c.writeJSONLocked(historyItemEvent(t)); err != nil {
+			return err
+		}
+	}
+
+	for _, audio := range c.pendingAudio {
+		event := map[string]interface{}{
+			"type":  InputAudioBufferAppendEventType,
+			"audio": audio,
+		}
+		if err := c.writeJSONLocked(event); err != nil {
+			return err
+		}
+	}
+	c.pendingAudio = nil
+	c.pendingAudioSize = 0
+	c.connected = true
+	return nil
+}
+
+// historyItemEvent recreates a conversation item from its transcript. The audio itself cannot be
+// replayed, so the new session only knows the conversation as text.
+func historyItemEvent(t Transcript) map[string]interface{} {
+	contentType := "input_text"
+	if t.Role == AssistantRole {
+		contentType = "text"
+	}
+	return map[string]interface{}{
+		"type": ConversationItemCreateEventType,
+		"item": map[string]interface{}{
+			"type": "message",
+			"role": t.Role,
+			"content": []map[string]interface{}{
+				{"type": contentType, "text": t.Text},
+			},
+		},
+	}
+}
+
+// abandonResponse forgets the response that was being generated when the connection dropped, and
+// tells the consumer of the events stream that it is over
+func (c *OpenAIClient) abandonResponse() {
+	c.stateMu.Lock()
+	responseID := c.activeResponseID
+	c.activeResponseID = ""
+	c.pendingToolResponse = false
+	c.stateMu.Unlock()
+
+	if responseID != "" {
+		c.emitEvent(Event{Type: ResponseDoneEventType, ResponseID: responseID, ResponseStatus: "incomplete"})
+	}
+}
+
+// remember adds a final transcript to the conversation history replayed after a reconnection
+func (c *OpenAIClient) remember(t Transcript) {
+	if t.Text == "" {
+		return
+	}
+	maxItems := newReconnectPolicy(c.aiconfig.Reconnect).replayItems
+
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	c.history = append(c.history, t)
+	if len(c.history) > maxItems {
+		c.history = c.history[len(c.history)-maxItems:]
+	}
+}
+
+// bufferAudio keeps base64 encoded audio sent while disconnected, dropping the oldest audio once
+// the buffer is full. c.mu must be held.
+func (c *OpenAIClient) bufferAudio(audio string) {
+	maxSize := newReconnectPolicy(c.aiconfig.Reconnect).audioBufferBytes * 4 / 3
+
+	c.pendingAudio = append(c.pendingAudio, audio)
+	c.pendingAudioSize += len(audio)
+	for c.pendingAudioSize > maxSize && len(c.pendingAudio) > 0 {
+		c.pendingAudioSize -= len(c.pendingAudio[0])
+		c.pendingAudio = c.pendingAudio[1:]
+	}
+}
+
+// keepAlive pings the server so that a dead connection is noticed by the read deadline
+func (c *OpenAIClient) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			if c.connected {
+				if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+					c.logger.Warn("Could not ping server", "error", err)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
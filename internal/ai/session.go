@@ -0,0 +1,122 @@
+package ai
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+)
+
+// ErrInvalidSession is returned by UpdateSession when the resulting session parameters are not valid
+var ErrInvalidSession = errors.New("invalid session parameters")
+
+// SessionUpdate holds the session parameters that can be changed for a single connection. Nil
+// fields are left untouched.
+type SessionUpdate struct {
+	Instructions      *string  `json:"instructions,omitempty"`
+	Voice             *string  `json:"voice,omitempty"`
+	Modalities        []string `json:"modalities,omitempty"`
+	Temperature       *float64 `json:"temperature,omitempty"`
+	MaxOutputTokens   *int     `json:"max_output_tokens,omitempty"`
+	TurnDetection     *string  `json:"turn_detection,omitempty"`
+	VADThreshold      *float64 `json:"vad_threshold,omitempty"`
+	PrefixPaddingMs   *int     `json:"prefix_padding_ms,omitempty"`
+	SilenceDurationMs *int     `json:"silence_duration_ms,omitempty"`
+}
+
+// Apply returns s with the changes of u
+func (u SessionUpdate) Apply(s config.SessionConfig) config.SessionConfig {
+	if u.Voice != nil {
+		s.Voice = *u.Voice
+	}
+	if u.Modalities != nil {
+		s.Modalities = u.Modalities
+	}
+	if u.Temperature != nil {
+		s.Temperature = u.Temperature
+	}
+	if u.MaxOutputTokens != nil {
+		s.MaxOutputTokens = *u.MaxOutputTokens
+	}
+	if u.TurnDetection != nil {
+		s.TurnDetection.Type = *u.TurnDetection
+	}
+	if u.VADThreshold != nil {
+		s.TurnDetection.Threshold = u.VADThreshold
+	}
+	if u.PrefixPaddingMs != nil {
+		s.TurnDetection.PrefixPaddingMs = u.PrefixPaddingMs
+	}
+	if u.SilenceDurationMs != nil {
+		s.TurnDetection.SilenceDurationMs = u.SilenceDurationMs
+	}
+	return s
+}
+
+// Validate checks that u leads to valid session parameters when applied to s
+func (u SessionUpdate) Validate(s config.SessionConfig) error {
+	if err := u.Apply(s).Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSession, err)
+	}
+	return nil
+}
+
+// sessionFields converts s, with its defaults filled in, into the fields of a session.update event
+func sessionFields(s config.SessionConfig) map[string]interface{} {
+	var maxTokens interface{} = "inf"
+	if s.MaxOutputTokens > 0 {
+		maxTokens = s.MaxOutputTokens
+	}
+	var turnDetection interface{}
+	if s.TurnDetection.Type == config.TurnDetectionServerVAD {
+		turnDetection = map[string]interface{}{
+			"type":                s.TurnDetection.Type,
+			"threshold":           *s.TurnDetection.Threshold,
+			"prefix_padding_ms":   *s.TurnDetection.PrefixPaddingMs,
+			"silence_duration_ms": *s.TurnDetection.SilenceDurationMs,
+		}
+	}
+
+	return map[string]interface{}{
+		"voice":                      s.Voice,
+		"modalities":                 s.Modalities,
+		"temperature":                *s.Temperature,
+		"max_response_output_tokens": maxTokens,
+		"output_audio_format":        s.OutputAudioFormat,
+		"turn_detection":             turnDetection,
+	}
+}
+
+// updateFields returns the session.update fields changed by u, with their values taken from s
+func (u SessionUpdate) updateFields(s config.SessionConfig) map[string]interface{} {
+	all := sessionFields(s)
+	fields := make(map[string]interface{})
+	for _, name := range u.changedFields() {
+		fields[name] = all[name]
+	}
+	if u.Instructions != nil {
+		fields["instructions"] = *u.Instructions
+	}
+	return fields
+}
+
+// changedFields returns the names of the session.update fields changed by u
+func (u SessionUpdate) changedFields() []string {
+	var names []string
+	if u.Voice != nil {
+		names = append(names, "voice")
+	}
+	if u.Modalities != nil {
+		names = append(names, "modalities")
+	}
+	if u.Temperature != nil {
+		names = append(names, "temperature")
+	}
+	if u.MaxOutputTokens != nil {
+		names = append(names, "max_response_output_tokens")
+	}
+	if u.TurnDetection != nil || u.VADThreshold != nil || u.PrefixPaddingMs != nil || u.SilenceDurationMs != nil {
+		names = append(names, "turn_detection")
+	}
+	return names
+}
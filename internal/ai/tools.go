@@ -0,0 +1,129 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ToolHandler executes a tool call. args holds the JSON arguments generated by the model, the
+// returned value is JSON encoded and handed back to the model as the result of the call.
+type ToolHandler func(ctx context.Context, args json.RawMessage) (interface{}, error)
+
+// Tool is a function the model can call during the conversation
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters is the JSON schema of the arguments the model has to generate
+	Parameters json.RawMessage
+	Handler    ToolHandler
+}
+
+// ToolDefinition is how a tool is advertised to the model in session.update
+type ToolDefinition struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// ToolRegistry holds the tools available in a session
+type ToolRegistry struct {
+	mu    sync.RWMutex
+	tools map[string]Tool
+	order []string
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{
+		tools: make(map[string]Tool),
+	}
+}
+
+// Register adds a tool to the registry. Tool names must be unique.
+func (r *ToolRegistry) Register(t Tool) error {
+	if t.Name == "" {
+		return fmt.Errorf("tool name is required")
+	}
+	if t.Handler == nil {
+		return fmt.Errorf("tool %s has no handler", t.Name)
+	}
+	if len(t.Parameters) == 0 {
+		t.Parameters = json.RawMessage(`{"type":"object","properties":{}}`)
+	}
+	if !json.Valid(t.Parameters) {
+		return fmt.Errorf("tool %s has an invalid parameters schema", t.Name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.tools[t.Name]; ok {
+		return fmt.Errorf("tool %s is already registered", t.Name)
+	}
+	r.tools[t.Name] = t
+	r.order = append(r.order, t.Name)
+	return nil
+}
+
+// Definitions returns the definitions of all the registered tools in registration order
+func (r *ToolRegistry) Definitions() []ToolDefinition {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	defs := make([]ToolDefinition, 0, len(r.order))
+	for _, name := range r.order {
+		t := r.tools[name]
+		defs = append(defs, ToolDefinition{
+			Type:        "function",
+			Name:        t.Name,
+			Description: t.Description,
+			Parameters:  t.Parameters,
+		})
+	}
+	return defs
+}
+
+// Call runs the named tool and returns its JSON encoded output. Failures are reported to the model
+// as an {"error": "..."} output so it can tell the user, the returned error is only for logging.
+func (r *ToolRegistry) Call(ctx context.Context, name string, args json.RawMessage) (string, error) {
+	r.mu.RLock()
+	t, ok := r.tools[name]
+	r.mu.RUnlock()
+
+	var result interface{}
+	var err error
+	if !ok {
+		err = fmt.Errorf("unknown tool %s", name)
+	} else {
+		result, err = t.Handler(ctx, args)
+	}
+	if err != nil {
+		return toolError(err), err
+	}
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		return toolError(err), fmt.Errorf("could not encode output of tool %s: %v", name, err)
+	}
+	return string(out), nil
+}
+
+func toolError(err error) string {
+	out, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return string(out)
+}
+
+// RegisterBuiltinTools adds the tools that are executed by the server itself
+func RegisterBuiltinTools(r *ToolRegistry) error {
+	return r.Register(Tool{
+		Name:        "get_current_time",
+		Description: "Returns the current date and time in RFC 3339 format.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{}}`),
+		Handler: func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+			return map[string]string{"time": time.Now().Format(time.RFC3339)}, nil
+		},
+	})
+}
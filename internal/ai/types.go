@@ -5,17 +5,39 @@ type EventType string
 const (
 	ErrorEventType                  EventType = "error"
 	InputAudioBufferAppendEventType EventType = "input_audio_buffer.append"
+	InputAudioBufferCommitEventType EventType = "input_audio_buffer.commit"
+	InputAudioBufferClearEventType  EventType = "input_audio_buffer.clear"
 
+	SessionUpdateEventType  EventType = "session.update"
+	ResponseCreateEventType EventType = "response.create"
+	ResponseCancelEventType EventType = "response.cancel"
+
+	ConversationItemTruncateEventType EventType = "conversation.item.truncate"
+	ConversationItemCreateEventType   EventType = "conversation.item.create"
+
+	FunctionCallArgumentsDoneEventType EventType = "response.function_call_arguments.done"
+
+	ResponseCreatedEventType    EventType = "response.created"
+	ResponseDoneEventType       EventType = "response.done"
 	ResponseAudioDeltaEventType EventType = "response.audio.delta"
 	ResponseAudioDoneEventType  EventType = "response.audio.done"
 
 	AudioTranscriptDeltaEventType EventType = "response.audio_transcript.delta"
 	AudioTranscriptDoneEventType  EventType = "response.audio_transcript.done"
 
+	InputAudioTranscriptionCompletedEventType EventType = "conversation.item.input_audio_transcription.completed"
+	InputAudioTranscriptionFailedEventType    EventType = "conversation.item.input_audio_transcription.failed"
+
 	// this
 	SpeechStartedEventType      EventType = "input_audio_buffer.speech_started"
 	SpeechStoppedEventType      EventType = "input_audio_buffer.speech_stopped"
 	AudioBufferClearedEventType EventType = "input_audio_buffer.cleared"
+
+	// events about the connection to the model server, these are generated by the client and never
+	// sent by the server
+	UpstreamReconnectingEventType EventType = "upstream.reconnecting"
+	UpstreamReconnectedEventType  EventType = "upstream.reconnected"
+	UpstreamFailedEventType       EventType = "upstream.failed"
 )
 
 // EventBase represents the base structure for all events
@@ -24,6 +46,93 @@ type EventBase struct {
 	Type    EventType `json:"type"`
 }
 
+// Event is a notable event from the model that the rest of the system can react to
+type Event struct {
+	Type EventType
+	// ResponseID and ResponseStatus are set for response.created and response.done events
+	ResponseID     string
+	ResponseStatus string
+	// Error is set for error events
+	Error *ErrorDetail
+	// Attempt is the reconnection attempt for upstream.reconnecting events
+	Attempt int
+}
+
+// ResponseEvent represents the response.created and response.done events
+type ResponseEvent struct {
+	EventBase
+	Response struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	} `json:"response"`
+}
+
+// ResponseAudioDeltaEvent carries a chunk of base64 encoded response audio
+type ResponseAudioDeltaEvent struct {
+	EventBase
+	ResponseID string `json:"response_id"`
+	ItemID     string `json:"item_id"`
+	Delta      string `json:"delta"`
+}
+
+// AudioTranscriptDeltaEvent carries a piece of the transcript of the response audio
+type AudioTranscriptDeltaEvent struct {
+	EventBase
+	ResponseID string `json:"response_id"`
+	ItemID     string `json:"item_id"`
+	Delta      string `json:"delta"`
+}
+
+// AudioTranscriptDoneEvent carries the full transcript of the response audio
+type AudioTranscriptDoneEvent struct {
+	EventBase
+	ResponseID string `json:"response_id"`
+	ItemID     string `json:"item_id"`
+	Transcript string `json:"transcript"`
+}
+
+// InputAudioTranscriptionCompletedEvent carries the transcript of what the user said
+type InputAudioTranscriptionCompletedEvent struct {
+	EventBase
+	ItemID     string `json:"item_id"`
+	Transcript string `json:"transcript"`
+}
+
+// InputAudioTranscriptionFailedEvent is sent when the user audio could not be transcribed
+type InputAudioTranscriptionFailedEvent struct {
+	EventBase
+	ItemID string      `json:"item_id"`
+	Error  ErrorDetail `json:"error"`
+}
+
+// FunctionCallArgumentsDoneEvent is sent once the model has generated the arguments of a tool call
+type FunctionCallArgumentsDoneEvent struct {
+	EventBase
+	ResponseID string `json:"response_id"`
+	ItemID     string `json:"item_id"`
+	CallID     string `json:"call_id"`
+	Name       string `json:"name"`
+	Arguments  string `json:"arguments"`
+}
+
+// TranscriptRole tells who is speaking in a transcript
+type TranscriptRole string
+
+const (
+	UserRole      TranscriptRole = "user"
+	AssistantRole TranscriptRole = "assistant"
+)
+
+// Transcript is a piece of text of what the user or the assistant said. Assistant transcripts are
+// streamed as deltas followed by the full text with Final set, user transcripts only arrive once
+// they are final.
+type Transcript struct {
+	Role   TranscriptRole
+	ItemID string
+	Text   string
+	Final  bool
+}
+
 // ErrorEvent represents an error from the server
 type ErrorEvent struct {
 	EventBase
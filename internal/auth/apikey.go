@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+)
+
+// apiKeyAuthenticator accepts the devices presenting one of a list of static keys. The keys are
+// shared by all devices, so the device ID is the one the device claims. It is meant for
+// development, devices in the field should use signed tokens.
+type apiKeyAuthenticator struct {
+	// hashes of the keys, comparing hashes of the same length keeps the comparison constant time
+	hashes     [][sha256.Size]byte
+	queryParam string
+}
+
+func newAPIKeyAuthenticator(cfg config.AuthConfig) (Authenticator, error) {
+	if len(cfg.APIKeys) == 0 {
+		return nil, fmt.Errorf("api_key authentication needs at least one key")
+	}
+	a := &apiKeyAuthenticator{queryParam: cfg.QueryParam}
+	for _, key := range cfg.APIKeys {
+		if key == "" {
+			return nil, fmt.Errorf("api keys cannot be empty")
+		}
+		a.hashes = append(a.hashes, sha256.Sum256([]byte(key)))
+	}
+	return a, nil
+}
+
+func (a *apiKeyAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	key := Credentials(r, a.queryParam)
+	if key == "" {
+		return Identity{}, ErrMissingCredentials
+	}
+	hash := sha256.Sum256([]byte(key))
+	match := 0
+	for _, h := range a.hashes {
+		match |= subtle.ConstantTimeCompare(hash[:], h[:])
+	}
+	if match == 0 {
+		return Identity{}, fmt.Errorf("%w: unknown api key", ErrInvalidCredentials)
+	}
+	return Identity{DeviceID: claimedDeviceID(r), Method: config.AuthAPIKey}, nil
+}
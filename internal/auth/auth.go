@@ -0,0 +1,149 @@
+// Package auth authenticates the devices connecting to the server, before their connection is
+// upgraded to a WebSocket
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+)
+
+// Errors of the authenticators. Status gives the HTTP status code of each.
+var (
+	// ErrMissingCredentials is returned when the request carries no credentials
+	ErrMissingCredentials = errors.New("missing credentials")
+	// ErrInvalidCredentials is returned when the credentials are wrong, malformed or expired
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrForbidden is returned when the device is known but not allowed to connect
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Identity is who a device authenticated as
+type Identity struct {
+	// DeviceID identifies the device, it is only as trustworthy as the authentication method
+	DeviceID string
+	// Method is the authentication mode that accepted the device
+	Method string
+	// ExpiresAt is when the credentials of the device expire, zero when they do not
+	ExpiresAt time.Time
+}
+
+type identityKey struct{}
+
+// NewContext returns a copy of ctx carrying identity
+func NewContext(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// FromContext returns the identity carried by ctx, if any
+func FromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// Authenticator checks the credentials of a device connecting to the server
+type Authenticator interface {
+	// Authenticate returns the identity of the device making r, or an error wrapping one of the
+	// errors of this package when it is rejected
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// AuthenticatorFunc lets a function be used as an Authenticator
+type AuthenticatorFunc func(r *http.Request) (Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (Identity, error) {
+	return f(r)
+}
+
+// Factory creates the authenticator of a mode from the configuration
+type Factory func(cfg config.AuthConfig) (Authenticator, error)
+
+var (
+	modesMu sync.RWMutex
+	modes   = map[string]Factory{
+		config.AuthNone: func(cfg config.AuthConfig) (Authenticator, error) {
+			return AuthenticatorFunc(func(r *http.Request) (Identity, error) {
+				return Identity{DeviceID: claimedDeviceID(r), Method: config.AuthNone}, nil
+			}), nil
+		},
+		config.AuthAPIKey: newAPIKeyAuthenticator,
+		config.AuthJWT:    newJWTAuthenticator,
+	}
+)
+
+// RegisterMode makes an authentication mode available under the given name, replacing any mode
+// registered with the same name
+func RegisterMode(name string, factory Factory) {
+	modesMu.Lock()
+	defer modesMu.Unlock()
+	modes[name] = factory
+}
+
+// Modes returns the names of the registered authentication modes
+func Modes() []string {
+	modesMu.RLock()
+	defer modesMu.RUnlock()
+
+	names := make([]string, 0, len(modes))
+	for name := range modes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the authenticator of the mode set in cfg.Mode
+func New(cfg config.AuthConfig) (Authenticator, error) {
+	name := cfg.Mode
+	if name == "" {
+		name = config.AuthNone
+	}
+
+	modesMu.RLock()
+	factory, ok := modes[name]
+	modesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown auth mode %q", name)
+	}
+	return factory(cfg)
+}
+
+// Status returns the HTTP status code of the response rejecting a device with err
+func Status(err error) int {
+	switch {
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrMissingCredentials), errors.Is(err, ErrInvalidCredentials):
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Credentials returns the credentials carried by r: the bearer token of the Authorization header,
+// or the queryParam parameter of the URL for the devices that cannot set headers
+func Credentials(r *http.Request, queryParam string) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	if queryParam != "" {
+		return r.URL.Query().Get(queryParam)
+	}
+	return ""
+}
+
+// claimedDeviceID returns the device ID a device gives for itself, in the X-Device-ID header or the
+// device_id query parameter. Nothing proves it, the modes without signed credentials rely on it.
+func claimedDeviceID(r *http.Request) string {
+	if id := r.Header.Get("X-Device-ID"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("device_id")
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+)
+
+const (
+	// minSecretLength is the shortest HMAC secret accepted, the size of the output of SHA-256
+	minSecretLength = 32
+	// clockSkew is how far the clock of a device may be off when checking the times of its token
+	clockSkew = 30 * time.Second
+)
+
+// jwtAuthenticator accepts the devices presenting a JWT signed with HMAC by our provisioning
+// service. The token must expire and name the device.
+type jwtAuthenticator struct {
+	secret      []byte
+	parser      *jwt.Parser
+	deviceClaim string
+	queryParam  string
+}
+
+func newJWTAuthenticator(cfg config.AuthConfig) (Authenticator, error) {
+	if len(cfg.JWTSecret) < minSecretLength {
+		return nil, fmt.Errorf("jwt secret must be at least %d bytes long", minSecretLength)
+	}
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(clockSkew),
+	}
+	if cfg.JWTIssuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.JWTIssuer))
+	}
+	if cfg.JWTAudience != "" {
+		options = append(options, jwt.WithAudience(cfg.JWTAudience))
+	}
+	deviceClaim := cfg.DeviceClaim
+	if deviceClaim == "" {
+		deviceClaim = "sub"
+	}
+	return &jwtAuthenticator{
+		secret:      []byte(cfg.JWTSecret),
+		parser:      jwt.NewParser(options...),
+		deviceClaim: deviceClaim,
+		queryParam:  cfg.QueryParam,
+	}, nil
+}
+
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	token := Credentials(r, a.queryParam)
+	if token == "" {
+		return Identity{}, ErrMissingCredentials
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return a.secret, nil
+	})
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	deviceID, _ := claims[a.deviceClaim].(string)
+	if deviceID == "" {
+		deviceID, _ = claims.GetSubject()
+	}
+	if deviceID == "" {
+		return Identity{}, fmt.Errorf("%w: token has no %s claim", ErrInvalidCredentials, a.deviceClaim)
+	}
+	expiresAt, _ := claims.GetExpirationTime()
+	return Identity{DeviceID: deviceID, Method: config.AuthJWT, ExpiresAt: expiresAt.Time}, nil
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+)
+
+// MethodCertificate is the method of the identities taken from a client certificate
+const MethodCertificate = "mtls"
+
+// crlCheckInterval is how often the revocation lists are checked for changes on disk
+const crlCheckInterval = 30 * time.Second
+
+// WithClientCertificates returns an authenticator taking the identity of the devices from their
+// verified client certificate, the device ID being in cfg.ClientDeviceID. The devices without one
+// are refused when cfg.ClientAuth is require, and authenticated by next otherwise.
+func WithClientCertificates(next Authenticator, cfg config.ServerConfig) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Identity, error) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			if cfg.ClientAuth != config.ClientAuthOptional {
+				return Identity{}, fmt.Errorf("%w: no client certificate", ErrMissingCredentials)
+			}
+			return next.Authenticate(r)
+		}
+		cert := r.TLS.VerifiedChains[0][0]
+		deviceID := certificateDeviceID(cert, cfg.ClientDeviceID)
+		if deviceID == "" {
+			return Identity{}, fmt.Errorf("%w: client certificate has no %s", ErrForbidden, cfg.ClientDeviceID)
+		}
+		return Identity{DeviceID: deviceID, Method: MethodCertificate, ExpiresAt: cert.NotAfter}, nil
+	})
+}
+
+// certificateDeviceID returns the device ID held by field in cert, the first one for the SANs
+func certificateDeviceID(cert *x509.Certificate, field config.CertificateField) string {
+	switch field {
+	case config.CertSANDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case config.CertSANURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	case config.CertSANEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+// parseCertificates parses a PEM bundle of certificates
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return certs, nil
+}
+
+// revocationLists are the certificates revoked by the CAs of the client certificates. The lists are
+// loaded again when their files change, so that a device can be revoked without a restart.
+type revocationLists struct {
+	files []string
+	cas   []*x509.Certificate
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	modified  map[string]time.Time
+	// revoked holds the revoked serial numbers by raw issuer
+	revoked map[string]map[string]bool
+}
+
+func newRevocationLists(files []string, cas []*x509.Certificate) (*revocationLists, error) {
+	l := &revocationLists{files: files, cas: cas}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	l.checkedAt = time.Now()
+	return l, nil
+}
+
+// load reads the revocation lists from disk. The signature of each list is verified with the CA that
+// issued it, which must be one of the CAs of the client certificates.
+func (l *revocationLists) load() error {
+	modified := make(map[string]time.Time)
+	revoked := make(map[string]map[string]bool)
+	for _, file := range l.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("could not read revocation list: %v", err)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("could not read revocation list: %v", err)
+		}
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return fmt.Errorf("invalid revocation list %s: %v", file, err)
+		}
+		if err := l.verify(crl); err != nil {
+			return fmt.Errorf("invalid revocation list %s: %v", file, err)
+		}
+
+		serials := revoked[string(crl.RawIssuer)]
+		if serials == nil {
+			serials = make(map[string]bool)
+			revoked[string(crl.RawIssuer)] = serials
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			serials[entry.SerialNumber.String()] = true
+		}
+		modified[file] = info.ModTime()
+	}
+	l.modified = modified
+	l.revoked = revoked
+	return nil
+}
+
+func (l *revocationLists) verify(crl *x509.RevocationList) error {
+	for _, ca := range l.cas {
+		if bytes.Equal(ca.RawSubject, crl.RawIssuer) {
+			return crl.CheckSignatureFrom(ca)
+		}
+	}
+	return fmt.Errorf("not issued by a client CA")
+}
+
+// refresh loads the lists again when one of the files changed since they were loaded. A list that
+// cannot be loaded anymore leaves the previous ones in use.
+func (l *revocationLists) refresh() {
+	if time.Since(l.checkedAt) < crlCheckInterval {
+		return
+	}
+	l.checkedAt = time.Now()
+	for _, file := range l.files {
+		if info, err := os.Stat(file); err != nil || !info.ModTime().Equal(l.modified[file]) {
+			l.load()
+			return
+		}
+	}
+}
+
+// check returns an error when a certificate of a verified chain has been revoked
+func (l *revocationLists) check(chain []*x509.Certificate) error {
+	if len(l.files) == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refresh()
+	for _, cert := range chain {
+		if l.revoked[string(cert.RawIssuer)][cert.SerialNumber.String()] {
+			return fmt.Errorf("certificate %s has been revoked", cert.Subject)
+		}
+	}
+	return nil
+}
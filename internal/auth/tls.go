@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+)
+
+// NewTLSConfig returns the TLS configuration of the server. The certificate of the server is loaded
+// again when its files change, so that it can be rotated without a restart. When cfg.ClientCAFile
+// is set, the client certificates of the devices are verified with its CAs and checked against the
+// revocation lists of cfg.CRLFiles. The handshake succeeds without a certificate so that the health
+// probes and the metrics scraper can connect, WithClientCertificates refuses the devices without one.
+func NewTLSConfig(cfg config.ServerConfig) (*tls.Config, error) {
+	certs := &certificateLoader{certFile: cfg.CertFile, keyFile: cfg.KeyFile}
+	if err := certs.load(); err != nil {
+		return nil, fmt.Errorf("could not load server certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if cfg.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	bundle, err := os.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client CA bundle: %v", err)
+	}
+	cas, err := parseCertificates(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+	crls, err := newRevocationLists(cfg.CRLFiles, cas)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		for _, chain := range cs.VerifiedChains {
+			if err := crls.check(chain); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return tlsConfig, nil
+}
+
+// certificateLoader serves the certificate of the server, loading it again when its files change.
+// The files are checked on each handshake, which costs two stats.
+type certificateLoader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified [2]time.Time
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A certificate that cannot be loaded, such as
+// one whose key has not been written yet, leaves the previous one in use until the next handshake.
+func (l *certificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if modified, err := l.modTimes(); err == nil && modified != l.modified {
+		l.loadLocked()
+	}
+	return l.cert, nil
+}
+
+func (l *certificateLoader) load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.loadLocked()
+}
+
+// loadLocked reads the certificate from disk, l.mu must be held
+func (l *certificateLoader) loadLocked() error {
+	modified, err := l.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.cert = &cert
+	l.modified = modified
+	return nil
+}
+
+func (l *certificateLoader) modTimes() ([2]time.Time, error) {
+	var modified [2]time.Time
+	for i, file := range []string{l.certFile, l.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modified, err
+		}
+		modified[i] = info.ModTime()
+	}
+	return modified, nil
+}
@@ -3,8 +3,12 @@ package config
 import (
 	"fmt"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/pixaverse-studios/websocket-server/internal/utils"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
 	"github.com/spf13/viper"
 )
 
@@ -13,25 +17,94 @@ type Config struct {
 	Websocket WebsocketConfig `mapstructure:"websocket"`
 	Audio     AudioConfig     `mapstructure:"audio"`
 	Azure     AzureConfig     `mapstructure:"azure"`
+	OpenAI    OpenAIConfig    `mapstructure:"openai"`
 	AIConfig  AIConfig        `mapstructure:"ai"`
+	Auth      AuthConfig      `mapstructure:"auth"`
+	Limits    LimitsConfig    `mapstructure:"limits"`
 }
 
+// AI providers, the provider decides which model server the sessions are connected to
+const (
+	ProviderAzureOpenAI = "azure_openai"
+	ProviderOpenAI      = "openai"
+	// ProviderMock connects to a fake Realtime API server without authentication, see cmd/mockrealtime
+	ProviderMock = "mock"
+	// ProviderEcho plays the user's audio back without any model server
+	ProviderEcho = "echo"
+)
+
 type AIConfig struct {
+	Provider             string `mapstructure:"provider"`
 	SystemPromptFilePath string `mapstructure:"system_prompt_filepath"`
+	// URL of the server used by the mock provider
+	MockURL string `mapstructure:"mock_url"`
+	// model used to transcribe the user's speech, transcription is disabled when empty
+	InputTranscriptionModel string          `mapstructure:"input_transcription_model"`
+	Reconnect               ReconnectConfig `mapstructure:"reconnect"`
+	Session                 SessionConfig   `mapstructure:",squash"`
+}
+
+// ReconnectConfig controls how the connection to the model server is re-established when it drops
+type ReconnectConfig struct {
+	MaxAttempts    int    `mapstructure:"max_attempts"`
+	InitialBackoff string `mapstructure:"initial_backoff"`
+	MaxBackoff     string `mapstructure:"max_backoff"`
+	// how much of the device audio is kept while reconnecting, older audio is dropped
+	AudioBuffer string `mapstructure:"audio_buffer"`
+	// number of recent conversation items replayed to the new session
+	ReplayItems int `mapstructure:"replay_items"`
 }
 
 type ServerConfig struct {
-	Port            int    `mapstructure:"port"`
-	CertFile        string `mapstructure:"cert_file"`
-	KeyFile         string `mapstructure:"key_file"`
-	EnableTLS       bool   `mapstructure:"enable_tls"`
+	Port      int    `mapstructure:"port"`
+	CertFile  string `mapstructure:"cert_file"`
+	KeyFile   string `mapstructure:"key_file"`
+	EnableTLS bool   `mapstructure:"enable_tls"`
+	// DrainTimeout is how long the sessions in progress have to finish their response when the
+	// server shuts down, before the devices are disconnected anyway
+	DrainTimeout string `mapstructure:"drain_timeout"`
+	// ClientCAFile is the bundle of CAs the client certificates of the devices are verified with,
+	// mutual TLS is off when it is empty
+	ClientCAFile string `mapstructure:"client_ca_file"`
+	// ClientAuth is whether devices must present a client certificate
+	ClientAuth ClientAuthMode `mapstructure:"client_auth"`
+	// ClientDeviceID is the field of the client certificates holding the device ID
+	ClientDeviceID CertificateField `mapstructure:"client_device_id"`
+	// CRLFiles are certificate revocation lists, PEM or DER, issued by the CAs of ClientCAFile
+	CRLFiles []string `mapstructure:"crl_files"`
 }
 
+// ClientAuthMode is whether devices must present a client certificate when mutual TLS is on
+type ClientAuthMode string
+
+const (
+	// ClientAuthRequire refuses the devices without a valid certificate. The TLS handshake succeeds
+	// without one, for the health probes, the WebSocket is refused.
+	ClientAuthRequire ClientAuthMode = "require"
+	// ClientAuthOptional verifies the certificates presented, the devices without one authenticate
+	// with the auth mode
+	ClientAuthOptional ClientAuthMode = "optional"
+)
+
+// CertificateField is a field of a certificate that can hold the device ID
+type CertificateField string
+
+const (
+	CertCommonName CertificateField = "common_name"
+	CertSANDNS     CertificateField = "san_dns"
+	CertSANURI     CertificateField = "san_uri"
+	CertSANEmail   CertificateField = "san_email"
+)
+
 type WebsocketConfig struct {
-	PingInterval    string `mapstructure:"ping_interval"`
-	PongWait        string `mapstructure:"pong_wait"`
-	WriteWait       string `mapstructure:"write_wait"`
-	MaxMessageQueue int    `mapstructure:"max_message_queue"`
+	PingInterval string `mapstructure:"ping_interval"`
+	PongWait     string `mapstructure:"pong_wait"`
+	WriteWait    string `mapstructure:"write_wait"`
+	// MaxMessageQueue is the number of audio frames queued for a device before QueuePolicy applies
+	MaxMessageQueue int `mapstructure:"max_message_queue"`
+	// QueuePolicy is what happens to the response audio when the queue is full: "block" holds
+	// the rest of the response audio until frames are sent, "drop_oldest" and "drop_newest" drop frames
+	QueuePolicy utils.QueuePolicy `mapstructure:"queue_policy"`
 }
 
 type AudioFormat string
@@ -40,6 +113,19 @@ const (
 	PCM16 AudioFormat = "pcm_16"
 	WAV   AudioFormat = "wav"
 	MP3   AudioFormat = "mp3"
+	Opus  AudioFormat = "opus"
+	// G711ULaw, G711ALaw and IMAADPCM are telephony formats, mostly used at 8 kHz
+	G711ULaw AudioFormat = "g711_ulaw"
+	G711ALaw AudioFormat = "g711_alaw"
+	IMAADPCM AudioFormat = "ima_adpcm"
+)
+
+// Framings of the opus audio format
+const (
+	// OpusFramingRaw sends one Opus packet per message
+	OpusFramingRaw = "raw"
+	// OpusFramingOgg sends an Ogg Opus stream, each message holds its next bytes
+	OpusFramingOgg = "ogg"
 )
 
 // this is the configuration of the audio the hardware will be sending
@@ -48,6 +134,90 @@ type AudioConfig struct {
 	SampleRate  int         `mapstructure:"sample_rate"`
 	Channels    int         `mapstructure:"channels"`
 	AudioFormat AudioFormat `mapstructure:"format"`
+	// MP3Bitrate is the bitrate in kbit/s of the MP3 responses sent to the device
+	MP3Bitrate int `mapstructure:"mp3_bitrate"`
+	// OpusBitrate is the bitrate in kbit/s of the Opus responses sent to the device
+	OpusBitrate int `mapstructure:"opus_bitrate"`
+	// OpusFraming is how Opus packets are put into messages, OpusFramingRaw or OpusFramingOgg
+	OpusFraming string `mapstructure:"opus_framing"`
+	// InputChannel selects the device channel, numbered from 1, sent to the model. 0 mixes the
+	// channels together.
+	InputChannel int `mapstructure:"input_channel"`
+	// InputWeights are the gains of each device channel when mixing them for the model. The
+	// channels are averaged when empty.
+	InputWeights []float64 `mapstructure:"input_weights"`
+	// FrameDuration is the duration of the frames the response audio is sent in, one frame at a
+	// time as the device plays them
+	FrameDuration string `mapstructure:"frame_duration"`
+	// PlaybackLead is how far ahead of the playback of the device the response audio is sent
+	PlaybackLead string `mapstructure:"playback_lead"`
+}
+
+// InputMixer returns the mixer turning the channels of the device into the mono audio of the model
+func (c AudioConfig) InputMixer() (*audio.Mixer, error) {
+	switch {
+	case c.InputChannel != 0 && len(c.InputWeights) > 0:
+		return nil, fmt.Errorf("input_channel and input_weights cannot be both set")
+	case c.InputChannel != 0:
+		return audio.NewChannelSelector(c.Channels, c.InputChannel-1)
+	case len(c.InputWeights) > 0:
+		if len(c.InputWeights) != c.Channels {
+			return nil, fmt.Errorf("%d input weights for %d channels", len(c.InputWeights), c.Channels)
+		}
+		return audio.NewMixer([][]float64{c.InputWeights})
+	default:
+		return audio.NewDownmixer(c.Channels), nil
+	}
+}
+
+// Authentication modes of the devices, see internal/auth
+const (
+	// AuthNone accepts every device, for local development
+	AuthNone = "none"
+	// AuthAPIKey accepts the devices presenting one of a list of static keys, for development
+	AuthAPIKey = "api_key"
+	// AuthJWT accepts the devices presenting a JWT signed with a shared HMAC secret
+	AuthJWT = "jwt"
+)
+
+type AuthConfig struct {
+	// Mode is how devices authenticate when they connect
+	Mode string `mapstructure:"mode"`
+	// APIKeys are the keys accepted in api_key mode
+	APIKeys []string `mapstructure:"api_keys"`
+	// JWTSecret is the HMAC secret the device tokens are signed with in jwt mode
+	JWTSecret string `mapstructure:"jwt_secret"`
+	// JWTIssuer and JWTAudience, when set, must match the iss and aud claims of the tokens
+	JWTIssuer   string `mapstructure:"jwt_issuer"`
+	JWTAudience string `mapstructure:"jwt_audience"`
+	// DeviceClaim is the claim of the tokens holding the device ID, sub is used when it is missing
+	DeviceClaim string `mapstructure:"device_claim"`
+	// QueryParam is the query parameter carrying the credentials of the devices that cannot set the
+	// Authorization header
+	QueryParam string `mapstructure:"query_param"`
+	// AllowedOrigins are the origins browsers may connect from, any origin when empty. Devices do not
+	// send an Origin header and are not checked.
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+}
+
+// LimitsConfig bounds what the devices can make the server do, each session holding a connection to
+// the model. A limit of 0 is no limit.
+type LimitsConfig struct {
+	// MaxSessions is the number of sessions the server runs at the same time
+	MaxSessions int `mapstructure:"max_sessions"`
+	// MaxSessionsPerDevice and MaxSessionsPerIP are the number of sessions a device ID or an IP
+	// address can have at the same time. The devices without an ID are only limited by IP.
+	MaxSessionsPerDevice int `mapstructure:"max_sessions_per_device"`
+	MaxSessionsPerIP     int `mapstructure:"max_sessions_per_ip"`
+	// UpgradeRate is the number of connections accepted per second, in bursts of up to UpgradeBurst
+	UpgradeRate  float64 `mapstructure:"upgrade_rate"`
+	UpgradeBurst int     `mapstructure:"upgrade_burst"`
+	// MaxAudioBytesPerSecond is the rate of the audio a device can send, as encoded on the wire
+	MaxAudioBytesPerSecond int `mapstructure:"max_audio_bytes_per_second"`
+	// ClientIPHeader is the header holding the IP address of the devices when the server is behind a
+	// proxy, such as X-Forwarded-For. The last address of the header is used, the one the proxy added.
+	// It must not be set when the devices connect directly, they could set it to anything.
+	ClientIPHeader string `mapstructure:"client_ip_header"`
 }
 
 type AzureConfig struct {
@@ -55,8 +225,24 @@ type AzureConfig struct {
 	ServiceURL string `mapstructure:"service_url"`
 }
 
+type OpenAIConfig struct {
+	APIKey string `mapstructure:"api_key"`
+	URL    string `mapstructure:"url"`
+	Model  string `mapstructure:"model"`
+}
+
 // LoadConfig loads configuration from file and environment variables
 func LoadConfig() (*Config, error) {
+	v, err := newViper()
+	if err != nil {
+		return nil, err
+	}
+	return unmarshal(v)
+}
+
+// newViper returns a viper instance with the defaults, the environment variables and the config
+// file, if one is found, read in
+func newViper() (*viper.Viper, error) {
 	v := viper.New()
 
 	// Set default values
@@ -64,13 +250,54 @@ func LoadConfig() (*Config, error) {
 	v.SetDefault("server.enable_tls", false)
 	v.SetDefault("server.cert_file", "")
 	v.SetDefault("server.key_file", "")
+	v.SetDefault("server.drain_timeout", "30s")
+	v.SetDefault("server.client_auth", ClientAuthRequire)
+	v.SetDefault("server.client_device_id", CertCommonName)
 	v.SetDefault("websocket.ping_interval", "30s")
 	v.SetDefault("websocket.pong_wait", "60s")
 	v.SetDefault("websocket.write_wait", "10s")
 	v.SetDefault("websocket.max_message_queue", 256)
+	v.SetDefault("websocket.queue_policy", utils.Block)
 	v.SetDefault("audio.sample_rate", 16000)
 	v.SetDefault("audio.channels", 2)
 	v.SetDefault("audio.format", "pcm_16")
+	v.SetDefault("audio.mp3_bitrate", audio.DefaultMP3Bitrate)
+	v.SetDefault("audio.opus_bitrate", 24)
+	v.SetDefault("audio.opus_framing", OpusFramingRaw)
+	v.SetDefault("audio.input_channel", 0)
+	v.SetDefault("audio.input_weights", []float64{})
+	v.SetDefault("audio.frame_duration", "20ms")
+	v.SetDefault("audio.playback_lead", "200ms")
+	v.SetDefault("openai.url", "wss://api.openai.com/v1/realtime")
+	v.SetDefault("openai.model", "gpt-4o-realtime-preview")
+	v.SetDefault("ai.provider", ProviderAzureOpenAI)
+	v.SetDefault("ai.mock_url", "ws://localhost:8090")
+	v.SetDefault("ai.input_transcription_model", "whisper-1")
+	session := DefaultSessionConfig()
+	v.SetDefault("ai.voice", session.Voice)
+	v.SetDefault("ai.modalities", session.Modalities)
+	v.SetDefault("ai.temperature", *session.Temperature)
+	v.SetDefault("ai.max_output_tokens", session.MaxOutputTokens)
+	v.SetDefault("ai.output_audio_format", session.OutputAudioFormat)
+	v.SetDefault("ai.turn_detection.type", session.TurnDetection.Type)
+	v.SetDefault("ai.turn_detection.threshold", *session.TurnDetection.Threshold)
+	v.SetDefault("ai.turn_detection.prefix_padding_ms", *session.TurnDetection.PrefixPaddingMs)
+	v.SetDefault("ai.turn_detection.silence_duration_ms", *session.TurnDetection.SilenceDurationMs)
+	v.SetDefault("ai.reconnect.max_attempts", 5)
+	v.SetDefault("ai.reconnect.initial_backoff", "500ms")
+	v.SetDefault("ai.reconnect.max_backoff", "10s")
+	v.SetDefault("ai.reconnect.audio_buffer", "5s")
+	v.SetDefault("ai.reconnect.replay_items", 20)
+	v.SetDefault("auth.mode", AuthNone)
+	v.SetDefault("auth.device_claim", "device_id")
+	v.SetDefault("auth.query_param", "token")
+	v.SetDefault("limits.max_sessions", 0)
+	v.SetDefault("limits.max_sessions_per_device", 0)
+	v.SetDefault("limits.max_sessions_per_ip", 0)
+	v.SetDefault("limits.upgrade_rate", 0)
+	v.SetDefault("limits.upgrade_burst", 20)
+	v.SetDefault("limits.max_audio_bytes_per_second", 0)
+	v.SetDefault("limits.client_ip_header", "")
 
 	// Config file support
 	v.SetConfigName("config")
@@ -91,6 +318,15 @@ func LoadConfig() (*Config, error) {
 	if azureURL := os.Getenv("AZURE_OPENAI_URL"); azureURL != "" {
 		v.Set("azure.service_url", azureURL)
 	}
+	if openAIKey := os.Getenv("OPENAI_API_KEY"); openAIKey != "" {
+		v.Set("openai.api_key", openAIKey)
+	}
+	if jwtSecret := os.Getenv("AUTH_JWT_SECRET"); jwtSecret != "" {
+		v.Set("auth.jwt_secret", jwtSecret)
+	}
+	if apiKeys := os.Getenv("AUTH_API_KEYS"); apiKeys != "" {
+		v.Set("auth.api_keys", strings.Split(apiKeys, ","))
+	}
 
 	// Read config file
 	if err := v.ReadInConfig(); err != nil {
@@ -98,18 +334,39 @@ func LoadConfig() (*Config, error) {
 			return nil, fmt.Errorf("error reading config file: %w", err)
 		}
 	}
+	return v, nil
+}
 
+// unmarshal returns the configuration held by v
+func unmarshal(v *viper.Viper) (*Config, error) {
 	var config Config
 	if err := v.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("error unmarshaling config: %w", err)
 	}
 
-	// Validate required configurations
-	if config.Azure.OpenAIKey == "" {
-		return nil, fmt.Errorf("AZURE_OPENAI_KEY environment variable is required")
+	// Validate required configurations, only the credentials of the selected provider are needed
+	switch config.AIConfig.Provider {
+	case ProviderAzureOpenAI:
+		if config.Azure.OpenAIKey == "" {
+			return nil, fmt.Errorf("AZURE_OPENAI_KEY environment variable is required")
+		}
+		if config.Azure.ServiceURL == "" {
+			return nil, fmt.Errorf("AZURE_OPENAI_URL environment variable or azure.service_url config is required")
+		}
+	case ProviderOpenAI:
+		if config.OpenAI.APIKey == "" {
+			return nil, fmt.Errorf("OPENAI_API_KEY environment variable or openai.api_key config is required")
+		}
 	}
-	if config.Azure.ServiceURL == "" {
-		return nil, fmt.Errorf("AZURE_OPENAI_URL environment variable or azure.service_url config is required")
+	switch config.Auth.Mode {
+	case AuthJWT:
+		if config.Auth.JWTSecret == "" {
+			return nil, fmt.Errorf("AUTH_JWT_SECRET environment variable or auth.jwt_secret config is required")
+		}
+	case AuthAPIKey:
+		if len(config.Auth.APIKeys) == 0 {
+			return nil, fmt.Errorf("AUTH_API_KEYS environment variable or auth.api_keys config is required")
+		}
 	}
 
 	return &config, nil
@@ -130,6 +387,31 @@ func ValidateConfig(cfg *Config) error {
 		}
 	}
 
+	if cfg.Server.ClientCAFile != "" {
+		if !cfg.Server.EnableTLS {
+			return fmt.Errorf("client_ca_file is set but TLS is not enabled")
+		}
+		if !slices.Contains([]ClientAuthMode{ClientAuthRequire, ClientAuthOptional}, cfg.Server.ClientAuth) {
+			return fmt.Errorf("invalid client_auth: %s", cfg.Server.ClientAuth)
+		}
+		if !slices.Contains([]CertificateField{CertCommonName, CertSANDNS, CertSANURI, CertSANEmail}, cfg.Server.ClientDeviceID) {
+			return fmt.Errorf("invalid client_device_id: %s", cfg.Server.ClientDeviceID)
+		}
+	} else if len(cfg.Server.CRLFiles) > 0 {
+		return fmt.Errorf("crl_files are set but client_ca_file is not")
+	}
+
+	if d, err := time.ParseDuration(cfg.Server.DrainTimeout); cfg.Server.DrainTimeout != "" && (err != nil || d < 0) {
+		return fmt.Errorf("invalid drain_timeout: %s", cfg.Server.DrainTimeout)
+	}
+
+	if cfg.Websocket.MaxMessageQueue <= 0 {
+		return fmt.Errorf("invalid max_message_queue: %d", cfg.Websocket.MaxMessageQueue)
+	}
+	if !slices.Contains([]utils.QueuePolicy{utils.Block, utils.DropOldest, utils.DropNewest}, cfg.Websocket.QueuePolicy) {
+		return fmt.Errorf("invalid queue_policy: %s", cfg.Websocket.QueuePolicy)
+	}
+
 	if cfg.Audio.SampleRate <= 0 {
 		return fmt.Errorf("invalid sample rate: %d", cfg.Audio.SampleRate)
 	}
@@ -138,9 +420,74 @@ func ValidateConfig(cfg *Config) error {
 		return fmt.Errorf("invalid number of channels: %d", cfg.Audio.Channels)
 	}
 
-	if cfg.Audio.AudioFormat != PCM16 && cfg.Audio.AudioFormat != WAV && cfg.Audio.AudioFormat != MP3 {
+	if !slices.Contains([]AudioFormat{PCM16, WAV, MP3, Opus, G711ULaw, G711ALaw, IMAADPCM}, cfg.Audio.AudioFormat) {
 		return fmt.Errorf("invalid audio format: %s", cfg.Audio.AudioFormat)
 	}
 
+	if d, err := time.ParseDuration(cfg.Audio.FrameDuration); cfg.Audio.FrameDuration != "" && (err != nil || d <= 0) {
+		return fmt.Errorf("invalid audio frame_duration: %s", cfg.Audio.FrameDuration)
+	}
+	if d, err := time.ParseDuration(cfg.Audio.PlaybackLead); cfg.Audio.PlaybackLead != "" && (err != nil || d < 0) {
+		return fmt.Errorf("invalid audio playback_lead: %s", cfg.Audio.PlaybackLead)
+	}
+
+	if _, err := cfg.Audio.InputMixer(); err != nil {
+		return fmt.Errorf("invalid input mixing: %v", err)
+	}
+
+	if cfg.Audio.AudioFormat == MP3 {
+		if _, err := audio.NewMP3Encoder(cfg.Audio.SampleRate, cfg.Audio.Channels, cfg.Audio.MP3Bitrate); err != nil {
+			return fmt.Errorf("invalid mp3 configuration: %v", err)
+		}
+	}
+
+	if cfg.Audio.AudioFormat == Opus {
+		if cfg.Audio.OpusFraming != OpusFramingRaw && cfg.Audio.OpusFraming != OpusFramingOgg {
+			return fmt.Errorf("invalid opus framing: %s", cfg.Audio.OpusFraming)
+		}
+		if _, err := audio.NewOpusStreamEncoder(cfg.Audio.SampleRate, cfg.Audio.Channels, cfg.Audio.OpusBitrate*1000, false); err != nil {
+			return fmt.Errorf("invalid opus configuration: %v", err)
+		}
+	}
+
+	if err := cfg.AIConfig.Session.Validate(); err != nil {
+		return fmt.Errorf("invalid ai session configuration: %v", err)
+	}
+
+	reconnect := cfg.AIConfig.Reconnect
+	if reconnect.MaxAttempts < 0 {
+		return fmt.Errorf("invalid reconnect max_attempts: %d", reconnect.MaxAttempts)
+	}
+	if reconnect.ReplayItems < 0 {
+		return fmt.Errorf("invalid reconnect replay_items: %d", reconnect.ReplayItems)
+	}
+	for name, d := range map[string]string{
+		"initial_backoff": reconnect.InitialBackoff,
+		"max_backoff":     reconnect.MaxBackoff,
+		"audio_buffer":    reconnect.AudioBuffer,
+	} {
+		if _, err := time.ParseDuration(d); d != "" && err != nil {
+			return fmt.Errorf("invalid reconnect %s: %v", name, err)
+		}
+	}
+
+	limits := cfg.Limits
+	for name, limit := range map[string]int{
+		"max_sessions":               limits.MaxSessions,
+		"max_sessions_per_device":    limits.MaxSessionsPerDevice,
+		"max_sessions_per_ip":        limits.MaxSessionsPerIP,
+		"max_audio_bytes_per_second": limits.MaxAudioBytesPerSecond,
+	} {
+		if limit < 0 {
+			return fmt.Errorf("invalid limits %s: %d", name, limit)
+		}
+	}
+	if limits.UpgradeRate < 0 {
+		return fmt.Errorf("invalid limits upgrade_rate: %v", limits.UpgradeRate)
+	}
+	if limits.UpgradeRate > 0 && limits.UpgradeBurst < 1 {
+		return fmt.Errorf("invalid limits upgrade_burst: %d", limits.UpgradeBurst)
+	}
+
 	return nil
 }
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchConfig calls onChange with the configuration loaded again, or the error preventing it, each
+// time the config file changes. The changes are not validated, see Reload for applying them.
+func WatchConfig(onChange func(*Config, error)) error {
+	v, err := newViper()
+	if err != nil {
+		return err
+	}
+	if v.ConfigFileUsed() == "" {
+		return fmt.Errorf("no config file to watch")
+	}
+	v.OnConfigChange(func(fsnotify.Event) {
+		// viper only logs the errors of the file it reads before calling us
+		if err := v.ReadInConfig(); err != nil {
+			onChange(nil, fmt.Errorf("error reading config file: %w", err))
+			return
+		}
+		onChange(unmarshal(v))
+	})
+	v.WatchConfig()
+	return nil
+}
+
+// Reload returns the configuration cur becomes when the config file changes to next. Only the
+// settings of the AI sessions are taken from next: they are read when a session starts, so changing
+// them does not affect the sessions in progress. The other settings need a restart, the names of
+// the sections of next that differ from cur and were left out are returned.
+func Reload(cur, next *Config) (*Config, []string) {
+	reloaded := *cur
+	reloaded.AIConfig.SystemPromptFilePath = next.AIConfig.SystemPromptFilePath
+	reloaded.AIConfig.InputTranscriptionModel = next.AIConfig.InputTranscriptionModel
+	reloaded.AIConfig.Reconnect = next.AIConfig.Reconnect
+	reloaded.AIConfig.Session = next.AIConfig.Session
+
+	var ignored []string
+	sections := []struct {
+		name      string
+		cur, next any
+	}{
+		{"server", cur.Server, next.Server},
+		{"websocket", cur.Websocket, next.Websocket},
+		{"audio", cur.Audio, next.Audio},
+		{"azure", cur.Azure, next.Azure},
+		{"openai", cur.OpenAI, next.OpenAI},
+		{"ai.provider", cur.AIConfig.Provider, next.AIConfig.Provider},
+		{"ai.mock_url", cur.AIConfig.MockURL, next.AIConfig.MockURL},
+		{"auth", cur.Auth, next.Auth},
+		{"limits", cur.Limits, next.Limits},
+	}
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.cur, section.next) {
+			ignored = append(ignored, section.name)
+		}
+	}
+	return &reloaded, ignored
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Voices supported by the realtime model
+var Voices = []string{"alloy", "ash", "ballad", "coral", "echo", "sage", "shimmer", "verse"}
+
+// Turn detection modes. With TurnDetectionNone the device decides when the user is done talking
+// and sends input.commit.
+const (
+	TurnDetectionServerVAD = "server_vad"
+	TurnDetectionNone      = "none"
+)
+
+// SessionConfig holds the parameters of the model session. Its fields live directly in the ai
+// section of the configuration and can be overridden per connection. The numbers for which 0 is a
+// value of its own are pointers, nil when they are not set.
+type SessionConfig struct {
+	Voice       string   `mapstructure:"voice"`
+	Modalities  []string `mapstructure:"modalities"`
+	Temperature *float64 `mapstructure:"temperature"`
+	// 0 means no limit
+	MaxOutputTokens   int                 `mapstructure:"max_output_tokens"`
+	OutputAudioFormat string              `mapstructure:"output_audio_format"`
+	TurnDetection     TurnDetectionConfig `mapstructure:"turn_detection"`
+}
+
+type TurnDetectionConfig struct {
+	Type              string   `mapstructure:"type"`
+	Threshold         *float64 `mapstructure:"threshold"`
+	PrefixPaddingMs   *int     `mapstructure:"prefix_padding_ms"`
+	SilenceDurationMs *int     `mapstructure:"silence_duration_ms"`
+}
+
+// DefaultSessionConfig returns the session parameters used when the configuration does not set them
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{
+		Voice:             "alloy",
+		Modalities:        []string{"audio", "text"},
+		Temperature:       ptr(0.8),
+		OutputAudioFormat: "pcm16",
+		TurnDetection: TurnDetectionConfig{
+			Type:              TurnDetectionServerVAD,
+			Threshold:         ptr(0.5),
+			PrefixPaddingMs:   ptr(300),
+			SilenceDurationMs: ptr(500),
+		},
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// WithDefaults returns a copy of s with the unset fields filled in from DefaultSessionConfig
+func (s SessionConfig) WithDefaults() SessionConfig {
+	d := DefaultSessionConfig()
+	if s.Voice == "" {
+		s.Voice = d.Voice
+	}
+	if len(s.Modalities) == 0 {
+		s.Modalities = d.Modalities
+	}
+	if s.Temperature == nil {
+		s.Temperature = d.Temperature
+	}
+	if s.OutputAudioFormat == "" {
+		s.OutputAudioFormat = d.OutputAudioFormat
+	}
+	if s.TurnDetection.Type == "" {
+		s.TurnDetection.Type = d.TurnDetection.Type
+	}
+	if s.TurnDetection.Threshold == nil {
+		s.TurnDetection.Threshold = d.TurnDetection.Threshold
+	}
+	if s.TurnDetection.PrefixPaddingMs == nil {
+		s.TurnDetection.PrefixPaddingMs = d.TurnDetection.PrefixPaddingMs
+	}
+	if s.TurnDetection.SilenceDurationMs == nil {
+		s.TurnDetection.SilenceDurationMs = d.TurnDetection.SilenceDurationMs
+	}
+	return s
+}
+
+// Validate checks that the session parameters are accepted by the model. The numbers that are not
+// set are not checked, WithDefaults gives them valid values.
+func (s SessionConfig) Validate() error {
+	if !slices.Contains(Voices, s.Voice) {
+		return fmt.Errorf("invalid voice: %s", s.Voice)
+	}
+
+	if !slices.Equal(s.Modalities, []string{"text"}) && !slices.Equal(s.Modalities, []string{"audio", "text"}) &&
+		!slices.Equal(s.Modalities, []string{"text", "audio"}) {
+		return fmt.Errorf("invalid modalities: %v, must be [text] or [audio text]", s.Modalities)
+	}
+
+	if s.Temperature != nil && (*s.Temperature < 0.6 || *s.Temperature > 1.2) {
+		return fmt.Errorf("invalid temperature: %v, must be between 0.6 and 1.2", *s.Temperature)
+	}
+
+	if s.MaxOutputTokens < 0 || s.MaxOutputTokens > 4096 {
+		return fmt.Errorf("invalid max_output_tokens: %d, must be between 1 and 4096, or 0 for no limit", s.MaxOutputTokens)
+	}
+
+	if s.OutputAudioFormat != "pcm16" {
+		return fmt.Errorf("invalid output_audio_format: %s", s.OutputAudioFormat)
+	}
+
+	td := s.TurnDetection
+	if td.Type != TurnDetectionServerVAD && td.Type != TurnDetectionNone {
+		return fmt.Errorf("invalid turn_detection type: %s", td.Type)
+	}
+	if td.Threshold != nil && (*td.Threshold < 0 || *td.Threshold > 1) {
+		return fmt.Errorf("invalid turn_detection threshold: %v, must be between 0 and 1", *td.Threshold)
+	}
+	if td.PrefixPaddingMs != nil && *td.PrefixPaddingMs < 0 {
+		return fmt.Errorf("invalid turn_detection prefix_padding_ms: %d", *td.PrefixPaddingMs)
+	}
+	if td.SilenceDurationMs != nil && *td.SilenceDurationMs < 0 {
+		return fmt.Errorf("invalid turn_detection silence_duration_ms: %d", *td.SilenceDurationMs)
+	}
+
+	return nil
+}
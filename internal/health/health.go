@@ -0,0 +1,137 @@
+// Package health serves the liveness and readiness endpoints probed by Kubernetes
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/ai"
+	"github.com/pixaverse-studios/websocket-server/internal/auth"
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+)
+
+const (
+	// probeTimeout is how long the upstream probe may take before the upstream counts as unreachable
+	probeTimeout = 2 * time.Second
+	// probeInterval is how long the result of the upstream probe is reused, so that frequent probes
+	// of the pod do not turn into as many connections upstream
+	probeInterval = 10 * time.Second
+)
+
+// Checker tells whether the server is alive and whether it is ready to take new devices
+type Checker struct {
+	// config returns the configuration the server is running with, which changes when it is reloaded
+	config func() *config.Config
+	// probe checks that the model server can be reached, ai.ProbeUpstream by default
+	probe    func(context.Context, *config.Config) error
+	draining atomic.Bool
+
+	mu sync.Mutex
+	// probed is the configuration the upstream was last probed with
+	probed   *config.Config
+	probedAt time.Time
+	probeErr error
+}
+
+// NewChecker creates a checker of the server whose configuration cfg returns, like
+// websocket.Handler.Config
+func NewChecker(cfg func() *config.Config) *Checker {
+	return &Checker{config: cfg, probe: ai.ProbeUpstream}
+}
+
+// Drain marks the server as draining: it stops being ready so that no new devices are sent to it
+func (c *Checker) Drain() {
+	c.draining.Store(true)
+}
+
+// Draining reports whether Drain was called
+func (c *Checker) Draining() bool {
+	return c.draining.Load()
+}
+
+// status is the body of the responses of the endpoints
+type status struct {
+	Status string `json:"status"`
+	// Checks holds the result of each readiness check, "ok" or the reason it failed
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Liveness answers the liveness probe. The server is alive as long as it answers.
+func (c *Checker) Liveness(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, status{Status: "ok"})
+}
+
+// Readiness answers the readiness probe. The server is ready when its configuration is valid, the
+// model server can be reached and it is not draining.
+func (c *Checker) Readiness(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"config":   result(c.checkConfig()),
+		"upstream": result(c.checkUpstream(r.Context())),
+		"draining": result(c.checkDraining()),
+	}
+	for _, check := range checks {
+		if check != "ok" {
+			writeStatus(w, http.StatusServiceUnavailable, status{Status: "not ready", Checks: checks})
+			return
+		}
+	}
+	writeStatus(w, http.StatusOK, status{Status: "ready", Checks: checks})
+}
+
+func (c *Checker) checkConfig() error {
+	cfg := c.config()
+	if err := config.ValidateConfig(cfg); err != nil {
+		return err
+	}
+	if provider := cfg.AIConfig.Provider; provider != "" && !slices.Contains(ai.Providers(), provider) {
+		return fmt.Errorf("unknown ai provider %q", provider)
+	}
+	if _, err := auth.New(cfg.Auth); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkUpstream probes the model server, at most once per probeInterval unless the configuration
+// was reloaded in between
+func (c *Checker) checkUpstream(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cfg := c.config()
+	if cfg == c.probed && time.Since(c.probedAt) < probeInterval {
+		return c.probeErr
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	c.probeErr = c.probe(ctx, cfg)
+	c.probed, c.probedAt = cfg, time.Now()
+	return c.probeErr
+}
+
+func (c *Checker) checkDraining() error {
+	if c.Draining() {
+		return fmt.Errorf("server is draining")
+	}
+	return nil
+}
+
+func result(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+func writeStatus(w http.ResponseWriter, code int, s status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(s)
+}
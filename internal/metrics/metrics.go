@@ -0,0 +1,114 @@
+// Package metrics holds the Prometheus metrics of the server. They are registered with the default
+// registry and served in the Prometheus text format by Handler.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "websocket_server"
+
+// Directions of the audio
+const (
+	// In is the audio received from devices
+	In = "in"
+	// Out is the audio sent to devices
+	Out = "out"
+)
+
+// Kinds of upstream errors
+const (
+	// UpstreamConnect is a failed connection to the model
+	UpstreamConnect = "connect"
+	// UpstreamDisconnect is a connection to the model lost in the middle of a session
+	UpstreamDisconnect = "disconnect"
+	// UpstreamReconnectFailed is a session given up after the reconnection attempts
+	UpstreamReconnectFailed = "reconnect_failed"
+	// UpstreamServerError is an error event sent by the model
+	UpstreamServerError = "server_error"
+)
+
+var (
+	// Connections counts the WebSocket upgrades of devices, by result: "accepted", "failed",
+	// "unauthorized" or "limited"
+	Connections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_total",
+		Help:      "WebSocket upgrades of devices, by result.",
+	}, []string{"result"})
+
+	// LimitBreaches counts the connections closed because a device reached a limit, by limit
+	LimitBreaches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "limit_breaches_total",
+		Help:      "Connections closed because a device reached a limit, by limit.",
+	}, []string{"limit"})
+
+	// ActiveSessions is the number of devices talking to the model
+	ActiveSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_sessions",
+		Help:      "Sessions between a device and the model in progress.",
+	})
+
+	// Sessions counts the sessions started
+	Sessions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sessions_total",
+		Help:      "Sessions between a device and the model started.",
+	})
+
+	// UpstreamErrors counts the errors of the connections to the model, by kind
+	UpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Errors of the connections to the model, by kind.",
+	}, []string{"kind"})
+
+	// AudioBytes counts the bytes of the audio messages exchanged with devices, by direction
+	AudioBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audio_bytes_total",
+		Help:      "Bytes of the audio messages exchanged with devices, as encoded on the wire, by direction.",
+	}, []string{"direction"})
+
+	// ResampleSeconds is the time spent resampling a chunk of audio, by direction
+	ResampleSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "resample_duration_seconds",
+		Help:      "Time spent resampling a chunk of audio, by direction.",
+		Buckets:   prometheus.ExponentialBuckets(10e-6, 4, 8),
+	}, []string{"direction"})
+
+	// TurnLatency is the time from the end of the speech of the user to the stages of the response,
+	// by stage
+	TurnLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "turn_latency_seconds",
+		Help:      "Time from the end of the speech of the user to a stage of the response, by stage.",
+		Buckets:   prometheus.ExponentialBuckets(0.025, 2, 10),
+	}, []string{"stage"})
+
+	// QueuedFrames is the number of response audio frames waiting to be sent, over all sessions
+	QueuedFrames = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queued_frames",
+		Help:      "Response audio frames waiting to be sent to devices.",
+	})
+
+	// DroppedFrames counts the response audio frames dropped because the queue of a session was full
+	DroppedFrames = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dropped_frames_total",
+		Help:      "Response audio frames dropped because the queue of a session was full.",
+	})
+)
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
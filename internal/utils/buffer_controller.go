@@ -2,69 +2,215 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"slices"
 	"sync"
+
+	"github.com/pixaverse-studios/websocket-server/internal/metrics"
 )
 
+// QueuePolicy is what a BufferSizeController does with a new chunk when its queue is full
+type QueuePolicy string
+
+const (
+	// DropOldest drops the oldest chunk of the queue to make room for the new one
+	DropOldest QueuePolicy = "drop_oldest"
+	// DropNewest drops the new chunk
+	DropNewest QueuePolicy = "drop_newest"
+	// Block waits for the reader to make room, or for the context of the write to be done. It is the
+	// policy of the zero value.
+	Block QueuePolicy = "block"
+)
+
+// Chunk is a fixed length piece of the stream. The chunk made by Flush holds whatever was left in the
+// buffer, possibly nothing, and has End set.
+type Chunk struct {
+	Data []byte
+	End  bool
+}
+
+// QueueStats are the counters of a BufferSizeController
+type QueueStats struct {
+	// Queued is the number of chunks waiting to be read
+	Queued int
+	// DroppedChunks and DroppedBytes count the chunks dropped because the queue was full
+	DroppedChunks int
+	DroppedBytes  int
+}
+
 // this data structure can be used whenever you have a stream of random length byte arrays coming to you, and you want to
-// convert them into a stream of fixed length byte arrays.
+// convert them into a stream of fixed length byte arrays. The chunks are queued until the reader reads them with Next,
+// at most maxChunks of them. What happens to the chunks made when the queue is full depends on the policy, the chunks
+// made by Flush are always queued so that the reader sees the end of the stream.
 type BufferSizeController struct {
 	buffer                bytes.Buffer
 	mutex                 sync.Mutex
 	outputByteArrayLength int
+	maxChunks             int
+	policy                QueuePolicy
 
-	outChan chan []byte
+	// chunks are the chunks made and not read yet
+	chunks []Chunk
+	// ready is signalled when chunks are queued, space when chunks leave the queue
+	ready chan struct{}
+	space chan struct{}
+	stats QueueStats
 }
 
-func NewBufferSizeController(capacity int) BufferSizeController {
+// NewBufferSizeController creates a controller making chunks of capacity bytes. A maxChunks of 0 or
+// less leaves the queue unbounded.
+func NewBufferSizeController(capacity, maxChunks int, policy QueuePolicy) BufferSizeController {
 	return BufferSizeController{
 		buffer:                bytes.Buffer{},
 		mutex:                 sync.Mutex{},
 		outputByteArrayLength: capacity,
+		maxChunks:             maxChunks,
+		policy:                policy,
 
-		outChan: make(chan []byte),
+		ready: make(chan struct{}, 1),
+		space: make(chan struct{}, 1),
 	}
 }
 
-func (ab *BufferSizeController) GetOutputChannel() <-chan []byte {
-	return ab.outChan
+// Ready returns a channel that receives a value when chunks have been queued since the last one
+func (ab *BufferSizeController) Ready() <-chan struct{} {
+	return ab.ready
+}
+
+// Next returns the oldest chunk not read yet, false if there is none
+func (ab *BufferSizeController) Next() (Chunk, bool) {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	if len(ab.chunks) == 0 {
+		return Chunk{}, false
+	}
+	c := ab.chunks[0]
+	ab.chunks[0] = Chunk{}
+	ab.chunks = ab.chunks[1:]
+	metrics.QueuedFrames.Dec()
+	signal(ab.space)
+	return c, true
+}
+
+// Stats returns the number of chunks queued and dropped so far
+func (ab *BufferSizeController) Stats() QueueStats {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	stats := ab.stats
+	stats.Queued = len(ab.chunks)
+	return stats
 }
 
-// this basically sends the leftover data from the internal buffer to the outChan
+// this basically queues the leftover data from the internal buffer as the end of the stream
 func (ab *BufferSizeController) Flush() error {
 	ab.mutex.Lock()
 	defer ab.mutex.Unlock()
 
-	ab.outChan <- ab.buffer.Bytes()
+	ab.chunks = append(ab.chunks, Chunk{Data: bytes.Clone(ab.buffer.Bytes()), End: true})
+	metrics.QueuedFrames.Inc()
+	signal(ab.ready)
 	ab.buffer.Reset()
 	return nil
 }
 
+// this drops the data waiting in the internal buffer and the chunks not read yet
+func (ab *BufferSizeController) Clear() {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	ab.buffer.Reset()
+	metrics.QueuedFrames.Sub(float64(len(ab.chunks)))
+	ab.chunks = nil
+	signal(ab.space)
+}
+
+// signal wakes up the goroutine waiting on c, if any, without waiting for it
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// push queues a chunk following the policy when the queue is full. It is called with the mutex held,
+// which it releases while it waits for room.
+func (ab *BufferSizeController) push(ctx context.Context, c Chunk) error {
+	for ab.maxChunks > 0 && len(ab.chunks) >= ab.maxChunks {
+		switch ab.policy {
+		case DropNewest:
+			ab.drop(c.Data)
+			return nil
+		case DropOldest:
+			// the ends of the stream are kept
+			i := slices.IndexFunc(ab.chunks, func(c Chunk) bool { return !c.End })
+			if i < 0 {
+				ab.drop(c.Data)
+				return nil
+			}
+			ab.drop(ab.chunks[i].Data)
+			ab.chunks = slices.Delete(ab.chunks, i, i+1)
+			metrics.QueuedFrames.Dec()
+		default:
+			ab.mutex.Unlock()
+			select {
+			case <-ctx.Done():
+				ab.mutex.Lock()
+				return ctx.Err()
+			case <-ab.space:
+			}
+			ab.mutex.Lock()
+			// the queue may have been cleared for a write that was cancelled meanwhile
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+	}
+	ab.chunks = append(ab.chunks, c)
+	metrics.QueuedFrames.Inc()
+	signal(ab.ready)
+	return nil
+}
+
+func (ab *BufferSizeController) drop(data []byte) {
+	ab.stats.DroppedChunks++
+	ab.stats.DroppedBytes += len(data)
+	metrics.DroppedFrames.Inc()
+}
+
 // this evaluates the state of the buffer makes sure that the buffer size is less than outputByteArrayLength
-// by making max possible number of chunks from the internal buffer and sends it to the outChan
-func (ab *BufferSizeController) makeChunksFromBuffer() error {
+// by making max possible number of chunks from the internal buffer and queues them
+func (ab *BufferSizeController) makeChunksFromBuffer(ctx context.Context) error {
 	for ab.buffer.Len() > ab.outputByteArrayLength {
 		outBuf := make([]byte, ab.outputByteArrayLength)
 		_, err := ab.buffer.Read(outBuf)
 		if err != nil {
 			return fmt.Errorf("Could not read bytes: %s", err)
 		}
-		// send the data to the outChan
-		ab.outChan <- outBuf
+		if err := ab.push(ctx, Chunk{Data: outBuf}); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (ab *BufferSizeController) processData(data []byte) error {
+func (ab *BufferSizeController) processData(ctx context.Context, data []byte) error {
 	ab.mutex.Lock()
 	defer ab.mutex.Unlock()
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	ab.buffer.Write(data)
-	return ab.makeChunksFromBuffer()
+	return ab.makeChunksFromBuffer(ctx)
 }
 
-func (ab *BufferSizeController) Write(data []byte) error {
-	err := ab.processData(data)
+// Write adds data to the stream. With the Block policy it waits for room in the queue until ctx is
+// done, and returns the error of the context then.
+func (ab *BufferSizeController) Write(ctx context.Context, data []byte) error {
+	err := ab.processData(ctx, data)
 	if err != nil {
 		return err
 	}
@@ -16,6 +16,7 @@ type Client struct {
 	logger *slog.Logger
 	mu     sync.Mutex
 	config *config.Config
+	closed bool
 }
 
 // NewClient creates a new WebSocket client
@@ -27,17 +28,44 @@ func NewClient(conn *websocket.Conn, logger *slog.Logger, cfg *config.Config) *C
 	}
 }
 
+// WriteJSON sends v to the client as a JSON text message
+func (c *Client) WriteJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeWait, _ := time.ParseDuration(c.config.Websocket.WriteWait)
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteJSON(v)
+}
+
+// WriteBinary sends data to the client as a binary message
+func (c *Client) WriteBinary(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeWait, _ := time.ParseDuration(c.config.Websocket.WriteWait)
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
 // Close closes the WebSocket connection and cleans up resources
 func (c *Client) Close() {
+	c.CloseWith(websocket.CloseNormalClosure, "")
+}
+
+// CloseWith closes the WebSocket connection with the given close code and reason. Only the first
+// close of a connection is sent to the device.
+func (c *Client) CloseWith(code int, reason string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	writeWait, _ := time.ParseDuration(c.config.Websocket.WriteWait)
 
-	if c.conn != nil {
+	if c.conn != nil && !c.closed {
+		c.closed = true
 		c.conn.WriteControl(
 			websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			websocket.FormatCloseMessage(code, reason),
 			time.Now().Add(writeWait),
 		)
 		c.conn.Close()
@@ -0,0 +1,214 @@
+package websocket
+
+import (
+	"fmt"
+
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+)
+
+// deviceCodec converts between the binary messages of the device, in the format set by
+// audio.format, and audio.Audio. A codec is created for each session so that it can keep state
+// from one message to the next.
+type deviceCodec interface {
+	// Decode converts a binary message received from the device. The audio is empty when the
+	// message does not complete a frame of the format.
+	Decode(data []byte) (audio.Audio, error)
+	// Encode converts response audio into binary messages for the device. There are none when the
+	// codec holds the audio back until it has enough of it.
+	Encode(a audio.Audio) ([][]byte, error)
+	// Flush returns the messages with the audio held back at the end of a response
+	Flush() ([][]byte, error)
+	// Reset drops the audio held back when a response is interrupted, so that none of it is sent
+	// with the next response
+	Reset()
+}
+
+func newDeviceCodec(cfg config.AudioConfig) (deviceCodec, error) {
+	switch cfg.AudioFormat {
+	case config.PCM16, "":
+		return pcm16Codec{sampleRate: cfg.SampleRate, channels: cfg.Channels}, nil
+	case config.WAV:
+		return wavCodec{}, nil
+	case config.MP3:
+		encoder, err := audio.NewMP3Encoder(cfg.SampleRate, cfg.Channels, cfg.MP3Bitrate)
+		if err != nil {
+			return nil, err
+		}
+		return &mp3Codec{decoder: audio.NewMP3Decoder(), encoder: encoder}, nil
+	case config.Opus:
+		ogg := cfg.OpusFraming == config.OpusFramingOgg
+		decoder, err := audio.NewOpusStreamDecoder(cfg.SampleRate, cfg.Channels, ogg)
+		if err != nil {
+			return nil, err
+		}
+		encoder, err := audio.NewOpusStreamEncoder(cfg.SampleRate, cfg.Channels, cfg.OpusBitrate*1000, ogg)
+		if err != nil {
+			return nil, err
+		}
+		return &opusCodec{decoder: decoder, encoder: encoder}, nil
+	case config.G711ULaw:
+		return g711Codec{sampleRate: cfg.SampleRate, channels: cfg.Channels,
+			decode: audio.FromMuLaw, encode: (*audio.Audio).AsMuLaw}, nil
+	case config.G711ALaw:
+		return g711Codec{sampleRate: cfg.SampleRate, channels: cfg.Channels,
+			decode: audio.FromALaw, encode: (*audio.Audio).AsALaw}, nil
+	case config.IMAADPCM:
+		encoder, err := audio.NewIMAADPCMEncoder(cfg.SampleRate, cfg.Channels)
+		if err != nil {
+			return nil, err
+		}
+		return &adpcmCodec{sampleRate: cfg.SampleRate, channels: cfg.Channels, encoder: encoder}, nil
+	default:
+		return nil, fmt.Errorf("unsupported audio format %s", cfg.AudioFormat)
+	}
+}
+
+// pcm16Codec exchanges raw 16-bit PCM, the sample rate and channels come from the configuration
+type pcm16Codec struct {
+	sampleRate int
+	channels   int
+}
+
+func (c pcm16Codec) Decode(data []byte) (audio.Audio, error) {
+	if len(data)%2 != 0 {
+		return audio.Audio{}, fmt.Errorf("pcm16 message has an odd length of %d bytes", len(data))
+	}
+	return audio.FromPCM16(data, c.sampleRate, c.channels), nil
+}
+
+func (c pcm16Codec) Encode(a audio.Audio) ([][]byte, error) {
+	return [][]byte{a.AsPCM16()}, nil
+}
+
+func (c pcm16Codec) Flush() ([][]byte, error) {
+	return nil, nil
+}
+
+func (pcm16Codec) Reset() {}
+
+// wavCodec exchanges messages that are each a complete WAV file. The device can send any sample
+// format, responses are sent as 16-bit PCM.
+type wavCodec struct{}
+
+func (wavCodec) Decode(data []byte) (audio.Audio, error) {
+	return audio.FromWAV(data)
+}
+
+func (wavCodec) Encode(a audio.Audio) ([][]byte, error) {
+	msg, err := a.AsWAV(audio.WAVPCM16)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{msg}, nil
+}
+
+func (wavCodec) Flush() ([][]byte, error) {
+	return nil, nil
+}
+
+func (wavCodec) Reset() {}
+
+// mp3Codec exchanges MP3 streams, each message holds the next bytes of the stream. The frames of
+// the device can be cut anywhere, responses are sent as whole frames at audio.mp3_bitrate.
+type mp3Codec struct {
+	decoder *audio.MP3Decoder
+	encoder audio.MP3Encoder
+}
+
+func (c *mp3Codec) Decode(data []byte) (audio.Audio, error) {
+	return c.decoder.Decode(data)
+}
+
+func (c *mp3Codec) Encode(a audio.Audio) ([][]byte, error) {
+	return message(c.encoder.Encode(a))
+}
+
+func (c *mp3Codec) Flush() ([][]byte, error) {
+	return message(c.encoder.Flush())
+}
+
+func (c *mp3Codec) Reset() {
+	c.encoder.Reset()
+}
+
+// message wraps the output of a stream encoder into a single message, or none if it is empty
+func message(data []byte, err error) ([][]byte, error) {
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	return [][]byte{data}, nil
+}
+
+// opusCodec exchanges Opus packets framed as set by audio.opus_framing: one packet per message,
+// or the next bytes of an Ogg Opus stream. Responses are encoded at audio.opus_bitrate.
+type opusCodec struct {
+	decoder *audio.OpusStreamDecoder
+	encoder *audio.OpusStreamEncoder
+}
+
+func (c *opusCodec) Decode(data []byte) (audio.Audio, error) {
+	return c.decoder.Decode(data)
+}
+
+func (c *opusCodec) Encode(a audio.Audio) ([][]byte, error) {
+	return c.encoder.Encode(a)
+}
+
+func (c *opusCodec) Flush() ([][]byte, error) {
+	return c.encoder.Flush()
+}
+
+func (c *opusCodec) Reset() {
+	c.encoder.Reset()
+}
+
+// g711Codec exchanges G.711 samples of one byte each, the sample rate and channels come from the
+// configuration
+type g711Codec struct {
+	sampleRate int
+	channels   int
+	decode     func(data []byte, sampleRate, channels int) audio.Audio
+	encode     func(a *audio.Audio) []byte
+}
+
+func (c g711Codec) Decode(data []byte) (audio.Audio, error) {
+	if len(data)%c.channels != 0 {
+		return audio.Audio{}, fmt.Errorf("g711 message of %d bytes does not hold whole frames of %d channels", len(data), c.channels)
+	}
+	return c.decode(data, c.sampleRate, c.channels), nil
+}
+
+func (c g711Codec) Encode(a audio.Audio) ([][]byte, error) {
+	return [][]byte{c.encode(&a)}, nil
+}
+
+func (c g711Codec) Flush() ([][]byte, error) {
+	return nil, nil
+}
+
+func (g711Codec) Reset() {}
+
+// adpcmCodec exchanges IMA ADPCM, each message is a block that decodes on its own. Responses hold
+// back the samples that do not fill a group of the block until the next message.
+type adpcmCodec struct {
+	sampleRate int
+	channels   int
+	encoder    *audio.IMAADPCMEncoder
+}
+
+func (c *adpcmCodec) Decode(data []byte) (audio.Audio, error) {
+	return audio.FromIMAADPCM(data, c.sampleRate, c.channels)
+}
+
+func (c *adpcmCodec) Encode(a audio.Audio) ([][]byte, error) {
+	return message(c.encoder.Encode(a))
+}
+
+func (c *adpcmCodec) Flush() ([][]byte, error) {
+	return message(c.encoder.Flush())
+}
+
+func (c *adpcmCodec) Reset() {
+	c.encoder.Reset()
+}
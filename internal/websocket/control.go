@@ -0,0 +1,87 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/pixaverse-studios/websocket-server/internal/ai"
+)
+
+// handleControlMessage parses a JSON text message from the device, dispatches it to the AI client
+// and writes the reply back to the device
+func (h *Handler) handleControlMessage(s *session, data []byte) error {
+	reply := h.dispatchControlMessage(s, data)
+	if reply == nil {
+		return nil
+	}
+	return s.client.WriteJSON(reply)
+}
+
+func (h *Handler) dispatchControlMessage(s *session, data []byte) interface{} {
+	base, perr := parseControlMessage(data)
+	if perr != nil {
+		return *perr
+	}
+
+	ack := AckMessage{
+		ControlMessageBase: ControlMessageBase{Type: AckMessageType, ID: base.ID},
+		RequestType:        base.Type,
+	}
+
+	var err error
+	switch base.Type {
+	case SessionConfigureMessageType:
+		var msg SessionConfigureMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return NewErrorMessage(base.ID, ErrCodeInvalidPayload, "invalid %s message: %v", base.Type, err)
+		}
+		err = s.aiClient.UpdateSession(msg.SessionUpdate)
+		if errors.Is(err, ai.ErrInvalidSession) {
+			return NewErrorMessage(base.ID, ErrCodeInvalidPayload, "%v", err)
+		}
+
+	case ResponseCancelMessageType:
+		err = s.interrupt()
+
+	case InputCommitMessageType:
+		// without turn detection the commit is the end of the speech of the user
+		if err = s.aiClient.CommitAudio(); err == nil {
+			s.turnStarted()
+		}
+
+	case InputClearMessageType:
+		err = s.aiClient.ClearAudio()
+
+	case ToolResultMessageType:
+		var msg ToolResultMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return NewErrorMessage(base.ID, ErrCodeInvalidPayload, "invalid %s message: %v", base.Type, err)
+		}
+		if !s.resolveToolCall(msg) {
+			return NewErrorMessage(base.ID, ErrCodeUnknownCall, "no pending tool call with id %q", msg.CallID)
+		}
+
+	case PingMessageType:
+		return ControlMessageBase{Type: PongMessageType, ID: base.ID}
+
+	case StatusMessageType:
+		return StatusMessage{
+			ControlMessageBase: ControlMessageBase{Type: StatusMessageType, ID: base.ID},
+			DeviceID:           s.identity.DeviceID,
+			Audio: AudioStatus{
+				SampleRate: s.client.config.Audio.SampleRate,
+				Channels:   s.client.config.Audio.Channels,
+				Format:     string(s.client.config.Audio.AudioFormat),
+			},
+		}
+
+	default:
+		return NewErrorMessage(base.ID, ErrCodeUnknownType, "unknown control message type: %s", base.Type)
+	}
+
+	if err != nil {
+		h.logger.Error("Could not forward control message to AI Client", "type", base.Type, "error", err)
+		return NewErrorMessage(base.ID, ErrCodeUpstream, "could not forward %s: %v", base.Type, err)
+	}
+	return ack
+}
@@ -0,0 +1,94 @@
+package websocket
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// drainPollInterval is how often a draining session checks whether its response is over
+const drainPollInterval = 50 * time.Millisecond
+
+// startSession registers a new session, unless the handler is shutting down
+func (h *Handler) startSession() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	select {
+	case <-h.draining:
+		return false
+	default:
+	}
+	h.sessions.Add(1)
+	return true
+}
+
+// Shutdown stops accepting devices and lets the sessions in progress finish their response. Each
+// device is then told to connect again and disconnected, along with its connection to the model.
+// When ctx is done before the sessions are over, the devices are disconnected right away and
+// Shutdown returns the error of ctx once they are.
+//
+// Shutdown does not close the listener, http.Server.Shutdown does but it does not wait for the
+// WebSocket connections. It should be called first so that the health endpoints keep answering.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	select {
+	case <-h.draining:
+	default:
+		close(h.draining)
+	}
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.sessions.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	h.mu.Lock()
+	select {
+	case <-h.forced:
+	default:
+		close(h.forced)
+	}
+	h.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+// drainSession waits for the session to be between turns, or for the shutdown to run out of time,
+// and closes the connection of the device
+func (h *Handler) drainSession(ctx context.Context, s *session, errChan <-chan error) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for !s.idle() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errChan:
+			return err
+		case <-h.forced:
+			h.logger.Warn("Disconnecting device before the end of its response, the server is out of time to shut down")
+			return h.goAway(s)
+		case <-ticker.C:
+		}
+	}
+	return h.goAway(s)
+}
+
+// goAway asks the device to connect again and closes its connection with the going away code
+func (h *Handler) goAway(s *session) error {
+	msg := GoingAwayMessage{ControlMessageBase: ControlMessageBase{Type: GoingAwayMessageType}, Reason: "shutdown"}
+	if err := s.client.WriteJSON(msg); err != nil {
+		h.logger.Error("Could not tell device the server is going away", "error", err)
+	}
+	s.client.CloseWith(websocket.CloseGoingAway, "server shutting down")
+	return nil
+}
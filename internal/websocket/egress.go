@@ -0,0 +1,191 @@
+package websocket
+
+import (
+	"context"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+)
+
+// Default pacing of the response audio, see config.AudioConfig
+const (
+	defaultFrameDuration = 20 * time.Millisecond
+	defaultPlaybackLead  = 200 * time.Millisecond
+)
+
+// egressTiming returns the duration of the frames the response audio is sent in and how far ahead
+// of the playback of the device they are sent
+func egressTiming(cfg config.AudioConfig) (frame, lead time.Duration) {
+	frame, lead = defaultFrameDuration, defaultPlaybackLead
+	if d, err := time.ParseDuration(cfg.FrameDuration); err == nil && d > 0 {
+		frame = d
+	}
+	if d, err := time.ParseDuration(cfg.PlaybackLead); err == nil && d >= 0 {
+		lead = d
+	}
+	return frame, lead
+}
+
+// bufferPump writes the response audio queued by the goroutine handling the model output to the
+// session buffer. With the block policy it waits there for egressPump to make room, until the
+// response is interrupted, while the model output goes on being handled.
+func (h *Handler) bufferPump(ctx context.Context, s *session) {
+	for {
+		q, writeCtx, ok := s.nextQueued(ctx)
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.queuedReady:
+			}
+			continue
+		}
+
+		err := s.buffer.Write(writeCtx, q.data)
+		if err == nil && q.end {
+			err = s.buffer.Flush()
+		}
+		if err != nil && writeCtx.Err() == nil {
+			h.logger.Error("Cannot write to BufferSizeController buffer", "error", err)
+		}
+		s.writeDone()
+	}
+}
+
+// egressPump sends the response audio queued in the session buffer to the device in real time,
+// frame by frame, so that the device never holds more than the playback lead it has not played.
+// Small speaker buffers would overflow if the audio was sent as fast as the model makes it.
+func (h *Handler) egressPump(ctx context.Context, s *session) {
+	for {
+		chunk, ok := s.buffer.Next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.buffer.Ready():
+			}
+			continue
+		}
+
+		if len(chunk.Data) > 0 && !s.dropAudio() {
+			if wait := s.egressWait(len(chunk.Data)); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+			// the user may have barged in while the frame was waiting
+			if !s.dropAudio() {
+				h.sendAudio(s, chunk.Data)
+			}
+		}
+
+		if chunk.End {
+			msgs, err := s.encoder().Flush()
+			if err != nil {
+				h.logger.Error("Could not encode audio for client", "error", err)
+			}
+			h.writeAudio(s.client, msgs)
+			for _, msg := range s.audioEnded() {
+				if err := s.client.WriteJSON(msg); err != nil {
+					h.logger.Error("Could not write message to client", "error", err)
+				}
+			}
+		}
+	}
+}
+
+// sendAudio encodes a frame of response audio and sends it to the device
+func (h *Handler) sendAudio(s *session, data []byte) {
+	msgs, err := s.encodeResponse(data)
+	if err != nil {
+		h.logger.Error("Could not encode audio for client", "error", err)
+		return
+	}
+	if err := h.writeAudio(s.client, msgs); err != nil {
+		return
+	}
+	if len(msgs) > 0 {
+		s.stageReached(stageFirstDeviceWrite)
+	}
+	if gap := s.audioSent(len(data)); gap > 0 {
+		h.logger.Warn("Playback underrun, the device ran out of response audio", "gap", gap)
+	}
+}
+
+// playbackClock follows the playback of the response audio on the device. The device plays the
+// audio in real time from the first frame it receives. When it runs out of audio it is silent
+// until the next frame arrives, and plays on from there.
+type playbackClock struct {
+	bytesPerSecond int
+	// startedAt is when the device would have started playing the audio sent so far, had it played
+	// it without pause
+	startedAt time.Time
+	sentBytes int
+	// responseStart is the offset in the audio sent of the start of the current response
+	responseStart int
+	// streaming is set from the first frame of a response to its end, a pause in between is an
+	// underrun
+	streaming bool
+}
+
+func (p *playbackClock) duration(n int) time.Duration {
+	if p.bytesPerSecond <= 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second / time.Duration(p.bytesPerSecond)
+}
+
+// reset forgets the audio sent, which the device has been told to drop
+func (p *playbackClock) reset() {
+	*p = playbackClock{bytesPerSecond: p.bytesPerSecond}
+}
+
+// wait returns how long to wait before sending n more bytes so that the device does not get more
+// than lead ahead of its playback
+func (p *playbackClock) wait(n int, lead time.Duration) time.Duration {
+	if p.startedAt.IsZero() {
+		return 0
+	}
+	ahead := p.duration(p.sentBytes+n) - time.Since(p.startedAt)
+	return max(ahead-lead, 0)
+}
+
+// add records that n bytes have been sent. It returns how long the device had been silent when it
+// ran out of audio in the middle of a response.
+func (p *playbackClock) add(n int) time.Duration {
+	now := time.Now()
+	var underrun time.Duration
+	if gap := now.Sub(p.startedAt) - p.duration(p.sentBytes); p.startedAt.IsZero() || gap > 0 {
+		// the device played everything it had and starts again with this audio
+		if p.streaming && !p.startedAt.IsZero() {
+			underrun = gap
+		}
+		p.startedAt = now.Add(-p.duration(p.sentBytes))
+	}
+	if !p.streaming {
+		p.streaming = true
+		p.responseStart = p.sentBytes
+	}
+	p.sentBytes += n
+	return underrun
+}
+
+// end records that the audio of the current response has all been sent
+func (p *playbackClock) end() {
+	p.streaming = false
+}
+
+// position returns how much of the current response the device has played and whether it is still
+// playing
+func (p *playbackClock) position() (time.Duration, bool) {
+	if p.startedAt.IsZero() {
+		return 0, false
+	}
+	sent := p.duration(p.sentBytes)
+	played := min(time.Since(p.startedAt), sent)
+	return max(played-p.duration(p.responseStart), 0), played < sent
+}
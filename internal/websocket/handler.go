@@ -7,12 +7,15 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pixaverse-studios/websocket-server/internal/ai"
+	"github.com/pixaverse-studios/websocket-server/internal/auth"
 	"github.com/pixaverse-studios/websocket-server/internal/config"
-	"github.com/pixaverse-studios/websocket-server/internal/utils"
-	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/internal/metrics"
 
 	"github.com/gorilla/websocket"
 )
@@ -21,7 +24,19 @@ import (
 type Handler struct {
 	upgrader websocket.Upgrader
 	logger   *slog.Logger
-	config   *config.Config
+	// config is the configuration of the new sessions, Reload replaces it
+	config atomic.Pointer[config.Config]
+	// auth checks the credentials of the devices before their connection is upgraded
+	auth auth.Authenticator
+	// limits bounds the sessions of the devices, they are not reloaded
+	limits *limits
+
+	// draining is closed when Shutdown starts, forced when the sessions are out of time to finish
+	// their response. sessions counts the sessions in progress.
+	mu       sync.Mutex
+	draining chan struct{}
+	forced   chan struct{}
+	sessions sync.WaitGroup
 }
 
 // NewHandler creates a new WebSocket handler with the provided options
@@ -31,116 +46,277 @@ func NewHandler(cfg *config.Config) *Handler {
 	h := &Handler{
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
-				return true // In production, implement proper origin checking
+				// devices do not send an Origin, browsers do
+				origin := r.Header.Get("Origin")
+				return origin == "" || len(cfg.Auth.AllowedOrigins) == 0 || slices.Contains(cfg.Auth.AllowedOrigins, origin)
 			},
 			HandshakeTimeout: pingInterval,
 			WriteBufferPool:  nil, // Use default pool
 		},
-		logger: slog.New(slog.NewJSONHandler(os.Stdout, nil)),
-		config: cfg,
+		logger:   slog.New(slog.NewJSONHandler(os.Stdout, nil)),
+		limits:   newLimits(cfg.Limits),
+		draining: make(chan struct{}),
+		forced:   make(chan struct{}),
+	}
+	h.config.Store(cfg)
+
+	authenticator, err := auth.New(cfg.Auth)
+	if err == nil && cfg.Server.EnableTLS && cfg.Server.ClientCAFile != "" {
+		authenticator = auth.WithClientCertificates(authenticator, cfg.Server)
 	}
+	if err != nil {
+		// refuse every device rather than let them all in
+		h.logger.Error("Invalid authentication configuration, devices will be rejected", "error", err)
+		authenticator = auth.AuthenticatorFunc(func(*http.Request) (auth.Identity, error) { return auth.Identity{}, err })
+	}
+	h.auth = authenticator
 
 	return h
 }
 
+// Config returns the configuration of the new sessions
+func (h *Handler) Config() *config.Config {
+	return h.config.Load()
+}
+
+// Reload applies the settings of next that can change without a restart, see config.Reload. They
+// are used by the sessions starting after, the sessions in progress keep theirs. The names of the
+// sections of next that need a restart to apply are returned.
+func (h *Handler) Reload(next *config.Config) ([]string, error) {
+	reloaded, ignored := config.Reload(h.config.Load(), next)
+	if err := config.ValidateConfig(reloaded); err != nil {
+		return nil, err
+	}
+	h.config.Store(reloaded)
+	return ignored, nil
+}
+
 // ServeHTTP handles WebSocket connections
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
+	if !h.startSession() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.sessions.Done()
+
+	identity, err := h.auth.Authenticate(r)
+	if err != nil {
+		metrics.Connections.WithLabelValues("unauthorized").Inc()
+		h.logger.Warn("Rejected device", "remote_addr", r.RemoteAddr, "error", err)
+		status := auth.Status(err)
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pixa"`)
+		}
+		// the reason is logged, not given to whoever is trying
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	// the session keeps the configuration it started with when it is reloaded
+	cfg := h.config.Load()
+	overrides, err := sessionUpdateFromQuery(r.URL.Query())
+	if err == nil {
+		err = overrides.Validate(cfg.AIConfig.Session.WithDefaults())
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r, cfg.Limits.ClientIPHeader)
+	release, limitErr := h.limits.acquire(identity.DeviceID, ip)
+	if limitErr == nil {
+		defer release()
+	}
+
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		metrics.Connections.WithLabelValues("failed").Inc()
 		h.logger.Error("Failed to upgrade connection", "error", err)
 		return
 	}
 
-	client := NewClient(conn, h.logger, h.config)
+	client := NewClient(conn, h.logger, cfg)
 	defer client.Close()
 
+	// the limits are reported in the close frame, which devices handle better than a refused upgrade
+	if limitErr != nil {
+		metrics.Connections.WithLabelValues("limited").Inc()
+		h.logger.Warn("Refused device", "device_id", identity.DeviceID, "remote_addr", ip, "error", limitErr)
+		h.closeLimited(client, limitErr)
+		return
+	}
+	metrics.Connections.WithLabelValues("accepted").Inc()
+
 	// Start sending pings to the client
 	client.StartPingTicker(ctx)
 
-	if err := h.handleClient(ctx, client); err != nil {
+	ctx = auth.NewContext(ctx, identity)
+	h.logger.Info("Device connected", "device_id", identity.DeviceID, "auth", identity.Method)
+	if err := h.handleClient(ctx, client, identity, overrides); err != nil {
 		h.logger.Error("Client handling error", "error", err)
 	}
 }
 
-// handleClient manages the client connection and message routing
-func (h *Handler) handleClient(ctx context.Context, client *Client) error {
-	aiClient := ai.NewOpenAIClient(client.config.Azure, h.config.AIConfig)
-	ab := utils.NewBufferSizeController(4096)
-
-	// Listen to the buffer controller output channel
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case audio := <-ab.GetOutputChannel():
-				client.conn.WriteMessage(websocket.BinaryMessage, audio)
-			}
+// handleClient manages the client connection and message routing. identity is who the device
+// authenticated as, overrides are the session parameters set by the device when connecting.
+func (h *Handler) handleClient(ctx context.Context, client *Client, identity auth.Identity, overrides ai.SessionUpdate) error {
+	s, err := newSession(client, identity)
+	if err != nil {
+		return fmt.Errorf("Could not create session: %v", err)
+	}
+	s.audioRate = h.limits.audioLimiter()
+	metrics.Sessions.Inc()
+	metrics.ActiveSessions.Inc()
+	defer metrics.ActiveSessions.Dec()
+	defer func() {
+		// the frames left are not sent, the queue depth does not count them anymore
+		s.buffer.Clear()
+		h.logger.Info("Session latency", s.latencySummary()...)
+		if stats := s.buffer.Stats(); stats.DroppedChunks > 0 {
+			h.logger.Warn("Response audio was dropped because the device queue was full",
+				"policy", client.config.Websocket.QueuePolicy, "chunks", stats.DroppedChunks, "bytes", stats.DroppedBytes)
 		}
 	}()
+	tools, err := newToolRegistry(s)
+	if err != nil {
+		return fmt.Errorf("Could not register tools: %v", err)
+	}
+	aiClient, err := ai.NewClient(client.config, tools)
+	if err != nil {
+		return fmt.Errorf("Could not create AI Client: %v", err)
+	}
+	defer aiClient.Close()
+	s.aiClient = aiClient
+	if err := aiClient.UpdateSession(overrides); err != nil {
+		return fmt.Errorf("Could not configure AI session: %v", err)
+	}
 
-	// Listen for critical events from the AI model
+	// Create error channel for goroutines
+	errChan := make(chan error, 2)
+
+	// Send the response audio to the device as it is played
+	go h.bufferPump(ctx, s)
+	go h.egressPump(ctx, s)
+
+	// Handle events and responses from the AI model. Both are handled by the same goroutine so that
+	// they are processed in the order the model sent them.
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			case e := <-aiClient.GetEventsStream():
-				if e == ai.ResponseAudioDoneEventType {
-					ab.Flush()
+				if err := h.handleEvent(ctx, s, e); err != nil {
+					errChan <- err
+					return
+				}
+			case t := <-aiClient.GetTranscriptStream():
+				if t.Final {
+					h.logger.Info("Transcript", "role", t.Role, "item_id", t.ItemID, "text", t.Text)
+				}
+				if err := client.WriteJSON(transcriptMessage(t)); err != nil {
+					h.logger.Error("Could not forward transcript to client", "error", err)
 				}
-			}
-		}
-	}()
-
-	// Start handling AI responses
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
 			case a := <-aiClient.GetResponseStream():
-				if a.GetSampleRate() != h.config.Audio.SampleRate {
-					a.Resample(h.config.Audio.SampleRate)
+				if s.dropAudio() {
+					continue
 				}
-				err := ab.Write(a.AsPCM16())
+				s.stageReached(stageFirstAudioDelta)
+				a, err := s.toDevice(a)
 				if err != nil {
-					h.logger.Error("Cannot write to BufferSizeController buffer", "error", err)
+					h.logger.Error("Could not convert response audio", "error", err)
+					continue
 				}
+				s.queueAudio(queuedAudio{data: a.AsPCM16()})
 			}
-
 		}
 	}()
 
-	err := aiClient.Initialize(ctx)
+	err = aiClient.Initialize(ctx)
 	if err != nil {
 		return fmt.Errorf("Could not initialize AI Client: %v", err)
 	}
 
-	// Create error channel for goroutines
-	errChan := make(chan error, 2)
-
 	// Start handling messages from the client
 	go func() {
-		if err := h.readPump(ctx, client, aiClient); err != nil {
+		if err := h.readPump(ctx, s); err != nil {
 			errChan <- fmt.Errorf("client message handling error: %w", err)
 		}
 	}()
 
-	// Wait for context cancellation or error
+	// Wait for context cancellation, error or shutdown
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	case err := <-errChan:
 		return err
+	case <-h.draining:
+		return h.drainSession(ctx, s, errChan)
 	}
 }
 
+// writeAudio sends encoded audio messages to the device
+func (h *Handler) writeAudio(client *Client, msgs [][]byte) error {
+	for _, msg := range msgs {
+		if err := client.WriteBinary(msg); err != nil {
+			h.logger.Error("Could not write audio to client", "error", err)
+			return err
+		}
+		metrics.AudioBytes.WithLabelValues(metrics.Out).Add(float64(len(msg)))
+	}
+	return nil
+}
+
+// handleEvent reacts to an event from the AI model and forwards it to the device. It returns an
+// error when the session cannot go on.
+func (h *Handler) handleEvent(ctx context.Context, s *session, e ai.Event) error {
+	switch e.Type {
+	case ai.SpeechStartedEventType:
+		// the user started talking over the response, stop it
+		if err := s.interrupt(); err != nil {
+			h.logger.Error("Could not interrupt response", "error", err)
+		}
+	case ai.SpeechStoppedEventType:
+		s.turnStarted()
+	case ai.ResponseCreatedEventType:
+		s.stageReached(stageResponseCreated)
+		s.responseStarted()
+		// forget the end of the previous response in case it ended without its audio being flushed
+		s.outbound.Reset()
+	case ai.ResponseAudioDoneEventType:
+		s.stageReached(stageAudioDone)
+		if !s.dropAudio() {
+			s.flushResponseAudio()
+		}
+	case ai.ResponseDoneEventType:
+		s.responseDone()
+	}
+
+	if msg := eventMessage(e); msg != nil {
+		send := s.client.WriteJSON
+		if e.Type == ai.ResponseAudioDoneEventType || e.Type == ai.ResponseDoneEventType {
+			// the response audio is still on its way to the device
+			send = s.sendAfterAudio
+		}
+		if err := send(msg); err != nil {
+			h.logger.Error("Could not forward event to client", "type", e.Type, "error", err)
+		}
+	}
+
+	if e.Type == ai.UpstreamFailedEventType {
+		return fmt.Errorf("lost connection to the AI model")
+	}
+	return nil
+}
+
 // readPump handles incoming messages from the WebSocket client
-func (h *Handler) readPump(ctx context.Context, client *Client, chatClient ai.AIClient) error {
+func (h *Handler) readPump(ctx context.Context, s *session) error {
+	client := s.client
 	for {
 		select {
 		case <-ctx.Done():
@@ -154,13 +330,33 @@ func (h *Handler) readPump(ctx context.Context, client *Client, chatClient ai.AI
 				return err
 			}
 
-			if typ == websocket.BinaryMessage {
-				a := audio.FromPCM16(message, h.config.Audio.SampleRate, h.config.Audio.Channels)
-				err := chatClient.SendAudio(a)
+			switch typ {
+			case websocket.BinaryMessage:
+				metrics.AudioBytes.WithLabelValues(metrics.In).Add(float64(len(message)))
+				if err := s.allowAudio(len(message)); err != nil {
+					h.closeLimited(client, err)
+					return err
+				}
+				a, err := s.codec.Decode(message)
+				if err == nil && len(a.AsFloat32()) == 0 {
+					// formats like MP3 and Ogg need more than this message to make a frame
+					continue
+				}
+				if err == nil {
+					a, err = s.toModel(a)
+				}
+				if err != nil {
+					h.logger.Error("Could not convert device audio", "error", err)
+					continue
+				}
+				err = s.aiClient.SendAudio(a)
 				if err != nil {
 					h.logger.Error("Could not send audio to AI Client", "error", err)
 				}
-
+			case websocket.TextMessage:
+				if err := h.handleControlMessage(s, message); err != nil {
+					h.logger.Error("Could not reply to control message", "error", err)
+				}
 			}
 		}
 	}
@@ -1,15 +1,1559 @@
 package websocket
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/pixaverse-studios/websocket-server/internal/ai"
+	"github.com/pixaverse-studios/websocket-server/internal/ai/realtimetest"
+	"github.com/pixaverse-studios/websocket-server/internal/auth"
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+	"github.com/pixaverse-studios/websocket-server/internal/metrics"
+	"github.com/pixaverse-studios/websocket-server/internal/utils"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio/audiotest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testDevice is a device connected to a Handler backed by the fake realtime server
+type testDevice struct {
+	t    *testing.T
+	conn *websocket.Conn
+	srv  *realtimetest.Server
+	cfg  *config.Config
+	// handler serves the device at url
+	handler *Handler
+	url     string
+	// mp3 and opus decode the response stream when the device uses MP3 or Opus
+	mp3  *audio.MP3Decoder
+	opus *audio.OpusStreamDecoder
+}
+
+func testConfig(srv *realtimetest.Server) *config.Config {
+	return &config.Config{
+		Websocket: config.WebsocketConfig{PingInterval: "30s", PongWait: "60s", WriteWait: "10s", MaxMessageQueue: 256},
+		Audio:     config.AudioConfig{SampleRate: 16000, Channels: 2, AudioFormat: config.PCM16, MP3Bitrate: 32, OpusBitrate: 24, OpusFraming: config.OpusFramingRaw},
+		Azure:     config.AzureConfig{ServiceURL: srv.URL, OpenAIKey: "test-key"},
+		AIConfig:  config.AIConfig{InputTranscriptionModel: "whisper-1"},
+	}
+}
+
+// newTestDevice connects a device to a new handler. The options change the configuration of the
+// handler.
+func newTestDevice(t *testing.T, scenario realtimetest.Scenario, options ...func(*config.Config)) *testDevice {
+	t.Helper()
+
+	srv := realtimetest.NewServer(scenario)
+	cfg := testConfig(srv)
+	for _, option := range options {
+		option(cfg)
+	}
+	handler := NewHandler(cfg)
+	server := httptest.NewServer(handler)
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.Close()
+		srv.Close()
+	})
+	return &testDevice{t: t, conn: conn, srv: srv, cfg: cfg, handler: handler, url: url, mp3: audio.NewMP3Decoder()}
+}
+
+func (d *testDevice) send(msg string) {
+	d.t.Helper()
+	if err := d.conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		d.t.Fatal(err)
+	}
+}
+
+// speak sends 600ms of silence, which is enough to trigger a turn of the fake server once the
+// resampler got the half second it needs
+func (d *testDevice) speak() {
+	d.t.Helper()
+	rate, channels := d.cfg.Audio.SampleRate, d.cfg.Audio.Channels
+	silence := make([]byte, rate*2*channels*6/10)
+	a := audio.FromPCM16(silence, rate, channels)
+	msgs := [][]byte{silence}
+	switch d.cfg.Audio.AudioFormat {
+	case config.WAV:
+		msgs[0], _ = a.AsWAV(audio.WAVPCM16)
+	case config.MP3:
+		msgs[0], _ = a.AsMP3()
+	case config.G711ULaw:
+		msgs[0] = a.AsMuLaw()
+	case config.G711ALaw:
+		msgs[0] = a.AsALaw()
+	case config.IMAADPCM:
+		msgs[0] = a.AsIMAADPCM()
+	case config.Opus:
+		e, err := audio.NewOpusStreamEncoder(rate, channels, 24000, d.cfg.Audio.OpusFraming == config.OpusFramingOgg)
+		if err != nil {
+			d.t.Fatal(err)
+		}
+		msgs, _ = e.Encode(a)
+	}
+	for _, msg := range msgs {
+		if err := d.conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+			d.t.Fatal(err)
+		}
+	}
+}
+
+// pcmBytes returns the size of an audio message as 16-bit PCM
+func (d *testDevice) pcmBytes(data []byte) int {
+	d.t.Helper()
+	var (
+		a   audio.Audio
+		err error
+	)
+	switch d.cfg.Audio.AudioFormat {
+	case config.WAV:
+		a, err = audio.FromWAV(data)
+	case config.MP3:
+		a, err = d.mp3.Decode(data)
+	case config.G711ULaw, config.G711ALaw:
+		return 2 * len(data)
+	case config.IMAADPCM:
+		a, err = audio.FromIMAADPCM(data, d.cfg.Audio.SampleRate, d.cfg.Audio.Channels)
+	case config.Opus:
+		if d.opus == nil {
+			d.opus, err = audio.NewOpusStreamDecoder(d.cfg.Audio.SampleRate, d.cfg.Audio.Channels, d.cfg.Audio.OpusFraming == config.OpusFramingOgg)
+		}
+		if err == nil {
+			a, err = d.opus.Decode(data)
+		}
+	default:
+		return len(data)
+	}
+	if err != nil {
+		d.t.Fatalf("device received invalid %s: %v", d.cfg.Audio.AudioFormat, err)
+	}
+	return len(a.AsPCM16())
+}
+
+// readUntil reads messages until a control message of the given type arrives. It returns the
+// control messages received, keyed by type, and the number of audio bytes received.
+func (d *testDevice) readUntil(typ ControlMessageType) (map[ControlMessageType][]json.RawMessage, int) {
+	d.t.Helper()
+
+	messages := make(map[ControlMessageType][]json.RawMessage)
+	audioBytes := 0
+	d.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msgType, data, err := d.conn.ReadMessage()
+		if err != nil {
+			d.t.Fatalf("failed waiting for %s: %v", typ, err)
+		}
+		if msgType == websocket.BinaryMessage {
+			audioBytes += d.pcmBytes(data)
+			continue
+		}
+		var base ControlMessageBase
+		if err := json.Unmarshal(data, &base); err != nil {
+			d.t.Fatal(err)
+		}
+		messages[base.Type] = append(messages[base.Type], data)
+		if base.Type == typ {
+			return messages, audioBytes
+		}
+	}
+}
+
+// readAudio reads audio until at least n bytes have been received in total, starting from the
+// given count. Audio goes through the send buffer, so it can trail the control messages.
+func (d *testDevice) readAudio(received, n int) int {
+	d.t.Helper()
+
+	d.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for received < n {
+		msgType, data, err := d.conn.ReadMessage()
+		if err != nil {
+			return received
+		}
+		if msgType == websocket.BinaryMessage {
+			received += d.pcmBytes(data)
+		}
+	}
+	return received
+}
+
+// useFakeOpus makes audio.NewOpusEncoder and audio.NewOpusDecoder create audiotest.FakeOpusCodec
+// until the test ends
+func useFakeOpus(t *testing.T) {
+	encoder, decoder := audio.NewOpusEncoder, audio.NewOpusDecoder
+	audio.NewOpusEncoder = func(int, int, int) (audio.OpusEncoder, error) { return audiotest.FakeOpusCodec{}, nil }
+	audio.NewOpusDecoder = func(int, int) (audio.OpusDecoder, error) { return audiotest.FakeOpusCodec{}, nil }
+	t.Cleanup(func() { audio.NewOpusEncoder, audio.NewOpusDecoder = encoder, decoder })
+}
 
 func TestWebSocketHandler(t *testing.T) {
 	t.Run("test connection handling", func(t *testing.T) {
-		// TODO: Implement connection handling test
-		t.Skip("Test not implemented")
+		d := newTestDevice(t, realtimetest.Scenario{})
+
+		d.send(`{"type":"ping","id":"1"}`)
+		messages, _ := d.readUntil(PongMessageType)
+		if !strings.Contains(string(messages[PongMessageType][0]), `"id":"1"`) {
+			t.Fatalf("unexpected pong: %s", messages[PongMessageType][0])
+		}
+
+		d.send(`{"type":"session.configure","voice":"verse"}`)
+		d.readUntil(AckMessageType)
+		if _, ok := d.srv.WaitForEvent("session.update", 2, time.Second); !ok {
+			t.Fatal("session.configure was not forwarded")
+		}
 	})
 
-	t.Run("test message relay", func(t *testing.T) {
-		// TODO: Implement message relay test
-		t.Skip("Test not implemented")
+	relay := func(t *testing.T, format config.AudioFormat, options ...func(*config.Config)) {
+		options = append(options, func(cfg *config.Config) { cfg.Audio.AudioFormat = format })
+		d := newTestDevice(t, realtimetest.Scenario{Turns: []realtimetest.Turn{{
+			UserTranscript: "hello",
+			Response:       realtimetest.Response{Transcript: "hi there", Audio: make([]byte, 9600)},
+		}}}, options...)
+
+		d.speak()
+		messages, audioBytes := d.readUntil(ResponseDoneMessageType)
+
+		for _, typ := range []ControlMessageType{SpeechStartedMessageType, SpeechStoppedMessageType, ResponseStartedMessageType, ResponseAudioDoneMessageType, TranscriptMessageType} {
+			if len(messages[typ]) == 0 {
+				t.Errorf("expected a %s message", typ)
+			}
+		}
+		// 200ms of 24 kHz model audio resampled to the device rate and copied to each channel
+		expected := d.cfg.Audio.SampleRate * 2 * d.cfg.Audio.Channels / 5
+		audioBytes = d.readAudio(audioBytes, expected)
+		if format == config.MP3 || format == config.IMAADPCM {
+			// the encoder pads the end of the response with silence to fill its frames
+			if audioBytes < expected {
+				t.Errorf("expected at least %d bytes of audio, got %d", expected, audioBytes)
+			}
+		} else if audioBytes != expected {
+			t.Errorf("expected %d bytes of audio, got %d", expected, audioBytes)
+		}
+	}
+	telephony := func(cfg *config.Config) { cfg.Audio.SampleRate, cfg.Audio.Channels = 8000, 1 }
+	t.Run("test message relay", func(t *testing.T) { relay(t, config.PCM16) })
+	t.Run("test wav message relay", func(t *testing.T) { relay(t, config.WAV) })
+	t.Run("test mp3 message relay", func(t *testing.T) { relay(t, config.MP3) })
+	t.Run("test opus message relay", func(t *testing.T) {
+		useFakeOpus(t)
+		relay(t, config.Opus)
 	})
+	t.Run("test ogg opus message relay", func(t *testing.T) {
+		useFakeOpus(t)
+		relay(t, config.Opus, func(cfg *config.Config) { cfg.Audio.OpusFraming = config.OpusFramingOgg })
+	})
+
+	t.Run("test g711 μ-law message relay", func(t *testing.T) { relay(t, config.G711ULaw, telephony) })
+	t.Run("test g711 A-law message relay", func(t *testing.T) { relay(t, config.G711ALaw, telephony) })
+	t.Run("test ima adpcm message relay", func(t *testing.T) { relay(t, config.IMAADPCM, telephony) })
+
+	t.Run("test paced audio", func(t *testing.T) {
+		d := newTestDevice(t, realtimetest.Scenario{Turns: []realtimetest.Turn{{
+			Response: realtimetest.Response{Audio: make([]byte, 48000)},
+		}}}, func(cfg *config.Config) {
+			cfg.Audio.Channels = 1
+			cfg.Audio.PlaybackLead = "100ms"
+		})
+
+		d.speak()
+		d.readUntil(ResponseStartedMessageType)
+		start := time.Now()
+		messages, audioBytes := d.readUntil(ResponseDoneMessageType)
+		// a second of audio is sent as it is played, with 100ms of lead
+		if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+			t.Errorf("expected the audio to take about 900ms, got %v", elapsed)
+		}
+		// and the end of the response waits for it
+		if audioBytes != 32000 || len(messages[ResponseAudioDoneMessageType]) != 1 {
+			t.Errorf("expected 32000 bytes of audio before the end of the response, got %d", audioBytes)
+		}
+	})
+
+	t.Run("test metrics", func(t *testing.T) {
+		sessions := testutil.ToFloat64(metrics.Sessions)
+		in := testutil.ToFloat64(metrics.AudioBytes.WithLabelValues(metrics.In))
+		out := testutil.ToFloat64(metrics.AudioBytes.WithLabelValues(metrics.Out))
+
+		d := newTestDevice(t, realtimetest.Scenario{Turns: []realtimetest.Turn{{
+			Response: realtimetest.Response{Audio: make([]byte, 9600)},
+		}}})
+		d.speak()
+		_, audioBytes := d.readUntil(ResponseDoneMessageType)
+
+		if got := testutil.ToFloat64(metrics.Sessions) - sessions; got != 1 {
+			t.Errorf("expected 1 more session, got %v", got)
+		}
+		if testutil.ToFloat64(metrics.ActiveSessions) < 1 {
+			t.Error("expected the session to be active")
+		}
+		if got := testutil.ToFloat64(metrics.AudioBytes.WithLabelValues(metrics.In)) - in; got == 0 {
+			t.Error("expected the audio of the device to be counted")
+		}
+		if got := testutil.ToFloat64(metrics.AudioBytes.WithLabelValues(metrics.Out)) - out; got < float64(audioBytes) {
+			t.Errorf("expected at least %d bytes of response audio to be counted, got %v", audioBytes, got)
+		}
+	})
+
+	t.Run("test device tools", func(t *testing.T) {
+		d := newTestDevice(t, realtimetest.Scenario{Turns: []realtimetest.Turn{{
+			ToolCall: &realtimetest.ToolCall{Name: "get_battery", Arguments: "{}"},
+			Response: realtimetest.Response{Transcript: "your battery is full"},
+		}}})
+
+		d.speak()
+		messages, _ := d.readUntil(ToolCallMessageType)
+		var call ToolCallMessage
+		json.Unmarshal(messages[ToolCallMessageType][0], &call)
+		if call.Name != "get_battery" {
+			t.Fatalf("unexpected tool call: %#v", call)
+		}
+
+		d.send(fmt.Sprintf(`{"type":"tool.result","call_id":%q,"output":{"level":100}}`, call.CallID))
+		e, ok := d.srv.WaitForEvent("conversation.item.create", 1, time.Second)
+		if !ok || !strings.Contains(string(e.Raw), `{\"level\":100}`) {
+			t.Fatalf("tool result was not forwarded: %s", e.Raw)
+		}
+	})
+}
+
+// fakeAIClient records the calls the handler makes to the AI client
+type fakeAIClient struct {
+	ai.AIClient
+	updates   []ai.SessionUpdate
+	commits   int
+	clears    int
+	cancels   int
+	truncated []time.Duration
+	failWrite bool
+}
+
+func (f *fakeAIClient) UpdateSession(u ai.SessionUpdate) error {
+	if f.failWrite {
+		return errors.New("connection closed")
+	}
+	if err := u.Validate(config.DefaultSessionConfig()); err != nil {
+		return err
+	}
+	f.updates = append(f.updates, u)
+	return nil
+}
+
+func (f *fakeAIClient) CommitAudio() error {
+	f.commits++
+	return nil
+}
+
+func (f *fakeAIClient) ClearAudio() error {
+	f.clears++
+	return nil
+}
+
+func (f *fakeAIClient) CancelResponse() error {
+	f.cancels++
+	return nil
+}
+
+func (f *fakeAIClient) TruncateResponse(audioEnd time.Duration) error {
+	f.truncated = append(f.truncated, audioEnd)
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	// a second of audio, sent to the device as it is played
+	scenario := realtimetest.Scenario{Turns: []realtimetest.Turn{{
+		Response: realtimetest.Response{Audio: make([]byte, 48000)},
+	}}}
+	mono := func(cfg *config.Config) { cfg.Audio.Channels = 1 }
+
+	// goingAway reads until the server closes the connection and checks how
+	goingAway := func(d *testDevice) (map[ControlMessageType][]json.RawMessage, int) {
+		t.Helper()
+		messages, audioBytes := d.readUntil(GoingAwayMessageType)
+		_, _, err := d.conn.ReadMessage()
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("expected the connection to be closed as going away, got %v", err)
+		}
+		return messages, audioBytes
+	}
+
+	t.Run("response finishes", func(t *testing.T) {
+		d := newTestDevice(t, scenario, mono)
+		d.speak()
+		d.readUntil(ResponseStartedMessageType)
+
+		done := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			done <- d.handler.Shutdown(ctx)
+		}()
+
+		messages, audioBytes := goingAway(d)
+		if audioBytes != 32000 || len(messages[ResponseDoneMessageType]) != 1 {
+			t.Errorf("expected the response to finish before going away, got %d bytes of audio", audioBytes)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("expected the shutdown to complete, got %v", err)
+		}
+
+		_, resp, err := websocket.DefaultDialer.Dial(d.url, nil)
+		if err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected new devices to be refused, got %v", err)
+		}
+	})
+
+	t.Run("response not created yet", func(t *testing.T) {
+		d := newTestDevice(t, realtimetest.Scenario{Turns: []realtimetest.Turn{{
+			Response:      realtimetest.Response{Audio: make([]byte, 48000)},
+			ResponseDelay: 300 * time.Millisecond,
+		}}}, mono)
+		d.speak()
+		d.readUntil(SpeechStoppedMessageType)
+
+		done := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			done <- d.handler.Shutdown(ctx)
+		}()
+
+		messages, audioBytes := goingAway(d)
+		if audioBytes != 32000 || len(messages[ResponseDoneMessageType]) != 1 {
+			t.Errorf("expected the user to get the response before going away, got %d bytes of audio", audioBytes)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("expected the shutdown to complete, got %v", err)
+		}
+	})
+
+	t.Run("manual commit", func(t *testing.T) {
+		d := newTestDevice(t, realtimetest.Scenario{Turns: []realtimetest.Turn{{
+			// the device commits the audio before the fake model hears enough of it
+			InputBytes:    1 << 30,
+			Response:      realtimetest.Response{Audio: make([]byte, 48000)},
+			ResponseDelay: 300 * time.Millisecond,
+		}}}, mono, func(cfg *config.Config) {
+			cfg.AIConfig.Session.TurnDetection.Type = config.TurnDetectionNone
+		})
+		latencies := turnLatencyCount(t, stageResponseCreated)
+		d.speak()
+		d.send(`{"type":"input.commit","id":"1"}`)
+		d.readUntil(AckMessageType)
+
+		done := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			done <- d.handler.Shutdown(ctx)
+		}()
+
+		messages, audioBytes := goingAway(d)
+		if audioBytes != 32000 || len(messages[ResponseDoneMessageType]) != 1 {
+			t.Errorf("expected the user to get the response before going away, got %d bytes of audio", audioBytes)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("expected the shutdown to complete, got %v", err)
+		}
+		if got := turnLatencyCount(t, stageResponseCreated) - latencies; got != 1 {
+			t.Errorf("expected the latency of the response to be measured once, got %d", got)
+		}
+	})
+
+	t.Run("out of time", func(t *testing.T) {
+		d := newTestDevice(t, scenario, mono)
+		d.speak()
+		d.readUntil(ResponseStartedMessageType)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := d.handler.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the shutdown to run out of time, got %v", err)
+		}
+		if messages, _ := goingAway(d); len(messages[ResponseDoneMessageType]) != 0 {
+			t.Error("expected the device to be disconnected before the end of the response")
+		}
+	})
+
+	t.Run("idle sessions", func(t *testing.T) {
+		d := newTestDevice(t, realtimetest.Scenario{})
+		d.send(`{"type":"ping","id":"1"}`)
+		d.readUntil(PongMessageType)
+
+		if err := d.handler.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		goingAway(d)
+		for deadline := time.Now().Add(time.Second); d.srv.OpenConnections() > 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the connection to the model to be closed")
+			}
+		}
+	})
+}
+
+func TestReload(t *testing.T) {
+	valid := func(cfg *config.Config) {
+		cfg.Server.Port = 8080
+		cfg.Websocket.QueuePolicy = utils.Block
+		cfg.AIConfig.Session = config.SessionConfig{}.WithDefaults()
+	}
+	d := newTestDevice(t, realtimetest.EchoScenario(), valid)
+	if _, ok := d.srv.WaitForEvent("session.update", 1, 2*time.Second); !ok {
+		t.Fatal("session was not configured")
+	}
+
+	next := *d.cfg
+	next.AIConfig.Session.Voice = "verse"
+	next.Audio.SampleRate = 24000
+	ignored, err := d.handler.Reload(&next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ignored, []string{"audio"}) {
+		t.Fatalf("expected the audio changes to need a restart, got %v", ignored)
+	}
+
+	invalid := next
+	temperature := 5.0
+	invalid.AIConfig.Session.Temperature = &temperature
+	if _, err := d.handler.Reload(&invalid); err == nil {
+		t.Fatal("expected an invalid configuration not to be reloaded")
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(d.url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	e, ok := d.srv.WaitForEvent("session.update", 2, 2*time.Second)
+	if !ok {
+		t.Fatal("new session was not configured")
+	}
+	if raw := string(e.Raw); !strings.Contains(raw, `"voice":"verse"`) || !strings.Contains(raw, `"temperature":0.8`) {
+		t.Fatalf("new session does not use the reloaded configuration: %s", raw)
+	}
+	second := &testDevice{t: t, conn: conn}
+	second.send(`{"type":"status","id":"1"}`)
+	messages, _ := second.readUntil(StatusMessageType)
+	var status StatusMessage
+	if err := json.Unmarshal(messages[StatusMessageType][0], &status); err != nil || status.Audio.SampleRate != 16000 {
+		t.Fatalf("expected the audio configuration to be unchanged, got %s", messages[StatusMessageType][0])
+	}
+
+	// the session in progress is left alone
+	if updates := d.srv.EventsOfType("session.update"); len(updates) != 2 {
+		t.Fatalf("expected one session.update per session, got %d", len(updates))
+	}
+}
+
+// closeReason returns the close code and reason of a connection closed by the server
+func closeReason(t *testing.T, conn *websocket.Conn) (int, CloseReason) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			var reason CloseReason
+			if err := json.Unmarshal([]byte(closeErr.Text), &reason); err != nil {
+				t.Fatalf("close reason is not JSON: %q", closeErr.Text)
+			}
+			return closeErr.Code, reason
+		}
+		if err != nil {
+			t.Fatalf("connection was not closed by the server: %v", err)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	// dial connects to the server of d with the headers given as name, value pairs
+	dial := func(d *testDevice, headers ...string) *websocket.Conn {
+		t.Helper()
+		header := http.Header{}
+		for i := 0; i < len(headers); i += 2 {
+			header.Set(headers[i], headers[i+1])
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(d.url, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	// expectOpen fails when conn gets closed
+	expectOpen := func(conn *websocket.Conn) {
+		t.Helper()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"ping","id":"1"}`))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatalf("expected the connection to be accepted: %v", err)
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+	expectLimit := func(conn *websocket.Conn, code int, expected CloseReason) {
+		t.Helper()
+		if gotCode, reason := closeReason(t, conn); gotCode != code || reason != expected {
+			t.Fatalf("expected close %d %+v, got %d %+v", code, expected, gotCode, reason)
+		}
+	}
+
+	t.Run("sessions", func(t *testing.T) {
+		d := newTestDevice(t, realtimetest.EchoScenario(), func(cfg *config.Config) { cfg.Limits.MaxSessions = 1 })
+		breaches := testutil.ToFloat64(metrics.LimitBreaches.WithLabelValues(LimitSessions))
+		expectLimit(dial(d), websocket.CloseTryAgainLater, CloseReason{Limit: LimitSessions})
+		if got := testutil.ToFloat64(metrics.LimitBreaches.WithLabelValues(LimitSessions)) - breaches; got != 1 {
+			t.Fatalf("expected 1 breach, got %v", got)
+		}
+
+		// the session is released when the device disconnects
+		d.conn.Close()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			conn := dial(d)
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"ping","id":"1"}`))
+			if _, _, err := conn.ReadMessage(); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("session was not released")
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	t.Run("sessions per device", func(t *testing.T) {
+		d := newTestDevice(t, realtimetest.EchoScenario(), func(cfg *config.Config) { cfg.Limits.MaxSessionsPerDevice = 1 })
+		expectOpen(dial(d, "X-Device-ID", "dev_1"))
+		expectLimit(dial(d, "X-Device-ID", "dev_1"), websocket.CloseTryAgainLater, CloseReason{Limit: LimitSessionsPerDevice})
+		expectOpen(dial(d, "X-Device-ID", "dev_2"))
+		// the devices without an ID are not limited by ID
+		expectOpen(dial(d))
+	})
+
+	t.Run("sessions per ip", func(t *testing.T) {
+		d := newTestDevice(t, realtimetest.EchoScenario(), func(cfg *config.Config) {
+			cfg.Limits.MaxSessionsPerIP = 1
+			cfg.Limits.ClientIPHeader = "X-Forwarded-For"
+		})
+		expectOpen(dial(d, "X-Forwarded-For", "10.0.0.1"))
+		// the proxy adds the address of the device at the end
+		expectLimit(dial(d, "X-Forwarded-For", "10.0.0.2, 10.0.0.1"), websocket.CloseTryAgainLater, CloseReason{Limit: LimitSessionsPerIP})
+		expectOpen(dial(d, "X-Forwarded-For", "10.0.0.1, 10.0.0.2"))
+	})
+
+	t.Run("upgrade rate", func(t *testing.T) {
+		d := newTestDevice(t, realtimetest.EchoScenario(), func(cfg *config.Config) {
+			cfg.Limits.UpgradeRate = 0.5
+			cfg.Limits.UpgradeBurst = 1
+		})
+		expectLimit(dial(d), websocket.CloseTryAgainLater, CloseReason{Limit: LimitUpgradeRate, RetryAfter: 2})
+	})
+
+	t.Run("audio rate", func(t *testing.T) {
+		d := newTestDevice(t, realtimetest.EchoScenario(), func(cfg *config.Config) { cfg.Limits.MaxAudioBytesPerSecond = 16000 })
+		// 600ms of 16 kHz stereo audio is 38400 bytes, more than the 2 seconds of audio allowed at once
+		d.speak()
+		expectLimit(d.conn, websocket.ClosePolicyViolation, CloseReason{Limit: LimitAudioRate})
+	})
+
+	t.Run("no limits", func(t *testing.T) {
+		d := newTestDevice(t, realtimetest.EchoScenario())
+		for i := 0; i < 3; i++ {
+			expectOpen(dial(d, "X-Device-ID", "dev_1"))
+		}
+		d.speak()
+		expectOpen(d.conn)
+	})
+}
+
+func TestAuthentication(t *testing.T) {
+	srv := realtimetest.NewServer(realtimetest.Scenario{})
+	defer srv.Close()
+
+	secret := "0123456789abcdef0123456789abcdef"
+	sign := func(key string, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := sign(secret, jwt.MapClaims{"device_id": "dev_1", "exp": time.Now().Add(time.Hour).Unix()})
+	jwtMode := func(cfg *config.Config) {
+		cfg.Auth = config.AuthConfig{Mode: config.AuthJWT, JWTSecret: secret, DeviceClaim: "device_id", QueryParam: "token"}
+	}
+
+	// connect returns the connection of a device or, when it is refused, the status of the response
+	connect := func(t *testing.T, option func(*config.Config), query string, header http.Header) (*websocket.Conn, *http.Response) {
+		t.Helper()
+		cfg := testConfig(srv)
+		option(cfg)
+		server := httptest.NewServer(NewHandler(cfg))
+		t.Cleanup(server.Close)
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/"+query, header)
+		if err != nil {
+			if resp == nil {
+				t.Fatal(err)
+			}
+			return nil, resp
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, resp
+	}
+	// deviceID asks the server for the status of the session and returns the device ID in it
+	deviceID := func(t *testing.T, conn *websocket.Conn) string {
+		t.Helper()
+		d := &testDevice{t: t, conn: conn}
+		d.send(`{"type":"status","id":"1"}`)
+		messages, _ := d.readUntil(StatusMessageType)
+		var status StatusMessage
+		if err := json.Unmarshal(messages[StatusMessageType][0], &status); err != nil {
+			t.Fatal(err)
+		}
+		return status.DeviceID
+	}
+	bearer := func(token string) http.Header { return http.Header{"Authorization": {"Bearer " + token}} }
+
+	t.Run("token in header", func(t *testing.T) {
+		conn, resp := connect(t, jwtMode, "", bearer(valid))
+		if conn == nil {
+			t.Fatalf("expected the device to be accepted, got %d", resp.StatusCode)
+		}
+		if id := deviceID(t, conn); id != "dev_1" {
+			t.Errorf("expected device dev_1, got %q", id)
+		}
+	})
+
+	t.Run("token in query", func(t *testing.T) {
+		token := sign(secret, jwt.MapClaims{"sub": "dev_2", "exp": time.Now().Add(time.Hour).Unix()})
+		conn, resp := connect(t, jwtMode, "?voice=verse&token="+token, nil)
+		if conn == nil {
+			t.Fatalf("expected the device to be accepted, got %d", resp.StatusCode)
+		}
+		// the subject names the device when the device claim is missing
+		if id := deviceID(t, conn); id != "dev_2" {
+			t.Errorf("expected device dev_2, got %q", id)
+		}
+	})
+
+	t.Run("rejected tokens", func(t *testing.T) {
+		for name, header := range map[string]http.Header{
+			"missing":      nil,
+			"expired":      bearer(sign(secret, jwt.MapClaims{"device_id": "dev_1", "exp": time.Now().Add(-time.Hour).Unix()})),
+			"no expiry":    bearer(sign(secret, jwt.MapClaims{"device_id": "dev_1"})),
+			"wrong secret": bearer(sign(strings.Repeat("x", 32), jwt.MapClaims{"device_id": "dev_1", "exp": time.Now().Add(time.Hour).Unix()})),
+			"no device":    bearer(sign(secret, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()})),
+			"malformed":    bearer("not-a-token"),
+		} {
+			conn, resp := connect(t, jwtMode, "", header)
+			if conn != nil || resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("%s: expected the device to be unauthorized, got %d", name, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("api key", func(t *testing.T) {
+		apiKey := func(cfg *config.Config) {
+			cfg.Auth = config.AuthConfig{Mode: config.AuthAPIKey, APIKeys: []string{"key-1", "key-2"}}
+		}
+		header := bearer("key-2")
+		header.Set("X-Device-ID", "bench_1")
+		conn, resp := connect(t, apiKey, "", header)
+		if conn == nil {
+			t.Fatalf("expected the device to be accepted, got %d", resp.StatusCode)
+		}
+		if id := deviceID(t, conn); id != "bench_1" {
+			t.Errorf("expected device bench_1, got %q", id)
+		}
+		if conn, resp := connect(t, apiKey, "", bearer("key-3")); conn != nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected an unknown key to be unauthorized, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("invalid configuration", func(t *testing.T) {
+		conn, resp := connect(t, func(cfg *config.Config) {
+			cfg.Auth = config.AuthConfig{Mode: config.AuthJWT, JWTSecret: "short"}
+		}, "", bearer(valid))
+		if conn != nil || resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("expected devices to be refused, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("origin", func(t *testing.T) {
+		origins := func(cfg *config.Config) { cfg.Auth.AllowedOrigins = []string{"https://app.pixa.com"} }
+		if conn, _ := connect(t, origins, "", http.Header{"Origin": {"https://app.pixa.com"}}); conn == nil {
+			t.Error("expected an allowed origin to be accepted")
+		}
+		if conn, resp := connect(t, origins, "", http.Header{"Origin": {"https://evil.example"}}); conn != nil || resp.StatusCode != http.StatusForbidden {
+			t.Error("expected an unknown origin to be forbidden")
+		}
+		if conn, _ := connect(t, origins, "", nil); conn == nil {
+			t.Error("expected a device without origin to be accepted")
+		}
+	})
+}
+
+// testPKI is a CA issuing the certificates of a test server and its devices, written to dir
+type testPKI struct {
+	t    *testing.T
+	dir  string
+	ca   *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	// serial is the serial number of the last certificate issued
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test devices CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	p := &testPKI{t: t, dir: t.TempDir(), ca: ca, key: key, pool: x509.NewCertPool(), serial: 1}
+	p.pool.AddCert(ca)
+	p.write("ca.pem", "CERTIFICATE", der)
+	return p
+}
+
+func (p *testPKI) write(name, typ string, der []byte) string {
+	p.t.Helper()
+	path := filepath.Join(p.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		p.t.Fatal(err)
+	}
+	return path
+}
+
+// issue returns a certificate signed by the CA, with template filled in
+func (p *testPKI) issue(template *x509.Certificate) tls.Certificate {
+	p.t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.serial++
+	template.SerialNumber = big.NewInt(p.serial)
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.key)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// revoke writes a revocation list of the CA revoking the certificates and returns its path
+func (p *testPKI) revoke(certs ...tls.Certificate) string {
+	p.t.Helper()
+
+	var entries []x509.RevocationListEntry
+	for _, cert := range certs {
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: leaf.SerialNumber, RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: entries,
+	}, p.ca, p.key)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return p.write("devices.crl", "X509 CRL", der)
+}
+
+func TestMutualTLS(t *testing.T) {
+	srv := realtimetest.NewServer(realtimetest.Scenario{})
+	defer srv.Close()
+
+	pki := newTestPKI(t)
+	serverCertificate := func(name string) tls.Certificate {
+		return pki.issue(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			DNSNames:    []string{"localhost"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+	}
+	// writeServerCertificate writes the certificate and key of the server to the files name.pem and
+	// name.key and returns their paths
+	writeServerCertificate := func(name string, cert tls.Certificate) (string, string) {
+		keyDER, _ := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		return pki.write(name+".pem", "CERTIFICATE", cert.Certificate[0]), pki.write(name+".key", "PRIVATE KEY", keyDER)
+	}
+	deviceURI, _ := url.Parse("urn:pixa:device:dev_7")
+	device := pki.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "dev_7"},
+		URIs:        []*url.URL{deviceURI},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	revoked := pki.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "dev_8"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	crl := pki.revoke(revoked)
+	certFile, keyFile := writeServerCertificate("server", serverCertificate("localhost"))
+
+	// newServer starts a server with mutual TLS set by option
+	newServer := func(t *testing.T, option func(*config.Config)) *httptest.Server {
+		t.Helper()
+		cfg := testConfig(srv)
+		cfg.Server = config.ServerConfig{
+			EnableTLS: true, CertFile: certFile, KeyFile: keyFile, ClientCAFile: filepath.Join(pki.dir, "ca.pem"),
+			ClientAuth: config.ClientAuthRequire, ClientDeviceID: config.CertCommonName, CRLFiles: []string{crl},
+		}
+		option(cfg)
+		tlsConfig, err := auth.NewTLSConfig(cfg.Server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewUnstartedServer(NewHandler(cfg))
+		server.TLS = tlsConfig
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		return server
+	}
+	// the server certificate is only served to the clients naming the server, httptest serves its
+	// own to the others
+	clientTLS := func(certs ...tls.Certificate) *tls.Config {
+		return &tls.Config{RootCAs: pki.pool, Certificates: certs, ServerName: "localhost"}
+	}
+
+	// connect connects a device presenting certs to a server with mutual TLS set by option. It
+	// returns the device ID of the session, or the error of the connection.
+	connect := func(t *testing.T, option func(*config.Config), certs ...tls.Certificate) (string, error) {
+		t.Helper()
+		server := newServer(t, option)
+		dialer := websocket.Dialer{TLSClientConfig: clientTLS(certs...)}
+		conn, _, err := dialer.Dial("wss"+strings.TrimPrefix(server.URL, "https"), nil)
+		if err != nil {
+			return "", err
+		}
+		t.Cleanup(func() { conn.Close() })
+		d := &testDevice{t: t, conn: conn}
+		d.send(`{"type":"status","id":"1"}`)
+		messages, _ := d.readUntil(StatusMessageType)
+		var status StatusMessage
+		if err := json.Unmarshal(messages[StatusMessageType][0], &status); err != nil {
+			t.Fatal(err)
+		}
+		return status.DeviceID, nil
+	}
+	required := func(*config.Config) {}
+
+	t.Run("device certificate", func(t *testing.T) {
+		if id, err := connect(t, required, device); err != nil || id != "dev_7" {
+			t.Fatalf("expected device dev_7, got %q: %v", id, err)
+		}
+	})
+
+	t.Run("device id from san", func(t *testing.T) {
+		id, err := connect(t, func(cfg *config.Config) { cfg.Server.ClientDeviceID = config.CertSANURI }, device)
+		if err != nil || id != "urn:pixa:device:dev_7" {
+			t.Fatalf("expected the device URI, got %q: %v", id, err)
+		}
+	})
+
+	t.Run("certificate required", func(t *testing.T) {
+		if _, err := connect(t, required); err == nil {
+			t.Fatal("expected a device without certificate to be refused")
+		}
+	})
+
+	t.Run("revoked certificate", func(t *testing.T) {
+		if _, err := connect(t, required, revoked); err == nil {
+			t.Fatal("expected a revoked certificate to be refused")
+		}
+	})
+
+	t.Run("optional certificate", func(t *testing.T) {
+		optional := func(cfg *config.Config) {
+			cfg.Server.ClientAuth = config.ClientAuthOptional
+			cfg.Auth = config.AuthConfig{Mode: config.AuthAPIKey, APIKeys: []string{"key-1"}}
+		}
+		if id, err := connect(t, optional, device); err != nil || id != "dev_7" {
+			t.Fatalf("expected device dev_7, got %q: %v", id, err)
+		}
+		// without certificate the device needs the credentials of the auth mode
+		if _, err := connect(t, optional); err == nil {
+			t.Fatal("expected a device without credentials to be refused")
+		}
+	})
+
+	t.Run("certificate rotation", func(t *testing.T) {
+		certFile, keyFile := writeServerCertificate("rotated", serverCertificate("server 1"))
+		server := newServer(t, func(cfg *config.Config) { cfg.Server.CertFile, cfg.Server.KeyFile = certFile, keyFile })
+		serverName := func() string {
+			t.Helper()
+			conn, err := tls.Dial("tcp", server.Listener.Addr().String(), clientTLS(device))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}
+		if name := serverName(); name != "server 1" {
+			t.Fatalf("expected the first certificate, got %q", name)
+		}
+
+		writeServerCertificate("rotated", serverCertificate("server 2"))
+		// make sure the files look modified on file systems with a coarse clock
+		later := time.Now().Add(time.Minute)
+		for _, file := range []string{certFile, keyFile} {
+			if err := os.Chtimes(file, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if name := serverName(); name != "server 2" {
+			t.Fatalf("expected the rotated certificate, got %q", name)
+		}
+	})
+}
+
+func TestControlMessages(t *testing.T) {
+	cfg := &config.Config{
+		Websocket: config.WebsocketConfig{PingInterval: "30s"},
+		Audio:     config.AudioConfig{SampleRate: 16000, Channels: 2, AudioFormat: config.PCM16, MP3Bitrate: 32, OpusBitrate: 24, OpusFraming: config.OpusFramingRaw},
+	}
+	h := NewHandler(cfg)
+
+	t.Run("session.configure is forwarded", func(t *testing.T) {
+		f := &fakeAIClient{}
+		reply := h.dispatchControlMessage(&session{aiClient: f}, []byte(`{"type":"session.configure","id":"1","voice":"alloy"}`))
+		ack, ok := reply.(AckMessage)
+		if !ok || ack.ID != "1" || ack.RequestType != SessionConfigureMessageType {
+			t.Fatalf("unexpected reply: %#v", reply)
+		}
+		if len(f.updates) != 1 || f.updates[0].Voice == nil || *f.updates[0].Voice != "alloy" {
+			t.Fatalf("session update not forwarded: %#v", f.updates)
+		}
+	})
+
+	t.Run("commit, clear and cancel are forwarded", func(t *testing.T) {
+		f := &fakeAIClient{}
+		s := &session{aiClient: f, responseActive: true}
+		h.dispatchControlMessage(s, []byte(`{"type":"input.commit"}`))
+		h.dispatchControlMessage(s, []byte(`{"type":"input.clear"}`))
+		h.dispatchControlMessage(s, []byte(`{"type":"response.cancel"}`))
+		if f.commits != 1 || f.clears != 1 || f.cancels != 1 {
+			t.Fatalf("unexpected calls: %#v", f)
+		}
+	})
+
+	t.Run("ping and status", func(t *testing.T) {
+		f := &fakeAIClient{}
+		if reply := h.dispatchControlMessage(&session{aiClient: f}, []byte(`{"type":"ping","id":"p"}`)); reply != (ControlMessageBase{Type: PongMessageType, ID: "p"}) {
+			t.Fatalf("unexpected ping reply: %#v", reply)
+		}
+		status, ok := h.dispatchControlMessage(&session{aiClient: f, client: &Client{config: cfg}}, []byte(`{"type":"status"}`)).(StatusMessage)
+		if !ok || status.Audio.SampleRate != 16000 || status.Audio.Channels != 2 {
+			t.Fatalf("unexpected status reply: %#v", status)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cases := []struct {
+			name string
+			msg  string
+			code string
+		}{
+			{"malformed json", `{"type":`, ErrCodeInvalidJSON},
+			{"missing type", `{"id":"1"}`, ErrCodeInvalidPayload},
+			{"unknown type", `{"type":"dance"}`, ErrCodeUnknownType},
+			{"bad payload", `{"type":"session.configure","temperature":"hot"}`, ErrCodeInvalidPayload},
+			{"invalid session", `{"type":"session.configure","temperature":5}`, ErrCodeInvalidPayload},
+		}
+		for _, c := range cases {
+			reply := h.dispatchControlMessage(&session{aiClient: &fakeAIClient{}}, []byte(c.msg))
+			if e, ok := reply.(ErrorMessage); !ok || e.Code != c.code {
+				t.Errorf("%s: expected error code %s, got %#v", c.name, c.code, reply)
+			}
+		}
+
+		reply := h.dispatchControlMessage(&session{aiClient: &fakeAIClient{failWrite: true}}, []byte(`{"type":"session.configure"}`))
+		if e, ok := reply.(ErrorMessage); !ok || e.Code != ErrCodeUpstream {
+			t.Fatalf("expected upstream error, got %#v", reply)
+		}
+	})
+}
+
+func TestSessionParams(t *testing.T) {
+	q, _ := url.ParseQuery("voice=verse&modalities=text&temperature=0.7&max_output_tokens=200&turn_detection=none&silence_duration_ms=800")
+	u, err := sessionUpdateFromQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *u.Voice != "verse" || !slices.Equal(u.Modalities, []string{"text"}) || *u.Temperature != 0.7 ||
+		*u.MaxOutputTokens != 200 || *u.TurnDetection != "none" || *u.SilenceDurationMs != 800 || u.VADThreshold != nil {
+		t.Fatalf("unexpected session update: %#v", u)
+	}
+
+	if _, err := sessionUpdateFromQuery(url.Values{"temperature": {"hot"}}); err == nil {
+		t.Fatal("expected an error for a malformed temperature")
+	}
+
+	srv := realtimetest.NewServer(realtimetest.EchoScenario())
+	defer srv.Close()
+	server := httptest.NewServer(NewHandler(testConfig(srv)))
+	defer server.Close()
+	for query, status := range map[string]int{"voice=nobody": http.StatusBadRequest, "temperature=5": http.StatusBadRequest} {
+		_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/?"+query, nil)
+		if err == nil || resp == nil || resp.StatusCode != status {
+			t.Errorf("%s: expected status %d, got %v", query, status, resp)
+		}
+	}
+
+	// 0 is a value of its own, it must not be replaced by the defaults
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/?voice=verse&vad_threshold=0&silence_duration_ms=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	e, ok := srv.WaitForEvent("session.update", 1, 2*time.Second)
+	if !ok {
+		t.Fatal("session was not configured")
+	}
+	if raw := string(e.Raw); !strings.Contains(raw, `"voice":"verse"`) || !strings.Contains(raw, `"threshold":0,`) ||
+		!strings.Contains(raw, `"silence_duration_ms":0`) || !strings.Contains(raw, `"prefix_padding_ms":300`) {
+		t.Fatalf("session parameters not sent to the model: %s", raw)
+	}
+}
+
+func TestEventMessages(t *testing.T) {
+	if msg := eventMessage(ai.Event{Type: ai.SpeechStartedEventType}); msg != (ControlMessageBase{Type: SpeechStartedMessageType}) {
+		t.Errorf("unexpected speech.started message: %#v", msg)
+	}
+
+	done, ok := eventMessage(ai.Event{Type: ai.ResponseDoneEventType, ResponseID: "resp_1", ResponseStatus: "completed"}).(ResponseMessage)
+	if !ok || done.Type != ResponseDoneMessageType || done.ResponseID != "resp_1" || done.Status != "completed" {
+		t.Errorf("unexpected response.done message: %#v", done)
+	}
+
+	e, ok := eventMessage(ai.Event{Type: ai.ErrorEventType, Error: &ai.ErrorDetail{Message: "rate limited"}}).(ErrorMessage)
+	if !ok || e.Code != ErrCodeModel || e.Message != "rate limited" {
+		t.Errorf("unexpected error message: %#v", e)
+	}
+
+	if msg := eventMessage(ai.Event{Type: ai.AudioBufferClearedEventType}); msg != nil {
+		t.Errorf("expected cleared event to be dropped, got %#v", msg)
+	}
+}
+
+func TestTranscriptMessage(t *testing.T) {
+	raw, err := json.Marshal(transcriptMessage(ai.Transcript{Role: ai.AssistantRole, ItemID: "item_1", Text: "Hel"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"type":"transcript","role":"assistant","item_id":"item_1","text":"Hel","final":false}`; string(raw) != expected {
+		t.Fatalf("expected %s, got %s", expected, raw)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	t.Run("nothing to interrupt", func(t *testing.T) {
+		f := &fakeAIClient{}
+		s := &session{aiClient: f}
+		if err := s.interrupt(); err != nil {
+			t.Fatal(err)
+		}
+		if f.cancels != 0 || len(f.truncated) != 0 || s.dropAudio() {
+			t.Fatalf("expected no interruption, got %#v", f)
+		}
+	})
+
+	t.Run("response in flight", func(t *testing.T) {
+		f := &fakeAIClient{}
+		s := &session{aiClient: f}
+		s.responseStarted()
+		if err := s.interrupt(); err != nil {
+			t.Fatal(err)
+		}
+		if f.cancels != 1 || !s.dropAudio() {
+			t.Fatalf("expected response to be cancelled, got %#v", f)
+		}
+		s.responseStarted()
+		if s.dropAudio() {
+			t.Fatal("expected audio of the next response to be kept")
+		}
+	})
+
+	t.Run("full queue", func(t *testing.T) {
+		// 20s of audio sent at once, the queue of 200ms fills up right away
+		d := newTestDevice(t, realtimetest.Scenario{Turns: []realtimetest.Turn{
+			{Response: realtimetest.Response{Audio: make([]byte, ai.SampleRate*2*20)}},
+			{},
+		}}, func(cfg *config.Config) {
+			cfg.Audio.Channels = 1
+			cfg.Websocket.MaxMessageQueue = 10
+		})
+		d.speak()
+		d.readUntil(ResponseStartedMessageType)
+		time.Sleep(300 * time.Millisecond)
+
+		start := time.Now()
+		d.speak()
+		d.readUntil(PlaybackStopMessageType)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("expected the barge-in to stop the playback right away, took %s", elapsed)
+		}
+	})
+
+	// the codec and the resampler hold back some of the interrupted response, none of it may be
+	// sent with the next one
+	for _, format := range []config.AudioFormat{config.MP3, config.IMAADPCM} {
+		t.Run(fmt.Sprintf("%s state", format), func(t *testing.T) {
+			srv := realtimetest.NewServer(realtimetest.Scenario{})
+			defer srv.Close()
+			cfg := testConfig(srv)
+			cfg.Audio.Channels = 1
+			cfg.Audio.AudioFormat = format
+			s, err := newSession(NewClient(nil, nil, cfg), auth.Identity{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.aiClient = &fakeAIClient{}
+
+			// 130ms of a loud tone, which leaves part of an MP3 frame and of an ADPCM group held back
+			speech := make([]float32, ai.SampleRate*13/100)
+			for i := range speech {
+				speech[i] = float32(0.8 * math.Sin(2*math.Pi*440*float64(i)/ai.SampleRate))
+			}
+			s.responseStarted()
+			a, err := s.toDevice(audio.FromFloat32(speech, ai.SampleRate, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.encodeResponse(a.AsPCM16()); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.interrupt(); err != nil {
+				t.Fatal(err)
+			}
+
+			s.responseStarted()
+			a, err = s.toDevice(audio.FromFloat32(make([]float32, ai.SampleRate), ai.SampleRate, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs, err := s.encodeResponse(a.AsPCM16())
+			if err != nil || len(msgs) == 0 {
+				t.Fatalf("expected the next response to be encoded, got %d messages: %v", len(msgs), err)
+			}
+			var next audio.Audio
+			if format == config.MP3 {
+				next, err = audio.NewMP3Decoder().Decode(msgs[0])
+			} else {
+				next, err = audio.FromIMAADPCM(msgs[0], 16000, 1)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			peak := 0.0
+			for _, sample := range next.AsFloat32() {
+				peak = max(peak, math.Abs(float64(sample)))
+			}
+			if len(next.AsFloat32()) == 0 || peak > 0.01 {
+				t.Fatalf("expected the first frame of the next response to be silent, got %d samples with a peak of %f", len(next.AsFloat32()), peak)
+			}
+		})
+	}
+}
+
+func TestEchoProvider(t *testing.T) {
+	d := newTestDevice(t, realtimetest.Scenario{}, func(cfg *config.Config) {
+		cfg.AIConfig.Provider = config.ProviderEcho
+		cfg.Audio.Channels = 1
+	})
+
+	// a second of speech makes a turn
+	speech := make([]float32, 16000)
+	for i := range speech {
+		speech[i] = float32(0.25 * math.Sin(2*math.Pi*440*float64(i)/16000))
+	}
+	a := audio.FromFloat32(speech, 16000, 1)
+	pcm := a.AsPCM16()
+	for i := 0; i < len(pcm); i += 3200 {
+		if err := d.conn.WriteMessage(websocket.BinaryMessage, pcm[i:i+3200]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the device keeps streaming its microphone while the reply plays
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := d.conn.WriteMessage(websocket.BinaryMessage, make([]byte, 1600*2)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	messages, audioBytes := d.readUntil(ResponseDoneMessageType)
+	var response ResponseMessage
+	json.Unmarshal(messages[ResponseDoneMessageType][0], &response)
+	if response.Status != "completed" || len(messages[PlaybackStopMessageType]) != 0 {
+		t.Fatalf("expected the reply not to be interrupted, got %s", messages[ResponseDoneMessageType][0])
+	}
+	if audioBytes = d.readAudio(audioBytes, 32000); audioBytes < 32000 {
+		t.Fatalf("expected the second of speech back, got %d bytes", audioBytes)
+	}
+}
+
+func TestPlaybackClock(t *testing.T) {
+	p := playbackClock{bytesPerSecond: 32000}
+	if _, playing := p.position(); playing {
+		t.Fatal("expected no playback before audio is sent")
+	}
+	if wait := p.wait(32000, 0); wait != 0 {
+		t.Fatalf("expected the first frame to be sent right away, got a wait of %v", wait)
+	}
+
+	// one second of audio was just sent, so the device is still playing it
+	p.add(32000)
+	pos, playing := p.position()
+	if !playing || pos > time.Second {
+		t.Fatalf("unexpected position %v, playing %v", pos, playing)
+	}
+	// the next second can only be sent once the device is less than the lead away from playing it
+	if wait := p.wait(32000, 200*time.Millisecond); wait < 1700*time.Millisecond || wait > 1800*time.Millisecond {
+		t.Fatalf("expected to wait about 1.8s, got %v", wait)
+	}
+
+	// all audio sent so far has been played
+	p.startedAt = time.Now().Add(-2 * time.Second)
+	pos, playing = p.position()
+	if playing || pos != time.Second {
+		t.Fatalf("unexpected position %v, playing %v", pos, playing)
+	}
+
+	// the device ran out of audio a second ago, it plays on from where it stopped
+	if gap := p.add(16000); gap < time.Second || gap > 1100*time.Millisecond {
+		t.Fatalf("expected an underrun of a second, got %v", gap)
+	}
+	if pos, playing = p.position(); !playing || pos < time.Second || pos > 1100*time.Millisecond {
+		t.Fatalf("unexpected position %v, playing %v", pos, playing)
+	}
+
+	// the position of the next response starts from its first frame, the pause before it is no underrun
+	p.end()
+	p.startedAt = time.Now().Add(-3 * time.Second)
+	if gap := p.add(32000); gap != 0 {
+		t.Fatalf("expected no underrun between responses, got %v", gap)
+	}
+	if pos, playing = p.position(); !playing || pos > 100*time.Millisecond {
+		t.Fatalf("unexpected position %v, playing %v", pos, playing)
+	}
+}
+
+// turnLatencyCount returns the number of latencies observed for stage
+func turnLatencyCount(t *testing.T, stage string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := metrics.TurnLatency.WithLabelValues(stage).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestTurnLatency(t *testing.T) {
+	var l turnLatency
+	start := time.Now()
+	if _, ok := l.reach(stageResponseCreated, start); ok {
+		t.Error("expected no latency before the user stopped talking")
+	}
+
+	l.start(start)
+	if d, ok := l.reach(stageResponseCreated, start.Add(100*time.Millisecond)); !ok || d != 100*time.Millisecond {
+		t.Errorf("expected a latency of 100ms, got %v", d)
+	}
+	// a response following a tool call does not count again
+	if _, ok := l.reach(stageResponseCreated, start.Add(time.Second)); ok {
+		t.Error("expected only the first response of the turn to count")
+	}
+	l.reach(stageFirstDeviceWrite, start.Add(300*time.Millisecond))
+
+	l.start(start.Add(2 * time.Second))
+	l.reach(stageFirstDeviceWrite, start.Add(2500*time.Millisecond))
+
+	stats := l.stats[stageFirstDeviceWrite]
+	if l.turns != 2 || stats.count != 2 || stats.total/2 != 400*time.Millisecond || stats.max != 500*time.Millisecond {
+		t.Errorf("unexpected summary: %d turns, %+v", l.turns, *stats)
+	}
+	if _, ok := l.stats[stageAudioDone]; ok {
+		t.Error("expected no latency for stages not reached")
+	}
+}
+
+func TestChannelMixing(t *testing.T) {
+	srv := realtimetest.NewServer(realtimetest.Scenario{})
+	defer srv.Close()
+	cfg := testConfig(srv)
+	cfg.Audio.Channels = 4
+	// one second with a full scale tone on the third channel only
+	frames := make([]float32, 16000*4)
+	for i := 2; i < len(frames); i += 4 {
+		frames[i] = float32(math.Sin(2 * math.Pi * 400 * float64(i/4) / 16000))
+	}
+	loudness := func(cfg *config.Config) float64 {
+		s, err := newSession(NewClient(nil, nil, cfg), auth.Identity{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := s.toModel(audio.FromFloat32(frames, 16000, 4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.GetChannels() != 1 || a.GetSampleRate() != ai.SampleRate {
+			t.Fatalf("model got %d channels at %d Hz", a.GetChannels(), a.GetSampleRate())
+		}
+		var peak float64
+		for _, s := range a.AsFloat32() {
+			peak = max(peak, math.Abs(float64(s)))
+		}
+		return peak
+	}
+
+	if peak := loudness(cfg); peak < 0.2 || peak > 0.3 {
+		t.Errorf("expected the channels to be averaged, got a peak of %f", peak)
+	}
+	cfg.Audio.InputChannel = 3
+	if peak := loudness(cfg); peak < 0.9 {
+		t.Errorf("expected the third channel to be selected, got a peak of %f", peak)
+	}
+	cfg.Audio.InputChannel = 1
+	if peak := loudness(cfg); peak > 0.01 {
+		t.Errorf("expected the first channel to be selected, got a peak of %f", peak)
+	}
+	cfg.Audio.InputChannel, cfg.Audio.InputWeights = 0, []float64{0, 0, 0.5, 0}
+	if peak := loudness(cfg); peak < 0.45 || peak > 0.55 {
+		t.Errorf("expected the third channel at half gain, got a peak of %f", peak)
+	}
+}
+
+func TestResponseQueue(t *testing.T) {
+	ctx := context.Background()
+	frames := func(b *utils.BufferSizeController) []byte {
+		var firsts []byte
+		for {
+			c, ok := b.Next()
+			if !ok {
+				return firsts
+			}
+			if len(c.Data) > 0 {
+				firsts = append(firsts, c.Data[0])
+			}
+		}
+	}
+	// five chunks of 2 bytes numbered from 1, the last one ending the stream
+	fill := func(b *utils.BufferSizeController) {
+		if err := b.Write(ctx, []byte{1, 1, 2, 2, 3, 3, 4, 4, 5, 5}); err != nil {
+			t.Fatal(err)
+		}
+		b.Flush()
+	}
+
+	b := utils.NewBufferSizeController(2, 3, utils.DropOldest)
+	fill(&b)
+	if got := frames(&b); !bytes.Equal(got, []byte{2, 3, 4, 5}) {
+		t.Errorf("drop_oldest: got chunks %v", got)
+	}
+	if stats := b.Stats(); stats.DroppedChunks != 1 || stats.DroppedBytes != 2 || stats.Queued != 0 {
+		t.Errorf("drop_oldest: unexpected stats %+v", stats)
+	}
+
+	b = utils.NewBufferSizeController(2, 3, utils.DropNewest)
+	fill(&b)
+	// the end of the stream is queued even when the queue is full
+	if got := frames(&b); !bytes.Equal(got, []byte{1, 2, 3, 5}) {
+		t.Errorf("drop_newest: got chunks %v", got)
+	}
+
+	b = utils.NewBufferSizeController(2, 3, utils.Block)
+	done := make(chan struct{})
+	go func() {
+		fill(&b)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected the write to wait for room in the queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	var got []byte
+	for len(got) < 5 {
+		<-b.Ready()
+		got = append(got, frames(&b)...)
+	}
+	<-done
+	if !bytes.Equal(got, []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("block: got chunks %v", got)
+	}
+
+	// a blocked write gives up when its context is done
+	b = utils.NewBufferSizeController(2, 1, utils.Block)
+	cancelled, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := b.Write(cancelled, []byte{1, 1, 2, 2, 3, 3}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the write to stop with its context, got %v", err)
+	}
 }
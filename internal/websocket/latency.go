@@ -0,0 +1,87 @@
+package websocket
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Stages of a turn, in the order they usually happen after the user stops talking
+const (
+	stageResponseCreated  = "response_created"
+	stageFirstAudioDelta  = "first_audio_delta"
+	stageFirstDeviceWrite = "first_device_write"
+	stageAudioDone        = "audio_done"
+)
+
+var turnStages = []string{stageResponseCreated, stageFirstAudioDelta, stageFirstDeviceWrite, stageAudioDone}
+
+// turnLatency measures how long after the end of the speech of the user each stage of the response
+// is reached. A turn lasts until the user stops talking again, so the stages of a response that
+// follows a tool call count for the turn that made the call. Only the first time a stage is reached
+// in a turn counts.
+type turnLatency struct {
+	// speechStopped is when the current turn started, zero before the first one
+	speechStopped time.Time
+	// reached holds the stages reached in the current turn
+	reached map[string]bool
+	turns   int
+	stats   map[string]*latencyStats
+}
+
+// latencyStats summarize the latencies of a stage over the turns of a session
+type latencyStats struct {
+	count int
+	total time.Duration
+	max   time.Duration
+}
+
+// start records that the user stopped talking at now, which starts a turn
+func (l *turnLatency) start(now time.Time) {
+	l.speechStopped = now
+	l.reached = make(map[string]bool)
+	l.turns++
+}
+
+// awaitingResponse reports whether the user finished a turn and no response was created for it yet
+func (l *turnLatency) awaitingResponse() bool {
+	return !l.speechStopped.IsZero() && !l.reached[stageResponseCreated]
+}
+
+// reach records that stage was reached at now. It returns the latency of the stage and true the
+// first time the stage is reached in a turn.
+func (l *turnLatency) reach(stage string, now time.Time) (time.Duration, bool) {
+	if l.speechStopped.IsZero() || l.reached[stage] {
+		return 0, false
+	}
+	l.reached[stage] = true
+	d := now.Sub(l.speechStopped)
+	if l.stats == nil {
+		l.stats = make(map[string]*latencyStats)
+	}
+	stats, ok := l.stats[stage]
+	if !ok {
+		stats = &latencyStats{}
+		l.stats[stage] = stats
+	}
+	stats.count++
+	stats.total += d
+	stats.max = max(stats.max, d)
+	return d, true
+}
+
+// summary returns the attributes of the log line summing up the latencies of the session: the
+// number of turns and the average and maximum latency of each stage reached
+func (l *turnLatency) summary() []any {
+	attrs := []any{"turns", l.turns}
+	for _, stage := range turnStages {
+		stats, ok := l.stats[stage]
+		if !ok {
+			continue
+		}
+		attrs = append(attrs, slog.Group(stage,
+			"count", stats.count,
+			"avg", stats.total/time.Duration(stats.count),
+			"max", stats.max))
+	}
+	return attrs
+}
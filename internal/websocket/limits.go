@@ -0,0 +1,135 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pixaverse-studios/websocket-server/internal/config"
+	"github.com/pixaverse-studios/websocket-server/internal/metrics"
+	"golang.org/x/time/rate"
+)
+
+// audioRateBurst is how many seconds of audio a device can send ahead of the audio rate limit, so
+// that it can catch up after a network stall
+const audioRateBurst = 2
+
+// limitError is a limit reached by a device, Code is the close code of its connection
+type limitError struct {
+	Code   int
+	Reason CloseReason
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("%s limit reached", e.Reason.Limit)
+}
+
+// limits enforces config.LimitsConfig across the sessions of a handler
+type limits struct {
+	config config.LimitsConfig
+	// upgrades limits the rate of the connections accepted, nil when unlimited
+	upgrades *rate.Limiter
+
+	mu       sync.Mutex
+	sessions int
+	devices  map[string]int
+	ips      map[string]int
+}
+
+func newLimits(cfg config.LimitsConfig) *limits {
+	l := &limits{config: cfg, devices: make(map[string]int), ips: make(map[string]int)}
+	if cfg.UpgradeRate > 0 {
+		l.upgrades = rate.NewLimiter(rate.Limit(cfg.UpgradeRate), cfg.UpgradeBurst)
+	}
+	return l
+}
+
+// acquire reserves a session for the device with deviceID connecting from ip, the device ID being
+// empty when the device has none. It returns the function releasing the session, or the limit
+// the device reached.
+func (l *limits) acquire(deviceID, ip string) (func(), *limitError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case reached(l.sessions, l.config.MaxSessions):
+		return nil, &limitError{websocket.CloseTryAgainLater, CloseReason{Limit: LimitSessions}}
+	case deviceID != "" && reached(l.devices[deviceID], l.config.MaxSessionsPerDevice):
+		return nil, &limitError{websocket.CloseTryAgainLater, CloseReason{Limit: LimitSessionsPerDevice}}
+	case reached(l.ips[ip], l.config.MaxSessionsPerIP):
+		return nil, &limitError{websocket.CloseTryAgainLater, CloseReason{Limit: LimitSessionsPerIP}}
+	}
+	// the connections refused for the other limits do not use up the rate
+	if l.upgrades != nil && !l.upgrades.Allow() {
+		retryAfter := int(math.Ceil(1 / l.config.UpgradeRate))
+		return nil, &limitError{websocket.CloseTryAgainLater, CloseReason{Limit: LimitUpgradeRate, RetryAfter: retryAfter}}
+	}
+
+	l.sessions++
+	l.devices[deviceID]++
+	l.ips[ip]++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		l.sessions--
+		release(l.devices, deviceID)
+		release(l.ips, ip)
+	}, nil
+}
+
+func reached(count, limit int) bool {
+	return limit > 0 && count >= limit
+}
+
+func release(counts map[string]int, key string) {
+	if counts[key]--; counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+// audioLimiter returns the limiter of the audio a session receives, nil when unlimited
+func (l *limits) audioLimiter() *rate.Limiter {
+	if l.config.MaxAudioBytesPerSecond == 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(l.config.MaxAudioBytesPerSecond), l.config.MaxAudioBytesPerSecond*audioRateBurst)
+}
+
+// allowAudio returns an error when the device of s sent n bytes of audio above the rate limit
+func (s *session) allowAudio(n int) *limitError {
+	if s.audioRate == nil || s.audioRate.AllowN(time.Now(), n) {
+		return nil
+	}
+	return &limitError{websocket.ClosePolicyViolation, CloseReason{Limit: LimitAudioRate}}
+}
+
+// closeLimited closes the connection of a device that reached a limit, telling it which one
+func (h *Handler) closeLimited(client *Client, err *limitError) {
+	metrics.LimitBreaches.WithLabelValues(err.Reason.Limit).Inc()
+	reason, _ := json.Marshal(err.Reason)
+	client.CloseWith(err.Code, string(reason))
+}
+
+// clientIP returns the IP address of the device making r, taken from header when set
+func clientIP(r *http.Request, header string) string {
+	if header != "" {
+		if values := r.Header.Values(header); len(values) > 0 {
+			addresses := strings.Split(values[len(values)-1], ",")
+			if ip := strings.TrimSpace(addresses[len(addresses)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
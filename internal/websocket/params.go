@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pixaverse-studios/websocket-server/internal/ai"
+)
+
+// sessionUpdateFromQuery reads the session parameters a device can set when it connects, e.g.
+// ws://server/?voice=verse&temperature=0.7&turn_detection=none
+//
+// Supported parameters: voice, modalities (comma separated), temperature, max_output_tokens,
+// turn_detection, vad_threshold, prefix_padding_ms and silence_duration_ms.
+func sessionUpdateFromQuery(q url.Values) (ai.SessionUpdate, error) {
+	var u ai.SessionUpdate
+	var err error
+
+	if v := q.Get("voice"); v != "" {
+		u.Voice = &v
+	}
+	if v := q.Get("modalities"); v != "" {
+		u.Modalities = strings.Split(v, ",")
+	}
+	if v := q.Get("turn_detection"); v != "" {
+		u.TurnDetection = &v
+	}
+	if u.Temperature, err = floatParam(q, "temperature"); err != nil {
+		return u, err
+	}
+	if u.VADThreshold, err = floatParam(q, "vad_threshold"); err != nil {
+		return u, err
+	}
+	if u.MaxOutputTokens, err = intParam(q, "max_output_tokens"); err != nil {
+		return u, err
+	}
+	if u.PrefixPaddingMs, err = intParam(q, "prefix_padding_ms"); err != nil {
+		return u, err
+	}
+	if u.SilenceDurationMs, err = intParam(q, "silence_duration_ms"); err != nil {
+		return u, err
+	}
+	return u, nil
+}
+
+func floatParam(q url.Values, name string) (*float64, error) {
+	v := q.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return &f, nil
+}
+
+func intParam(q url.Values, name string) (*int, error) {
+	v := q.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return &i, nil
+}
@@ -0,0 +1,318 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pixaverse-studios/websocket-server/internal/ai"
+)
+
+// The device talks to the server over a single WebSocket. Binary frames carry audio in the
+// configured audio format, text frames carry JSON control messages described in this file.
+//
+// Every control message is a JSON object with a "type" field and an optional "id" field. When a
+// device sets "id" on a request, the server echoes it on the reply so the device can correlate
+// them.
+//
+// Device -> server:
+//
+//	{"type": "session.configure", "id": "1", "instructions": "...", "voice": "alloy", "temperature": 0.8,
+//	 "modalities": ["audio", "text"], "max_output_tokens": 500, "turn_detection": "server_vad",
+//	 "vad_threshold": 0.5, "prefix_padding_ms": 300, "silence_duration_ms": 500}
+//	{"type": "response.cancel", "id": "2"}
+//	{"type": "input.commit", "id": "3"}
+//	{"type": "input.clear", "id": "4"}
+//	{"type": "ping", "id": "5"}
+//	{"type": "status", "id": "6"}
+//	{"type": "tool.result", "call_id": "call_1", "output": {"level": 80, "charging": false}}
+//	{"type": "tool.result", "call_id": "call_2", "error": "timer limit reached"}
+//
+// Server -> device:
+//
+//	{"type": "ack", "id": "1", "request_type": "session.configure"}
+//	{"type": "pong", "id": "5"}
+//	{"type": "status", "id": "6", "device_id": "dev_1", "audio": {"sample_rate": 16000, "channels": 2, "format": "pcm_16"}}
+//	{"type": "error", "id": "1", "code": "invalid_payload", "message": "..."}
+//
+// The server also forwards events from the model as they happen, so the device can reflect the
+// state of the conversation (listening while the user speaks, thinking between speech.stopped
+// and the first audio frame, speaking until response.audio_done):
+//
+//	{"type": "speech.started"}
+//	{"type": "speech.stopped"}
+//	{"type": "response.started", "response_id": "resp_1"}
+//	{"type": "response.audio_done"}
+//	{"type": "response.done", "response_id": "resp_1", "status": "completed"}
+//	{"type": "error", "code": "model_error", "message": "..."}
+//
+// When the user starts speaking while a response is playing, or the device sends response.cancel,
+// the server stops sending the response audio and asks the device to drop the audio it has
+// buffered but not played yet:
+//
+//	{"type": "playback.stop"}
+//
+// Transcripts of both sides of the conversation are forwarded as captions. Assistant transcripts
+// are streamed as they are generated and end with a message that has "final" set to true and the
+// full text, user transcripts are only sent once final:
+//
+//	{"type": "transcript", "role": "assistant", "item_id": "item_1", "text": "Hel", "final": false}
+//	{"type": "transcript", "role": "user", "item_id": "item_0", "text": "Hello there", "final": true}
+//
+// Some of the tools the model can call are actions on the device. The server sends the call and
+// the device has to answer with a tool.result message carrying the same call_id, either with an
+// "output" JSON value or an "error" string:
+//
+//	{"type": "tool.call", "call_id": "call_1", "name": "get_battery", "arguments": {}}
+//
+// When the connection to the model drops, the server reconnects on its own and keeps the audio the
+// device sends in the meantime. The device is kept informed; after "failed" the server closes the
+// connection:
+//
+//	{"type": "upstream.status", "status": "reconnecting", "attempt": 1}
+//	{"type": "upstream.status", "status": "connected"}
+//	{"type": "upstream.status", "status": "failed"}
+//
+// When the server shuts down, it lets the response in progress finish, asks the device to connect
+// again, to another server, and closes the connection with the 1001 (going away) close code:
+//
+//	{"type": "server.going_away", "reason": "shutdown"}
+//
+// When a device reaches a limit of the server, its connection is closed with a JSON close reason
+// naming the limit. The limits on the sessions and connections use the 1013 (try again later) close
+// code, the device can connect again later, after retry_after seconds when it is given. A device
+// sending audio faster than allowed is closed with the 1008 (policy violation) code:
+//
+//	1013 {"limit": "sessions"}
+//	1013 {"limit": "sessions_per_device"}
+//	1013 {"limit": "sessions_per_ip"}
+//	1013 {"limit": "upgrade_rate", "retry_after": 1}
+//	1008 {"limit": "audio_rate"}
+
+// ControlMessageType identifies a JSON control message exchanged with the device
+type ControlMessageType string
+
+const (
+	// device -> server
+	SessionConfigureMessageType ControlMessageType = "session.configure"
+	ResponseCancelMessageType   ControlMessageType = "response.cancel"
+	InputCommitMessageType      ControlMessageType = "input.commit"
+	InputClearMessageType       ControlMessageType = "input.clear"
+	PingMessageType             ControlMessageType = "ping"
+	StatusMessageType           ControlMessageType = "status"
+	ToolResultMessageType       ControlMessageType = "tool.result"
+
+	// server -> device
+	AckMessageType   ControlMessageType = "ack"
+	PongMessageType  ControlMessageType = "pong"
+	ErrorMessageType ControlMessageType = "error"
+
+	// model events forwarded to the device
+	SpeechStartedMessageType     ControlMessageType = "speech.started"
+	SpeechStoppedMessageType     ControlMessageType = "speech.stopped"
+	ResponseStartedMessageType   ControlMessageType = "response.started"
+	ResponseAudioDoneMessageType ControlMessageType = "response.audio_done"
+	ResponseDoneMessageType      ControlMessageType = "response.done"
+	PlaybackStopMessageType      ControlMessageType = "playback.stop"
+	TranscriptMessageType        ControlMessageType = "transcript"
+	ToolCallMessageType          ControlMessageType = "tool.call"
+	UpstreamStatusMessageType    ControlMessageType = "upstream.status"
+	GoingAwayMessageType         ControlMessageType = "server.going_away"
+)
+
+// Statuses of the connection to the model reported in UpstreamStatusMessage
+const (
+	UpstreamReconnecting = "reconnecting"
+	UpstreamConnected    = "connected"
+	UpstreamFailed       = "failed"
+)
+
+// Error codes sent to the device in ErrorMessage.Code
+const (
+	ErrCodeInvalidJSON    = "invalid_json"
+	ErrCodeUnknownType    = "unknown_type"
+	ErrCodeInvalidPayload = "invalid_payload"
+	ErrCodeUpstream       = "upstream_error"
+	ErrCodeModel          = "model_error"
+	ErrCodeUnknownCall    = "unknown_call"
+)
+
+// Limits reported in CloseReason.Limit
+const (
+	LimitSessions          = "sessions"
+	LimitSessionsPerDevice = "sessions_per_device"
+	LimitSessionsPerIP     = "sessions_per_ip"
+	LimitUpgradeRate       = "upgrade_rate"
+	LimitAudioRate         = "audio_rate"
+)
+
+// CloseReason is the reason of the close frame sent to a device that reached a limit, encoded as JSON
+type CloseReason struct {
+	Limit string `json:"limit"`
+	// RetryAfter is the number of seconds to wait before connecting again, 0 when unknown
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// ControlMessageBase represents the fields shared by all control messages
+type ControlMessageBase struct {
+	Type ControlMessageType `json:"type"`
+	ID   string             `json:"id,omitempty"`
+}
+
+// SessionConfigureMessage asks the server to change the parameters of the ongoing AI session. It
+// accepts the fields of ai.SessionUpdate, fields that are omitted are left unchanged.
+type SessionConfigureMessage struct {
+	ControlMessageBase
+	ai.SessionUpdate
+}
+
+// ToolResultMessage is the answer of the device to a ToolCallMessage
+type ToolResultMessage struct {
+	ControlMessageBase
+	CallID string          `json:"call_id"`
+	Output json.RawMessage `json:"output,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// ToolCallMessage asks the device to run one of its tools
+type ToolCallMessage struct {
+	ControlMessageBase
+	CallID    string          `json:"call_id"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// AckMessage confirms that a device request has been forwarded to the model
+type AckMessage struct {
+	ControlMessageBase
+	RequestType ControlMessageType `json:"request_type"`
+}
+
+// StatusMessage describes the current state of the session
+type StatusMessage struct {
+	ControlMessageBase
+	// DeviceID is the ID the device authenticated with
+	DeviceID string      `json:"device_id,omitempty"`
+	Audio    AudioStatus `json:"audio"`
+}
+
+// AudioStatus is the audio configuration the server expects from and sends to the device
+type AudioStatus struct {
+	SampleRate int    `json:"sample_rate"`
+	Channels   int    `json:"channels"`
+	Format     string `json:"format"`
+}
+
+// ErrorMessage reports a failed or rejected device request
+type ErrorMessage struct {
+	ControlMessageBase
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ResponseMessage notifies the device that a model response started or finished
+type ResponseMessage struct {
+	ControlMessageBase
+	ResponseID string `json:"response_id,omitempty"`
+	Status     string `json:"status,omitempty"`
+}
+
+// UpstreamStatusMessage reports a change in the connection between the server and the model
+type UpstreamStatusMessage struct {
+	ControlMessageBase
+	Status  string `json:"status"`
+	Attempt int    `json:"attempt,omitempty"`
+}
+
+// GoingAwayMessage tells the device that the server closes the connection and that it should
+// connect again
+type GoingAwayMessage struct {
+	ControlMessageBase
+	Reason string `json:"reason"`
+}
+
+// TranscriptMessage carries a caption of what the user or the assistant said
+type TranscriptMessage struct {
+	ControlMessageBase
+	Role   ai.TranscriptRole `json:"role"`
+	ItemID string            `json:"item_id,omitempty"`
+	Text   string            `json:"text"`
+	Final  bool              `json:"final"`
+}
+
+func transcriptMessage(t ai.Transcript) TranscriptMessage {
+	return TranscriptMessage{
+		ControlMessageBase: ControlMessageBase{Type: TranscriptMessageType},
+		Role:               t.Role,
+		ItemID:             t.ItemID,
+		Text:               t.Text,
+		Final:              t.Final,
+	}
+}
+
+// eventMessage converts a model event into the message forwarded to the device. It returns nil for
+// events the device is not interested in.
+func eventMessage(e ai.Event) interface{} {
+	switch e.Type {
+	case ai.SpeechStartedEventType:
+		return ControlMessageBase{Type: SpeechStartedMessageType}
+	case ai.SpeechStoppedEventType:
+		return ControlMessageBase{Type: SpeechStoppedMessageType}
+	case ai.ResponseCreatedEventType:
+		return ResponseMessage{
+			ControlMessageBase: ControlMessageBase{Type: ResponseStartedMessageType},
+			ResponseID:         e.ResponseID,
+		}
+	case ai.ResponseAudioDoneEventType:
+		return ControlMessageBase{Type: ResponseAudioDoneMessageType}
+	case ai.ResponseDoneEventType:
+		return ResponseMessage{
+			ControlMessageBase: ControlMessageBase{Type: ResponseDoneMessageType},
+			ResponseID:         e.ResponseID,
+			Status:             e.ResponseStatus,
+		}
+	case ai.UpstreamReconnectingEventType, ai.UpstreamReconnectedEventType, ai.UpstreamFailedEventType:
+		status := map[ai.EventType]string{
+			ai.UpstreamReconnectingEventType: UpstreamReconnecting,
+			ai.UpstreamReconnectedEventType:  UpstreamConnected,
+			ai.UpstreamFailedEventType:       UpstreamFailed,
+		}[e.Type]
+		msg := UpstreamStatusMessage{
+			ControlMessageBase: ControlMessageBase{Type: UpstreamStatusMessageType},
+			Status:             status,
+		}
+		if e.Type == ai.UpstreamReconnectingEventType {
+			msg.Attempt = e.Attempt
+		}
+		return msg
+	case ai.ErrorEventType:
+		if e.Error == nil {
+			return NewErrorMessage("", ErrCodeModel, "unknown model error")
+		}
+		return NewErrorMessage("", ErrCodeModel, "%s", e.Error.Message)
+	}
+	return nil
+}
+
+// NewErrorMessage creates an error reply for the request with the given id
+func NewErrorMessage(id string, code string, format string, args ...interface{}) ErrorMessage {
+	return ErrorMessage{
+		ControlMessageBase: ControlMessageBase{Type: ErrorMessageType, ID: id},
+		Code:               code,
+		Message:            fmt.Sprintf(format, args...),
+	}
+}
+
+// parseControlMessage decodes the envelope of a control message. The returned error is an
+// ErrorMessage that can be sent back to the device as-is.
+func parseControlMessage(data []byte) (ControlMessageBase, *ErrorMessage) {
+	var base ControlMessageBase
+	if err := json.Unmarshal(data, &base); err != nil {
+		e := NewErrorMessage("", ErrCodeInvalidJSON, "could not parse control message: %v", err)
+		return base, &e
+	}
+	if base.Type == "" {
+		e := NewErrorMessage(base.ID, ErrCodeInvalidPayload, "control message has no type")
+		return base, &e
+	}
+	return base, nil
+}
@@ -0,0 +1,400 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/ai"
+	"github.com/pixaverse-studios/websocket-server/internal/auth"
+	"github.com/pixaverse-studios/websocket-server/internal/metrics"
+	"github.com/pixaverse-studios/websocket-server/internal/utils"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// session holds the state of a single conversation between a device and the AI model
+type session struct {
+	client   *Client
+	aiClient ai.AIClient
+	// identity is who the device authenticated as
+	identity auth.Identity
+	// buffer queues the response audio, mono PCM16 at the device rate cut into frames, until
+	// egressPump sends it
+	buffer utils.BufferSizeController
+	codec  deviceCodec
+	// lead is how far ahead of the playback position of the device the audio is sent
+	lead time.Duration
+	// inbound resamples the device audio to the model rate and is only used by the read pump, outbound
+	// resamples the response audio to the device rate and is only used by the goroutine handling the
+	// model output
+	inbound  *audio.Resampler
+	outbound *audio.Resampler
+	// downmix turns the channels of the device into the mono audio of the model, upmix copies the
+	// mono response audio into the channels of the device
+	downmix *audio.Mixer
+	upmix   *audio.Mixer
+	// audioRate limits the audio the device sends, nil when unlimited. Only used by the read pump.
+	audioRate *rate.Limiter
+
+	mu sync.Mutex
+	// responseActive is true while the model is generating a response
+	responseActive bool
+	// interrupted is set when the user barges in and cleared when the next response starts. Audio that
+	// arrives in between belongs to the cancelled response and is dropped.
+	interrupted bool
+	playback    playbackClock
+	// pendingEnds counts the ends of response audio queued in the buffer and not sent yet, deferred
+	// holds the control messages to send once they are
+	pendingEnds int
+	deferred    []any
+	latency     turnLatency
+	// codecStale and outboundStale are set when a response is interrupted. The codec and the
+	// outbound resampler still hold some of its audio, the goroutines using them reset them first.
+	codecStale    bool
+	outboundStale bool
+	// queued is the response audio on its way to the buffer, bufferPump writes it there so that a
+	// full queue does not hold up the events of the model. queuedReady is signalled when audio is
+	// queued, cancelWrite stops the write in progress and is nil when there is none.
+	queued      []queuedAudio
+	queuedReady chan struct{}
+	cancelWrite context.CancelFunc
+
+	// toolCalls are the device tool calls waiting for a result, keyed by call id
+	toolCalls   map[string]chan ToolResultMessage
+	toolCallSeq int
+}
+
+// newSession creates the session for client, which authenticated as identity. The AI client is set afterwards, once the tools that
+// run through the session are registered.
+func newSession(client *Client, identity auth.Identity) (*session, error) {
+	codec, err := newDeviceCodec(client.config.Audio)
+	if err != nil {
+		return nil, err
+	}
+	downmix, err := client.config.Audio.InputMixer()
+	if err != nil {
+		return nil, err
+	}
+	rate := client.config.Audio.SampleRate
+	inbound, err := audio.NewResampler(rate, ai.SampleRate, 1)
+	if err != nil {
+		return nil, err
+	}
+	outbound, err := audio.NewResampler(ai.SampleRate, rate, 1)
+	if err != nil {
+		return nil, err
+	}
+	frame, lead := egressTiming(client.config.Audio)
+	// response audio is buffered as mono PCM16, it is upmixed once it leaves the buffer
+	bytesPerSecond := rate * 2
+	return &session{
+		client:   client,
+		identity: identity,
+		buffer: utils.NewBufferSizeController(int(frame.Seconds()*float64(bytesPerSecond)),
+			client.config.Websocket.MaxMessageQueue, client.config.Websocket.QueuePolicy),
+		codec:    codec,
+		lead:     lead,
+		inbound:  inbound,
+		outbound: outbound,
+		downmix:  downmix,
+		upmix:    audio.NewUpmixer(client.config.Audio.Channels),
+		playback: playbackClock{bytesPerSecond: bytesPerSecond},
+
+		queuedReady: make(chan struct{}, 1),
+	}, nil
+}
+
+// queuedAudio is response audio, mono PCM16 at the device rate, waiting to be written to the
+// buffer. end marks the end of the response audio.
+type queuedAudio struct {
+	data []byte
+	end  bool
+}
+
+// toModel converts audio received from the device to the format of the model
+func (s *session) toModel(a audio.Audio) (audio.Audio, error) {
+	if a.GetSampleRate() != s.inbound.InputRate() {
+		// the device changed its sample rate, which formats like WAV carry in every message
+		inbound, err := audio.NewResampler(a.GetSampleRate(), ai.SampleRate, 1)
+		if err != nil {
+			return audio.Audio{}, err
+		}
+		s.inbound = inbound
+	}
+	if a.GetChannels() != 1 {
+		mixer := s.downmix
+		if a.GetChannels() != mixer.InputChannels() {
+			// formats like WAV carry their own channels, the configured mixing is for audio.channels
+			mixer = audio.NewDownmixer(a.GetChannels())
+		}
+		var err error
+		if a, err = mixer.Mix(a); err != nil {
+			return audio.Audio{}, err
+		}
+	}
+	timer := prometheus.NewTimer(metrics.ResampleSeconds.WithLabelValues(metrics.In))
+	defer timer.ObserveDuration()
+	return s.inbound.Resample(a)
+}
+
+// toDevice converts response audio to the sample rate of the device. It stays mono until
+// encodeResponse.
+func (s *session) toDevice(a audio.Audio) (audio.Audio, error) {
+	timer := prometheus.NewTimer(metrics.ResampleSeconds.WithLabelValues(metrics.Out))
+	defer timer.ObserveDuration()
+	return s.resampler().Resample(a)
+}
+
+// resampler returns the outbound resampler, reset if the response it was resampling was
+// interrupted. Only used by the goroutine handling the model output.
+func (s *session) resampler() *audio.Resampler {
+	s.mu.Lock()
+	stale := s.outboundStale
+	s.outboundStale = false
+	s.mu.Unlock()
+	if stale {
+		s.outbound.Reset()
+	}
+	return s.outbound
+}
+
+// encoder returns the codec of the device, reset if the response it was encoding was interrupted.
+// Only used by egressPump.
+func (s *session) encoder() deviceCodec {
+	s.mu.Lock()
+	stale := s.codecStale
+	s.codecStale = false
+	s.mu.Unlock()
+	if stale {
+		s.codec.Reset()
+	}
+	return s.codec
+}
+
+// encodeResponse converts buffered response audio, mono PCM16 at the device rate, into messages
+// with the channels and format of the device
+func (s *session) encodeResponse(data []byte) ([][]byte, error) {
+	a, err := s.upmix.Mix(audio.FromPCM16(data, s.client.config.Audio.SampleRate, 1))
+	if err != nil {
+		return nil, err
+	}
+	return s.encoder().Encode(a)
+}
+
+// flushResponseAudio queues the end of the response audio, held back by the resampler, and
+// whatever is left in the buffer. egressPump sends them along with the audio held back by the codec.
+func (s *session) flushResponseAudio() {
+	outbound := s.resampler()
+	tail := audio.FromFloat32(outbound.Flush(), outbound.OutputRate(), 1)
+	s.queueAudio(queuedAudio{data: tail.AsPCM16(), end: true})
+}
+
+// queueAudio hands response audio to bufferPump, unless the response was interrupted
+func (s *session) queueAudio(q queuedAudio) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.interrupted {
+		return
+	}
+	if q.end {
+		s.pendingEnds++
+	}
+	s.queued = append(s.queued, q)
+	select {
+	case s.queuedReady <- struct{}{}:
+	default:
+	}
+}
+
+// nextQueued returns the oldest audio queued by queueAudio, false if there is none, and the context
+// of its write to the buffer, which interrupt cancels. writeDone must be called once it is written.
+func (s *session) nextQueued(ctx context.Context) (queuedAudio, context.Context, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queued) == 0 {
+		return queuedAudio{}, nil, false
+	}
+	q := s.queued[0]
+	s.queued = s.queued[1:]
+	writeCtx, cancel := context.WithCancel(ctx)
+	s.cancelWrite = cancel
+	return q, writeCtx, true
+}
+
+// writeDone records that the audio returned by nextQueued has been written to the buffer
+func (s *session) writeDone() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancelWrite != nil {
+		s.cancelWrite()
+		s.cancelWrite = nil
+	}
+}
+
+// sendAfterAudio sends a control message to the device once the response audio queued so far has
+// been sent, so that it does not overtake it
+func (s *session) sendAfterAudio(msg any) error {
+	s.mu.Lock()
+	if s.pendingEnds > 0 {
+		s.deferred = append(s.deferred, msg)
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+	return s.client.WriteJSON(msg)
+}
+
+// audioEnded records that the end of some response audio has been sent and returns the control
+// messages that were waiting for it
+func (s *session) audioEnded() []any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.playback.end()
+	s.pendingEnds = max(s.pendingEnds-1, 0)
+	if s.pendingEnds > 0 {
+		return nil
+	}
+	deferred := s.deferred
+	s.deferred = nil
+	return deferred
+}
+
+// responseStarted resets the state of the session for a new response from the model
+func (s *session) responseStarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responseActive = true
+	s.interrupted = false
+}
+
+func (s *session) responseDone() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responseActive = false
+}
+
+// turnStarted records that the user stopped talking, or committed the audio, which starts the
+// measure of the latency of the response
+func (s *session) turnStarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latency.start(time.Now())
+}
+
+// stageReached records that the response reached stage, see turnLatency
+func (s *session) stageReached(stage string) {
+	s.mu.Lock()
+	d, ok := s.latency.reach(stage, time.Now())
+	s.mu.Unlock()
+	if ok {
+		metrics.TurnLatency.WithLabelValues(stage).Observe(d.Seconds())
+	}
+}
+
+// latencySummary returns the attributes of the log line summing up the latencies of the session
+func (s *session) latencySummary() []any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.latency.summary()
+}
+
+// idle reports whether the session is between turns: the user is not waiting for a response, none
+// is being generated or sent to the device and no tool call is waiting for the device
+func (s *session) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return !s.latency.awaitingResponse() && !s.responseActive && s.pendingEnds == 0 && len(s.toolCalls) == 0 &&
+		len(s.queued) == 0 && s.cancelWrite == nil && s.buffer.Stats().Queued == 0
+}
+
+// dropAudio reports whether response audio should be discarded because the user interrupted it
+func (s *session) dropAudio() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.interrupted
+}
+
+// audioSent records that n bytes of audio have been written to the device speaker. It returns how
+// long the device had been waiting for them when it ran out of audio in the middle of a response.
+func (s *session) audioSent(n int) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.playback.add(n)
+}
+
+// egressWait returns how long to wait before sending n bytes of audio to keep the device no more
+// than the lead ahead of its playback
+func (s *session) egressWait(n int) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.playback.wait(n, s.lead)
+}
+
+// interrupt stops the current response: the model stops generating, the conversation history is
+// truncated to what the device has played so far, queued audio is dropped and the device is told
+// to empty its speaker buffer.
+func (s *session) interrupt() error {
+	s.mu.Lock()
+	cancel := s.responseActive
+	played, playing := s.playback.position()
+	// audio still queued to be sent will be played too
+	playing = playing || s.pendingEnds > 0
+	s.interrupted = cancel || playing
+	s.responseActive = false
+	s.mu.Unlock()
+
+	if !cancel && !playing {
+		return nil
+	}
+
+	// the audio on its way to the buffer is dropped first, so that none of it is written after the
+	// buffer is cleared
+	s.mu.Lock()
+	s.queued = nil
+	if s.cancelWrite != nil {
+		s.cancelWrite()
+	}
+	s.mu.Unlock()
+	s.buffer.Clear()
+	// the ends of response audio queued were dropped along with the audio
+	s.mu.Lock()
+	s.playback.reset()
+	s.pendingEnds = 0
+	deferred := s.deferred
+	s.deferred = nil
+	s.codecStale = true
+	s.outboundStale = true
+	s.mu.Unlock()
+	for _, msg := range deferred {
+		if err := s.client.WriteJSON(msg); err != nil {
+			return err
+		}
+	}
+
+	if cancel {
+		if err := s.aiClient.CancelResponse(); err != nil {
+			return err
+		}
+	}
+	if playing {
+		if err := s.aiClient.TruncateResponse(played); err != nil {
+			return err
+		}
+		return s.client.WriteJSON(ControlMessageBase{Type: PlaybackStopMessageType})
+	}
+	return nil
+}
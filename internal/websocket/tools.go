@@ -0,0 +1,124 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/ai"
+)
+
+// toolCallTimeout is how long the device has to answer a tool call
+const toolCallTimeout = 10 * time.Second
+
+// deviceTools are executed on the device: the server forwards the call over the control channel
+// and waits for the device to send back the result
+var deviceTools = []ai.Tool{
+	{
+		Name:        "set_volume",
+		Description: "Sets the speaker volume of the device.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"level": {"type": "integer", "minimum": 0, "maximum": 100, "description": "Volume level in percent"}
+			},
+			"required": ["level"]
+		}`),
+	},
+	{
+		Name:        "get_battery",
+		Description: "Returns the battery level of the device in percent and whether it is charging.",
+		Parameters:  json.RawMessage(`{"type": "object", "properties": {}}`),
+	},
+	{
+		Name:        "set_timer",
+		Description: "Starts a timer on the device that rings when it runs out.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"seconds": {"type": "integer", "minimum": 1, "description": "Duration of the timer in seconds"},
+				"label": {"type": "string", "description": "What the timer is for"}
+			},
+			"required": ["seconds"]
+		}`),
+	},
+}
+
+// newToolRegistry creates the tools available to the model in the given session
+func newToolRegistry(s *session) (*ai.ToolRegistry, error) {
+	r := ai.NewToolRegistry()
+	if err := ai.RegisterBuiltinTools(r); err != nil {
+		return nil, err
+	}
+	for _, t := range deviceTools {
+		name := t.Name
+		t.Handler = func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+			return s.callDeviceTool(ctx, name, args)
+		}
+		if err := r.Register(t); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// callDeviceTool sends a tool call to the device and waits for its result
+func (s *session) callDeviceTool(ctx context.Context, name string, args json.RawMessage) (interface{}, error) {
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+
+	s.mu.Lock()
+	s.toolCallSeq++
+	callID := fmt.Sprintf("call_%d", s.toolCallSeq)
+	if s.toolCalls == nil {
+		s.toolCalls = make(map[string]chan ToolResultMessage)
+	}
+	result := make(chan ToolResultMessage, 1)
+	s.toolCalls[callID] = result
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.toolCalls, callID)
+		s.mu.Unlock()
+	}()
+
+	err := s.client.WriteJSON(ToolCallMessage{
+		ControlMessageBase: ControlMessageBase{Type: ToolCallMessageType},
+		CallID:             callID,
+		Name:               name,
+		Arguments:          args,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not send tool call to device: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, toolCallTimeout)
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("device did not answer the %s call: %v", name, ctx.Err())
+	case r := <-result:
+		if r.Error != "" {
+			return nil, fmt.Errorf("%s", r.Error)
+		}
+		return r.Output, nil
+	}
+}
+
+// resolveToolCall hands a result sent by the device to the call waiting for it
+func (s *session) resolveToolCall(r ToolResultMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, ok := s.toolCalls[r.CallID]
+	if !ok {
+		return false
+	}
+	delete(s.toolCalls, r.CallID)
+	result <- r
+	return true
+}
@@ -0,0 +1,222 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidADPCM is returned when IMA ADPCM data cannot be decoded
+var ErrInvalidADPCM = errors.New("invalid ima adpcm data")
+
+// IMA ADPCM codes each sample in 4 bits as the difference from a prediction, with a step size that
+// adapts to the signal. The data is split into blocks laid out as in WAV files (format tag 0x11):
+// each channel starts with a 4-byte header holding its first sample and step index, then the
+// channels alternate in groups of 4 bytes, each byte holding two samples, low nibble first. Every
+// block can be decoded on its own.
+
+// imaGroupSamples is the number of samples of a channel in a group of 4 bytes
+const imaGroupSamples = 8
+
+var imaStepTable = [89]int{
+	7, 8, 9, 10, 11, 12, 13, 14, 16, 17, 19, 21, 23, 25, 28, 31, 34, 37, 41, 45,
+	50, 55, 60, 66, 73, 80, 88, 97, 107, 118, 130, 143, 157, 173, 190, 209, 230, 253, 279, 307,
+	337, 371, 408, 449, 494, 544, 598, 658, 724, 796, 876, 963, 1060, 1166, 1282, 1411, 1552, 1707, 1878, 2066,
+	2272, 2499, 2749, 3024, 3327, 3660, 4026, 4428, 4871, 5358, 5894, 6484, 7132, 7845, 8630, 9493, 10442, 11487, 12635, 13899,
+	15289, 16818, 18500, 20350, 22385, 24623, 27086, 29794, 32767,
+}
+
+var imaIndexTable = [8]int{-1, -1, -1, -1, 2, 4, 6, 8}
+
+// imaChannel is the state of the codec for a channel
+type imaChannel struct {
+	predictor int
+	index     int
+}
+
+// adapt updates the state with a coded sample and returns the new prediction
+func (c *imaChannel) adapt(nibble byte) int16 {
+	step := imaStepTable[c.index]
+	delta := step >> 3
+	if nibble&4 != 0 {
+		delta += step
+	}
+	if nibble&2 != 0 {
+		delta += step >> 1
+	}
+	if nibble&1 != 0 {
+		delta += step >> 2
+	}
+	if nibble&8 != 0 {
+		c.predictor -= delta
+	} else {
+		c.predictor += delta
+	}
+	c.predictor = min(max(c.predictor, -32768), 32767)
+	c.index = min(max(c.index+imaIndexTable[nibble&7], 0), len(imaStepTable)-1)
+	return int16(c.predictor)
+}
+
+// encode codes sample and updates the state as the decoder will
+func (c *imaChannel) encode(sample int16) byte {
+	step := imaStepTable[c.index]
+	diff := int(sample) - c.predictor
+	var nibble byte
+	if diff < 0 {
+		nibble = 8
+		diff = -diff
+	}
+	for bit := byte(4); bit > 0; bit >>= 1 {
+		if diff >= step {
+			nibble |= bit
+			diff -= step
+		}
+		step >>= 1
+	}
+	c.adapt(nibble)
+	return nibble
+}
+
+// FromIMAADPCM decodes a block of IMA ADPCM
+func FromIMAADPCM(block []byte, sampleRate int, channels int) (Audio, error) {
+	if channels < 1 {
+		return Audio{}, fmt.Errorf("%w: %d channels", ErrInvalidADPCM, channels)
+	}
+	header := 4 * channels
+	if len(block) < header || (len(block)-header)%(4*channels) != 0 {
+		return Audio{}, fmt.Errorf("%w: block of %d bytes for %d channels", ErrInvalidADPCM, len(block), channels)
+	}
+	groups := (len(block) - header) / (4 * channels)
+	frames := 1 + groups*imaGroupSamples
+	samples := make([]int16, frames*channels)
+
+	state := make([]imaChannel, channels)
+	for ch := range state {
+		h := block[4*ch:]
+		state[ch].predictor = int(int16(binary.LittleEndian.Uint16(h)))
+		state[ch].index = int(h[2])
+		if state[ch].index >= len(imaStepTable) {
+			return Audio{}, fmt.Errorf("%w: step index %d", ErrInvalidADPCM, h[2])
+		}
+		samples[ch] = int16(state[ch].predictor)
+	}
+
+	data := block[header:]
+	for g := 0; g < groups; g++ {
+		for ch := range state {
+			frame := 1 + g*imaGroupSamples
+			for _, b := range data[:4] {
+				samples[frame*channels+ch] = state[ch].adapt(b & 0x0f)
+				samples[(frame+1)*channels+ch] = state[ch].adapt(b >> 4)
+				frame += 2
+			}
+			data = data[4:]
+		}
+	}
+	return Audio{
+		float32Data: Int16ToFloat32(samples),
+		sampleRate:  sampleRate,
+		channels:    channels,
+	}, nil
+}
+
+// encodeIMABlock codes interleaved samples into a block. The number of frames must be 1 plus a
+// multiple of imaGroupSamples. The step indexes of state carry over from the previous block.
+func encodeIMABlock(samples []int16, state []imaChannel) []byte {
+	channels := len(state)
+	groups := (len(samples)/channels - 1) / imaGroupSamples
+	block := make([]byte, 4*channels+groups*4*channels)
+	for ch := range state {
+		state[ch].predictor = int(samples[ch])
+		binary.LittleEndian.PutUint16(block[4*ch:], uint16(samples[ch]))
+		block[4*ch+2] = byte(state[ch].index)
+	}
+
+	data := block[4*channels:]
+	for g := 0; g < groups; g++ {
+		for ch := range state {
+			frame := 1 + g*imaGroupSamples
+			for i := range 4 {
+				lo := state[ch].encode(samples[frame*channels+ch])
+				hi := state[ch].encode(samples[(frame+1)*channels+ch])
+				data[i] = lo | hi<<4
+				frame += 2
+			}
+			data = data[4:]
+		}
+	}
+	return block
+}
+
+// imaFrames returns the number of frames of the block holding frames, padded to a whole group
+func imaFrames(frames int) int {
+	groups := (max(frames-1, 0) + imaGroupSamples - 1) / imaGroupSamples
+	return 1 + groups*imaGroupSamples
+}
+
+// AsIMAADPCM encodes the audio as a single block of IMA ADPCM, padded with silence to a whole
+// group of samples
+func (a *Audio) AsIMAADPCM() []byte {
+	samples := Float32ToInt16(a.float32Data)
+	frames := imaFrames(len(samples) / a.channels)
+	samples = append(samples, make([]int16, frames*a.channels-len(samples))...)
+	return encodeIMABlock(samples, make([]imaChannel, a.channels))
+}
+
+// IMAADPCMEncoder encodes a stream of audio into IMA ADPCM blocks. The step size carries over from
+// one block to the next so that it does not have to adapt again at the start of each block.
+//
+// An IMAADPCMEncoder is not safe for concurrent use.
+type IMAADPCMEncoder struct {
+	sampleRate int
+	state      []imaChannel
+	// pending holds the interleaved samples not encoded yet
+	pending []int16
+}
+
+// NewIMAADPCMEncoder creates an encoder for audio with the given sample rate and number of channels
+func NewIMAADPCMEncoder(sampleRate, channels int) (*IMAADPCMEncoder, error) {
+	if channels < 1 {
+		return nil, fmt.Errorf("ima adpcm needs at least 1 channel, got %d", channels)
+	}
+	return &IMAADPCMEncoder{sampleRate: sampleRate, state: make([]imaChannel, channels)}, nil
+}
+
+// Encode adds a to the stream and returns a block of the samples encoded so far. The samples that
+// do not make a whole group are held back for the next block, the block is nil if there are not
+// enough of them yet.
+func (e *IMAADPCMEncoder) Encode(a Audio) ([]byte, error) {
+	channels := len(e.state)
+	if a.sampleRate != e.sampleRate || a.channels != channels {
+		return nil, fmt.Errorf("ima adpcm encoder expects %d Hz audio with %d channels, got %d Hz with %d channels",
+			e.sampleRate, channels, a.sampleRate, a.channels)
+	}
+	e.pending = append(e.pending, Float32ToInt16(a.float32Data)...)
+
+	frames := len(e.pending) / channels
+	if frames <= imaGroupSamples {
+		return nil, nil
+	}
+	frames = 1 + (frames-1)/imaGroupSamples*imaGroupSamples
+	block := encodeIMABlock(e.pending[:frames*channels], e.state)
+	e.pending = append([]int16(nil), e.pending[frames*channels:]...)
+	return block, nil
+}
+
+// Flush encodes the samples held back by the encoder, padded with silence to a whole group
+func (e *IMAADPCMEncoder) Flush() ([]byte, error) {
+	if len(e.pending) == 0 {
+		return nil, nil
+	}
+	channels := len(e.state)
+	frames := imaFrames(len(e.pending) / channels)
+	samples := append(e.pending, make([]int16, frames*channels-len(e.pending))...)
+	e.pending = nil
+	return encodeIMABlock(samples, e.state), nil
+}
+
+// Reset drops the samples held back by the encoder and the step size it adapted to
+func (e *IMAADPCMEncoder) Reset() {
+	e.pending = nil
+	e.state = make([]imaChannel, len(e.state))
+}
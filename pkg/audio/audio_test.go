@@ -1,6 +1,17 @@
 package audio
 
-import "testing"
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio/audiotest"
+)
 
 func TestAudioProcessing(t *testing.T) {
 	t.Run("test audio conversion", func(t *testing.T) {
@@ -13,3 +24,796 @@ func TestAudioProcessing(t *testing.T) {
 		t.Skip("Test not implemented")
 	})
 }
+
+func sine(freq float64, rate, frames int) []float32 {
+	out := make([]float32, frames)
+	for i := range out {
+		out[i] = float32(0.5 * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+	}
+	return out
+}
+
+func rms(data []float32) float64 {
+	var sum float64
+	for _, s := range data {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(data)))
+}
+
+func newResampler(t *testing.T, inRate, outRate, channels int) *Resampler {
+	t.Helper()
+	r, err := NewResampler(inRate, outRate, channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestResampler(t *testing.T) {
+	t.Run("chunks give the same output as the whole stream", func(t *testing.T) {
+		in := sine(440, 16000, 16000)
+		whole := newResampler(t, 16000, 24000, 1).Process(in)
+		if len(whole) == 0 {
+			t.Fatal("expected output")
+		}
+
+		r := newResampler(t, 16000, 24000, 1)
+		var chunked []float32
+		for i := 0; i < len(in); i += 317 {
+			chunked = append(chunked, r.Process(in[i:min(i+317, len(in))])...)
+		}
+		if len(chunked) != len(whole) {
+			t.Fatalf("expected %d frames, got %d", len(whole), len(chunked))
+		}
+		for i := range whole {
+			if math.Abs(float64(whole[i]-chunked[i])) > 1e-6 {
+				t.Fatalf("frame %d differs: %f != %f", i, whole[i], chunked[i])
+			}
+		}
+	})
+
+	t.Run("no drift", func(t *testing.T) {
+		for _, rates := range [][2]int{{16000, 24000}, {24000, 16000}, {8000, 24000}, {44100, 24000}} {
+			r := newResampler(t, rates[0], rates[1], 2)
+			frames := 0
+			for i := 0; i < 100; i++ {
+				frames += len(r.Process(make([]float32, rates[0]/100*2))) / 2
+			}
+			frames += len(r.Flush()) / 2
+			if frames != rates[1] {
+				t.Errorf("%d -> %d Hz: expected %d frames for a second of audio, got %d", rates[0], rates[1], rates[1], frames)
+			}
+		}
+	})
+
+	t.Run("tone is preserved", func(t *testing.T) {
+		r := newResampler(t, 24000, 16000, 1)
+		out := r.Process(sine(1000, 24000, 24000))
+		out = append(out, r.Flush()...)
+		want := sine(1000, 16000, 16000)
+		if len(out) != len(want) {
+			t.Fatalf("expected %d frames, got %d", len(want), len(out))
+		}
+		var errSum float64
+		for i := 1000; i < 15000; i++ {
+			d := float64(out[i]) - float64(want[i])
+			errSum += d * d
+		}
+		if e := math.Sqrt(errSum / 14000); e > 0.01 {
+			t.Fatalf("output differs from the tone, rms error %f", e)
+		}
+	})
+
+	t.Run("frequencies above the output nyquist are removed", func(t *testing.T) {
+		out := newResampler(t, 24000, 16000, 1).Process(sine(10000, 24000, 24000))
+		if level := rms(out[1000:]); level > 0.001 {
+			t.Fatalf("10 kHz tone aliased into 16 kHz output with rms %f", level)
+		}
+	})
+
+	t.Run("channels are kept apart", func(t *testing.T) {
+		left := sine(440, 16000, 1600)
+		in := make([]float32, 2*len(left))
+		for i, s := range left {
+			in[2*i] = s
+		}
+		out, err := newResampler(t, 16000, 24000, 2).Resample(FromFloat32(in, 16000, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, s := range out.AsFloat32() {
+			if i%2 == 1 && s != 0 {
+				t.Fatalf("left channel leaked into the right one at frame %d", i/2)
+			}
+		}
+		if _, err := newResampler(t, 16000, 24000, 2).Resample(FromFloat32(in, 8000, 2)); err == nil {
+			t.Fatal("expected audio at the wrong rate to be rejected")
+		}
+	})
+
+	t.Run("filter size is limited", func(t *testing.T) {
+		// rates with little in common need a filter of millions of taps
+		for _, rates := range [][2]int{{999983, 24000}, {44101, 24000}, {1<<31 - 1, 24000}, {0, 24000}} {
+			if _, err := NewResampler(rates[0], rates[1], 1); err == nil {
+				t.Errorf("%d -> %d Hz: expected the resampler to be refused", rates[0], rates[1])
+			}
+		}
+		for _, rate := range []int{8000, 11025, 22050, 44100, 48000, 96000, 192000} {
+			if _, err := NewResampler(rate, 24000, 1); err != nil {
+				t.Errorf("%d Hz: %v", rate, err)
+			}
+		}
+	})
+}
+
+func TestWAV(t *testing.T) {
+	in := FromFloat32(sine(440, 16000, 1600), 16000, 1)
+	stereo := FromFloat32(sine(440, 48000, 960), 48000, 2)
+
+	t.Run("round trip", func(t *testing.T) {
+		for _, c := range []struct {
+			format    WAVSampleFormat
+			tolerance float64
+		}{
+			{WAVPCM8, 1.0 / 100},
+			{WAVPCM16, 1.0 / 30000},
+			{WAVPCM24, 1e-6},
+			{WAVPCM32, 1e-6},
+			{WAVFloat32, 0},
+		} {
+			for _, a := range []Audio{in, stereo} {
+				data, err := a.AsWAV(c.format)
+				if err != nil {
+					t.Fatal(err)
+				}
+				out, err := FromWAV(data)
+				if err != nil {
+					t.Fatalf("%+v: %v", c.format, err)
+				}
+				if out.GetSampleRate() != a.GetSampleRate() || out.GetChannels() != a.GetChannels() || len(out.AsFloat32()) != len(a.AsFloat32()) {
+					t.Fatalf("%+v: got %d Hz, %d channels, %d samples", c.format, out.GetSampleRate(), out.GetChannels(), len(out.AsFloat32()))
+				}
+				for i, s := range out.AsFloat32() {
+					if d := math.Abs(float64(s - a.AsFloat32()[i])); d > c.tolerance {
+						t.Fatalf("%+v: sample %d differs by %f", c.format, i, d)
+					}
+				}
+			}
+		}
+	})
+
+	t.Run("extra chunks and streaming headers", func(t *testing.T) {
+		data, _ := in.AsWAV(WAVPCM16)
+		// insert an odd sized LIST chunk, which is padded, before the data chunk
+		list := append([]byte("LIST\x03\x00\x00\x00abc"), 0)
+		withList := append(append(append([]byte(nil), data[:36]...), list...), data[36:]...)
+		// streaming encoders write the largest possible data size
+		copy(withList[36+len(list)+4:], []byte{0xff, 0xff, 0xff, 0xff})
+		out, err := FromWAV(withList[:len(withList)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out.AsFloat32()) != len(in.AsFloat32())-1 {
+			t.Fatalf("expected the incomplete last frame to be dropped, got %d samples", len(out.AsFloat32()))
+		}
+	})
+
+	t.Run("extensible format", func(t *testing.T) {
+		data, _ := stereo.AsWAV(WAVFloat32)
+		fmtChunk := make([]byte, 40)
+		copy(fmtChunk, data[20:36])
+		binary.LittleEndian.PutUint16(fmtChunk[0:2], 0xFFFE)
+		binary.LittleEndian.PutUint16(fmtChunk[16:18], 22)
+		binary.LittleEndian.PutUint16(fmtChunk[24:26], 3)
+		ext := append([]byte("RIFF\x00\x00\x00\x00WAVEfmt \x28\x00\x00\x00"), fmtChunk...)
+		ext = append(ext, data[36:]...)
+		out, err := FromWAV(ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.GetChannels() != 2 || out.AsFloat32()[5] != stereo.AsFloat32()[5] {
+			t.Fatal("extensible wav decoded incorrectly")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		data, _ := in.AsWAV(WAVPCM16)
+		alaw := append([]byte(nil), data...)
+		binary.LittleEndian.PutUint16(alaw[20:22], 6)
+		withRate := func(rate uint32) []byte {
+			d := append([]byte(nil), data...)
+			binary.LittleEndian.PutUint32(d[24:28], rate)
+			return d
+		}
+		for name, d := range map[string][]byte{
+			"empty":         nil,
+			"not riff":      []byte("RIFX\x00\x00\x00\x00WAVE"),
+			"no data":       data[:36],
+			"unknown tag":   alaw,
+			"data first":    append([]byte("RIFF\x00\x00\x00\x00WAVE"), data[36:]...),
+			"short format":  append([]byte("RIFF\x00\x00\x00\x00WAVEfmt \x04\x00\x00\x00"), data[20:24]...),
+			"rate too low":  withRate(4000),
+			"rate too high": withRate(999983),
+			"huge rate":     withRate(1<<31 - 1),
+		} {
+			if _, err := FromWAV(d); !errors.Is(err, ErrInvalidWAV) {
+				t.Errorf("%s: expected ErrInvalidWAV, got %v", name, err)
+			}
+		}
+		if _, err := in.AsWAV(WAVSampleFormat{BitsPerSample: 12}); err == nil {
+			t.Error("expected 12-bit samples to be rejected")
+		}
+	})
+}
+
+// snr returns the ratio in dB between in and the difference between out, delayed by lag frames,
+// and in
+func snr(in, out []float32, lag int) float64 {
+	var signal, noise float64
+	for i, s := range in {
+		d := float64(out[i+lag] - s)
+		signal += float64(s) * float64(s)
+		noise += d * d
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+func TestMP3(t *testing.T) {
+	// a tone with some noise, so that the encoder has to make do with its bitrate
+	noisy := func(rate, channels int) Audio {
+		tone := sine(440, rate, rate/2)
+		data := make([]float32, len(tone)*channels)
+		for i := range data {
+			data[i] = 0.6*tone[i/channels] + 0.05*float32(rand.Float64()-0.5)
+		}
+		return FromFloat32(data, rate, channels)
+	}
+	// the filter banks of the encoder and the decoder delay the audio by this many frames
+	const lag = granuleSize + 481
+
+	t.Run("round trip", func(t *testing.T) {
+		for _, c := range []struct {
+			rate, channels, bitrate int
+		}{
+			{16000, 1, 32},
+			{24000, 1, 32},
+			{24000, 2, 64},
+			{44100, 2, 128},
+			{48000, 1, 64},
+		} {
+			in := noisy(c.rate, c.channels)
+			encoder, err := NewMP3Encoder(c.rate, c.channels, c.bitrate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames, _ := encoder.Encode(in)
+			tail, _ := encoder.Flush()
+			data := append(frames, tail...)
+			// the frames are padded to keep the bitrate, only the flushed silence adds to it
+			seconds := float64(len(in.AsFloat32())/c.channels+lag) / float64(c.rate)
+			if kbps := float64(len(data)*8) / seconds / 1000; kbps > float64(c.bitrate)*1.2 {
+				t.Errorf("%+v: %f kbit/s", c, kbps)
+			}
+
+			out, err := FromMP3(data)
+			if err != nil {
+				t.Fatalf("%+v: %v", c, err)
+			}
+			if out.GetSampleRate() != c.rate || out.GetChannels() != c.channels {
+				t.Fatalf("%+v: decoded %d Hz with %d channels", c, out.GetSampleRate(), out.GetChannels())
+			}
+			if len(out.AsFloat32()) < len(in.AsFloat32())+lag*c.channels {
+				t.Fatalf("%+v: the flush did not output the end of the audio", c)
+			}
+			if r := snr(in.AsFloat32(), out.AsFloat32(), lag*c.channels); r < 15 {
+				t.Errorf("%+v: signal to noise ratio of %.1f dB", c, r)
+			}
+		}
+	})
+
+	t.Run("streaming decoder", func(t *testing.T) {
+		in := noisy(24000, 1)
+		data, err := in.AsMP3()
+		if err != nil {
+			t.Fatal(err)
+		}
+		whole, _ := FromMP3(data)
+
+		// an ID3 tag and junk before the first frame
+		tag := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x05"), "abcde"...)
+		stream := append(append(tag, 0xff, 0x00), data...)
+		d := NewMP3Decoder()
+		var chunked []float32
+		for i := 0; i < len(stream); i += 100 {
+			a, err := d.Decode(stream[i:min(i+100, len(stream))])
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunked = append(chunked, a.AsFloat32()...)
+		}
+		if len(chunked) != len(whole.AsFloat32()) {
+			t.Fatalf("expected %d samples, got %d", len(whole.AsFloat32()), len(chunked))
+		}
+		for i := range chunked {
+			if chunked[i] != whole.AsFloat32()[i] {
+				t.Fatalf("sample %d differs", i)
+			}
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		e, err := NewMP3Encoder(16000, 1, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Encode(noisy(16000, 1))
+		e.Reset()
+		stream, _ := e.Encode(FromFloat32(make([]float32, 16000), 16000, 1))
+		out, err := FromMP3(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, s := range out.AsFloat32() {
+			if math.Abs(float64(s)) > 1e-4 {
+				t.Fatalf("sample %d of the audio before the reset was encoded: %f", i, s)
+			}
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if _, err := FromMP3([]byte("not an mp3 file")); !errors.Is(err, ErrInvalidMP3) {
+			t.Errorf("expected ErrInvalidMP3, got %v", err)
+		}
+		for _, c := range [][3]int{{8000, 1, 32}, {16000, 3, 32}, {16000, 1, 320}, {44100, 1, 8}} {
+			if _, err := NewMP3Encoder(c[0], c[1], c[2]); err == nil {
+				t.Errorf("expected %d Hz, %d channels at %d kbit/s to be rejected", c[0], c[1], c[2])
+			}
+		}
+	})
+}
+
+func TestOgg(t *testing.T) {
+	// packets ending on a lacing value of 255, spanning pages and empty
+	var packets [][]byte
+	for _, n := range []int{1, 254, 255, 510, 300, 0, 255*255 + 10, 40} {
+		p := make([]byte, n)
+		for i := range p {
+			p[i] = byte(i + n)
+		}
+		packets = append(packets, p)
+	}
+	w := oggWriter{serial: 7}
+	stream := w.pages(packets[:3], []int64{1, 2, 3}, oggFirstPage)
+	stream = append(stream, w.pages(packets[3:], []int64{4, 5, 6, 7, 8}, 0)...)
+
+	var r oggReader
+	var got [][]byte
+	for i := 0; i < len(stream); i += 1000 {
+		p, err := r.Read(stream[i:min(i+1000, len(stream))])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p...)
+	}
+	if len(got) != len(packets) {
+		t.Fatalf("expected %d packets, got %d", len(packets), len(got))
+	}
+	for i := range packets {
+		if string(got[i]) != string(packets[i]) {
+			t.Fatalf("packet %d differs", i)
+		}
+	}
+
+	stream[40] ^= 1
+	if _, err := new(oggReader).Read(stream); !errors.Is(err, ErrInvalidOgg) {
+		t.Errorf("expected a corrupted page to be rejected, got %v", err)
+	}
+}
+
+// useFakeOpus makes NewOpusEncoder and NewOpusDecoder create audiotest.FakeOpusCodec until the test ends
+func useFakeOpus(t *testing.T) {
+	encoder, decoder := NewOpusEncoder, NewOpusDecoder
+	NewOpusEncoder = func(int, int, int) (OpusEncoder, error) { return audiotest.FakeOpusCodec{}, nil }
+	NewOpusDecoder = func(int, int) (OpusDecoder, error) { return audiotest.FakeOpusCodec{}, nil }
+	t.Cleanup(func() { NewOpusEncoder, NewOpusDecoder = encoder, decoder })
+}
+
+func TestOpus(t *testing.T) {
+	t.Run("packet duration", func(t *testing.T) {
+		for _, c := range []struct {
+			packet   []byte
+			duration time.Duration
+		}{
+			{[]byte{1 << 3}, 20 * time.Millisecond},       // SILK 20ms
+			{[]byte{3<<3 | 1}, 120 * time.Millisecond},    // two SILK 60ms frames
+			{[]byte{13 << 3}, 20 * time.Millisecond},      // hybrid 20ms
+			{[]byte{16 << 3}, 2500 * time.Microsecond},    // CELT 2.5ms
+			{[]byte{31<<3 | 3, 3}, 60 * time.Millisecond}, // three CELT 20ms frames
+		} {
+			if d, err := OpusPacketDuration(c.packet); err != nil || d != c.duration {
+				t.Errorf("%x: expected %s, got %s, %v", c.packet, c.duration, d, err)
+			}
+		}
+		for _, packet := range [][]byte{nil, {3}, {31<<3 | 3, 7}, {3, 0}} {
+			if _, err := OpusPacketDuration(packet); !errors.Is(err, ErrInvalidOpus) {
+				t.Errorf("%x: expected ErrInvalidOpus, got %v", packet, err)
+			}
+		}
+	})
+
+	for _, ogg := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream with ogg framing %t", ogg), func(t *testing.T) {
+			useFakeOpus(t)
+			in := FromFloat32(sine(440, 16000, 1000), 16000, 1)
+			e, err := NewOpusStreamEncoder(16000, 1, 24000, ogg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs, _ := e.Encode(in)
+			tail, _ := e.Flush()
+			msgs = append(msgs, tail...)
+			if !ogg && len(msgs) != 4 {
+				t.Fatalf("expected a message for each of the 4 packets, got %d", len(msgs))
+			}
+
+			d, err := NewOpusStreamDecoder(16000, 1, ogg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out []float32
+			for _, msg := range msgs {
+				a, err := d.Decode(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				out = append(out, a.AsFloat32()...)
+			}
+			// the last packet is padded with silence
+			if len(out) != 1280 {
+				t.Fatalf("expected 1280 samples, got %d", len(out))
+			}
+			for i, s := range in.AsFloat32() {
+				if math.Abs(float64(s-out[i])) > 1e-4 {
+					t.Fatalf("sample %d differs", i)
+				}
+			}
+		})
+	}
+
+	// runs against libopus in builds with the opus tag, CI runs them with go test -tags opus
+	for _, ogg := range []bool{false, true} {
+		t.Run(fmt.Sprintf("libopus round trip with ogg framing %t", ogg), func(t *testing.T) {
+			e, err := NewOpusStreamEncoder(16000, 1, 24000, ogg)
+			if errors.Is(err, ErrOpusUnavailable) {
+				t.Skip("built without libopus")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			in := sine(440, 16000, 16000)
+			msgs, err := e.Encode(FromFloat32(in, 16000, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tail, err := e.Flush()
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, tail...)
+
+			d, err := NewOpusStreamDecoder(16000, 1, ogg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out []float32
+			for _, msg := range msgs {
+				a, err := d.Decode(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				out = append(out, a.AsFloat32()...)
+			}
+			if len(out) != len(in) {
+				t.Fatalf("expected %d samples, got %d", len(in), len(out))
+			}
+			// the codec is lossy and delays the audio, the middle of the tone keeps its level and pitch
+			middle := out[4000:12000]
+			if r := rms(middle) / rms(in[4000:12000]); r < 0.5 || r > 2 {
+				t.Fatalf("decoded level is %.2f times the original", r)
+			}
+			crossings := 0
+			for i := 1; i < len(middle); i++ {
+				if (middle[i-1] < 0) != (middle[i] < 0) {
+					crossings++
+				}
+			}
+			// 880 crossings per second for 440 Hz, the middle lasts half a second
+			if crossings < 420 || crossings > 460 {
+				t.Fatalf("expected a 440 Hz tone, got %d zero crossings", crossings)
+			}
+		})
+	}
+
+	t.Run("reset", func(t *testing.T) {
+		useFakeOpus(t)
+		e, err := NewOpusStreamEncoder(16000, 1, 24000, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// half a packet is held back
+		if msgs, _ := e.Encode(FromFloat32(sine(440, 16000, 160), 16000, 1)); len(msgs) != 0 {
+			t.Fatalf("expected no packet yet, got %d", len(msgs))
+		}
+		e.Reset()
+		if msgs, _ := e.Flush(); len(msgs) != 0 {
+			t.Fatalf("expected nothing to flush after a reset, got %d packets", len(msgs))
+		}
+	})
+
+	t.Run("ogg headers", func(t *testing.T) {
+		useFakeOpus(t)
+		w := oggWriter{serial: 1}
+		head := opusHead{channels: 2, preSkip: 480, sampleRate: 48000}
+		stream := w.pages([][]byte{head.packet()}, []int64{0}, oggFirstPage)
+		stream = append(stream, w.pages([][]byte{opusTags("test")}, []int64{0}, 0)...)
+		packet, _ := audiotest.FakeOpusCodec{}.Encode(make([]float32, 640))
+		stream = append(stream, w.pages([][]byte{packet}, []int64{960}, 0)...)
+
+		d, err := NewOpusStreamDecoder(16000, 1, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := d.Decode(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the stream is stereo and the pre-skip drops 10ms
+		if a.GetChannels() != 2 || len(a.AsFloat32()) != 640-320 {
+			t.Fatalf("got %d channels and %d samples", a.GetChannels(), len(a.AsFloat32()))
+		}
+
+		noHead := (&oggWriter{}).pages([][]byte{packet}, []int64{960}, oggFirstPage)
+		d, _ = NewOpusStreamDecoder(16000, 1, true)
+		if _, err := d.Decode(noHead); !errors.Is(err, ErrInvalidOpus) {
+			t.Errorf("expected a stream without OpusHead to be rejected, got %v", err)
+		}
+		if _, err := NewOpusStreamEncoder(44100, 1, 24000, false); err == nil {
+			t.Error("expected 44.1 kHz to be rejected")
+		}
+	})
+}
+
+func TestG711(t *testing.T) {
+	t.Run("reference values", func(t *testing.T) {
+		for _, c := range []struct {
+			name   string
+			code   byte
+			sample int16
+			expand func(byte) int16
+		}{
+			{"μ-law zero", 0xff, 0, muLawToLinear},
+			{"μ-law max", 0x80, 32124, muLawToLinear},
+			{"μ-law min", 0x00, -32124, muLawToLinear},
+			{"A-law smallest", 0xd5, 8, aLawToLinear},
+			{"A-law smallest negative", 0x55, -8, aLawToLinear},
+			{"A-law max", 0xaa, 32256, aLawToLinear},
+		} {
+			if s := c.expand(c.code); s != c.sample {
+				t.Errorf("%s: expected %d, got %d", c.name, c.sample, s)
+			}
+		}
+		if u := linearToMuLaw(32767); u != 0x80 {
+			t.Errorf("expected full scale to be clipped to 0x80, got %#x", u)
+		}
+		if a := linearToALaw(-32768); a != 0x2a {
+			t.Errorf("expected negative full scale to be 0x2a, got %#x", a)
+		}
+	})
+
+	t.Run("every code round trips", func(t *testing.T) {
+		for i := range 256 {
+			if u := linearToMuLaw(muLawToLinear(byte(i))); u != byte(i) && !(i == 0x7f && u == 0xff) {
+				t.Errorf("μ-law %#x came back as %#x", i, u)
+			}
+			if a := linearToALaw(aLawToLinear(byte(i))); a != byte(i) {
+				t.Errorf("A-law %#x came back as %#x", i, a)
+			}
+		}
+	})
+
+	in := FromFloat32(sine(440, 8000, 800), 8000, 1)
+	for _, c := range []struct {
+		name   string
+		encode func(*Audio) []byte
+		decode func([]byte, int, int) Audio
+	}{
+		{"μ-law", (*Audio).AsMuLaw, FromMuLaw},
+		{"A-law", (*Audio).AsALaw, FromALaw},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			data := c.encode(&in)
+			if len(data) != 800 {
+				t.Fatalf("expected a byte per sample, got %d bytes", len(data))
+			}
+			out := c.decode(data, 8000, 1)
+			if out.GetSampleRate() != 8000 || out.GetChannels() != 1 {
+				t.Fatalf("got %d Hz with %d channels", out.GetSampleRate(), out.GetChannels())
+			}
+			// companding keeps about 38 dB of signal to noise ratio over most of the range
+			if r := snr(in.AsFloat32(), out.AsFloat32(), 0); r < 30 {
+				t.Errorf("signal to noise ratio of %.1f dB", r)
+			}
+		})
+	}
+}
+
+func TestIMAADPCM(t *testing.T) {
+	if imaStepTable[len(imaStepTable)-1] != 32767 {
+		t.Fatal("incomplete step table")
+	}
+
+	in := FromFloat32(sine(440, 8000, 801), 8000, 1)
+	t.Run("block", func(t *testing.T) {
+		block := in.AsIMAADPCM()
+		// a 4 byte header holding the first sample, then 4 bits for each of the others
+		if len(block) != 4+400 {
+			t.Fatalf("expected a block of 404 bytes, got %d", len(block))
+		}
+		out, err := FromIMAADPCM(block, 8000, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out.AsFloat32()) != 801 {
+			t.Fatalf("expected 801 samples, got %d", len(out.AsFloat32()))
+		}
+		if r := snr(in.AsFloat32(), out.AsFloat32(), 0); r < 15 {
+			t.Errorf("signal to noise ratio of %.1f dB", r)
+		}
+	})
+
+	t.Run("stereo layout", func(t *testing.T) {
+		// the left channel is silent, the right one holds the tone
+		tone := sine(440, 8000, 801)
+		samples := make([]float32, 2*len(tone))
+		for i, s := range tone {
+			samples[2*i+1] = s
+		}
+		stereo := FromFloat32(samples, 8000, 2)
+		block := stereo.AsIMAADPCM()
+		if len(block) != 8+2*400 {
+			t.Fatalf("expected headers and 100 groups per channel, got %d bytes", len(block))
+		}
+		// silence codes as zero nibbles, in the first group of each channel
+		if !bytes.Equal(block[8:12], make([]byte, 4)) || bytes.Equal(block[12:16], make([]byte, 4)) {
+			t.Fatalf("channels are not interleaved by groups of 4 bytes: %x", block[8:])
+		}
+		out, err := FromIMAADPCM(block, 8000, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := snr(samples, out.AsFloat32(), 0); r < 15 {
+			t.Errorf("signal to noise ratio of %.1f dB", r)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		e, err := NewIMAADPCMEncoder(8000, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []float32
+		samples := in.AsFloat32()
+		for len(samples) > 0 {
+			chunk := samples[:min(len(samples), 100)]
+			samples = samples[len(chunk):]
+			block, err := e.Encode(FromFloat32(chunk, 8000, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block == nil {
+				continue
+			}
+			a, err := FromIMAADPCM(block, 8000, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, a.AsFloat32()...)
+		}
+		block, _ := e.Flush()
+		a, err := FromIMAADPCM(block, 8000, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, a.AsFloat32()...)
+		// the held back samples are padded with silence to a whole group at the end
+		if len(out) < 801 || len(out) >= 801+imaGroupSamples {
+			t.Fatalf("expected 801 samples and some padding, got %d", len(out))
+		}
+		if r := snr(in.AsFloat32(), out, 0); r < 15 {
+			t.Errorf("signal to noise ratio of %.1f dB", r)
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		e, err := NewIMAADPCMEncoder(8000, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Encode(FromFloat32(in.AsFloat32()[:100], 8000, 1))
+		e.Reset()
+		if block, _ := e.Flush(); block != nil {
+			t.Fatalf("expected nothing to flush after a reset, got %d bytes", len(block))
+		}
+		fresh, _ := NewIMAADPCMEncoder(8000, 1)
+		want, _ := fresh.Encode(FromFloat32(in.AsFloat32()[:100], 8000, 1))
+		got, _ := e.Encode(FromFloat32(in.AsFloat32()[:100], 8000, 1))
+		if !bytes.Equal(got, want) {
+			t.Fatal("expected the step size to start over after a reset")
+		}
+	})
+
+	t.Run("invalid blocks", func(t *testing.T) {
+		for _, block := range [][]byte{{1, 2}, {0, 0, 0, 0, 1}, {0, 0, 89, 0}} {
+			if _, err := FromIMAADPCM(block, 8000, 1); !errors.Is(err, ErrInvalidADPCM) {
+				t.Errorf("%x: expected ErrInvalidADPCM, got %v", block, err)
+			}
+		}
+	})
+}
+
+func TestMixer(t *testing.T) {
+	// four channels holding 0.1, 0.2, 0.3 and 0.4, then their opposites
+	quad := FromFloat32([]float32{0.1, 0.2, 0.3, 0.4, -0.1, -0.2, -0.3, -0.4}, 16000, 4)
+	weighted, err := NewMixer([][]float64{{1, 0, 0, 1}, {0, 2, 2, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector, err := NewChannelSelector(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name     string
+		mixer    *Mixer
+		in       Audio
+		expected []float32
+	}{
+		{"downmix", NewDownmixer(4), quad, []float32{0.25, -0.25}},
+		{"weights", weighted, quad, []float32{0.5, 1, -0.5, -1}},
+		{"select", selector, quad, []float32{0.3, -0.3}},
+		{"upmix", NewUpmixer(3), FromFloat32([]float32{0.5, -0.5}, 16000, 1), []float32{0.5, 0.5, 0.5, -0.5, -0.5, -0.5}},
+		{"quad to stereo", NewChannelMixer(4, 2), quad, []float32{0.2, 0.3, -0.2, -0.3}},
+		{"stereo to quad", NewChannelMixer(2, 4), FromFloat32([]float32{0.1, 0.2}, 16000, 2), []float32{0.1, 0.2, 0.1, 0.2}},
+	} {
+		out, err := c.mixer.Mix(c.in)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if out.GetChannels() != c.mixer.OutputChannels() || out.GetSampleRate() != 16000 || len(out.AsFloat32()) != len(c.expected) {
+			t.Fatalf("%s: got %d channels, %d samples", c.name, out.GetChannels(), len(out.AsFloat32()))
+		}
+		for i, s := range out.AsFloat32() {
+			if math.Abs(float64(s-c.expected[i])) > 1e-6 {
+				t.Fatalf("%s: expected %v, got %v", c.name, c.expected, out.AsFloat32())
+			}
+		}
+	}
+
+	if _, err := NewDownmixer(2).Mix(quad); err == nil {
+		t.Error("expected a mixer to reject audio with other channels")
+	}
+	if _, err := NewChannelSelector(2, 2); err == nil {
+		t.Error("expected selecting a missing channel to fail")
+	}
+	if _, err := NewMixer([][]float64{{1, 1}, {1}}); err == nil {
+		t.Error("expected rows of different lengths to be rejected")
+	}
+
+	six := FromFloat32(make([]float32, 60), 16000, 6)
+	six.SetChannels(1)
+	if six.GetChannels() != 1 || len(six.AsFloat32()) != 10 {
+		t.Errorf("expected 6 channels to be mixed to 10 mono samples, got %d channels, %d samples", six.GetChannels(), len(six.AsFloat32()))
+	}
+}
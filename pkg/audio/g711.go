@@ -0,0 +1,126 @@
+package audio
+
+// G.711 μ-law and A-law companding, as in the ITU-T reference implementation. Both code a 16-bit
+// sample in 8 bits with a logarithmic scale, they are mostly used for 8 kHz telephony.
+
+const (
+	muLawBias = 0x84
+	muLawClip = 8159
+)
+
+// segmentEnds are the largest magnitudes of each of the 8 segments of the logarithmic scale, for
+// μ-law on 14-bit magnitudes and A-law on 13-bit ones
+var (
+	muLawSegmentEnds = [8]int{0x3f, 0x7f, 0xff, 0x1ff, 0x3ff, 0x7ff, 0xfff, 0x1fff}
+	aLawSegmentEnds  = [8]int{0x1f, 0x3f, 0x7f, 0xff, 0x1ff, 0x3ff, 0x7ff, 0xfff}
+)
+
+func segment(v int, ends *[8]int) int {
+	for seg, end := range ends {
+		if v <= end {
+			return seg
+		}
+	}
+	return len(ends)
+}
+
+func linearToMuLaw(s int16) byte {
+	v := int(s) >> 2
+	mask := byte(0xff)
+	if v < 0 {
+		v = -v
+		mask = 0x7f
+	}
+	v = min(v, muLawClip) + muLawBias>>2
+	seg := segment(v, &muLawSegmentEnds)
+	if seg >= 8 {
+		return 0x7f ^ mask
+	}
+	return byte(seg<<4|(v>>(seg+1))&0x0f) ^ mask
+}
+
+func muLawToLinear(u byte) int16 {
+	u = ^u
+	t := (int(u&0x0f)<<3 + muLawBias) << ((u & 0x70) >> 4)
+	if u&0x80 != 0 {
+		return int16(muLawBias - t)
+	}
+	return int16(t - muLawBias)
+}
+
+func linearToALaw(s int16) byte {
+	v := int(s) >> 3
+	mask := byte(0xd5)
+	if v < 0 {
+		v = -v - 1
+		mask = 0x55
+	}
+	seg := segment(v, &aLawSegmentEnds)
+	if seg >= 8 {
+		return 0x7f ^ mask
+	}
+	a := seg << 4
+	if seg < 2 {
+		a |= (v >> 1) & 0x0f
+	} else {
+		a |= (v >> seg) & 0x0f
+	}
+	return byte(a) ^ mask
+}
+
+func aLawToLinear(a byte) int16 {
+	a ^= 0x55
+	t := int(a&0x0f) << 4
+	switch seg := (a & 0x70) >> 4; seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t = (t + 0x108) << (seg - 1)
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+// FromMuLaw creates audio from G.711 μ-law samples, one byte each
+func FromMuLaw(data []byte, sampleRate int, channels int) Audio {
+	return fromCompanded(data, sampleRate, channels, muLawToLinear)
+}
+
+// FromALaw creates audio from G.711 A-law samples, one byte each
+func FromALaw(data []byte, sampleRate int, channels int) Audio {
+	return fromCompanded(data, sampleRate, channels, aLawToLinear)
+}
+
+func fromCompanded(data []byte, sampleRate, channels int, expand func(byte) int16) Audio {
+	samples := make([]int16, len(data))
+	for i, b := range data {
+		samples[i] = expand(b)
+	}
+	return Audio{
+		float32Data: Int16ToFloat32(samples),
+		sampleRate:  sampleRate,
+		channels:    channels,
+	}
+}
+
+// AsMuLaw encodes the audio as G.711 μ-law
+func (a *Audio) AsMuLaw() []byte {
+	return a.compand(linearToMuLaw)
+}
+
+// AsALaw encodes the audio as G.711 A-law
+func (a *Audio) AsALaw() []byte {
+	return a.compand(linearToALaw)
+}
+
+func (a *Audio) compand(compress func(int16) byte) []byte {
+	out := make([]byte, len(a.float32Data))
+	for i, s := range Float32ToInt16(a.float32Data) {
+		out[i] = compress(s)
+	}
+	return out
+}
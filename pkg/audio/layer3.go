@@ -0,0 +1,565 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// granuleSize is the number of samples of each channel in a granule
+	granuleSize = 576
+	// maxBigValue is the largest quantized value the Huffman tables can code, 15 plus 13 linbits
+	maxBigValue = 15 + 1<<13 - 1
+	// layer3Delay is the number of samples the filter banks of the encoder and the decoder hold back
+	layer3Delay = granuleSize + 512
+)
+
+// Layer3Encoder is a pure Go MPEG-1 and MPEG-2 Layer III encoder. It favours speed and simplicity
+// over quality: it has no psychoacoustic model, no bit reservoir and only uses long blocks, so the
+// quantization noise is spread evenly over the spectrum. That is good enough for speech.
+//
+// A Layer3Encoder is not safe for concurrent use.
+type Layer3Encoder struct {
+	sampleRate int
+	channels   int
+	// lsf is 0 for MPEG-1 and 1 for MPEG-2, whose low sampling frequencies have one granule per frame
+	lsf          int
+	rateIndex    int
+	bitrateIndex int
+	granules     int
+	// a frame is slotsNum/sampleRate bytes long, padding keeps the average exact. slotLag is the
+	// fraction of a byte accumulated by the frames so far, times sampleRate.
+	slotsNum int
+	slotLag  int
+
+	// pending holds the interleaved input samples not encoded yet
+	pending []float32
+	state   [2]layer3Channel
+}
+
+// layer3Channel is the filter bank state of a channel
+type layer3Channel struct {
+	// fifo holds the last 512 input samples of the analysis filter bank, newest first
+	fifo [512]float64
+	// prev holds the subband samples of the previous granule, which the MDCT overlaps with the
+	// current one
+	prev [32][18]float64
+}
+
+// granule is a quantized granule of a channel along with its side information
+type granule struct {
+	xr34 [granuleSize]float64
+	ix   [granuleSize]int
+	sign [granuleSize]bool
+
+	part23Length int
+	bigValues    int
+	globalGain   int
+	tableSelect  [3]int
+	region0Count int
+	region1Count int
+	count1Table  int
+	// count1End is the end of the count1 region, the lines after it are zero
+	count1End int
+}
+
+var (
+	// analysisMatrix is the matrix of the analysis filter bank
+	analysisMatrix [32][64]float64
+	// mdctTable is the windowed MDCT of a long block
+	mdctTable [18][36]float64
+)
+
+func init() {
+	for k := range analysisMatrix {
+		for i := range analysisMatrix[k] {
+			analysisMatrix[k][i] = math.Cos(float64((2*k+1)*(i-16)) * math.Pi / 64)
+		}
+	}
+	for k := range mdctTable {
+		for i := range mdctTable[k] {
+			window := math.Sin(math.Pi / 36 * (float64(i) + 0.5))
+			// the inverse transform of the decoder has no normalization, the factor makes the
+			// round trip lossless
+			mdctTable[k][i] = window * math.Cos(math.Pi/72*float64((2*i+19)*(2*k+1))) / 9
+		}
+	}
+}
+
+// NewLayer3Encoder creates an encoder for audio with the given sample rate and number of channels
+// at bitrate kbit/s. The sample rate must be one of those of MPEG-1 (32, 44.1 and 48 kHz) or MPEG-2
+// (16, 22.05 and 24 kHz), and the bitrate one of the bitrates of that version.
+func NewLayer3Encoder(sampleRate, channels, bitrate int) (*Layer3Encoder, error) {
+	if channels != 1 && channels != 2 {
+		return nil, fmt.Errorf("mp3 supports 1 or 2 channels, got %d", channels)
+	}
+	e := &Layer3Encoder{sampleRate: sampleRate, channels: channels, rateIndex: -1, bitrateIndex: -1}
+	for lsf, rates := range mp3SampleRates {
+		for i, rate := range rates {
+			if rate == sampleRate {
+				e.lsf, e.rateIndex = lsf, i
+			}
+		}
+	}
+	if e.rateIndex < 0 {
+		return nil, fmt.Errorf("unsupported mp3 sample rate %d Hz", sampleRate)
+	}
+	for i, rate := range mp3Bitrates[e.lsf] {
+		if rate == bitrate && i > 0 {
+			e.bitrateIndex = i
+		}
+	}
+	if e.bitrateIndex < 0 {
+		return nil, fmt.Errorf("unsupported mp3 bitrate %d kbit/s at %d Hz", bitrate, sampleRate)
+	}
+
+	e.granules = 2 - e.lsf
+	// a frame holds 1152 samples in MPEG-1 and 576 in MPEG-2, that is 1152/8 bytes per kbit/s
+	e.slotsNum = e.granules * granuleSize / 8 * bitrate * 1000
+	return e, nil
+}
+
+// Encode adds a to the stream and returns the frames completed so far
+func (e *Layer3Encoder) Encode(a Audio) ([]byte, error) {
+	if a.sampleRate != e.sampleRate || a.channels != e.channels {
+		return nil, fmt.Errorf("mp3 encoder expects %d Hz audio with %d channels, got %d Hz with %d channels",
+			e.sampleRate, e.channels, a.sampleRate, a.channels)
+	}
+	e.pending = append(e.pending, a.float32Data...)
+
+	var out []byte
+	frameSize := e.granules * granuleSize * e.channels
+	for len(e.pending) >= frameSize {
+		out = e.encodeFrame(out, e.pending[:frameSize])
+		e.pending = e.pending[frameSize:]
+	}
+	e.pending = append([]float32(nil), e.pending...)
+	return out, nil
+}
+
+// Flush encodes the samples held back by the encoder, followed by enough silence for the decoder
+// to play them all. The stream can go on afterwards, the silence is then part of it.
+func (e *Layer3Encoder) Flush() ([]byte, error) {
+	frameSize := e.granules * granuleSize * e.channels
+	n := len(e.pending) + layer3Delay*e.channels
+	silence := make([]float32, (n+frameSize-1)/frameSize*frameSize-len(e.pending))
+	return e.Encode(FromFloat32(silence, e.sampleRate, e.channels))
+}
+
+// Reset drops the samples held back by the encoder along with the filter bank state, so that none
+// of the audio encoded so far overlaps the next frame
+func (e *Layer3Encoder) Reset() {
+	e.pending = nil
+	e.state = [2]layer3Channel{}
+}
+
+func (e *Layer3Encoder) encodeFrame(out []byte, samples []float32) []byte {
+	frameBytes := e.slotsNum / e.sampleRate
+	padding := 0
+	e.slotLag += e.slotsNum % e.sampleRate
+	if e.slotLag >= e.sampleRate {
+		e.slotLag -= e.sampleRate
+		padding = 1
+	}
+	frameBytes += padding
+
+	sideInfoBytes := [2][2]int{{17, 32}, {9, 17}}[e.lsf][e.channels-1]
+	mainBits := (frameBytes - 4 - sideInfoBytes) * 8
+	// without bit reservoir every granule gets the same share of the frame
+	budget := min(mainBits/(e.granules*e.channels), 1<<12-1)
+
+	var granules [2][2]granule
+	var xr [granuleSize]float64
+	for gr := 0; gr < e.granules; gr++ {
+		for ch := 0; ch < e.channels; ch++ {
+			e.transform(ch, samples[gr*granuleSize*e.channels:], &xr)
+			e.quantize(&granules[gr][ch], &xr, budget)
+		}
+	}
+
+	w := bitWriter{buf: make([]byte, 0, frameBytes)}
+	e.writeHeader(&w, padding)
+	e.writeSideInfo(&w, &granules)
+	for gr := 0; gr < e.granules; gr++ {
+		for ch := 0; ch < e.channels; ch++ {
+			// the scalefactors are all zero and take no bits, the main data only holds the spectrum
+			e.writeSpectrum(&w, &granules[gr][ch])
+		}
+	}
+	w.pad(frameBytes * 8)
+	return append(out, w.buf...)
+}
+
+// transform computes the spectrum of a granule of channel ch, samples are interleaved and start
+// with the granule
+func (e *Layer3Encoder) transform(ch int, samples []float32, xr *[granuleSize]float64) {
+	s := &e.state[ch]
+	var cur [32][18]float64
+	var y [64]float64
+	for slot := 0; slot < 18; slot++ {
+		// polyphase analysis filter bank, ISO/IEC 11172-3 C.1.3
+		copy(s.fifo[32:], s.fifo[:480])
+		for j := 0; j < 32; j++ {
+			s.fifo[31-j] = float64(samples[(slot*32+j)*e.channels+ch])
+		}
+		for i := range y {
+			var sum float64
+			for j := i; j < 512; j += 64 {
+				sum += synthesisWindow[j] / 32 * s.fifo[j]
+			}
+			y[i] = sum
+		}
+		for sb := 0; sb < 32; sb++ {
+			var sum float64
+			for i, v := range y {
+				sum += analysisMatrix[sb][i] * v
+			}
+			// the decoder inverts the odd samples of the odd subbands, undo it upfront
+			if sb%2 == 1 && slot%2 == 1 {
+				sum = -sum
+			}
+			cur[sb][slot] = sum
+		}
+	}
+
+	for sb := 0; sb < 32; sb++ {
+		for k := 0; k < 18; k++ {
+			var sum float64
+			for i := 0; i < 18; i++ {
+				sum += mdctTable[k][i]*s.prev[sb][i] + mdctTable[k][i+18]*cur[sb][i]
+			}
+			xr[sb*18+k] = sum
+		}
+	}
+	s.prev = cur
+
+	// alias reduction, the inverse of the butterflies of the decoder
+	for sb := 1; sb < 32; sb++ {
+		for i := 0; i < 8; i++ {
+			lo, hi := sb*18-1-i, sb*18+i
+			l, u := xr[lo], xr[hi]
+			xr[lo] = l*aliasCs[i] + u*aliasCa[i]
+			xr[hi] = u*aliasCs[i] - l*aliasCa[i]
+		}
+	}
+}
+
+// quantize finds the finest global gain whose spectrum fits in budget bits
+func (e *Layer3Encoder) quantize(g *granule, xr *[granuleSize]float64, budget int) {
+	for i, v := range xr {
+		g.xr34[i] = math.Pow(math.Abs(v), 0.75)
+		g.sign[i] = v < 0
+	}
+
+	lo, hi := 0, 255
+	for lo < hi {
+		gain := (lo + hi) / 2
+		if e.quantizeWith(g, gain) && g.part23Length <= budget {
+			hi = gain
+		} else {
+			lo = gain + 1
+		}
+	}
+	e.quantizeWith(g, lo)
+}
+
+// quantizeWith quantizes the spectrum with gain and counts its bits. It returns false when a value
+// is too large for the Huffman tables.
+func (e *Layer3Encoder) quantizeWith(g *granule, gain int) bool {
+	g.globalGain = gain
+	// xr = ix^(4/3) * 2^((gain-210)/4), so ix = xr^(3/4) * 2^(-3/16*(gain-210))
+	scale := math.Pow(2, -0.1875*float64(gain-210))
+	for i, v := range g.xr34 {
+		ix := int(v*scale + 0.4054)
+		if ix > maxBigValue {
+			return false
+		}
+		g.ix[i] = ix
+	}
+
+	// the spectrum ends with zeros, preceded by the count1 region of quadruples of values up to 1
+	// and the big values region of pairs
+	end := granuleSize
+	for end > 1 && g.ix[end-1] == 0 && g.ix[end-2] == 0 {
+		end -= 2
+	}
+	g.count1End = end
+	for end > 3 && g.ix[end-1] <= 1 && g.ix[end-2] <= 1 && g.ix[end-3] <= 1 && g.ix[end-4] <= 1 {
+		end -= 4
+	}
+	g.bigValues = end / 2
+
+	e.splitRegions(g)
+	bits := 0
+	start := 0
+	for r := range g.tableSelect {
+		end := e.regionEnd(g, r)
+		table, n := chooseTable(g.ix[start:end])
+		g.tableSelect[r] = table
+		bits += n
+		start = end
+	}
+	bitsA, bitsB := countCount1(g.ix[end:g.count1End])
+	g.count1Table = 0
+	if bitsB < bitsA {
+		g.count1Table = 1
+	}
+	g.part23Length = bits + min(bitsA, bitsB)
+	return true
+}
+
+// splitRegions splits the big values into three regions along scalefactor band boundaries, each
+// region is coded with its own table
+func (e *Layer3Encoder) splitRegions(g *granule) {
+	bands := &scalefactorBands[e.lsf][e.rateIndex]
+	end := g.bigValues * 2
+	n := 0
+	for n < len(bands)-1 && bands[n] < end {
+		n++
+	}
+	r0 := regionCounts[n][0]
+	for r0 > 0 && bands[r0+1] > end {
+		r0--
+	}
+	r1 := regionCounts[n][1]
+	for r1 > 0 && bands[r0+r1+2] > end {
+		r1--
+	}
+	g.region0Count, g.region1Count = r0, r1
+}
+
+// regionEnd returns the end of region r of the big values
+func (e *Layer3Encoder) regionEnd(g *granule, r int) int {
+	bands := &scalefactorBands[e.lsf][e.rateIndex]
+	end := g.bigValues * 2
+	switch r {
+	case 0:
+		return min(bands[g.region0Count+1], end)
+	case 1:
+		return min(bands[g.region0Count+g.region1Count+2], end)
+	default:
+		return end
+	}
+}
+
+// tableCandidates are the tables that can code pairs of values up to their index
+var tableCandidates = [16][]int{
+	{0}, {1}, {2, 3}, {5, 6}, {7, 8, 9}, {7, 8, 9}, {10, 11, 12}, {10, 11, 12},
+	{13, 15}, {13, 15}, {13, 15}, {13, 15}, {13, 15}, {13, 15}, {13, 15}, {13, 15},
+}
+
+// chooseTable returns the table that codes ix in the fewest bits and that number of bits
+func chooseTable(ix []int) (int, int) {
+	largest := 0
+	for _, v := range ix {
+		largest = max(largest, v)
+	}
+	if largest == 0 {
+		return 0, 0
+	}
+
+	candidates := tableCandidates[min(largest, 15)]
+	if largest > 15 {
+		// the smallest linbits of each of the two families of tables that fit the largest value
+		candidates = nil
+		for _, family := range [2]int{16, 24} {
+			for t := family; t < family+8; t++ {
+				if largest-15 < 1<<huffmanLinbits[t] {
+					candidates = append(candidates, t)
+					break
+				}
+			}
+		}
+	}
+
+	best, bestBits := 0, math.MaxInt
+	for _, t := range candidates {
+		if bits := countPairs(t, ix); bits < bestBits {
+			best, bestBits = t, bits
+		}
+	}
+	return best, bestBits
+}
+
+// codeTable returns the codes of table t
+func codeTable(t int) huffmanCode {
+	switch {
+	case t >= 24:
+		return huffmanCodes[24]
+	case t >= 16:
+		return huffmanCodes[16]
+	default:
+		return huffmanCodes[t]
+	}
+}
+
+func countPairs(t int, ix []int) int {
+	code := codeTable(t)
+	linbits := huffmanLinbits[t]
+	bits := 0
+	for i := 0; i+1 < len(ix); i += 2 {
+		x, y := ix[i], ix[i+1]
+		if x >= 15 && linbits > 0 {
+			bits += linbits
+			x = 15
+		}
+		if y >= 15 && linbits > 0 {
+			bits += linbits
+			y = 15
+		}
+		bits += int(code.lengths[x*code.size+y])
+		if x > 0 {
+			bits++
+		}
+		if y > 0 {
+			bits++
+		}
+	}
+	return bits
+}
+
+// countCount1 returns the bits taken by the quadruples of ix with table 32 and with table 33
+func countCount1(ix []int) (int, int) {
+	a, b := 0, 0
+	for i := 0; i+3 < len(ix); i += 4 {
+		q := ix[i]<<3 | ix[i+1]<<2 | ix[i+2]<<1 | ix[i+3]
+		signs := ix[i] + ix[i+1] + ix[i+2] + ix[i+3]
+		a += int(huffmanCodes[32].lengths[q]) + signs
+		b += int(huffmanCodes[33].lengths[q]) + signs
+	}
+	return a, b
+}
+
+func (e *Layer3Encoder) writeHeader(w *bitWriter, padding int) {
+	w.write(0x7ff, 11)
+	// ID is 1 for MPEG-1 and 0 for MPEG-2, after a bit set for both
+	w.write(uint32(3-e.lsf), 2)
+	w.write(1, 2) // layer III
+	w.write(1, 1) // no CRC
+	w.write(uint32(e.bitrateIndex), 4)
+	w.write(uint32(e.rateIndex), 2)
+	w.write(uint32(padding), 1)
+	w.write(0, 1) // private bit
+	if e.channels == 1 {
+		w.write(3, 2) // single channel
+	} else {
+		w.write(0, 2) // stereo
+	}
+	w.write(0, 2) // mode extension
+	w.write(0, 1) // copyright
+	w.write(1, 1) // original
+	w.write(0, 2) // no emphasis
+}
+
+func (e *Layer3Encoder) writeSideInfo(w *bitWriter, granules *[2][2]granule) {
+	if e.lsf == 0 {
+		w.write(0, 9) // main_data_begin
+		w.write(0, [2]int{5, 3}[e.channels-1])
+		w.write(0, 4*e.channels) // scfsi
+	} else {
+		w.write(0, 8)
+		w.write(0, e.channels)
+	}
+	for gr := 0; gr < e.granules; gr++ {
+		for ch := 0; ch < e.channels; ch++ {
+			g := &granules[gr][ch]
+			w.write(uint32(g.part23Length), 12)
+			w.write(uint32(g.bigValues), 9)
+			w.write(uint32(g.globalGain), 8)
+			// scalefac_compress of 0 gives no bits to the scalefactors
+			w.write(0, [2]int{4, 9}[e.lsf])
+			w.write(0, 1) // no window switching, long blocks only
+			for _, t := range g.tableSelect {
+				w.write(uint32(t), 5)
+			}
+			w.write(uint32(g.region0Count), 4)
+			w.write(uint32(g.region1Count), 3)
+			if e.lsf == 0 {
+				w.write(0, 1) // preflag
+			}
+			w.write(0, 1) // scalefac_scale
+			w.write(uint32(g.count1Table), 1)
+		}
+	}
+}
+
+func (e *Layer3Encoder) writeSpectrum(w *bitWriter, g *granule) {
+	start := 0
+	for r := 0; r < 3; r++ {
+		end := e.regionEnd(g, r)
+		t := g.tableSelect[r]
+		if t == 0 {
+			start = end
+			continue
+		}
+		code := codeTable(t)
+		linbits := huffmanLinbits[t]
+		for i := start; i+1 < end; i += 2 {
+			x, y := g.ix[i], g.ix[i+1]
+			cx, cy := x, y
+			if linbits > 0 {
+				cx, cy = min(x, 15), min(y, 15)
+			}
+			k := cx*code.size + cy
+			w.write(code.codes[k], int(code.lengths[k]))
+			e.writeValue(w, x, linbits, g.sign[i])
+			e.writeValue(w, y, linbits, g.sign[i+1])
+		}
+		start = end
+	}
+
+	count1 := huffmanCodes[32+g.count1Table]
+	for i := g.bigValues * 2; i+3 < g.count1End; i += 4 {
+		q := g.ix[i]<<3 | g.ix[i+1]<<2 | g.ix[i+2]<<1 | g.ix[i+3]
+		w.write(count1.codes[q], int(count1.lengths[q]))
+		for j := i; j < i+4; j++ {
+			if g.ix[j] != 0 {
+				w.writeBool(g.sign[j])
+			}
+		}
+	}
+}
+
+// writeValue writes the linbits and the sign of a value of a pair, after the code of the pair
+func (e *Layer3Encoder) writeValue(w *bitWriter, v, linbits int, negative bool) {
+	if linbits > 0 && v >= 15 {
+		w.write(uint32(v-15), linbits)
+	}
+	if v != 0 {
+		w.writeBool(negative)
+	}
+}
+
+// bitWriter writes bits most significant first
+type bitWriter struct {
+	buf []byte
+	// n is the number of bits written
+	n int
+}
+
+func (w *bitWriter) write(v uint32, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>i&1 != 0 {
+			w.buf[len(w.buf)-1] |= 0x80 >> (w.n % 8)
+		}
+		w.n++
+	}
+}
+
+func (w *bitWriter) writeBool(b bool) {
+	if b {
+		w.write(1, 1)
+	} else {
+		w.write(0, 1)
+	}
+}
+
+// pad fills the buffer with zeros up to n bits
+func (w *bitWriter) pad(n int) {
+	for w.n < n {
+		w.write(0, min(n-w.n, 32))
+	}
+}
@@ -0,0 +1,98 @@
+package audio
+
+import "fmt"
+
+// Mixer converts interleaved audio from one number of channels to another. Every output channel
+// is a weighted sum of the input channels.
+type Mixer struct {
+	// weights[o][i] is the gain of input channel i in output channel o
+	weights [][]float64
+}
+
+// NewMixer creates a mixer from a matrix of gains, weights[o][i] being the gain of input channel i in
+// output channel o. Every row holds a gain for each input channel.
+func NewMixer(weights [][]float64) (*Mixer, error) {
+	if len(weights) == 0 || len(weights[0]) == 0 {
+		return nil, fmt.Errorf("a mixer needs at least one input and one output channel")
+	}
+	m := &Mixer{weights: make([][]float64, len(weights))}
+	for o, row := range weights {
+		if len(row) != len(weights[0]) {
+			return nil, fmt.Errorf("output channel %d has %d gains, expected %d", o, len(row), len(weights[0]))
+		}
+		m.weights[o] = append([]float64(nil), row...)
+	}
+	return m, nil
+}
+
+// NewDownmixer creates a mixer that averages channels into mono
+func NewDownmixer(channels int) *Mixer {
+	return NewChannelMixer(channels, 1)
+}
+
+// NewChannelSelector creates a mixer that keeps channel, numbered from 0, of audio with channels
+// channels and drops the others
+func NewChannelSelector(channels, channel int) (*Mixer, error) {
+	if channel < 0 || channel >= channels {
+		return nil, fmt.Errorf("cannot select channel %d of %d", channel, channels)
+	}
+	row := make([]float64, channels)
+	row[channel] = 1
+	return &Mixer{weights: [][]float64{row}}, nil
+}
+
+// NewUpmixer creates a mixer that copies mono audio into each of channels
+func NewUpmixer(channels int) *Mixer {
+	return NewChannelMixer(1, channels)
+}
+
+// NewChannelMixer creates the default mixer from in to out channels. Downmixing averages into each
+// output channel o the input channels whose index is o modulo out, so that everything goes into
+// mono. Upmixing copies input channel o modulo in into output channel o, so that mono goes into
+// every channel.
+func NewChannelMixer(in, out int) *Mixer {
+	weights := make([][]float64, out)
+	for o := range weights {
+		weights[o] = make([]float64, in)
+		if in <= out {
+			weights[o][o%in] = 1
+			continue
+		}
+		n := (in - o + out - 1) / out
+		for i := o; i < in; i += out {
+			weights[o][i] = 1 / float64(n)
+		}
+	}
+	return &Mixer{weights: weights}
+}
+
+// InputChannels returns the number of channels of the audio the mixer takes
+func (m *Mixer) InputChannels() int {
+	return len(m.weights[0])
+}
+
+// OutputChannels returns the number of channels of the audio the mixer makes
+func (m *Mixer) OutputChannels() int {
+	return len(m.weights)
+}
+
+// Mix returns a with the output channels of the mixer. Samples are clipped to [-1, 1].
+func (m *Mixer) Mix(a Audio) (Audio, error) {
+	in, out := m.InputChannels(), m.OutputChannels()
+	if a.channels != in {
+		return Audio{}, fmt.Errorf("mixer expects %d channels, got %d", in, a.channels)
+	}
+	frames := len(a.float32Data) / in
+	mixed := make([]float32, frames*out)
+	for f := 0; f < frames; f++ {
+		frame := a.float32Data[f*in : (f+1)*in]
+		for o, row := range m.weights {
+			var sum float64
+			for i, w := range row {
+				sum += w * float64(frame[i])
+			}
+			mixed[f*out+o] = float32(min(max(sum, -1), 1))
+		}
+	}
+	return Audio{float32Data: mixed, sampleRate: a.sampleRate, channels: out}, nil
+}
@@ -0,0 +1,231 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/hajimehoshi/go-mp3"
+)
+
+// ErrInvalidMP3 is returned when MP3 data cannot be decoded
+var ErrInvalidMP3 = errors.New("invalid mp3 data")
+
+// DefaultMP3Bitrate is the bitrate in kbit/s of the audio encoded by AsMP3. It is valid at the
+// sample rates of both MPEG-1 and MPEG-2.
+const DefaultMP3Bitrate = 32
+
+// MP3Encoder encodes a stream of audio into MP3 frames
+type MP3Encoder interface {
+	// Encode adds a to the stream and returns the frames completed so far
+	Encode(a Audio) ([]byte, error)
+	// Flush encodes the audio held back by the encoder and returns the last frames
+	Flush() ([]byte, error)
+	// Reset drops the audio held back by the encoder, for streams that are cut off
+	Reset()
+}
+
+// MP3EncoderFactory creates an encoder for audio with the given sample rate and number of channels,
+// at bitrate kbit/s
+type MP3EncoderFactory func(sampleRate, channels, bitrate int) (MP3Encoder, error)
+
+// NewMP3Encoder creates the MP3 encoders used by the package. It defaults to the pure Go
+// Layer3Encoder, builds that can use cgo may replace it with a binding to an encoder like LAME.
+var NewMP3Encoder MP3EncoderFactory = func(sampleRate, channels, bitrate int) (MP3Encoder, error) {
+	return NewLayer3Encoder(sampleRate, channels, bitrate)
+}
+
+// mp3Header is the header of an MPEG audio frame
+type mp3Header struct {
+	lsf        int
+	sampleRate int
+	channels   int
+	// size is the length of the frame in bytes, including the header
+	size int
+}
+
+// parseMP3Header parses the 4 byte frame header at the start of data. It returns false if data does
+// not start with the header of a Layer III frame.
+func parseMP3Header(data []byte) (mp3Header, bool) {
+	if len(data) < 4 || data[0] != 0xff || data[1]&0xe0 != 0xe0 {
+		return mp3Header{}, false
+	}
+	version := data[1] >> 3 & 3
+	layer := data[1] >> 1 & 3
+	bitrateIndex := int(data[2] >> 4)
+	rateIndex := int(data[2] >> 2 & 3)
+	padding := int(data[2] >> 1 & 1)
+	mode := data[3] >> 6
+	// version 0 is MPEG-2.5 and 1 is reserved, layer 1 is Layer III, bitrate index 0 is the free
+	// format and 15 is invalid
+	if version < 2 || layer != 1 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return mp3Header{}, false
+	}
+
+	h := mp3Header{lsf: int(3 - version), channels: 2}
+	h.sampleRate = mp3SampleRates[h.lsf][rateIndex]
+	if mode == 3 {
+		h.channels = 1
+	}
+	// a frame holds 1152 samples in MPEG-1 and 576 in MPEG-2
+	h.size = (2-h.lsf)*granuleSize/8*mp3Bitrates[h.lsf][bitrateIndex]*1000/h.sampleRate + padding
+	return h, true
+}
+
+// MP3Decoder decodes a stream of MPEG-1 and MPEG-2 Layer III frames received in chunks, like
+// messages of a WebSocket, that need not end on frame boundaries. The end of a frame cut by a chunk
+// is decoded along with the next chunk. ID3 tags and bytes between frames are skipped.
+//
+// An MP3Decoder is not safe for concurrent use.
+type MP3Decoder struct {
+	// buf holds the bytes received and not decoded yet
+	buf []byte
+	// feed holds the frames waiting to be read by the decoder
+	feed    mp3Feed
+	decoder *mp3.Decoder
+	// header is the header of the first frame given to the decoder
+	header mp3Header
+	pcm    []byte
+}
+
+// mp3Feed is the source of the decoder, it only ever holds complete frames so the decoder never
+// stops in the middle of one
+type mp3Feed struct {
+	data []byte
+}
+
+func (f *mp3Feed) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+// NewMP3Decoder creates a decoder for a new stream
+func NewMP3Decoder() *MP3Decoder {
+	// the decoder outputs 16-bit stereo, 1152 samples per frame at most
+	return &MP3Decoder{pcm: make([]byte, 2*granuleSize*4)}
+}
+
+// Decode decodes the frames completed by data. The audio has the sample rate and the channels of
+// the frames. When they change, Decode stops at the first frame of the new format, which is decoded
+// by the next call.
+func (d *MP3Decoder) Decode(data []byte) (Audio, error) {
+	d.buf = append(d.buf, data...)
+
+	var out []float32
+	format := d.header
+	for {
+		frame, h, ok := d.nextFrame()
+		if !ok {
+			break
+		}
+		if d.decoder != nil && (h.sampleRate != d.header.sampleRate || h.channels != d.header.channels) {
+			if len(out) > 0 {
+				break
+			}
+			// the decoder keeps the filter bank of the previous frames, start over with the new format
+			d.decoder = nil
+		}
+		d.buf = d.buf[h.size:]
+
+		samples, err := d.decodeFrame(frame, h)
+		if err != nil {
+			d.decoder = nil
+			return Audio{}, err
+		}
+		format = h
+		out = append(out, samples...)
+	}
+	return FromFloat32(out, format.sampleRate, format.channels), nil
+}
+
+// nextFrame skips to the next frame in the buffer. It returns false if the buffer does not hold
+// a complete frame yet.
+func (d *MP3Decoder) nextFrame() ([]byte, mp3Header, bool) {
+	for len(d.buf) >= 4 {
+		switch {
+		case string(d.buf[:3]) == "ID3":
+			// ID3v2 tag, a 10 byte header followed by the size of the tag as a 28 bit integer in 4
+			// bytes of 7 bits, and a footer of 10 bytes if flagged
+			if len(d.buf) < 10 {
+				return nil, mp3Header{}, false
+			}
+			size := 10 + (int(d.buf[6]&0x7f)<<21 | int(d.buf[7]&0x7f)<<14 | int(d.buf[8]&0x7f)<<7 | int(d.buf[9]&0x7f))
+			if d.buf[5]&0x10 != 0 {
+				size += 10
+			}
+			if len(d.buf) < size {
+				return nil, mp3Header{}, false
+			}
+			d.buf = d.buf[size:]
+		case string(d.buf[:3]) == "TAG":
+			// ID3v1 tag, 128 bytes at the end of a file
+			if len(d.buf) < 128 {
+				return nil, mp3Header{}, false
+			}
+			d.buf = d.buf[128:]
+		default:
+			h, ok := parseMP3Header(d.buf)
+			if !ok {
+				d.buf = d.buf[1:]
+				continue
+			}
+			if len(d.buf) < h.size {
+				return nil, mp3Header{}, false
+			}
+			return d.buf[:h.size], h, true
+		}
+	}
+	return nil, mp3Header{}, false
+}
+
+// decodeFrame decodes a frame with header h into float samples
+func (d *MP3Decoder) decodeFrame(frame []byte, h mp3Header) (samples []float32, err error) {
+	defer func() {
+		// corrupted frames can make the decoder index out of range
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrInvalidMP3, r)
+		}
+	}()
+
+	d.feed.data = append(d.feed.data[:0], frame...)
+	if d.decoder == nil {
+		// creating the decoder reads the first frame
+		d.decoder, err = mp3.NewDecoder(&d.feed)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMP3, err)
+		}
+		d.header = h
+	}
+	n, err := d.decoder.Read(d.pcm)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMP3, err)
+	}
+
+	// the decoder always outputs stereo, mono frames have the same samples on both sides
+	pcm := Pcm16toFloat32(d.pcm[:n])
+	if h.channels == 2 {
+		return pcm, nil
+	}
+	samples = make([]float32, len(pcm)/2)
+	for i := range samples {
+		samples[i] = pcm[2*i]
+	}
+	return samples, nil
+}
+
+// FromMP3 decodes an MP3 file. The audio has the format of the first frame, the decoding stops at
+// a frame with another sample rate or number of channels.
+func FromMP3(data []byte) (Audio, error) {
+	a, err := NewMP3Decoder().Decode(data)
+	if err != nil {
+		return Audio{}, err
+	}
+	if a.sampleRate == 0 {
+		return Audio{}, fmt.Errorf("%w: no frames found", ErrInvalidMP3)
+	}
+	return a, nil
+}
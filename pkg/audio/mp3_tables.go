@@ -0,0 +1,504 @@
+package audio
+
+// Tables of the MPEG-1/2 Layer III encoder, from ISO/IEC 11172-3 and ISO/IEC 13818-3.
+
+// huffmanCode is a Huffman code table of Annex B. Tables 1 to 24 code pairs of values, the code of
+// (x, y) is at index x*size+y. Tables 32 and 33 code quadruples of values that are 0 or 1, the code
+// of (v, w, x, y) is at index v<<3|w<<2|x<<1|y.
+type huffmanCode struct {
+	size    int
+	codes   []uint32
+	lengths []uint8
+}
+
+// huffmanCodes holds the code tables by table number. Tables 17 to 23 share the codes of table 16
+// and tables 25 to 31 the codes of table 24, they only differ in linbits.
+var huffmanCodes = map[int]huffmanCode{
+	1: {
+		size: 2,
+		codes: []uint32{
+			0x1, 0x1, 0x1, 0x0,
+		},
+		lengths: []uint8{
+			1, 3, 2, 3,
+		},
+	},
+	2: {
+		size: 3,
+		codes: []uint32{
+			0x1, 0x2, 0x1, 0x3, 0x1, 0x1, 0x3, 0x2, 0x0,
+		},
+		lengths: []uint8{
+			1, 3, 6, 3, 3, 5, 5, 5, 6,
+		},
+	},
+	3: {
+		size: 3,
+		codes: []uint32{
+			0x3, 0x2, 0x1, 0x1, 0x1, 0x1, 0x3, 0x2, 0x0,
+		},
+		lengths: []uint8{
+			2, 2, 6, 3, 2, 5, 5, 5, 6,
+		},
+	},
+	5: {
+		size: 4,
+		codes: []uint32{
+			0x1, 0x2, 0x6, 0x5, 0x3, 0x1, 0x4, 0x4, 0x7, 0x5, 0x7, 0x1,
+			0x6, 0x1, 0x1, 0x0,
+		},
+		lengths: []uint8{
+			1, 3, 6, 7, 3, 3, 6, 7, 6, 6, 7, 8,
+			7, 6, 7, 8,
+		},
+	},
+	6: {
+		size: 4,
+		codes: []uint32{
+			0x7, 0x3, 0x5, 0x1, 0x6, 0x2, 0x3, 0x2, 0x5, 0x4, 0x4, 0x1,
+			0x3, 0x3, 0x2, 0x0,
+		},
+		lengths: []uint8{
+			3, 3, 5, 7, 3, 2, 4, 5, 4, 4, 5, 6,
+			6, 5, 6, 7,
+		},
+	},
+	7: {
+		size: 6,
+		codes: []uint32{
+			0x1, 0x2, 0xa, 0x13, 0x10, 0xa, 0x3, 0x3, 0x7, 0xa, 0x5, 0x3,
+			0xb, 0x4, 0xd, 0x11, 0x8, 0x4, 0xc, 0xb, 0x12, 0xf, 0xb, 0x2,
+			0x7, 0x6, 0x9, 0xe, 0x3, 0x1, 0x6, 0x4, 0x5, 0x3, 0x2, 0x0,
+		},
+		lengths: []uint8{
+			1, 3, 6, 8, 8, 9, 3, 4, 6, 7, 7, 8,
+			6, 5, 7, 8, 8, 9, 7, 7, 8, 9, 9, 9,
+			7, 7, 8, 9, 9, 10, 8, 8, 9, 10, 10, 10,
+		},
+	},
+	8: {
+		size: 6,
+		codes: []uint32{
+			0x3, 0x4, 0x6, 0x12, 0xc, 0x5, 0x5, 0x1, 0x2, 0x10, 0x9, 0x3,
+			0x7, 0x3, 0x5, 0xe, 0x7, 0x3, 0x13, 0x11, 0xf, 0xd, 0xa, 0x4,
+			0xd, 0x5, 0x8, 0xb, 0x5, 0x1, 0xc, 0x4, 0x4, 0x1, 0x1, 0x0,
+		},
+		lengths: []uint8{
+			2, 3, 6, 8, 8, 9, 3, 2, 4, 8, 8, 8,
+			6, 4, 6, 8, 8, 9, 8, 8, 8, 9, 9, 10,
+			8, 7, 8, 9, 10, 10, 9, 8, 9, 9, 11, 11,
+		},
+	},
+	9: {
+		size: 6,
+		codes: []uint32{
+			0x7, 0x5, 0x9, 0xe, 0xf, 0x7, 0x6, 0x4, 0x5, 0x5, 0x6, 0x7,
+			0x7, 0x6, 0x8, 0x8, 0x8, 0x5, 0xf, 0x6, 0x9, 0xa, 0x5, 0x1,
+			0xb, 0x7, 0x9, 0x6, 0x4, 0x1, 0xe, 0x4, 0x6, 0x2, 0x6, 0x0,
+		},
+		lengths: []uint8{
+			3, 3, 5, 6, 8, 9, 3, 3, 4, 5, 6, 8,
+			4, 4, 5, 6, 7, 8, 6, 5, 6, 7, 7, 8,
+			7, 6, 7, 7, 8, 9, 8, 7, 8, 8, 9, 9,
+		},
+	},
+	10: {
+		size: 8,
+		codes: []uint32{
+			0x1, 0x2, 0xa, 0x17, 0x23, 0x1e, 0xc, 0x11, 0x3, 0x3, 0x8, 0xc,
+			0x12, 0x15, 0xc, 0x7, 0xb, 0x9, 0xf, 0x15, 0x20, 0x28, 0x13, 0x6,
+			0xe, 0xd, 0x16, 0x22, 0x2e, 0x17, 0x12, 0x7, 0x14, 0x13, 0x21, 0x2f,
+			0x1b, 0x16, 0x9, 0x3, 0x1f, 0x16, 0x29, 0x1a, 0x15, 0x14, 0x5, 0x3,
+			0xe, 0xd, 0xa, 0xb, 0x10, 0x6, 0x5, 0x1, 0x9, 0x8, 0x7, 0x8,
+			0x4, 0x4, 0x2, 0x0,
+		},
+		lengths: []uint8{
+			1, 3, 6, 8, 9, 9, 9, 10, 3, 4, 6, 7,
+			8, 9, 8, 8, 6, 6, 7, 8, 9, 10, 9, 9,
+			7, 7, 8, 9, 10, 10, 9, 10, 8, 8, 9, 10,
+			10, 10, 10, 10, 9, 9, 10, 10, 11, 11, 10, 11,
+			8, 8, 9, 10, 10, 10, 11, 11, 9, 8, 9, 10,
+			10, 11, 11, 11,
+		},
+	},
+	11: {
+		size: 8,
+		codes: []uint32{
+			0x3, 0x4, 0xa, 0x18, 0x22, 0x21, 0x15, 0xf, 0x5, 0x3, 0x4, 0xa,
+			0x20, 0x11, 0xb, 0xa, 0xb, 0x7, 0xd, 0x12, 0x1e, 0x1f, 0x14, 0x5,
+			0x19, 0xb, 0x13, 0x3b, 0x1b, 0x12, 0xc, 0x5, 0x23, 0x21, 0x1f, 0x3a,
+			0x1e, 0x10, 0x7, 0x5, 0x1c, 0x1a, 0x20, 0x13, 0x11, 0xf, 0x8, 0xe,
+			0xe, 0xc, 0x9, 0xd, 0xe, 0x9, 0x4, 0x1, 0xb, 0x4, 0x6, 0x6,
+			0x6, 0x3, 0x2, 0x0,
+		},
+		lengths: []uint8{
+			2, 3, 5, 7, 8, 9, 8, 9, 3, 3, 4, 6,
+			8, 8, 7, 8, 5, 5, 6, 7, 8, 9, 8, 8,
+			7, 6, 7, 9, 8, 10, 8, 9, 8, 8, 8, 9,
+			9, 10, 9, 10, 8, 8, 9, 10, 10, 11, 10, 11,
+			8, 7, 7, 8, 9, 10, 10, 10, 8, 7, 8, 9,
+			10, 10, 10, 10,
+		},
+	},
+	12: {
+		size: 8,
+		codes: []uint32{
+			0x9, 0x6, 0x10, 0x21, 0x29, 0x27, 0x26, 0x1a, 0x7, 0x5, 0x6, 0x9,
+			0x17, 0x10, 0x1a, 0xb, 0x11, 0x7, 0xb, 0xe, 0x15, 0x1e, 0xa, 0x7,
+			0x11, 0xa, 0xf, 0xc, 0x12, 0x1c, 0xe, 0x5, 0x20, 0xd, 0x16, 0x13,
+			0x12, 0x10, 0x9, 0x5, 0x28, 0x11, 0x1f, 0x1d, 0x11, 0xd, 0x4, 0x2,
+			0x1b, 0xc, 0xb, 0xf, 0xa, 0x7, 0x4, 0x1, 0x1b, 0xc, 0x8, 0xc,
+			0x6, 0x3, 0x1, 0x0,
+		},
+		lengths: []uint8{
+			4, 3, 5, 7, 8, 9, 9, 9, 3, 3, 4, 5,
+			7, 7, 8, 8, 5, 4, 5, 6, 7, 8, 7, 8,
+			6, 5, 6, 6, 7, 8, 8, 8, 7, 6, 7, 7,
+			8, 8, 8, 9, 8, 7, 8, 8, 8, 9, 8, 9,
+			8, 7, 7, 8, 8, 9, 9, 10, 9, 8, 8, 9,
+			9, 9, 9, 10,
+		},
+	},
+	13: {
+		size: 16,
+		codes: []uint32{
+			0x1, 0x5, 0xe, 0x15, 0x22, 0x33, 0x2e, 0x47, 0x2a, 0x34, 0x44, 0x34,
+			0x43, 0x2c, 0x2b, 0x13, 0x3, 0x4, 0xc, 0x13, 0x1f, 0x1a, 0x2c, 0x21,
+			0x1f, 0x18, 0x20, 0x18, 0x1f, 0x23, 0x16, 0xe, 0xf, 0xd, 0x17, 0x24,
+			0x3b, 0x31, 0x4d, 0x41, 0x1d, 0x28, 0x1e, 0x28, 0x1b, 0x21, 0x2a, 0x10,
+			0x16, 0x14, 0x25, 0x3d, 0x38, 0x4f, 0x49, 0x40, 0x2b, 0x4c, 0x38, 0x25,
+			0x1a, 0x1f, 0x19, 0xe, 0x23, 0x10, 0x3c, 0x39, 0x61, 0x4b, 0x72, 0x5b,
+			0x36, 0x49, 0x37, 0x29, 0x30, 0x35, 0x17, 0x18, 0x3a, 0x1b, 0x32, 0x60,
+			0x4c, 0x46, 0x5d, 0x54, 0x4d, 0x3a, 0x4f, 0x1d, 0x4a, 0x31, 0x29, 0x11,
+			0x2f, 0x2d, 0x4e, 0x4a, 0x73, 0x5e, 0x5a, 0x4f, 0x45, 0x53, 0x47, 0x32,
+			0x3b, 0x26, 0x24, 0xf, 0x48, 0x22, 0x38, 0x5f, 0x5c, 0x55, 0x5b, 0x5a,
+			0x56, 0x49, 0x4d, 0x41, 0x33, 0x2c, 0x2b, 0x2a, 0x2b, 0x14, 0x1e, 0x2c,
+			0x37, 0x4e, 0x48, 0x57, 0x4e, 0x3d, 0x2e, 0x36, 0x25, 0x1e, 0x14, 0x10,
+			0x35, 0x19, 0x29, 0x25, 0x2c, 0x3b, 0x36, 0x51, 0x42, 0x4c, 0x39, 0x36,
+			0x25, 0x12, 0x27, 0xb, 0x23, 0x21, 0x1f, 0x39, 0x2a, 0x52, 0x48, 0x50,
+			0x2f, 0x3a, 0x37, 0x15, 0x16, 0x1a, 0x26, 0x16, 0x35, 0x19, 0x17, 0x26,
+			0x46, 0x3c, 0x33, 0x24, 0x37, 0x1a, 0x22, 0x17, 0x1b, 0xe, 0x9, 0x7,
+			0x22, 0x20, 0x1c, 0x27, 0x31, 0x4b, 0x1e, 0x34, 0x30, 0x28, 0x34, 0x1c,
+			0x12, 0x11, 0x9, 0x5, 0x2d, 0x15, 0x22, 0x40, 0x38, 0x32, 0x31, 0x2d,
+			0x1f, 0x13, 0xc, 0xf, 0xa, 0x7, 0x6, 0x3, 0x30, 0x17, 0x14, 0x27,
+			0x24, 0x23, 0x35, 0x15, 0x10, 0x17, 0xd, 0xa, 0x6, 0x1, 0x4, 0x2,
+			0x10, 0xf, 0x11, 0x1b, 0x19, 0x14, 0x1d, 0xb, 0x11, 0xc, 0x10, 0x8,
+			0x1, 0x1, 0x0, 0x1,
+		},
+		lengths: []uint8{
+			1, 4, 6, 7, 8, 9, 9, 10, 9, 10, 11, 11,
+			12, 12, 13, 13, 3, 4, 6, 7, 8, 8, 9, 9,
+			9, 9, 10, 10, 11, 12, 12, 12, 6, 6, 7, 8,
+			9, 9, 10, 10, 9, 10, 10, 11, 11, 12, 13, 13,
+			7, 7, 8, 9, 9, 10, 10, 10, 10, 11, 11, 11,
+			11, 12, 13, 13, 8, 7, 9, 9, 10, 10, 11, 11,
+			10, 11, 11, 12, 12, 13, 13, 14, 9, 8, 9, 10,
+			10, 10, 11, 11, 11, 11, 12, 11, 13, 13, 14, 14,
+			9, 9, 10, 10, 11, 11, 11, 11, 11, 12, 12, 12,
+			13, 13, 14, 14, 10, 9, 10, 11, 11, 11, 12, 12,
+			12, 12, 13, 13, 13, 14, 16, 16, 9, 8, 9, 10,
+			10, 11, 11, 12, 12, 12, 12, 13, 13, 14, 15, 15,
+			10, 9, 10, 10, 11, 11, 11, 13, 12, 13, 13, 14,
+			14, 14, 16, 15, 10, 10, 10, 11, 11, 12, 12, 13,
+			12, 13, 14, 13, 14, 15, 16, 17, 11, 10, 10, 11,
+			12, 12, 12, 12, 13, 13, 13, 14, 15, 15, 15, 16,
+			11, 11, 11, 12, 12, 13, 12, 13, 14, 14, 15, 15,
+			15, 16, 16, 16, 12, 11, 12, 13, 13, 13, 14, 14,
+			14, 14, 14, 15, 16, 15, 16, 16, 13, 12, 12, 13,
+			13, 13, 15, 14, 14, 17, 15, 15, 15, 17, 16, 16,
+			12, 12, 13, 14, 14, 14, 15, 14, 15, 15, 16, 16,
+			19, 18, 19, 16,
+		},
+	},
+	15: {
+		size: 16,
+		codes: []uint32{
+			0x7, 0xc, 0x12, 0x35, 0x2f, 0x4c, 0x7c, 0x6c, 0x59, 0x7b, 0x6c, 0x77,
+			0x6b, 0x51, 0x7a, 0x3f, 0xd, 0x5, 0x10, 0x1b, 0x2e, 0x24, 0x3d, 0x33,
+			0x2a, 0x46, 0x34, 0x53, 0x41, 0x29, 0x3b, 0x24, 0x13, 0x11, 0xf, 0x18,
+			0x29, 0x22, 0x3b, 0x30, 0x28, 0x40, 0x32, 0x4e, 0x3e, 0x50, 0x38, 0x21,
+			0x1d, 0x1c, 0x19, 0x2b, 0x27, 0x3f, 0x37, 0x5d, 0x4c, 0x3b, 0x5d, 0x48,
+			0x36, 0x4b, 0x32, 0x1d, 0x34, 0x16, 0x2a, 0x28, 0x43, 0x39, 0x5f, 0x4f,
+			0x48, 0x39, 0x59, 0x45, 0x31, 0x42, 0x2e, 0x1b, 0x4d, 0x25, 0x23, 0x42,
+			0x3a, 0x34, 0x5b, 0x4a, 0x3e, 0x30, 0x4f, 0x3f, 0x5a, 0x3e, 0x28, 0x26,
+			0x7d, 0x20, 0x3c, 0x38, 0x32, 0x5c, 0x4e, 0x41, 0x37, 0x57, 0x47, 0x33,
+			0x49, 0x33, 0x46, 0x1e, 0x6d, 0x35, 0x31, 0x5e, 0x58, 0x4b, 0x42, 0x7a,
+			0x5b, 0x49, 0x38, 0x2a, 0x40, 0x2c, 0x15, 0x19, 0x5a, 0x2b, 0x29, 0x4d,
+			0x49, 0x3f, 0x38, 0x5c, 0x4d, 0x42, 0x2f, 0x43, 0x30, 0x35, 0x24, 0x14,
+			0x47, 0x22, 0x43, 0x3c, 0x3a, 0x31, 0x58, 0x4c, 0x43, 0x6a, 0x47, 0x36,
+			0x26, 0x27, 0x17, 0xf, 0x6d, 0x35, 0x33, 0x2f, 0x5a, 0x52, 0x3a, 0x39,
+			0x30, 0x48, 0x39, 0x29, 0x17, 0x1b, 0x3e, 0x9, 0x56, 0x2a, 0x28, 0x25,
+			0x46, 0x40, 0x34, 0x2b, 0x46, 0x37, 0x2a, 0x19, 0x1d, 0x12, 0xb, 0xb,
+			0x76, 0x44, 0x1e, 0x37, 0x32, 0x2e, 0x4a, 0x41, 0x31, 0x27, 0x18, 0x10,
+			0x16, 0xd, 0xe, 0x7, 0x5b, 0x2c, 0x27, 0x26, 0x22, 0x3f, 0x34, 0x2d,
+			0x1f, 0x34, 0x1c, 0x13, 0xe, 0x8, 0x9, 0x3, 0x7b, 0x3c, 0x3a, 0x35,
+			0x2f, 0x2b, 0x20, 0x16, 0x25, 0x18, 0x11, 0xc, 0xf, 0xa, 0x2, 0x1,
+			0x47, 0x25, 0x22, 0x1e, 0x1c, 0x14, 0x11, 0x1a, 0x15, 0x10, 0xa, 0x6,
+			0x8, 0x6, 0x2, 0x0,
+		},
+		lengths: []uint8{
+			3, 4, 5, 7, 7, 8, 9, 9, 9, 10, 10, 11,
+			11, 11, 12, 13, 4, 3, 5, 6, 7, 7, 8, 8,
+			8, 9, 9, 10, 10, 10, 11, 11, 5, 5, 5, 6,
+			7, 7, 8, 8, 8, 9, 9, 10, 10, 11, 11, 11,
+			6, 6, 6, 7, 7, 8, 8, 9, 9, 9, 10, 10,
+			10, 11, 11, 11, 7, 6, 7, 7, 8, 8, 9, 9,
+			9, 9, 10, 10, 10, 11, 11, 11, 8, 7, 7, 8,
+			8, 8, 9, 9, 9, 9, 10, 10, 11, 11, 11, 12,
+			9, 7, 8, 8, 8, 9, 9, 9, 9, 10, 10, 10,
+			11, 11, 12, 12, 9, 8, 8, 9, 9, 9, 9, 10,
+			10, 10, 10, 10, 11, 11, 11, 12, 9, 8, 8, 9,
+			9, 9, 9, 10, 10, 10, 10, 11, 11, 12, 12, 12,
+			9, 8, 9, 9, 9, 9, 10, 10, 10, 11, 11, 11,
+			11, 12, 12, 12, 10, 9, 9, 9, 10, 10, 10, 10,
+			10, 11, 11, 11, 11, 12, 13, 12, 10, 9, 9, 9,
+			10, 10, 10, 10, 11, 11, 11, 11, 12, 12, 12, 13,
+			11, 10, 9, 10, 10, 10, 11, 11, 11, 11, 11, 11,
+			12, 12, 13, 13, 11, 10, 10, 10, 10, 11, 11, 11,
+			11, 12, 12, 12, 12, 12, 13, 13, 12, 11, 11, 11,
+			11, 11, 11, 11, 12, 12, 12, 12, 13, 13, 12, 13,
+			12, 11, 11, 11, 11, 11, 11, 12, 12, 12, 12, 12,
+			13, 13, 13, 13,
+		},
+	},
+	16: {
+		size: 16,
+		codes: []uint32{
+			0x1, 0x5, 0xe, 0x2c, 0x4a, 0x3f, 0x6e, 0x5d, 0xac, 0x95, 0x8a, 0xf2,
+			0xe1, 0xc3, 0x178, 0x11, 0x3, 0x4, 0xc, 0x14, 0x23, 0x3e, 0x35, 0x2f,
+			0x53, 0x4b, 0x44, 0x77, 0xc9, 0x6b, 0xcf, 0x9, 0xf, 0xd, 0x17, 0x26,
+			0x43, 0x3a, 0x67, 0x5a, 0xa1, 0x48, 0x7f, 0x75, 0x6e, 0xd1, 0xce, 0x10,
+			0x2d, 0x15, 0x27, 0x45, 0x40, 0x72, 0x63, 0x57, 0x9e, 0x8c, 0xfc, 0xd4,
+			0xc7, 0x183, 0x16d, 0x1a, 0x4b, 0x24, 0x44, 0x41, 0x73, 0x65, 0xb3, 0xa4,
+			0x9b, 0x108, 0xf6, 0xe2, 0x18b, 0x17e, 0x16a, 0x9, 0x42, 0x1e, 0x3b, 0x38,
+			0x66, 0xb9, 0xad, 0x109, 0x8e, 0xfd, 0xe8, 0x190, 0x184, 0x17a, 0x1bd, 0x10,
+			0x6f, 0x36, 0x34, 0x64, 0xb8, 0xb2, 0xa0, 0x85, 0x101, 0xf4, 0xe4, 0xd9,
+			0x181, 0x16e, 0x2cb, 0xa, 0x62, 0x30, 0x5b, 0x58, 0xa5, 0x9d, 0x94, 0x105,
+			0xf8, 0x197, 0x18d, 0x174, 0x17c, 0x379, 0x374, 0x8, 0x55, 0x54, 0x51, 0x9f,
+			0x9c, 0x8f, 0x104, 0xf9, 0x1ab, 0x191, 0x188, 0x17f, 0x2d7, 0x2c9, 0x2c4, 0x7,
+			0x9a, 0x4c, 0x49, 0x8d, 0x83, 0x100, 0xf5, 0x1aa, 0x196, 0x18a, 0x180, 0x2df,
+			0x167, 0x2c6, 0x160, 0xb, 0x8b, 0x81, 0x43, 0x7d, 0xf7, 0xe9, 0xe5, 0xdb,
+			0x189, 0x2e7, 0x2e1, 0x2d0, 0x375, 0x372, 0x1b7, 0x4, 0xf3, 0x78, 0x76, 0x73,
+			0xe3, 0xdf, 0x18c, 0x2ea, 0x2e6, 0x2e0, 0x2d1, 0x2c8, 0x2c2, 0xdf, 0x1b4, 0x6,
+			0xca, 0xe0, 0xde, 0xda, 0xd8, 0x185, 0x182, 0x17d, 0x16c, 0x378, 0x1bb, 0x2c3,
+			0x1b8, 0x1b5, 0x6c0, 0x4, 0x2eb, 0xd3, 0xd2, 0xd0, 0x172, 0x17b, 0x2de, 0x2d3,
+			0x2ca, 0x6c7, 0x373, 0x36d, 0x36c, 0xd83, 0x361, 0x2, 0x179, 0x171, 0x66, 0xbb,
+			0x2d6, 0x2d2, 0x166, 0x2c7, 0x2c5, 0x362, 0x6c6, 0x367, 0xd82, 0x366, 0x1b2, 0x0,
+			0xc, 0xa, 0x7, 0xb, 0xa, 0x11, 0xb, 0x9, 0xd, 0xc, 0xa, 0x7,
+			0x5, 0x3, 0x1, 0x3,
+		},
+		lengths: []uint8{
+			1, 4, 6, 8, 9, 9, 10, 10, 11, 11, 11, 12,
+			12, 12, 13, 9, 3, 4, 6, 7, 8, 9, 9, 9,
+			10, 10, 10, 11, 12, 11, 12, 8, 6, 6, 7, 8,
+			9, 9, 10, 10, 11, 10, 11, 11, 11, 12, 12, 9,
+			8, 7, 8, 9, 9, 10, 10, 10, 11, 11, 12, 12,
+			12, 13, 13, 10, 9, 8, 9, 9, 10, 10, 11, 11,
+			11, 12, 12, 12, 13, 13, 13, 9, 9, 8, 9, 9,
+			10, 11, 11, 12, 11, 12, 12, 13, 13, 13, 14, 10,
+			10, 9, 9, 10, 11, 11, 11, 11, 12, 12, 12, 12,
+			13, 13, 14, 10, 10, 9, 10, 10, 11, 11, 11, 12,
+			12, 13, 13, 13, 13, 15, 15, 10, 10, 10, 10, 11,
+			11, 11, 12, 12, 13, 13, 13, 13, 14, 14, 14, 10,
+			11, 10, 10, 11, 11, 12, 12, 13, 13, 13, 13, 14,
+			13, 14, 13, 11, 11, 11, 10, 11, 12, 12, 12, 12,
+			13, 14, 14, 14, 15, 15, 14, 10, 12, 11, 11, 11,
+			12, 12, 13, 14, 14, 14, 14, 14, 14, 13, 14, 11,
+			12, 12, 12, 12, 12, 13, 13, 13, 13, 15, 14, 14,
+			14, 14, 16, 11, 14, 12, 12, 12, 13, 13, 14, 14,
+			14, 16, 15, 15, 15, 17, 15, 11, 13, 13, 11, 12,
+			14, 14, 13, 14, 14, 15, 16, 15, 17, 15, 14, 11,
+			9, 8, 8, 9, 9, 10, 10, 10, 11, 11, 11, 11,
+			11, 11, 11, 8,
+		},
+	},
+	24: {
+		size: 16,
+		codes: []uint32{
+			0xf, 0xd, 0x2e, 0x50, 0x92, 0x106, 0xf8, 0x1b2, 0x1aa, 0x29d, 0x28d, 0x289,
+			0x26d, 0x205, 0x408, 0x58, 0xe, 0xc, 0x15, 0x26, 0x47, 0x82, 0x7a, 0xd8,
+			0xd1, 0xc6, 0x147, 0x159, 0x13f, 0x129, 0x117, 0x2a, 0x2f, 0x16, 0x29, 0x4a,
+			0x44, 0x80, 0x78, 0xdd, 0xcf, 0xc2, 0xb6, 0x154, 0x13b, 0x127, 0x21d, 0x12,
+			0x51, 0x27, 0x4b, 0x46, 0x86, 0x7d, 0x74, 0xdc, 0xcc, 0xbe, 0xb2, 0x145,
+			0x137, 0x125, 0x10f, 0x10, 0x93, 0x48, 0x45, 0x87, 0x7f, 0x76, 0x70, 0xd2,
+			0xc8, 0xbc, 0x160, 0x143, 0x132, 0x11d, 0x21c, 0xe, 0x107, 0x42, 0x81, 0x7e,
+			0x77, 0x72, 0xd6, 0xca, 0xc0, 0xb4, 0x155, 0x13d, 0x12d, 0x119, 0x106, 0xc,
+			0xf9, 0x7b, 0x79, 0x75, 0x71, 0xd7, 0xce, 0xc3, 0xb9, 0x15b, 0x14a, 0x134,
+			0x123, 0x110, 0x208, 0xa, 0x1b3, 0x73, 0x6f, 0x6d, 0xd3, 0xcb, 0xc4, 0xbb,
+			0x161, 0x14c, 0x139, 0x12a, 0x11b, 0x213, 0x17d, 0x11, 0x1ab, 0xd4, 0xd0, 0xcd,
+			0xc9, 0xc1, 0xba, 0xb1, 0xa9, 0x140, 0x12f, 0x11e, 0x10c, 0x202, 0x179, 0x10,
+			0x14f, 0xc7, 0xc5, 0xbf, 0xbd, 0xb5, 0xae, 0x14d, 0x141, 0x131, 0x121, 0x113,
+			0x209, 0x17b, 0x173, 0xb, 0x29c, 0xb8, 0xb7, 0xb3, 0xaf, 0x158, 0x14b, 0x13a,
+			0x130, 0x122, 0x115, 0x212, 0x17f, 0x175, 0x16e, 0xa, 0x28c, 0x15a, 0xab, 0xa8,
+			0xa4, 0x13e, 0x135, 0x12b, 0x11f, 0x114, 0x107, 0x201, 0x177, 0x170, 0x16a, 0x6,
+			0x288, 0x142, 0x13c, 0x138, 0x133, 0x12e, 0x124, 0x11c, 0x10d, 0x105, 0x200, 0x178,
+			0x172, 0x16c, 0x167, 0x4, 0x26c, 0x12c, 0x128, 0x126, 0x120, 0x11a, 0x111, 0x10a,
+			0x203, 0x17c, 0x176, 0x171, 0x16d, 0x169, 0x165, 0x2, 0x409, 0x118, 0x116, 0x112,
+			0x10b, 0x108, 0x103, 0x17e, 0x17a, 0x174, 0x16f, 0x16b, 0x168, 0x166, 0x164, 0x0,
+			0x2b, 0x14, 0x13, 0x11, 0xf, 0xd, 0xb, 0x9, 0x7, 0x6, 0x4, 0x7,
+			0x5, 0x3, 0x1, 0x3,
+		},
+		lengths: []uint8{
+			4, 4, 6, 7, 8, 9, 9, 10, 10, 11, 11, 11,
+			11, 11, 12, 9, 4, 4, 5, 6, 7, 8, 8, 9,
+			9, 9, 10, 10, 10, 10, 10, 8, 6, 5, 6, 7,
+			7, 8, 8, 9, 9, 9, 9, 10, 10, 10, 11, 7,
+			7, 6, 7, 7, 8, 8, 8, 9, 9, 9, 9, 10,
+			10, 10, 10, 7, 8, 7, 7, 8, 8, 8, 8, 9,
+			9, 9, 10, 10, 10, 10, 11, 7, 9, 7, 8, 8,
+			8, 8, 9, 9, 9, 9, 10, 10, 10, 10, 10, 7,
+			9, 8, 8, 8, 8, 9, 9, 9, 9, 10, 10, 10,
+			10, 10, 11, 7, 10, 8, 8, 8, 9, 9, 9, 9,
+			10, 10, 10, 10, 10, 11, 11, 8, 10, 9, 9, 9,
+			9, 9, 9, 9, 9, 10, 10, 10, 10, 11, 11, 8,
+			10, 9, 9, 9, 9, 9, 9, 10, 10, 10, 10, 10,
+			11, 11, 11, 8, 11, 9, 9, 9, 9, 10, 10, 10,
+			10, 10, 10, 11, 11, 11, 11, 8, 11, 10, 9, 9,
+			9, 10, 10, 10, 10, 10, 10, 11, 11, 11, 11, 8,
+			11, 10, 10, 10, 10, 10, 10, 10, 10, 10, 11, 11,
+			11, 11, 11, 8, 11, 10, 10, 10, 10, 10, 10, 10,
+			11, 11, 11, 11, 11, 11, 11, 8, 12, 10, 10, 10,
+			10, 10, 10, 11, 11, 11, 11, 11, 11, 11, 11, 8,
+			8, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 8,
+			8, 8, 8, 4,
+		},
+	},
+	32: {
+		size: 16,
+		codes: []uint32{
+			0x1, 0x5, 0x4, 0x5, 0x6, 0x5, 0x4, 0x4, 0x7, 0x3, 0x6, 0x0,
+			0x7, 0x2, 0x3, 0x1,
+		},
+		lengths: []uint8{
+			1, 4, 4, 5, 4, 6, 5, 6, 4, 5, 5, 6,
+			5, 6, 6, 6,
+		},
+	},
+	33: {
+		size: 16,
+		codes: []uint32{
+			0xf, 0xe, 0xd, 0xc, 0xb, 0xa, 0x9, 0x8, 0x7, 0x6, 0x5, 0x4,
+			0x3, 0x2, 0x1, 0x0,
+		},
+		lengths: []uint8{
+			4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+			4, 4, 4, 4,
+		},
+	},
+}
+
+// huffmanLinbits is the number of bits of the values above 15 for the tables that have them
+var huffmanLinbits = [32]int{
+	16: 1, 17: 2, 18: 3, 19: 4, 20: 6, 21: 8, 22: 10, 23: 13,
+	24: 4, 25: 5, 26: 6, 27: 7, 28: 8, 29: 9, 30: 11, 31: 13,
+}
+
+// mp3Bitrates are the bitrates in kbit/s by bitrate index, for MPEG-1 and MPEG-2 (low sampling
+// frequencies)
+var mp3Bitrates = [2][15]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+// mp3SampleRates are the sample rates by sampling frequency index, for MPEG-1 and MPEG-2
+var mp3SampleRates = [2][3]int{
+	{44100, 48000, 32000},
+	{22050, 24000, 16000},
+}
+
+// scalefactorBands are the boundaries of the long block scalefactor bands, by MPEG version and
+// sampling frequency index
+var scalefactorBands = [2][3][23]int{
+	{
+		{0, 4, 8, 12, 16, 20, 24, 30, 36, 44, 52, 62, 74, 90, 110, 134, 162, 196, 238, 288, 342, 418, 576},
+		{0, 4, 8, 12, 16, 20, 24, 30, 36, 42, 50, 60, 72, 88, 106, 128, 156, 190, 230, 276, 330, 384, 576},
+		{0, 4, 8, 12, 16, 20, 24, 30, 36, 44, 54, 66, 82, 102, 126, 156, 194, 240, 296, 364, 448, 550, 576},
+	},
+	{
+		{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 116, 140, 168, 200, 238, 284, 336, 396, 464, 522, 576},
+		{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 114, 136, 162, 194, 232, 278, 332, 394, 464, 540, 576},
+		{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 116, 140, 168, 200, 238, 284, 336, 396, 464, 522, 576},
+	},
+}
+
+// regionCounts are region0_count and region1_count by the number of scalefactor bands holding big
+// values, splitting them into three regions of growing size
+var regionCounts = [23][2]int{
+	{0, 0}, {0, 0}, {0, 0}, {0, 0}, {0, 0}, {0, 1}, {1, 1}, {1, 1}, {1, 2}, {2, 2}, {2, 3}, {2, 3},
+	{3, 4}, {3, 4}, {3, 4}, {4, 5}, {4, 5}, {4, 6}, {5, 6}, {5, 6}, {5, 7}, {6, 7}, {6, 7},
+}
+
+// Coefficients of the alias reduction butterflies
+var (
+	aliasCs = [8]float64{0.857493, 0.881742, 0.949629, 0.983315, 0.995518, 0.999161, 0.999899, 0.999993}
+	aliasCa = [8]float64{-0.514496, -0.471732, -0.313377, -0.181913, -0.094574, -0.040966, -0.014199, -0.003700}
+)
+
+// synthesisWindow is the window D of the polyphase synthesis filter bank. The window C of the
+// analysis filter bank is D/32.
+var synthesisWindow = [512]float64{
+	0.000000000, -0.000015259, -0.000015259, -0.000015259, -0.000015259, -0.000015259, -0.000015259, -0.000030518,
+	-0.000030518, -0.000030518, -0.000030518, -0.000045776, -0.000045776, -0.000061035, -0.000061035, -0.000076294,
+	-0.000076294, -0.000091553, -0.000106812, -0.000106812, -0.000122070, -0.000137329, -0.000152588, -0.000167847,
+	-0.000198364, -0.000213623, -0.000244141, -0.000259399, -0.000289917, -0.000320435, -0.000366211, -0.000396729,
+	-0.000442505, -0.000473022, -0.000534058, -0.000579834, -0.000625610, -0.000686646, -0.000747681, -0.000808716,
+	-0.000885010, -0.000961304, -0.001037598, -0.001113892, -0.001205444, -0.001296997, -0.001388550, -0.001480103,
+	-0.001586914, -0.001693726, -0.001785278, -0.001907349, -0.002014160, -0.002120972, -0.002243042, -0.002349854,
+	-0.002456665, -0.002578735, -0.002685547, -0.002792358, -0.002899170, -0.002990723, -0.003082275, -0.003173828,
+	0.003250122, 0.003326416, 0.003387451, 0.003433228, 0.003463745, 0.003479004, 0.003479004, 0.003463745,
+	0.003417969, 0.003372192, 0.003280640, 0.003173828, 0.003051758, 0.002883911, 0.002700806, 0.002487183,
+	0.002227783, 0.001937866, 0.001617432, 0.001266479, 0.000869751, 0.000442505, -0.000030518, -0.000549316,
+	-0.001098633, -0.001693726, -0.002334595, -0.003005981, -0.003723145, -0.004486084, -0.005294800, -0.006118774,
+	-0.007003784, -0.007919312, -0.008865356, -0.009841919, -0.010848999, -0.011886597, -0.012939453, -0.014022827,
+	-0.015121460, -0.016235352, -0.017349243, -0.018463135, -0.019577026, -0.020690918, -0.021789551, -0.022857666,
+	-0.023910522, -0.024932861, -0.025909424, -0.026840210, -0.027725220, -0.028533936, -0.029281616, -0.029937744,
+	-0.030532837, -0.031005859, -0.031387329, -0.031661987, -0.031814575, -0.031845093, -0.031738281, -0.031478882,
+	0.031082153, 0.030517578, 0.029785156, 0.028884888, 0.027801514, 0.026535034, 0.025085449, 0.023422241,
+	0.021575928, 0.019531250, 0.017257690, 0.014801025, 0.012115479, 0.009231567, 0.006134033, 0.002822876,
+	-0.000686646, -0.004394531, -0.008316040, -0.012420654, -0.016708374, -0.021179199, -0.025817871, -0.030609131,
+	-0.035552979, -0.040634155, -0.045837402, -0.051132202, -0.056533813, -0.061996460, -0.067520142, -0.073059082,
+	-0.078628540, -0.084182739, -0.089706421, -0.095169067, -0.100540161, -0.105819702, -0.110946655, -0.115921021,
+	-0.120697021, -0.125259399, -0.129562378, -0.133590698, -0.137298584, -0.140670776, -0.143676758, -0.146255493,
+	-0.148422241, -0.150115967, -0.151306152, -0.151962280, -0.152069092, -0.151596069, -0.150497437, -0.148773193,
+	-0.146362305, -0.143264771, -0.139450073, -0.134887695, -0.129577637, -0.123474121, -0.116577148, -0.108856201,
+	0.100311279, 0.090927124, 0.080688477, 0.069595337, 0.057617188, 0.044784546, 0.031082153, 0.016510010,
+	0.001068115, -0.015228271, -0.032379150, -0.050354004, -0.069168091, -0.088775635, -0.109161377, -0.130310059,
+	-0.152206421, -0.174789429, -0.198059082, -0.221984863, -0.246505737, -0.271591187, -0.297210693, -0.323318481,
+	-0.349868774, -0.376800537, -0.404083252, -0.431655884, -0.459472656, -0.487472534, -0.515609741, -0.543823242,
+	-0.572036743, -0.600219727, -0.628295898, -0.656219482, -0.683914185, -0.711318970, -0.738372803, -0.765029907,
+	-0.791213989, -0.816864014, -0.841949463, -0.866363525, -0.890090942, -0.913055420, -0.935195923, -0.956481934,
+	-0.976852417, -0.996246338, -1.014617920, -1.031936646, -1.048156738, -1.063217163, -1.077117920, -1.089782715,
+	-1.101211548, -1.111373901, -1.120223999, -1.127746582, -1.133926392, -1.138763428, -1.142211914, -1.144287109,
+	1.144989014, 1.144287109, 1.142211914, 1.138763428, 1.133926392, 1.127746582, 1.120223999, 1.111373901,
+	1.101211548, 1.089782715, 1.077117920, 1.063217163, 1.048156738, 1.031936646, 1.014617920, 0.996246338,
+	0.976852417, 0.956481934, 0.935195923, 0.913055420, 0.890090942, 0.866363525, 0.841949463, 0.816864014,
+	0.791213989, 0.765029907, 0.738372803, 0.711318970, 0.683914185, 0.656219482, 0.628295898, 0.600219727,
+	0.572036743, 0.543823242, 0.515609741, 0.487472534, 0.459472656, 0.431655884, 0.404083252, 0.376800537,
+	0.349868774, 0.323318481, 0.297210693, 0.271591187, 0.246505737, 0.221984863, 0.198059082, 0.174789429,
+	0.152206421, 0.130310059, 0.109161377, 0.088775635, 0.069168091, 0.050354004, 0.032379150, 0.015228271,
+	-0.001068115, -0.016510010, -0.031082153, -0.044784546, -0.057617188, -0.069595337, -0.080688477, -0.090927124,
+	0.100311279, 0.108856201, 0.116577148, 0.123474121, 0.129577637, 0.134887695, 0.139450073, 0.143264771,
+	0.146362305, 0.148773193, 0.150497437, 0.151596069, 0.152069092, 0.151962280, 0.151306152, 0.150115967,
+	0.148422241, 0.146255493, 0.143676758, 0.140670776, 0.137298584, 0.133590698, 0.129562378, 0.125259399,
+	0.120697021, 0.115921021, 0.110946655, 0.105819702, 0.100540161, 0.095169067, 0.089706421, 0.084182739,
+	0.078628540, 0.073059082, 0.067520142, 0.061996460, 0.056533813, 0.051132202, 0.045837402, 0.040634155,
+	0.035552979, 0.030609131, 0.025817871, 0.021179199, 0.016708374, 0.012420654, 0.008316040, 0.004394531,
+	0.000686646, -0.002822876, -0.006134033, -0.009231567, -0.012115479, -0.014801025, -0.017257690, -0.019531250,
+	-0.021575928, -0.023422241, -0.025085449, -0.026535034, -0.027801514, -0.028884888, -0.029785156, -0.030517578,
+	0.031082153, 0.031478882, 0.031738281, 0.031845093, 0.031814575, 0.031661987, 0.031387329, 0.031005859,
+	0.030532837, 0.029937744, 0.029281616, 0.028533936, 0.027725220, 0.026840210, 0.025909424, 0.024932861,
+	0.023910522, 0.022857666, 0.021789551, 0.020690918, 0.019577026, 0.018463135, 0.017349243, 0.016235352,
+	0.015121460, 0.014022827, 0.012939453, 0.011886597, 0.010848999, 0.009841919, 0.008865356, 0.007919312,
+	0.007003784, 0.006118774, 0.005294800, 0.004486084, 0.003723145, 0.003005981, 0.002334595, 0.001693726,
+	0.001098633, 0.000549316, 0.000030518, -0.000442505, -0.000869751, -0.001266479, -0.001617432, -0.001937866,
+	-0.002227783, -0.002487183, -0.002700806, -0.002883911, -0.003051758, -0.003173828, -0.003280640, -0.003372192,
+	-0.003417969, -0.003463745, -0.003479004, -0.003479004, -0.003463745, -0.003433228, -0.003387451, -0.003326416,
+	0.003250122, 0.003173828, 0.003082275, 0.002990723, 0.002899170, 0.002792358, 0.002685547, 0.002578735,
+	0.002456665, 0.002349854, 0.002243042, 0.002120972, 0.002014160, 0.001907349, 0.001785278, 0.001693726,
+	0.001586914, 0.001480103, 0.001388550, 0.001296997, 0.001205444, 0.001113892, 0.001037598, 0.000961304,
+	0.000885010, 0.000808716, 0.000747681, 0.000686646, 0.000625610, 0.000579834, 0.000534058, 0.000473022,
+	0.000442505, 0.000396729, 0.000366211, 0.000320435, 0.000289917, 0.000259399, 0.000244141, 0.000213623,
+	0.000198364, 0.000167847, 0.000152588, 0.000137329, 0.000122070, 0.000106812, 0.000106812, 0.000091553,
+	0.000076294, 0.000076294, 0.000061035, 0.000061035, 0.000045776, 0.000045776, 0.000030518, 0.000030518,
+	0.000030518, 0.000030518, 0.000015259, 0.000015259, 0.000015259, 0.000015259, 0.000015259, 0.000015259,
+}
@@ -0,0 +1,174 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidOgg is returned when an Ogg stream cannot be parsed
+var ErrInvalidOgg = errors.New("invalid ogg data")
+
+// Flags of the header_type field of an Ogg page
+const (
+	oggContinued = 0x01
+	oggFirstPage = 0x02
+)
+
+// oggHeaderSize is the size of a page header without its segment table
+const oggHeaderSize = 27
+
+var oggCRCTable = func() (table [256]uint32) {
+	// CRC-32 with polynomial 0x04c11db7, most significant bit first, as defined by RFC 3533
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// oggReader splits an Ogg stream received in chunks into packets. Pages, and packets spanning
+// pages, are put back together across chunks. Only the first logical stream is read.
+type oggReader struct {
+	// buf holds the bytes received and not parsed yet
+	buf []byte
+	// packet is the start of a packet continued on the next page
+	packet []byte
+	serial uint32
+	// started is set once the first page has been read
+	started bool
+}
+
+// Read adds data to the stream and returns the packets completed by it
+func (r *oggReader) Read(data []byte) ([][]byte, error) {
+	r.buf = append(r.buf, data...)
+
+	var packets [][]byte
+	for {
+		if len(r.buf) < oggHeaderSize {
+			return packets, nil
+		}
+		if string(r.buf[:4]) != "OggS" || r.buf[4] != 0 {
+			r.buf = nil
+			return packets, fmt.Errorf("%w: missing page header", ErrInvalidOgg)
+		}
+		segments := int(r.buf[26])
+		if len(r.buf) < oggHeaderSize+segments {
+			return packets, nil
+		}
+		lacing := r.buf[oggHeaderSize : oggHeaderSize+segments]
+		size := oggHeaderSize + segments
+		for _, l := range lacing {
+			size += int(l)
+		}
+		if len(r.buf) < size {
+			return packets, nil
+		}
+
+		page := r.buf[:size]
+		r.buf = r.buf[size:]
+		crc := binary.LittleEndian.Uint32(page[22:26])
+		binary.LittleEndian.PutUint32(page[22:26], 0)
+		if oggCRC(page) != crc {
+			return packets, fmt.Errorf("%w: page checksum mismatch", ErrInvalidOgg)
+		}
+		serial := binary.LittleEndian.Uint32(page[14:18])
+		if !r.started {
+			r.started, r.serial = true, serial
+		}
+		if serial != r.serial {
+			// another logical stream multiplexed with ours
+			continue
+		}
+		if page[5]&oggContinued == 0 {
+			r.packet = nil
+		}
+
+		body := page[oggHeaderSize+segments:]
+		for _, l := range lacing {
+			r.packet = append(r.packet, body[:l]...)
+			body = body[l:]
+			// a lacing value below 255 ends the packet
+			if l < 255 {
+				packets = append(packets, r.packet)
+				r.packet = nil
+			}
+		}
+	}
+}
+
+// oggWriter builds the pages of a logical Ogg stream
+type oggWriter struct {
+	serial   uint32
+	sequence uint32
+}
+
+// pages returns the pages holding packets. granules are the granule positions of the end of each
+// packet, flags the header_type of the first page.
+func (w *oggWriter) pages(packets [][]byte, granules []int64, flags byte) []byte {
+	var lacing []byte
+	var body []byte
+	for _, p := range packets {
+		for n := len(p); ; n -= 255 {
+			if n < 255 {
+				lacing = append(lacing, byte(n))
+				break
+			}
+			lacing = append(lacing, 255)
+		}
+		body = append(body, p...)
+	}
+
+	var out []byte
+	ended := 0
+	for len(lacing) > 0 {
+		// a page holds 255 segments at most, the packets go on in the next page
+		segments := lacing[:min(len(lacing), 255)]
+		lacing = lacing[len(segments):]
+		size := 0
+		// the granule position of a page is that of the last packet ending on it, -1 if none does
+		granule := int64(-1)
+		for _, l := range segments {
+			size += int(l)
+			if l < 255 {
+				granule = granules[ended]
+				ended++
+			}
+		}
+
+		page := make([]byte, oggHeaderSize+len(segments)+size)
+		copy(page, "OggS")
+		page[5] = flags
+		binary.LittleEndian.PutUint64(page[6:14], uint64(granule))
+		binary.LittleEndian.PutUint32(page[14:18], w.serial)
+		binary.LittleEndian.PutUint32(page[18:22], w.sequence)
+		page[26] = byte(len(segments))
+		copy(page[oggHeaderSize:], segments)
+		copy(page[oggHeaderSize+len(segments):], body[:size])
+		binary.LittleEndian.PutUint32(page[22:26], oggCRC(page))
+		body = body[size:]
+		w.sequence++
+
+		flags &^= oggFirstPage | oggContinued
+		if segments[len(segments)-1] == 255 {
+			flags |= oggContinued
+		}
+		out = append(out, page...)
+	}
+	return out
+}
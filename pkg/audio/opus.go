@@ -0,0 +1,324 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+var (
+	// ErrInvalidOpus is returned when Opus data cannot be decoded
+	ErrInvalidOpus = errors.New("invalid opus data")
+	// ErrOpusUnavailable is returned when the binary was built without an Opus codec
+	ErrOpusUnavailable = errors.New("opus codec not available, build with -tags opus and libopus")
+)
+
+// OpusFrameDuration is the duration of the packets made by OpusStreamEncoder
+const OpusFrameDuration = 20 * time.Millisecond
+
+// opusSampleRates are the sample rates Opus encodes and decodes, every stream is 48 kHz for Ogg
+var opusSampleRates = []int{8000, 12000, 16000, 24000, 48000}
+
+// OpusEncoder encodes frames of audio into Opus packets
+type OpusEncoder interface {
+	// Encode encodes a frame of interleaved samples. The frame lasts 2.5, 5, 10, 20, 40 or 60ms.
+	Encode(pcm []float32) ([]byte, error)
+}
+
+// OpusDecoder decodes Opus packets
+type OpusDecoder interface {
+	// Decode decodes a packet into interleaved samples
+	Decode(packet []byte) ([]float32, error)
+}
+
+// OpusEncoderFactory creates an encoder for audio with the given sample rate and number of channels,
+// at bitrate bit/s
+type OpusEncoderFactory func(sampleRate, channels, bitrate int) (OpusEncoder, error)
+
+// OpusDecoderFactory creates a decoder that outputs audio with the given sample rate and number of
+// channels
+type OpusDecoderFactory func(sampleRate, channels int) (OpusDecoder, error)
+
+// NewOpusEncoder and NewOpusDecoder create the Opus codecs used by the package. Builds with the
+// opus tag set them to libopus, otherwise they return ErrOpusUnavailable.
+var (
+	NewOpusEncoder OpusEncoderFactory = func(int, int, int) (OpusEncoder, error) {
+		return nil, ErrOpusUnavailable
+	}
+	NewOpusDecoder OpusDecoderFactory = func(int, int) (OpusDecoder, error) {
+		return nil, ErrOpusUnavailable
+	}
+)
+
+// opusFrameSamples are the frame durations of each TOC configuration, in samples at 48 kHz. The
+// configurations go by four for SILK, by two for hybrid and by four for CELT.
+var opusFrameSamples = [32]int{
+	480, 960, 1920, 2880, 480, 960, 1920, 2880, 480, 960, 1920, 2880,
+	480, 960, 480, 960,
+	120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960,
+}
+
+// opusPacketSamples returns the duration of an Opus packet in samples at 48 kHz, from its TOC byte
+// as defined by RFC 6716 section 3.1
+func opusPacketSamples(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, fmt.Errorf("%w: empty packet", ErrInvalidOpus)
+	}
+	toc := packet[0]
+	frames := 1
+	switch toc & 3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, fmt.Errorf("%w: missing frame count", ErrInvalidOpus)
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+	samples := frames * opusFrameSamples[toc>>3]
+	// a packet lasts 120ms at most
+	if frames == 0 || samples > 5760 {
+		return 0, fmt.Errorf("%w: packet of %d frames", ErrInvalidOpus, frames)
+	}
+	return samples, nil
+}
+
+// OpusPacketDuration returns the duration of an Opus packet
+func OpusPacketDuration(packet []byte) (time.Duration, error) {
+	samples, err := opusPacketSamples(packet)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(samples) * time.Second / 48000, nil
+}
+
+// opusHead is the identification header of an Ogg Opus stream, RFC 7845 section 5.1
+type opusHead struct {
+	channels int
+	// preSkip is the number of samples at 48 kHz to drop at the start of the stream
+	preSkip    int
+	sampleRate int
+}
+
+func parseOpusHead(packet []byte) (opusHead, error) {
+	if len(packet) < 19 || string(packet[:8]) != "OpusHead" {
+		return opusHead{}, fmt.Errorf("%w: missing OpusHead", ErrInvalidOpus)
+	}
+	if packet[8]>>4 != 0 {
+		return opusHead{}, fmt.Errorf("%w: unsupported version %d", ErrInvalidOpus, packet[8])
+	}
+	h := opusHead{
+		channels:   int(packet[9]),
+		preSkip:    int(binary.LittleEndian.Uint16(packet[10:12])),
+		sampleRate: int(binary.LittleEndian.Uint32(packet[12:16])),
+	}
+	// mapping family 0 covers mono and stereo, the others need a multistream decoder
+	if family := packet[18]; family != 0 || h.channels < 1 || h.channels > 2 {
+		return opusHead{}, fmt.Errorf("%w: %d channels with mapping family %d are not supported", ErrInvalidOpus, h.channels, family)
+	}
+	return h, nil
+}
+
+func (h opusHead) packet() []byte {
+	p := make([]byte, 19)
+	copy(p, "OpusHead")
+	p[8] = 1
+	p[9] = byte(h.channels)
+	binary.LittleEndian.PutUint16(p[10:12], uint16(h.preSkip))
+	binary.LittleEndian.PutUint32(p[12:16], uint32(h.sampleRate))
+	return p
+}
+
+// opusTags returns a comment header with no comments, RFC 7845 section 5.2
+func opusTags(vendor string) []byte {
+	p := append([]byte("OpusTags"), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(p[8:], uint32(len(vendor)))
+	p = append(p, vendor...)
+	return append(p, 0, 0, 0, 0)
+}
+
+func checkOpusFormat(sampleRate, channels int) error {
+	if !slices.Contains(opusSampleRates, sampleRate) {
+		return fmt.Errorf("unsupported opus sample rate %d Hz", sampleRate)
+	}
+	if channels != 1 && channels != 2 {
+		return fmt.Errorf("opus supports 1 or 2 channels, got %d", channels)
+	}
+	return nil
+}
+
+// OpusStreamEncoder encodes a stream of audio into packets of OpusFrameDuration. With raw framing
+// every packet makes a message, with Ogg framing the stream is an Ogg Opus file whose pages make
+// the messages.
+//
+// An OpusStreamEncoder is not safe for concurrent use.
+type OpusStreamEncoder struct {
+	encoder    OpusEncoder
+	sampleRate int
+	channels   int
+	// pending holds the interleaved samples not encoded yet
+	pending []float32
+
+	// ogg is nil with raw framing
+	ogg *oggWriter
+	// granule is the granule position of the end of the last packet, in samples at 48 kHz
+	granule int64
+}
+
+// NewOpusStreamEncoder creates an encoder for audio with the given sample rate and number of
+// channels, at bitrate bit/s. ogg selects Ogg framing instead of raw packets.
+func NewOpusStreamEncoder(sampleRate, channels, bitrate int, ogg bool) (*OpusStreamEncoder, error) {
+	if err := checkOpusFormat(sampleRate, channels); err != nil {
+		return nil, err
+	}
+	encoder, err := NewOpusEncoder(sampleRate, channels, bitrate)
+	if err != nil {
+		return nil, err
+	}
+	e := &OpusStreamEncoder{encoder: encoder, sampleRate: sampleRate, channels: channels}
+	if ogg {
+		e.ogg = &oggWriter{serial: uint32(time.Now().UnixNano())}
+	}
+	return e, nil
+}
+
+// Encode adds a to the stream and returns the messages completed so far
+func (e *OpusStreamEncoder) Encode(a Audio) ([][]byte, error) {
+	if a.sampleRate != e.sampleRate || a.channels != e.channels {
+		return nil, fmt.Errorf("opus encoder expects %d Hz audio with %d channels, got %d Hz with %d channels",
+			e.sampleRate, e.channels, a.sampleRate, a.channels)
+	}
+	e.pending = append(e.pending, a.float32Data...)
+
+	frameSize := e.sampleRate * e.channels * int(OpusFrameDuration/time.Millisecond) / 1000
+	var packets [][]byte
+	var granules []int64
+	for len(e.pending) >= frameSize {
+		packet, err := e.encoder.Encode(e.pending[:frameSize])
+		if err != nil {
+			return nil, err
+		}
+		e.pending = e.pending[frameSize:]
+		e.granule += int64(48 * (OpusFrameDuration / time.Millisecond))
+		packets = append(packets, packet)
+		granules = append(granules, e.granule)
+	}
+	e.pending = append([]float32(nil), e.pending...)
+
+	if e.ogg == nil || len(packets) == 0 {
+		return packets, nil
+	}
+	var pages []byte
+	if e.ogg.sequence == 0 {
+		// the stream starts with its headers, each on its own page. The pre-skip is left at 0, the
+		// lookahead of the encoder is played as a few milliseconds of silence.
+		head := opusHead{channels: e.channels, sampleRate: e.sampleRate}
+		pages = e.ogg.pages([][]byte{head.packet()}, []int64{0}, oggFirstPage)
+		pages = append(pages, e.ogg.pages([][]byte{opusTags("pixaverse")}, []int64{0}, 0)...)
+	}
+	pages = append(pages, e.ogg.pages(packets, granules, 0)...)
+	return [][]byte{pages}, nil
+}
+
+// Flush encodes the samples held back by the encoder, padded with silence to a whole frame
+func (e *OpusStreamEncoder) Flush() ([][]byte, error) {
+	frameSize := e.sampleRate * e.channels * int(OpusFrameDuration/time.Millisecond) / 1000
+	if len(e.pending) == 0 {
+		return nil, nil
+	}
+	silence := make([]float32, frameSize-len(e.pending))
+	return e.Encode(FromFloat32(silence, e.sampleRate, e.channels))
+}
+
+// Reset drops the samples held back by the encoder. The stream goes on from there, its packets and
+// granule positions stay contiguous.
+func (e *OpusStreamEncoder) Reset() {
+	e.pending = nil
+}
+
+// OpusStreamDecoder decodes the Opus packets sent by a device. With raw framing every message is a
+// packet, with Ogg framing the messages are the next bytes of an Ogg Opus stream.
+//
+// An OpusStreamDecoder is not safe for concurrent use.
+type OpusStreamDecoder struct {
+	decoder    OpusDecoder
+	sampleRate int
+	channels   int
+
+	// ogg is nil with raw framing
+	ogg *oggReader
+	// headers is the number of Ogg Opus header packets read so far
+	headers int
+	// skip is the number of samples left to drop at the start of an Ogg stream
+	skip int
+}
+
+// NewOpusStreamDecoder creates a decoder of audio at sampleRate. channels is the number of channels
+// of raw packets, Ogg streams declare their own. ogg selects Ogg framing instead of raw packets.
+func NewOpusStreamDecoder(sampleRate, channels int, ogg bool) (*OpusStreamDecoder, error) {
+	if err := checkOpusFormat(sampleRate, channels); err != nil {
+		return nil, err
+	}
+	d := &OpusStreamDecoder{sampleRate: sampleRate, channels: channels}
+	if ogg {
+		d.ogg = &oggReader{}
+		return d, nil
+	}
+	var err error
+	d.decoder, err = NewOpusDecoder(sampleRate, channels)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Decode decodes the packets completed by data. The audio is empty until the decoder has a whole
+// packet to decode.
+func (d *OpusStreamDecoder) Decode(data []byte) (Audio, error) {
+	packets := [][]byte{data}
+	if d.ogg != nil {
+		var err error
+		packets, err = d.ogg.Read(data)
+		if err != nil {
+			return Audio{}, err
+		}
+	}
+
+	var out []float32
+	for _, packet := range packets {
+		switch {
+		case d.ogg != nil && d.headers == 0:
+			head, err := parseOpusHead(packet)
+			if err != nil {
+				return Audio{}, err
+			}
+			d.channels = head.channels
+			d.skip = head.preSkip * d.sampleRate / 48000
+			d.decoder, err = NewOpusDecoder(d.sampleRate, d.channels)
+			if err != nil {
+				return Audio{}, err
+			}
+			d.headers++
+		case d.ogg != nil && d.headers == 1:
+			// the comment header, which holds nothing we need
+			d.headers++
+		default:
+			if _, err := opusPacketSamples(packet); err != nil {
+				return Audio{}, err
+			}
+			pcm, err := d.decoder.Decode(packet)
+			if err != nil {
+				return Audio{}, fmt.Errorf("%w: %v", ErrInvalidOpus, err)
+			}
+			if d.skip > 0 {
+				n := min(d.skip, len(pcm)/d.channels)
+				pcm = pcm[n*d.channels:]
+				d.skip -= n
+			}
+			out = append(out, pcm...)
+		}
+	}
+	return FromFloat32(out, d.sampleRate, d.channels), nil
+}
@@ -0,0 +1,96 @@
+//go:build cgo && opus
+
+package audio
+
+/*
+#cgo pkg-config: opus
+#include <opus.h>
+
+static int set_bitrate(OpusEncoder *enc, opus_int32 bitrate) {
+	return opus_encoder_ctl(enc, OPUS_SET_BITRATE(bitrate));
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// maxOpusPacket is the size of the buffer packets are encoded into, as recommended by libopus
+const maxOpusPacket = 4000
+
+func init() {
+	NewOpusEncoder = func(sampleRate, channels, bitrate int) (OpusEncoder, error) {
+		return newLibopusEncoder(sampleRate, channels, bitrate)
+	}
+	NewOpusDecoder = func(sampleRate, channels int) (OpusDecoder, error) {
+		return newLibopusDecoder(sampleRate, channels)
+	}
+}
+
+// libopusEncoder encodes with libopus, tuned for speech
+type libopusEncoder struct {
+	enc      *C.OpusEncoder
+	channels int
+	buf      []byte
+}
+
+func newLibopusEncoder(sampleRate, channels, bitrate int) (*libopusEncoder, error) {
+	var errno C.int
+	enc := C.opus_encoder_create(C.opus_int32(sampleRate), C.int(channels), C.OPUS_APPLICATION_VOIP, &errno)
+	if errno != C.OPUS_OK {
+		return nil, fmt.Errorf("could not create opus encoder: %s", C.GoString(C.opus_strerror(errno)))
+	}
+	if errno = C.set_bitrate(enc, C.opus_int32(bitrate)); errno != C.OPUS_OK {
+		C.opus_encoder_destroy(enc)
+		return nil, fmt.Errorf("could not set opus bitrate %d: %s", bitrate, C.GoString(C.opus_strerror(errno)))
+	}
+	e := &libopusEncoder{enc: enc, channels: channels, buf: make([]byte, maxOpusPacket)}
+	runtime.SetFinalizer(e, func(e *libopusEncoder) { C.opus_encoder_destroy(e.enc) })
+	return e, nil
+}
+
+func (e *libopusEncoder) Encode(pcm []float32) ([]byte, error) {
+	if len(pcm) == 0 {
+		return nil, fmt.Errorf("empty opus frame")
+	}
+	n := C.opus_encode_float(e.enc, (*C.float)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)/e.channels),
+		(*C.uchar)(unsafe.Pointer(&e.buf[0])), C.opus_int32(len(e.buf)))
+	if n < 0 {
+		return nil, fmt.Errorf("could not encode opus frame: %s", C.GoString(C.opus_strerror(C.int(n))))
+	}
+	return append([]byte(nil), e.buf[:n]...), nil
+}
+
+// libopusDecoder decodes with libopus
+type libopusDecoder struct {
+	dec      *C.OpusDecoder
+	channels int
+	// pcm holds the longest packet, 120ms
+	pcm []float32
+}
+
+func newLibopusDecoder(sampleRate, channels int) (*libopusDecoder, error) {
+	var errno C.int
+	dec := C.opus_decoder_create(C.opus_int32(sampleRate), C.int(channels), &errno)
+	if errno != C.OPUS_OK {
+		return nil, fmt.Errorf("could not create opus decoder: %s", C.GoString(C.opus_strerror(errno)))
+	}
+	d := &libopusDecoder{dec: dec, channels: channels, pcm: make([]float32, sampleRate*120/1000*channels)}
+	runtime.SetFinalizer(d, func(d *libopusDecoder) { C.opus_decoder_destroy(d.dec) })
+	return d, nil
+}
+
+func (d *libopusDecoder) Decode(packet []byte) ([]float32, error) {
+	if len(packet) == 0 {
+		return nil, fmt.Errorf("empty opus packet")
+	}
+	n := C.opus_decode_float(d.dec, (*C.uchar)(unsafe.Pointer(&packet[0])), C.opus_int32(len(packet)),
+		(*C.float)(unsafe.Pointer(&d.pcm[0])), C.int(len(d.pcm)/d.channels), 0)
+	if n < 0 {
+		return nil, fmt.Errorf("could not decode opus packet: %s", C.GoString(C.opus_strerror(n)))
+	}
+	return append([]float32(nil), d.pcm[:int(n)*d.channels]...), nil
+}
@@ -14,9 +14,6 @@ type Audio struct {
 	channels    int
 }
 
-//func FromMP3(){}
-//func FromWAV(){}
-
 func (a *Audio) GetChannels() int {
 	return a.channels
 }
@@ -32,14 +29,21 @@ func (a *Audio) AsPCM16() []byte {
 	return Int16ToPCM(Float32ToInt16(a.float32Data))
 }
 
+// AsMP3 encodes the audio as MP3 at DefaultMP3Bitrate with the encoder created by NewMP3Encoder
 func (a *Audio) AsMP3() ([]byte, error) {
-	// Commenting this out because this requires the go-lame library which requires some complicated steps for installing the C dependencies.
-	// mp3Data, err := float32ToMP3(a.float32Data, a.sampleRate, a.channels)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// return mp3Data, nil
-	return nil, nil
+	encoder, err := NewMP3Encoder(a.sampleRate, a.channels, DefaultMP3Bitrate)
+	if err != nil {
+		return nil, err
+	}
+	frames, err := encoder.Encode(*a)
+	if err != nil {
+		return nil, err
+	}
+	tail, err := encoder.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return append(frames, tail...), nil
 }
 
 func FromPCM16(data []byte, sampleRate int, channels int) Audio {
@@ -50,25 +54,34 @@ func FromPCM16(data []byte, sampleRate int, channels int) Audio {
 	}
 }
 
+// FromFloat32 creates audio from interleaved samples in the range [-1, 1]
+func FromFloat32(data []float32, sampleRate int, channels int) Audio {
+	return Audio{
+		float32Data: data,
+		sampleRate:  sampleRate,
+		channels:    channels,
+	}
+}
+
+// Resample converts the audio to targetSampleRate with linear interpolation. It treats the audio on
+// its own, streams resampled chunk by chunk should use a Resampler instead.
 func (a *Audio) Resample(targetSampleRate int) {
 	a.float32Data = ResampleAudio(a.float32Data, float64(a.sampleRate), float64(targetSampleRate))
 	a.sampleRate = targetSampleRate
 }
 
-// Convert stereo to mono if input is 2 channels
-// Assuming interleaved stereo samples: [left1, right1, left2, right2, ...]
-func (a *Audio) StereoToMono() {
-	audioSlice := Float32ToInt16(a.float32Data)
-
-	monoSlice := make([]int16, len(audioSlice)/2)
-	for i := 0; i < len(monoSlice); i++ {
-		// Average the left and right channels
-		left := float64(audioSlice[i*2])
-		right := float64(audioSlice[i*2+1])
-		monoSample := int16((left + right) / 2)
-		monoSlice[i] = monoSample
+// SetChannels converts the audio to channels with the default mixer of NewChannelMixer
+func (a *Audio) SetChannels(channels int) {
+	if a.channels == channels {
+		return
 	}
+	// the default mixer always matches the audio
+	*a, _ = NewChannelMixer(a.channels, channels).Mix(*a)
+}
 
-	a.float32Data = Int16ToFloat32(monoSlice)
-	a.channels = 1
+// StereoToMono averages the channels of the audio into mono.
+//
+// Deprecated: use SetChannels, which handles any number of channels.
+func (a *Audio) StereoToMono() {
+	a.SetChannels(1)
 }
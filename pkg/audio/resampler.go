@@ -0,0 +1,201 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+)
+
+// zeroCrossings is the number of zero crossings of the sinc on each side of the filter centre,
+// relative to the lower of the two sample rates. More zero crossings make a steeper filter.
+const zeroCrossings = 16
+
+// maxFilterLength is the number of taps of the largest filter NewResampler designs. The length
+// grows with the rates divided by their greatest common divisor, rates that have little in common
+// like 44101 and 24000 Hz would need millions of them.
+const maxFilterLength = 1 << 20
+
+// Resampler converts a stream of audio from one sample rate to another with a polyphase windowed-sinc
+// filter. It keeps the filter history and the phase between calls, so resampling a stream chunk by
+// chunk gives the same result as resampling it in one go, without clicks at the chunk boundaries.
+//
+// The filter holds back Delay input frames: the output starts once they have been received, and Flush
+// returns the end of the stream. A Resampler is not safe for concurrent use.
+type Resampler struct {
+	inRate, outRate int
+	channels        int
+	// the stream is upsampled by up and downsampled by down
+	up, down int
+	// phases holds the filter taps of each of the up phases
+	phases [][]float32
+
+	// buf holds the input frames still needed by the filter, interleaved. bufStart is the index of
+	// its first frame relative to the input frame of output n = 0.
+	buf      []float32
+	bufStart int
+	// n is the index of the next output frame, it is kept below up by moving the origin forward
+	n int
+	// skip is the number of output frames left that come before the start of the stream
+	skip int
+}
+
+// NewResampler creates a resampler for interleaved audio with the given number of channels
+func NewResampler(inRate, outRate, channels int) (*Resampler, error) {
+	if inRate <= 0 || outRate <= 0 || channels <= 0 {
+		return nil, fmt.Errorf("cannot resample %d Hz to %d Hz with %d channels", inRate, outRate, channels)
+	}
+	g := gcd(inRate, outRate)
+	r := &Resampler{
+		inRate:   inRate,
+		outRate:  outRate,
+		channels: channels,
+		up:       outRate / g,
+		down:     inRate / g,
+	}
+	if length := filterTaps(r.up, r.down) * r.up; length > maxFilterLength {
+		return nil, fmt.Errorf("cannot resample %d Hz to %d Hz, the filter would need %d taps", inRate, outRate, length)
+	}
+	r.phases = designFilter(r.up, r.down)
+	r.Reset()
+	return r, nil
+}
+
+// filterTaps returns the number of taps per phase of the filter designed for up and down, so that
+// the filter spans zeroCrossings on each side at the lower rate
+func filterTaps(up, down int) int {
+	taps := 2 * zeroCrossings * max(up, down) / up
+	if taps%2 != 0 {
+		taps++
+	}
+	return taps
+}
+
+// designFilter builds a Blackman windowed-sinc low-pass filter for the stream upsampled by up,
+// cutting below the Nyquist frequency of the lower rate, and splits it into up phases
+func designFilter(up, down int) [][]float32 {
+	factor := max(up, down)
+	taps := filterTaps(up, down)
+	length := taps * up
+	// cutoff in cycles per sample of the upsampled stream, slightly below Nyquist to leave room for
+	// the transition band
+	cutoff := 0.5 / float64(factor) * 0.92
+	// centring the filter on a multiple of up makes the delay a whole number of input frames
+	centre := float64(length / 2)
+
+	phases := make([][]float32, up)
+	for p := range phases {
+		phases[p] = make([]float32, taps)
+	}
+	for j := 0; j < length; j++ {
+		x := float64(j) - centre
+		sinc := 2 * cutoff
+		if x != 0 {
+			sinc = math.Sin(2*math.Pi*cutoff*x) / (math.Pi * x)
+		}
+		w := 0.42 - 0.5*math.Cos(math.Pi*float64(j)/centre) + 0.08*math.Cos(2*math.Pi*float64(j)/centre)
+		// upsampling by inserting zeros divides the gain by up
+		phases[j%up][j/up] = float32(sinc * w * float64(up))
+	}
+	return phases
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// InputRate returns the sample rate of the audio the resampler expects
+func (r *Resampler) InputRate() int {
+	return r.inRate
+}
+
+// OutputRate returns the sample rate of the audio the resampler produces
+func (r *Resampler) OutputRate() int {
+	return r.outRate
+}
+
+// Delay returns the number of input frames held back by the filter
+func (r *Resampler) Delay() int {
+	return len(r.phases[0]) / 2
+}
+
+// Reset forgets the stream resampled so far, as if the resampler was just created
+func (r *Resampler) Reset() {
+	taps := len(r.phases[0])
+	r.buf = make([]float32, (taps-1)*r.channels)
+	r.bufStart = -(taps - 1)
+	r.n = 0
+	r.skip = (r.Delay()*r.up + r.down - 1) / r.down
+}
+
+// Process resamples the next interleaved samples of the stream. It returns the output frames that
+// can be computed from the input received so far.
+func (r *Resampler) Process(in []float32) []float32 {
+	if r.up == r.down {
+		return append([]float32(nil), in...)
+	}
+
+	r.buf = append(r.buf, in...)
+	taps := len(r.phases[0])
+	ch := r.channels
+
+	out := make([]float32, 0, (len(in)/ch*r.up/r.down+1)*ch)
+	for {
+		pos := r.n * r.down
+		i, p := pos/r.up, pos%r.up
+		// the filter needs input frame i, the last frame received is bufStart + len(buf)/ch - 1
+		if i >= r.bufStart+len(r.buf)/ch {
+			break
+		}
+		if r.skip > 0 {
+			r.skip--
+			r.advance()
+			continue
+		}
+		filter := r.phases[p]
+		// frame i of the input is at buf index i - bufStart, the filter runs backwards from there
+		base := (i - r.bufStart) * ch
+		for c := 0; c < ch; c++ {
+			var sum float32
+			for k := 0; k < taps; k++ {
+				sum += filter[k] * r.buf[base-k*ch+c]
+			}
+			out = append(out, sum)
+		}
+		r.advance()
+	}
+
+	// keep the frames the next output still needs
+	next := r.n * r.down / r.up
+	if drop := next - (taps - 1) - r.bufStart; drop > 0 {
+		drop = min(drop, len(r.buf)/ch)
+		r.buf = append(r.buf[:0], r.buf[drop*ch:]...)
+		r.bufStart += drop
+	}
+	return out
+}
+
+// advance moves to the next output frame
+func (r *Resampler) advance() {
+	r.n++
+	if r.n == r.up {
+		r.n = 0
+		r.bufStart -= r.down
+	}
+}
+
+// Flush returns the output still held back by the filter delay, by feeding it silence. The stream
+// can go on afterwards, the silence is then part of it.
+func (r *Resampler) Flush() []float32 {
+	return r.Process(make([]float32, r.Delay()*r.channels))
+}
+
+// Resample resamples the next chunk of the stream
+func (r *Resampler) Resample(a Audio) (Audio, error) {
+	if a.sampleRate != r.inRate || a.channels != r.channels {
+		return Audio{}, fmt.Errorf("resampler expects %d Hz audio with %d channels, got %d Hz with %d channels",
+			r.inRate, r.channels, a.sampleRate, a.channels)
+	}
+	return FromFloat32(r.Process(a.float32Data), r.outRate, r.channels), nil
+}
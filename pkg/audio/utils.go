@@ -1,46 +1,10 @@
 package audio
 
 import (
-	//"bytes"
 	"encoding/binary"
 	"fmt"
-	//"github.com/viert/go-lame"
 )
 
-// Commenting this out because this requires the go-lame library which requires some complicated steps for installing the C dependencies.
-/*func float32ToMP3(data []float32, sampleRate, channels int) ([]byte, error) {
-	pcmData := Float32ToPcm16(data)
-	buf := new(bytes.Buffer)
-	encoder := lame.NewEncoder(buf)
-	defer encoder.Close()
-
-	if err := encoder.SetInSamplerate(sampleRate); err != nil {
-		return nil, fmt.Errorf("failed to set input sample rate: %v", err)
-	}
-	if err := encoder.SetQuality(7); err != nil {
-		return nil, fmt.Errorf("failed to set quality: %v", err)
-	}
-	if err := encoder.SetBrate(16); err != nil {
-		return nil, fmt.Errorf("failed to set bitrate: %v", err)
-	}
-	if channels == 1 {
-		if err := encoder.SetMode(lame.MpegMono); err != nil {
-			return nil, fmt.Errorf("failed to set mono mode: %v", err)
-		}
-	}
-	if err := encoder.SetLowPassFrequency(4000); err != nil {
-		return nil, fmt.Errorf("failed to set lowpass filter: %v", err)
-	}
-
-	_, err := encoder.Write(pcmData)
-	if err != nil {
-		return nil, fmt.Errorf("error encoding: %v", err)
-	}
-
-	encoder.Close()
-	return buf.Bytes(), nil
-}*/
-
 func ResampleAudio(inputData []float32, inputSampleRate, targetSampleRate float64) []float32 {
 	ratio := targetSampleRate / inputSampleRate
 	outputLength := int(float64(len(inputData)) * ratio)
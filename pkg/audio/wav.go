@@ -0,0 +1,195 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrInvalidWAV is returned when WAV data cannot be parsed
+var ErrInvalidWAV = errors.New("invalid wav data")
+
+// WAV format tags
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+// The sample rates FromWAV accepts. Devices set the rate of every message, rates past these are
+// not audio they record and would only cost resampling filters.
+const (
+	minWAVSampleRate = 8000
+	maxWAVSampleRate = 192000
+)
+
+// WAVSampleFormat is the encoding of the samples of a WAV file
+type WAVSampleFormat struct {
+	// Float is true for IEEE float samples, false for integer PCM
+	Float         bool
+	BitsPerSample int
+}
+
+var (
+	WAVPCM8    = WAVSampleFormat{BitsPerSample: 8}
+	WAVPCM16   = WAVSampleFormat{BitsPerSample: 16}
+	WAVPCM24   = WAVSampleFormat{BitsPerSample: 24}
+	WAVPCM32   = WAVSampleFormat{BitsPerSample: 32}
+	WAVFloat32 = WAVSampleFormat{Float: true, BitsPerSample: 32}
+)
+
+func (f WAVSampleFormat) valid() bool {
+	if f.Float {
+		return f.BitsPerSample == 32 || f.BitsPerSample == 64
+	}
+	return f.BitsPerSample == 8 || f.BitsPerSample == 16 || f.BitsPerSample == 24 || f.BitsPerSample == 32
+}
+
+// FromWAV parses a RIFF/WAVE file holding PCM or float samples. A data chunk that is shorter than
+// its header says, as written by streaming encoders that do not know the length upfront, is read
+// up to the last complete frame.
+func FromWAV(data []byte) (Audio, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return Audio{}, fmt.Errorf("%w: missing RIFF/WAVE header", ErrInvalidWAV)
+	}
+
+	var (
+		format     WAVSampleFormat
+		channels   int
+		sampleRate int
+		haveFormat bool
+	)
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		body := data[pos+8:]
+		if size < len(body) {
+			body = body[:size]
+		}
+
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return Audio{}, fmt.Errorf("%w: fmt chunk too short", ErrInvalidWAV)
+			}
+			tag := binary.LittleEndian.Uint16(body[0:2])
+			channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			sampleRate = int(binary.LittleEndian.Uint32(body[4:8]))
+			format.BitsPerSample = int(binary.LittleEndian.Uint16(body[14:16]))
+			if tag == wavFormatExtensible && len(body) >= 26 {
+				// the actual format tag starts the sub format GUID
+				tag = binary.LittleEndian.Uint16(body[24:26])
+			}
+			switch tag {
+			case wavFormatPCM:
+			case wavFormatFloat:
+				format.Float = true
+			default:
+				return Audio{}, fmt.Errorf("%w: unsupported format tag %#x", ErrInvalidWAV, tag)
+			}
+			if !format.valid() || channels <= 0 || sampleRate < minWAVSampleRate || sampleRate > maxWAVSampleRate {
+				return Audio{}, fmt.Errorf("%w: unsupported format %+v with %d channels at %d Hz",
+					ErrInvalidWAV, format, channels, sampleRate)
+			}
+			haveFormat = true
+
+		case "data":
+			if !haveFormat {
+				return Audio{}, fmt.Errorf("%w: data chunk before fmt chunk", ErrInvalidWAV)
+			}
+			frameSize := channels * format.BitsPerSample / 8
+			body = body[:len(body)/frameSize*frameSize]
+			return Audio{
+				float32Data: decodeWAVSamples(body, format),
+				sampleRate:  sampleRate,
+				channels:    channels,
+			}, nil
+		}
+
+		// chunks are padded to an even size
+		pos += 8 + size + size%2
+	}
+	return Audio{}, fmt.Errorf("%w: missing data chunk", ErrInvalidWAV)
+}
+
+func decodeWAVSamples(data []byte, format WAVSampleFormat) []float32 {
+	width := format.BitsPerSample / 8
+	out := make([]float32, len(data)/width)
+	for i := range out {
+		b := data[i*width : (i+1)*width]
+		switch {
+		case format.Float && width == 4:
+			out[i] = math.Float32frombits(binary.LittleEndian.Uint32(b))
+		case format.Float:
+			out[i] = float32(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+		case width == 1:
+			// 8-bit samples are unsigned
+			out[i] = float32(int(b[0])-128) / 128
+		case width == 2:
+			out[i] = float32(int16(binary.LittleEndian.Uint16(b))) / 32768
+		case width == 3:
+			v := int32(b[0]) | int32(b[1])<<8 | int32(int8(b[2]))<<16
+			out[i] = float32(v) / (1 << 23)
+		case width == 4:
+			out[i] = float32(float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31))
+		}
+	}
+	return out
+}
+
+// AsWAV encodes the audio as a RIFF/WAVE file with the given sample format
+func (a *Audio) AsWAV(format WAVSampleFormat) ([]byte, error) {
+	if !format.valid() {
+		return nil, fmt.Errorf("unsupported wav sample format %+v", format)
+	}
+
+	width := format.BitsPerSample / 8
+	dataSize := len(a.float32Data) * width
+	tag := uint16(wavFormatPCM)
+	if format.Float {
+		tag = wavFormatFloat
+	}
+
+	out := make([]byte, 44+dataSize)
+	copy(out[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(out[4:8], uint32(36+dataSize))
+	copy(out[8:12], "WAVE")
+	copy(out[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(out[16:20], 16)
+	binary.LittleEndian.PutUint16(out[20:22], tag)
+	binary.LittleEndian.PutUint16(out[22:24], uint16(a.channels))
+	binary.LittleEndian.PutUint32(out[24:28], uint32(a.sampleRate))
+	binary.LittleEndian.PutUint32(out[28:32], uint32(a.sampleRate*a.channels*width))
+	binary.LittleEndian.PutUint16(out[32:34], uint16(a.channels*width))
+	binary.LittleEndian.PutUint16(out[34:36], uint16(format.BitsPerSample))
+	copy(out[36:40], "data")
+	binary.LittleEndian.PutUint32(out[40:44], uint32(dataSize))
+
+	samples := out[44:]
+	for i, s := range a.float32Data {
+		b := samples[i*width : (i+1)*width]
+		if format.Float {
+			if width == 4 {
+				binary.LittleEndian.PutUint32(b, math.Float32bits(s))
+			} else {
+				binary.LittleEndian.PutUint64(b, math.Float64bits(float64(s)))
+			}
+			continue
+		}
+
+		s = max(-1, min(1, s))
+		switch width {
+		case 1:
+			b[0] = uint8(int(math.Round(float64(s)*127)) + 128)
+		case 2:
+			binary.LittleEndian.PutUint16(b, uint16(int16(math.Round(float64(s)*32767))))
+		case 3:
+			v := int32(math.Round(float64(s) * (1<<23 - 1)))
+			b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+		case 4:
+			binary.LittleEndian.PutUint32(b, uint32(int32(math.Round(float64(s)*(1<<31-1)))))
+		}
+	}
+	return out, nil
+}
@@ -6,7 +6,7 @@ import os
 
 
 class WebSocketAudioClient:
-    def __init__(self, server="localhost", port=80, path="/"):
+    def __init__(self, server="localhost", port=80, path="/ws"):
         self.uri = f"ws://{server}:{port}{path}"
 
         # Audio settings